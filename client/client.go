@@ -3,50 +3,145 @@ package client
 import (
 	"bufio"
 	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"os"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/liuscraft/spider-network/pkg/protocol"
 	"github.com/liuscraft/spider-network/pkg/protocol/hole"
+	"github.com/liuscraft/spider-network/pkg/punch"
+	"github.com/liuscraft/spider-network/pkg/secure"
 	"github.com/liuscraft/spider-network/pkg/xlog"
 )
 
+// 默认参数，可通过 Option 修改
+const (
+	defaultHeartbeatInterval = 10 * time.Second
+	defaultDialTimeout       = 5 * time.Second
+	defaultListenAddr        = "127.0.0.1:0" // 使用0让系统分配端口
+	defaultMinBackoff        = time.Second
+	defaultMaxBackoff        = 30 * time.Second
+)
+
+// peerQueueSize 每个对等连接等待回调或写入 TUN 的消息数
+const peerQueueSize = 256
+
+// ErrPeerNotConnected 与对等端之间没有已建立的连接
+var ErrPeerNotConnected = errors.New("peer not connected")
+
 type Client struct {
-	clientID   string
-	name       string
-	serverConn net.Conn
+	clientID string
+	name     string
+	token    string // 预共享令牌，为空时不进行认证
+	// 信令连接，切换服务端时替换，通过 server 读取
+	// serverMu 同时保护重连时更新的虚拟 IP、UDP 地址和打洞端点
+	serverMu   sync.RWMutex
+	serverAddr string
+	serverConn *hole.Conn
+	servers    []string // 按优先级排列的服务端地址
+	serverIdx  int      // 当前服务端在 servers 中的位置，只在连接协程中访问
+	closed     atomic.Bool
+	done       chan struct{} // Close 时关闭，用于打断重连等待
+	tlsConfig  *tls.Config   // 信令通道 TLS，为 nil 时使用明文 TCP
 	peers      sync.Map
+	// 连接参数
+	listenAddr        string        // 对等连接监听地址
+	dialTimeout       time.Duration // 连接服务端、对等端和本地服务的超时
+	heartbeatInterval time.Duration
+	heartbeatTimeout  time.Duration // 服务端回复心跳后，超过该时间没有任何消息则认为连接已断开
+	minBackoff        time.Duration // 所有服务端都不可用时的重试间隔，每轮翻倍直到 maxBackoff
+	maxBackoff        time.Duration
+	// 端到端加密
+	identity   *secure.Identity
+	peerKeys   sync.Map // 对等端ID -> 静态公钥
+	keyWaiters sync.Map // 对等端ID -> 等待公钥查询结果的通道
 	xl         xlog.Logger
 	listener   net.Listener
+	// UDP 打洞
+	endpoint       *punch.Endpoint // 创建后不再替换
+	udpPublicAddr  string
+	udpPrivateAddr string
+	listenPacket   func() (net.PacketConn, error)
+	// 虚拟网络
+	virtualIP string                     // 服务端分配的地址（CIDR 格式）
+	vnet      atomic.Pointer[virtualNet] // 启用 TUN 后的虚拟网卡
+	routes    sync.Map                   // 虚拟 IP -> 对等端ID
+	pending   sync.Map                   // 正在进行的地址查询或连接 -> 发起时间
+	// 端口转发
+	exposed  sync.Map // 对等端ID/地址 -> 允许该对等端访问的本地服务
+	forwards sync.Map // 本地转发监听器，TCP 为 net.Listener，UDP 为 net.PacketConn
+	// 在服务端发布的 HTTP 服务
+	published      sync.Map // 服务名 -> 本地地址
+	publishWaiters sync.Map // 服务名 -> 等待发布结果的通道
+	// 作为出口时各对等端允许访问的目标
+	exitMu    sync.RWMutex
+	exitRules map[string][]*exitRule
+	// 文件传输
+	recvDir     atomic.Value  // 接收目录，为空时拒绝接收
+	receiving   sync.Map      // 正在写入的临时文件
+	transfers   sync.Map      // 传输ID -> *transfer
+	transferSeq atomic.Uint32 // 传输序号
+	// 反射地址发现
+	stunAddr   string
+	publicAddr string
+	natType    punch.NATType
 	// 添加统计信息
 	stats struct {
 		bytesSent    int64
 		bytesRecv    int64
 		p2pBytesSent int64
 		p2pBytesRecv int64
-		startTime    time.Time
-		mutex        sync.Mutex
+		// 经服务端中继的流量
+		relayBytesSent int64
+		relayBytesRecv int64
+		startTime      time.Time
+		mutex          sync.Mutex
 	}
 	heartbeatCtx    context.Context
 	heartbeatCancel context.CancelFunc
+	heartbeatAcked  atomic.Bool  // 当前服务端是否回复心跳，旧版本服务端不回复时不检测超时
+	serverSeen      atomic.Int64 // 最后一次收到服务端消息的时间（UnixNano）
+	// 事件回调
+	handlersMu           sync.RWMutex
+	stateHandlers        []func(ServerStateEvent)
+	connectedHandlers    []func(peerID string)
+	disconnectedHandlers []func(peerID string, err error)
+	messageHandlers      []func(peerID string, payload []byte)
+	state                atomic.Int32
 }
 
-func NewClient(clientID, name string) *Client {
+// NewClient 创建客户端，token 为服务端配置的预共享令牌，服务端未启用认证时可为空
+func NewClient(clientID, name, token string, opts ...Option) *Client {
 	ctx, cancel := context.WithCancel(context.Background())
 	c := &Client{
 		clientID:        clientID,
 		name:            name,
+		token:           token,
 		xl:              xlog.New(),
 		heartbeatCtx:    ctx,
 		heartbeatCancel: cancel,
+		done:            make(chan struct{}),
+		listenAddr:      defaultListenAddr,
+		dialTimeout:     defaultDialTimeout,
+		minBackoff:      defaultMinBackoff,
+		maxBackoff:      defaultMaxBackoff,
+		listenPacket: func() (net.PacketConn, error) {
+			return net.ListenPacket("udp", ":0")
+		},
+		natType: punch.NATUnknown,
 	}
 	c.stats.startTime = time.Now()
+	WithHeartbeatInterval(defaultHeartbeatInterval)(c)
+	for _, opt := range opts {
+		opt(c)
+	}
 	return c
 }
 
@@ -75,6 +170,18 @@ func (c *Client) addP2PBytesRecv(n int64) {
 	c.stats.p2pBytesRecv += n
 }
 
+func (c *Client) addRelayBytesSent(n int64) {
+	c.stats.mutex.Lock()
+	defer c.stats.mutex.Unlock()
+	c.stats.relayBytesSent += n
+}
+
+func (c *Client) addRelayBytesRecv(n int64) {
+	c.stats.mutex.Lock()
+	defer c.stats.mutex.Unlock()
+	c.stats.relayBytesRecv += n
+}
+
 func (c *Client) getStats() (int64, int64, int64, int64) {
 	c.stats.mutex.Lock()
 	defer c.stats.mutex.Unlock()
@@ -82,6 +189,7 @@ func (c *Client) getStats() (int64, int64, int64, int64) {
 }
 
 // 添加心跳机制
+// 服务端回复过心跳确认后，超过 heartbeatTimeout 没有收到服务端的任何消息时视为连接断开
 func (c *Client) startHeartbeat() {
 	// 取消之前的心跳（如果有）
 	if c.heartbeatCancel != nil {
@@ -90,202 +198,195 @@ func (c *Client) startHeartbeat() {
 
 	// 创建新的心跳上下文
 	c.heartbeatCtx, c.heartbeatCancel = context.WithCancel(context.Background())
+	ctx := c.heartbeatCtx
+	interval, timeout := c.heartbeatInterval, c.heartbeatTimeout
 
 	go func() {
-		ticker := time.NewTicker(10 * time.Second)
+		ticker := time.NewTicker(interval)
 		defer ticker.Stop()
 
 		for {
 			select {
-			case <-c.heartbeatCtx.Done():
+			case <-ctx.Done():
 				return
 			case <-ticker.C:
-				if c.serverConn == nil {
+				conn := c.server()
+				if conn == nil {
 					continue
 				}
-
-				// 收集当前状态
-				sent, recv, p2pSent, p2pRecv := c.getStats()
-				peers := make([]string, 0)
-				c.peers.Range(func(key, value interface{}) bool {
-					if peerID, ok := key.(string); ok {
-						peers = append(peers, peerID)
-					}
-					return true
-				})
-
-				// 构造心跳消息
-				heartbeatData := hole.HeartbeatPayload{
-					ClientID:     c.clientID,
-					BytesSent:    sent,
-					BytesRecv:    recv,
-					P2PBytesSent: p2pSent,
-					P2PBytesRecv: p2pRecv,
-					Peers:        peers,
-					Timestamp:    time.Now().UnixNano(),
-				}
-
-				// 序列化心跳数据
-				payloadBytes, err := json.Marshal(heartbeatData)
-				if err != nil {
-					c.xl.Errorf("Failed to marshal heartbeat data: %v", err)
-					continue
-				}
-
-				// 构造消息
-				msg := &hole.Message{
-					Type:    hole.TypeHeartbeat,
-					From:    c.clientID,
-					To:      "server",
-					Payload: payloadBytes,
-				}
-
-				// 发送心跳
-				data, err := json.Marshal(msg)
-				if err != nil {
-					c.xl.Errorf("Failed to marshal message: %v", err)
+				// 关闭连接后由 superviseServer 重连
+				if c.heartbeatAcked.Load() && time.Since(time.Unix(0, c.serverSeen.Load())) > timeout {
+					c.xl.Warnf("Server %s missed heartbeats, reconnecting", c.ServerAddr())
+					conn.Close()
 					continue
 				}
-
-				if _, err := c.serverConn.Write(append(data, '\n')); err != nil {
-					c.xl.Errorf("Failed to send heartbeat: %v", err)
-				} else {
-					c.xl.Debugf("Sent heartbeat: server=%d/%d, p2p=%d/%d bytes, peers=%v",
-						sent, recv, p2pSent, p2pRecv, peers)
-				}
+				c.sendHeartbeat()
 			}
 		}
 	}()
 }
 
-func (c *Client) Connect(serverAddr string) error {
-	var backoff = time.Second
-	maxBackoff := 30 * time.Second
+// sendHeartbeat 发送心跳，同时上报流量统计和当前连接的对等端
+func (c *Client) sendHeartbeat() {
+	// 收集当前状态
+	sent, recv, p2pSent, p2pRecv := c.getStats()
+	peers := make([]string, 0)
+	c.peers.Range(func(key, value interface{}) bool {
+		if peerID, ok := key.(string); ok {
+			peers = append(peers, peerID)
+		}
+		return true
+	})
 
-	// 首先创建监听器
-	listener, err := net.Listen("tcp", "127.0.0.1:0") // 使用0让系统分配端口
+	// 构造心跳消息
+	heartbeatData := hole.HeartbeatPayload{
+		ClientID:     c.clientID,
+		BytesSent:    sent,
+		BytesRecv:    recv,
+		P2PBytesSent: p2pSent,
+		P2PBytesRecv: p2pRecv,
+		Peers:        peers,
+		Timestamp:    time.Now().UnixNano(),
+	}
+
+	// 序列化心跳数据
+	payloadBytes, err := json.Marshal(heartbeatData)
 	if err != nil {
-		return fmt.Errorf("failed to create listener: %v", err)
+		c.xl.Errorf("Failed to marshal heartbeat data: %v", err)
+		return
 	}
-	c.listener = listener
-	c.xl.Infof("Listening for peer connections on %s", listener.Addr())
 
-	// 启动监听协程
-	go c.acceptPeerConnections()
+	// 构造消息
+	msg := &hole.Message{
+		Type:    hole.TypeHeartbeat,
+		From:    c.clientID,
+		To:      "server",
+		Payload: payloadBytes,
+	}
 
-	for {
-		// 尝试连接服务器
-		conn, err := net.Dial("tcp", serverAddr)
-		if err != nil {
-			c.xl.Errorf("Failed to connect to server: %v", err)
-			time.Sleep(backoff)
+	// 发送心跳
+	if err := c.sendToServer(msg); err != nil {
+		c.xl.Errorf("Failed to send heartbeat: %v", err)
+	} else {
+		c.xl.Debugf("Sent heartbeat: server=%d/%d, p2p=%d/%d bytes, peers=%v",
+			sent, recv, p2pSent, p2pRecv, peers)
+	}
+}
 
-			// 指数退避
-			backoff *= 2
-			if backoff > maxBackoff {
-				backoff = maxBackoff
-			}
-			continue
-		}
+// Connect 连接服务端并注册，serverAddr 可以是逗号分隔的多个地址，见 ConnectServers
+func (c *Client) Connect(serverAddr string) error {
+	return c.ConnectServers(strings.Split(serverAddr, ","))
+}
 
-		// 重置退避时间
-		backoff = time.Second
-		c.serverConn = conn
-		c.xl.Infof("Connected to server %s", serverAddr)
-
-		// 发送注册消息
-		registerPayload := hole.RegisterPayload{
-			ClientID:    c.clientID,
-			Name:        c.name,
-			PublicAddr:  c.listener.Addr().String(), // 添加监听地址
-			PrivateAddr: c.listener.Addr().String(), // 添加监听地址
-		}
+// ConnectServers 按顺序连接服务端列表中第一个可用的服务端并注册
+// 信令连接断开后依次切换到后续服务端，使用相同的客户端ID重新注册，已建立的对等连接不受影响
+// 以 srv: 开头的地址通过 DNS SRV 记录展开，如 srv:_spider._tcp.example.com
+func (c *Client) ConnectServers(serverAddrs []string) error {
+	servers, err := resolveServers(serverAddrs)
+	if err != nil {
+		return err
+	}
+	c.servers = servers
 
-		payloadBytes, err := json.Marshal(registerPayload)
+	// 生成端到端加密的静态密钥
+	if c.identity == nil {
+		identity, err := secure.GenerateIdentity()
 		if err != nil {
-			c.xl.Errorf("Failed to marshal register payload: %v", err)
-			conn.Close()
-			continue
-		}
-
-		msg := &hole.Message{
-			Type:    hole.TypeRegister,
-			From:    c.clientID,
-			To:      "server",
-			Payload: payloadBytes,
+			return fmt.Errorf("failed to generate identity: %v", err)
 		}
+		c.identity = identity
+	}
 
-		data, err := json.Marshal(msg)
-		if err != nil {
-			c.xl.Errorf("Failed to marshal register message: %v", err)
-			conn.Close()
-			continue
-		}
+	// 首先创建监听器
+	listener, err := net.Listen("tcp", c.listenAddr)
+	if err != nil {
+		return fmt.Errorf("failed to create listener: %v", err)
+	}
+	c.listener = listener
+	c.xl.Infof("Listening for peer connections on %s", listener.Addr())
 
-		if _, err := conn.Write(append(data, '\n')); err != nil {
-			c.xl.Errorf("Failed to send register message: %v", err)
-			conn.Close()
-			continue
-		}
+	// 启动监听协程
+	go c.acceptPeerConnections()
 
-		// 等待注册响应
-		reader := bufio.NewReader(conn)
-		response, err := reader.ReadBytes('\n')
-		if err != nil {
-			c.xl.Errorf("Failed to read register response: %v", err)
-			conn.Close()
-			continue
-		}
+	// 探测公网地址和 NAT 类型
+	c.discoverNAT(servers[0])
 
-		var respMsg hole.Message
-		if err := json.Unmarshal(response, &respMsg); err != nil {
-			c.xl.Errorf("Failed to unmarshal register response: %v", err)
-			conn.Close()
-			continue
-		}
+	c.setServerState(ServerConnecting, nil)
+	conn, err := c.connectServers(0)
+	if err != nil {
+		c.setServerState(ServerDisconnected, err)
+		return err
+	}
+	c.setServerState(ServerConnected, nil)
 
-		if respMsg.Type != hole.TypeRegister {
-			c.xl.Errorf("Unexpected response type: %s", respMsg.Type)
-			conn.Close()
-			continue
-		}
+	// 启动心跳
+	c.startHeartbeat()
 
-		c.xl.Infof("Successfully registered with server")
+	// 启动消息处理循环，断开后自动重连
+	go c.superviseServer(conn)
+	return nil
+}
 
-		// 启动心跳
-		c.startHeartbeat()
+// server 返回当前的信令连接，未连接时返回 nil
+func (c *Client) server() *hole.Conn {
+	c.serverMu.RLock()
+	defer c.serverMu.RUnlock()
+	return c.serverConn
+}
 
-		// 启动消息处理循环
-		go c.handleServerMessages()
+// ServerAddr 返回当前连接的服务端地址
+func (c *Client) ServerAddr() string {
+	c.serverMu.RLock()
+	defer c.serverMu.RUnlock()
+	return c.serverAddr
+}
 
-		return nil
+// sendToServer 通过当前信令连接发送消息
+func (c *Client) sendToServer(msg *hole.Message) error {
+	conn := c.server()
+	if conn == nil {
+		return errors.New("not connected to server")
 	}
+	return conn.WriteMessage(msg)
 }
 
-func (c *Client) handleServerMessages() {
-	reader := bufio.NewReader(c.serverConn)
+// handleServerMessages 处理信令连接上的消息，连接断开时返回读取错误
+func (c *Client) handleServerMessages(conn *hole.Conn) error {
 	for {
-		data, err := reader.ReadBytes('\n')
+		msg, err := conn.ReadMessage()
 		if err != nil {
-			if err != io.EOF {
+			if err != io.EOF && !errors.Is(err, net.ErrClosed) {
 				c.xl.Errorf("Failed to read from server: %v", err)
 			}
-			c.serverConn.Close()
-			return
-		}
-
-		var msg hole.Message
-		if err := json.Unmarshal(data, &msg); err != nil {
-			c.xl.Errorf("Failed to unmarshal message: %v", err)
-			continue
+			conn.Close()
+			return err
 		}
+		c.serverSeen.Store(time.Now().UnixNano())
 
 		// 处理不同类型的消息
 		switch msg.Type {
-		case hole.TypePunch:
-			c.handlePunchMessage(&msg)
+		case hole.TypePunchReady, hole.TypePunch:
+			c.handlePunchMessage(msg)
 		case hole.TypeConnect:
-			c.handleConnectMessage(&msg)
+			c.handleConnectMessage(msg)
+		case hole.TypeRelay:
+			c.handleRelayMessage(msg)
+		case hole.TypePeerKey:
+			c.handlePeerKeyMessage(msg)
+		case hole.TypeResolve:
+			c.handleResolveMessage(msg)
+		case hole.TypePublish:
+			c.handlePublishMessage(msg)
+		case hole.TypeHeartbeat:
+			c.heartbeatAcked.Store(true)
+		case hole.TypeRevoke:
+			c.handleRevokeMessage(msg)
+		case hole.TypeError:
+			// 服务端断开连接前说明原因，例如被管理员断开
+			var reason hole.ErrorPayload
+			if err := json.Unmarshal(msg.Payload, &reason); err == nil {
+				c.xl.Warnf("Server %s: %v", c.ServerAddr(), &reason)
+			}
 		default:
 			c.xl.Warnf("Unknown message type: %s", msg.Type)
 		}
@@ -294,52 +395,42 @@ func (c *Client) handleServerMessages() {
 
 func (c *Client) acceptPeerConnections() {
 	for {
-		conn, err := c.listener.Accept()
+		rawConn, err := c.listener.Accept()
 		if err != nil {
-			if err != net.ErrClosed {
+			if !errors.Is(err, net.ErrClosed) {
 				c.xl.Errorf("Failed to accept connection: %v", err)
 			}
 			return
 		}
 
 		// 启动一个新的 goroutine 来处理连接
-		go func(conn net.Conn) {
-			// 读取第一条消息以获取对方的ID
-			reader := bufio.NewReader(conn)
-			data, err := reader.ReadBytes('\n')
+		go func(rawConn net.Conn) {
+			// 通过加密握手认证对方身份
+			conn, peerID, err := c.secureHandshake(c.newPeerConn(rawConn), "", false)
 			if err != nil {
-				c.xl.Errorf("Failed to read initial message: %v", err)
-				conn.Close()
+				c.xl.Errorf("Failed to accept connection from %s: %v", rawConn.RemoteAddr(), err)
 				return
 			}
 
-			var msg hole.Message
-			if err := json.Unmarshal(data, &msg); err != nil {
-				c.xl.Errorf("Failed to unmarshal initial message: %v", err)
+			// 保存连接，已有连接时保留旧连接
+			if _, loaded := c.peers.LoadOrStore(peerID, conn); loaded {
+				c.xl.Infof("Already connected to peer %s", peerID)
 				conn.Close()
 				return
 			}
-
-			peerID := msg.From
 			c.xl.Infof("Accepted connection from peer %s", peerID)
 
-			// 保存连接
-			c.peers.Store(peerID, conn)
-
 			// 启动消息处理
 			c.startPeerMessageHandler(peerID, conn)
-		}(conn)
+		}(rawConn)
 	}
 }
 
 func (c *Client) ConnectToPeer(peerID string) error {
 	c.xl.Infof("Initiating connection to peer %s...", peerID)
 
-	// 构造打洞消息
-	payload := hole.PunchPayload{
-		PublicAddr:  c.listener.Addr().String(),
-		PrivateAddr: c.listener.Addr().String(),
-	}
+	// 构造打洞消息，支持时优先使用 UDP
+	payload := c.localPunchPayload(hole.NetworkUDP)
 
 	payloadBytes, err := json.Marshal(payload)
 	if err != nil {
@@ -353,12 +444,7 @@ func (c *Client) ConnectToPeer(peerID string) error {
 		Payload: payloadBytes,
 	}
 
-	data, err := json.Marshal(msg)
-	if err != nil {
-		return fmt.Errorf("failed to marshal punch message: %v", err)
-	}
-
-	if _, err := c.serverConn.Write(append(data, '\n')); err != nil {
+	if err := c.sendToServer(msg); err != nil {
 		return fmt.Errorf("failed to send punch message: %v", err)
 	}
 
@@ -369,172 +455,175 @@ func (c *Client) ConnectToPeer(peerID string) error {
 func (c *Client) handlePunchMessage(msg *hole.Message) {
 	c.xl.Infof("Received punch message from %s", msg.From)
 
+	// 检查是否已经连接
+	if _, exists := c.peers.Load(msg.From); exists {
+		c.xl.Infof("Already connected to peer %s", msg.From)
+		return
+	}
+
 	// 解析打洞消息
 	var payload hole.PunchPayload
 	if err := json.Unmarshal(msg.Payload, &payload); err != nil {
 		c.xl.Errorf("Failed to unmarshal punch payload: %v", err)
 		return
 	}
+	c.storePeerKey(msg.From, payload.PublicKey)
 
-	// 尝试连接对方
-	addrs := []string{payload.PublicAddr}
-	if payload.PrivateAddr != "" && payload.PrivateAddr != payload.PublicAddr {
-		addrs = append(addrs, payload.PrivateAddr)
-	}
-
-	var conn net.Conn
-	var err error
-	for _, addr := range addrs {
-		c.xl.Infof("Trying to connect to %s at %s", msg.From, addr)
-		conn, err = net.DialTimeout("tcp", addr, 5*time.Second)
-		if err == nil {
-			break
+	// UDP 打洞：先把本端候选地址发给对方，双方同时探测
+	// 本端不支持 UDP 时回复 TCP 地址，由对方主动连接
+	if payload.Network == hole.NetworkUDP {
+		if err := c.sendConnect(msg.From, c.localPunchPayload(hole.NetworkUDP)); err != nil {
+			c.xl.Errorf("Failed to reply punch to %s: %v", msg.From, err)
+			return
 		}
-		c.xl.Warnf("Failed to connect to %s at %s: %v", msg.From, addr, err)
+		if c.udpReady() {
+			go c.punchUDP(msg.From, &payload)
+		}
+		return
 	}
 
-	if err != nil {
-		c.xl.Errorf("Failed to connect to peer %s: %v", msg.From, err)
+	// 连接成功后回复本端的地址信息
+	go c.connectTCP(msg.From, &payload, true)
+}
+
+func (c *Client) handleConnectMessage(msg *hole.Message) {
+	c.xl.Infof("Received connect message from %s", msg.From)
+
+	// 检查是否已经连接
+	if _, exists := c.peers.Load(msg.From); exists {
+		c.xl.Infof("Already connected to peer %s", msg.From)
 		return
 	}
 
-	// 发送初始消息
-	initMsg := &hole.Message{
-		Type: hole.TypeMessage,
-		From: c.clientID,
-		To:   msg.From,
-	}
-	data, err := json.Marshal(initMsg)
-	if err != nil {
-		c.xl.Errorf("Failed to marshal initial message: %v", err)
-		conn.Close()
+	// 解析地址信息
+	var payload hole.PunchPayload
+	if err := json.Unmarshal(msg.Payload, &payload); err != nil {
+		c.xl.Errorf("Failed to unmarshal connect payload: %v", err)
 		return
 	}
+	c.storePeerKey(msg.From, payload.PublicKey)
 
-	if _, err := conn.Write(append(data, '\n')); err != nil {
-		c.xl.Errorf("Failed to send initial message: %v", err)
-		conn.Close()
+	if payload.Network == hole.NetworkUDP {
+		if c.udpReady() {
+			go c.punchUDP(msg.From, &payload)
+		}
 		return
 	}
 
-	// 保存连接
-	c.peers.Store(msg.From, conn)
-	c.xl.Infof("Successfully connected to peer %s", msg.From)
-
-	// 发送连接确认消息给服务器
-	connectMsg := &hole.Message{
-		Type:    hole.TypeConnect,
-		From:    c.clientID,
-		To:      msg.From,
-		Payload: msg.Payload, // 使用相同的地址信息
-	}
+	go c.connectTCP(msg.From, &payload, false)
+}
 
-	data, err = json.Marshal(connectMsg)
+// connectTCP 主动连接对方，所有地址都失败时改用中继
+// 加密握手可能需要通过信令查询对方公钥，不能在信令读取协程中执行
+// reply 为 true 时连接成功后把本端的 TCP 地址发给对方
+func (c *Client) connectTCP(peerID string, payload *hole.PunchPayload, reply bool) {
+	conn, err := c.dialPeer(peerID, payload)
 	if err != nil {
-		c.xl.Errorf("Failed to marshal connect message: %v", err)
+		c.xl.Errorf("Failed to connect to peer %s: %v", peerID, err)
+		c.requestRelay(peerID)
 		return
 	}
 
-	if _, err := c.serverConn.Write(append(data, '\n')); err != nil {
-		c.xl.Errorf("Failed to send connect message: %v", err)
+	// 保存连接，等待期间对方可能已通过其他路径连上
+	if _, loaded := c.peers.LoadOrStore(peerID, conn); loaded {
+		c.xl.Infof("Already connected to peer %s", peerID)
+		conn.Close()
 		return
 	}
+	c.xl.Infof("Successfully connected to peer %s", peerID)
+
+	if reply {
+		if err := c.sendConnect(peerID, c.localPunchPayload(hole.NetworkTCP)); err != nil {
+			c.xl.Errorf("Failed to reply punch to %s: %v", peerID, err)
+		}
+	}
 
 	// 启动消息处理
-	go c.startPeerMessageHandler(msg.From, conn)
+	c.startPeerMessageHandler(peerID, conn)
 }
 
-func (c *Client) handleConnectMessage(msg *hole.Message) {
-	c.xl.Infof("Received connect message from %s", msg.From)
-
-	// 检查是否已经连接
-	if _, exists := c.peers.Load(msg.From); exists {
-		c.xl.Infof("Already connected to peer %s", msg.From)
-		return
-	}
-
-	// 解析地址信息
-	var payload hole.PunchPayload
+// handleRevokeMessage 对等端被服务端移除，断开与其的连接并丢弃其公钥
+func (c *Client) handleRevokeMessage(msg *hole.Message) {
+	var payload hole.RevokePayload
 	if err := json.Unmarshal(msg.Payload, &payload); err != nil {
-		c.xl.Errorf("Failed to unmarshal connect payload: %v", err)
+		c.xl.Errorf("Failed to unmarshal revoke payload: %v", err)
 		return
 	}
+	c.xl.Warnf("Peer %s revoked by server: %s", payload.ClientID, payload.Reason)
+	c.peerKeys.Delete(payload.ClientID)
+	if conn, ok := c.peers.LoadAndDelete(payload.ClientID); ok {
+		conn.(*hole.Conn).Close()
+	}
+}
 
-	// 尝试主动连接对方
+// dialPeer 依次尝试对方的公网和内网地址，连接成功后作为发起方完成加密握手
+func (c *Client) dialPeer(peerID string, payload *hole.PunchPayload) (*hole.Conn, error) {
 	addrs := []string{payload.PublicAddr}
 	if payload.PrivateAddr != "" && payload.PrivateAddr != payload.PublicAddr {
 		addrs = append(addrs, payload.PrivateAddr)
 	}
 
-	var conn net.Conn
+	var rawConn net.Conn
 	var err error
 	for _, addr := range addrs {
-		c.xl.Infof("Trying to connect to %s at %s", msg.From, addr)
-		conn, err = net.DialTimeout("tcp", addr, 5*time.Second)
+		c.xl.Infof("Trying to connect to %s at %s", peerID, addr)
+		rawConn, err = net.DialTimeout("tcp", addr, c.dialTimeout)
 		if err == nil {
 			break
 		}
-		c.xl.Warnf("Failed to connect to %s at %s: %v", msg.From, addr, err)
-	}
-
-	if err != nil {
-		c.xl.Errorf("Failed to connect to peer %s: %v", msg.From, err)
-		return
+		c.xl.Warnf("Failed to connect to %s at %s: %v", peerID, addr, err)
 	}
-
-	// 发送初始消息
-	initMsg := &hole.Message{
-		Type: hole.TypeMessage,
-		From: c.clientID,
-		To:   msg.From,
-	}
-	data, err := json.Marshal(initMsg)
 	if err != nil {
-		c.xl.Errorf("Failed to marshal initial message: %v", err)
-		conn.Close()
-		return
+		return nil, err
 	}
 
-	if _, err := conn.Write(append(data, '\n')); err != nil {
-		c.xl.Errorf("Failed to send initial message: %v", err)
-		conn.Close()
-		return
-	}
+	conn, _, err := c.secureHandshake(c.newPeerConn(rawConn), peerID, true)
+	return conn, err
+}
 
-	// 保存连接并启动消息处理
-	c.peers.Store(msg.From, conn)
-	c.xl.Infof("Successfully connected to peer %s", msg.From)
-	go c.startPeerMessageHandler(msg.From, conn)
+// newPeerConn 包装对等连接，统计点对点流量
+func (c *Client) newPeerConn(conn net.Conn) net.Conn {
+	return newCountingConn(conn, c.addP2PBytesSent, c.addP2PBytesRecv)
 }
 
-func (c *Client) startPeerMessageHandler(peerID string, conn net.Conn) {
+func (c *Client) startPeerMessageHandler(peerID string, conn *hole.Conn) {
+	var readErr error
+	c.emitPeerConnected(peerID)
+	// 读取协程同时处理多路复用流，消息回调和 TUN 写入交给单独的协程，避免阻塞流
+	queue := make(chan *hole.Message, peerQueueSize)
+	dispatched := make(chan struct{})
+	go func() {
+		defer close(dispatched)
+		for msg := range queue {
+			c.dispatchPeerMessage(peerID, msg)
+		}
+	}()
 	defer func() {
 		conn.Close()
-		c.peers.Delete(peerID)
+		c.peers.CompareAndDelete(peerID, conn)
+		// 已收到的消息处理完后再通知断开
+		close(queue)
+		<-dispatched
 		c.xl.Infof("Connection with peer %s closed", peerID)
+		c.emitPeerDisconnected(peerID, readErr)
 	}()
 
-	reader := bufio.NewReader(conn)
+	// 多路复用流与消息共用对等连接
+	if session := conn.Session(); session != nil {
+		go c.acceptStreams(peerID, session)
+	}
+
 	for {
 		// 读取消息
-		data, err := reader.ReadBytes('\n')
+		msg, err := conn.ReadMessage()
 		if err != nil {
-			if err != io.EOF {
+			if err != io.EOF && !errors.Is(err, net.ErrClosed) {
 				c.xl.Errorf("Failed to read from peer %s: %v", peerID, err)
+				readErr = err
 			}
 			return
 		}
 
-		// 更新接收字节数
-		c.addP2PBytesRecv(int64(len(data)))
-
-		// 解析消息
-		var msg hole.Message
-		if err := json.Unmarshal(data, &msg); err != nil {
-			c.xl.Errorf("Failed to unmarshal message from peer %s: %v", peerID, err)
-			continue
-		}
-
 		// 验证消息来源
 		if msg.From != peerID {
 			c.xl.Warnf("Message from %s claims to be from %s", peerID, msg.From)
@@ -543,17 +632,15 @@ func (c *Client) startPeerMessageHandler(peerID string, conn net.Conn) {
 
 		// 处理不同类型的消息
 		switch msg.Type {
-		case hole.TypeMessage:
-			if len(msg.Payload) > 0 {
-				// 尝试作为JSON解析，如果失败则作为普通文本处理
-				var jsonContent string
-				if err := json.Unmarshal(msg.Payload, &jsonContent); err != nil {
-					// 作为普通文本处理
-					c.xl.Infof("Message from %s: %s", peerID, string(msg.Payload))
-				} else {
-					// 作为JSON内容处理
-					c.xl.Infof("Message from %s: %s", peerID, jsonContent)
-				}
+		case hole.TypeMessage, hole.TypeData:
+			// 队列满时等待回调处理，保证消息不丢失
+			queue <- msg
+		case hole.TypePacket:
+			// 与网卡队列一样，队列满时丢弃报文
+			select {
+			case queue <- msg:
+			default:
+				c.xl.Debugf("Dispatch queue of peer %s full, dropping packet", peerID)
 			}
 		case hole.TypeHeartbeat:
 			// 处理心跳消息
@@ -570,6 +657,68 @@ func (c *Client) startPeerMessageHandler(peerID string, conn net.Conn) {
 	}
 }
 
+// dispatchPeerMessage 回调消息或写入 TUN 报文，同一对等端的消息按接收顺序依次处理
+func (c *Client) dispatchPeerMessage(peerID string, msg *hole.Message) {
+	switch msg.Type {
+	case hole.TypeMessage:
+		if len(msg.Payload) > 0 {
+			// 尝试作为JSON解析，如果失败则作为普通文本处理
+			var jsonContent string
+			if err := json.Unmarshal(msg.Payload, &jsonContent); err != nil {
+				// 作为普通文本处理
+				jsonContent = string(msg.Payload)
+			}
+			c.xl.Infof("Message from %s: %s", peerID, jsonContent)
+			c.emitMessage(peerID, []byte(jsonContent))
+		}
+	case hole.TypeData:
+		var data []byte
+		if err := json.Unmarshal(msg.Payload, &data); err != nil {
+			c.xl.Errorf("Failed to unmarshal data from peer %s: %v", peerID, err)
+			return
+		}
+		c.emitMessage(peerID, data)
+	case hole.TypePacket:
+		c.handlePacketMessage(peerID, msg)
+	}
+}
+
+// Send 向已连接的对等端发送数据，对方通过 OnMessage 接收
+// ctx 结束时立即返回，已开始的写入仍在后台完成
+func (c *Client) Send(ctx context.Context, peerID string, data []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	conn, ok := c.peers.Load(peerID)
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrPeerNotConnected, peerID)
+	}
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Errorf("marshal data error: %v", err)
+	}
+	msg := &hole.Message{
+		Type:    hole.TypeData,
+		From:    c.clientID,
+		To:      peerID,
+		Payload: payload,
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- conn.(*hole.Conn).WriteMessage(msg)
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			return fmt.Errorf("send to peer %s error: %v", peerID, err)
+		}
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 func (c *Client) SendMessage(peerID string, message string) {
 	// 检查是否已连接到peer
 	conn, ok := c.peers.Load(peerID)
@@ -578,53 +727,59 @@ func (c *Client) SendMessage(peerID string, message string) {
 		return
 	}
 
-	// 构造消息
+	// 构造消息，文本内容编码为 JSON 字符串
+	payload, err := json.Marshal(message)
+	if err != nil {
+		c.xl.Errorf("Failed to marshal message: %v", err)
+		return
+	}
 	msg := &hole.Message{
 		Type:    hole.TypeMessage,
 		From:    c.clientID,
 		To:      peerID,
-		Payload: []byte(message), // 直接使用文本内容
-	}
-
-	// 序列化整个消息
-	data, err := json.Marshal(msg)
-	if err != nil {
-		c.xl.Errorf("Failed to marshal message: %v", err)
-		return
+		Payload: payload,
 	}
 
-	// 添加换行符并发送
-	data = append(data, '\n')
-	if _, err := conn.(net.Conn).Write(data); err != nil {
+	if err := conn.(*hole.Conn).WriteMessage(msg); err != nil {
 		c.xl.Errorf("Failed to send message to peer %s: %v", peerID, err)
 		return
 	}
 
-	// 更新发送字节数
-	c.addP2PBytesSent(int64(len(data)))
-
 	c.xl.Infof("Message sent to %s: %s", peerID, message)
 }
 
 func (c *Client) Close() {
+	if c.closed.CompareAndSwap(false, true) {
+		close(c.done)
+	}
 	// 停止心跳
 	if c.heartbeatCancel != nil {
 		c.heartbeatCancel()
 	}
 
 	// 关闭连接
-	if c.serverConn != nil {
-		c.serverConn.Close()
+	if conn := c.server(); conn != nil {
+		conn.Close()
 	}
 
 	// 关闭监听器
 	if c.listener != nil {
 		c.listener.Close()
 	}
+	if endpoint := c.udpEndpoint(); endpoint != nil {
+		endpoint.Close()
+	}
+	if vnet := c.vnet.Load(); vnet != nil {
+		vnet.dev.Close()
+	}
+	c.forwards.Range(func(key, _ interface{}) bool {
+		key.(io.Closer).Close()
+		return true
+	})
 
 	// 关闭所有对等连接
 	c.peers.Range(func(key, value interface{}) bool {
-		if conn, ok := value.(net.Conn); ok {
+		if conn, ok := value.(*hole.Conn); ok {
 			conn.Close()
 			c.xl.Infof("Connection with peer %s closed", key)
 		}
@@ -637,6 +792,15 @@ func (c *Client) StartCLI() {
 	c.xl.Info("  list              - List all connected peers")
 	c.xl.Info("  connect <peer_id> - Connect to a peer")
 	c.xl.Info("  send <peer_id> <message> - Send message to a peer")
+	c.xl.Info("  tun [name]        - Join the virtual network through a TUN device")
+	c.xl.Info("  expose <peer_id> <local_addr> [tcp|udp] - Allow a peer to access a local service")
+	c.xl.Info("  forward <listen_addr> <peer_id> <remote_addr> [tcp|udp] - Forward local traffic to a service exposed by a peer")
+	c.xl.Info("  socks <listen_addr> <peer_id> - Start a SOCKS5 proxy that exits through a peer")
+	c.xl.Info("  allowexit <peer_id> <cidr[:ports]> - Allow a peer to reach destinations through this node")
+	c.xl.Info("  publish <name> <local_addr> - Publish a local HTTP service through the server")
+	c.xl.Info("  sendfile <peer_id> <path> - Send a file to a peer")
+	c.xl.Info("  recvdir <dir>     - Accept files from peers into a directory")
+	c.xl.Info("  transfers         - Show file transfer progress")
 	c.xl.Info("  exit              - Exit the program")
 
 	scanner := bufio.NewScanner(os.Stdin)
@@ -667,6 +831,82 @@ func (c *Client) StartCLI() {
 				continue
 			}
 			c.handleSendCommand(parts[1], strings.Join(parts[2:], " "))
+		case "expose":
+			if len(parts) != 3 && len(parts) != 4 {
+				c.xl.Error("Usage: expose <peer_id> <local_addr> [tcp|udp]")
+				continue
+			}
+			if len(parts) == 4 && parts[3] == "udp" {
+				c.ExposeUDP(parts[1], parts[2])
+			} else {
+				c.Expose(parts[1], parts[2])
+			}
+		case "forward":
+			if len(parts) != 4 && len(parts) != 5 {
+				c.xl.Error("Usage: forward <listen_addr> <peer_id> <remote_addr> [tcp|udp]")
+				continue
+			}
+			var err error
+			if len(parts) == 5 && parts[4] == "udp" {
+				_, err = c.ForwardUDP(parts[1], parts[2], parts[3])
+			} else {
+				_, err = c.Forward(parts[1], parts[2], parts[3])
+			}
+			if err != nil {
+				c.xl.Errorf("Failed to forward: %v", err)
+			}
+		case "tun":
+			var name string
+			if len(parts) > 1 {
+				name = parts[1]
+			}
+			if err := c.StartTUN(name); err != nil {
+				c.xl.Errorf("Failed to start tun: %v", err)
+			}
+		case "socks":
+			if len(parts) != 3 {
+				c.xl.Error("Usage: socks <listen_addr> <peer_id>")
+				continue
+			}
+			if _, err := c.SOCKS(parts[1], parts[2]); err != nil {
+				c.xl.Errorf("Failed to start socks proxy: %v", err)
+			}
+		case "allowexit":
+			if len(parts) != 3 {
+				c.xl.Error("Usage: allowexit <peer_id> <cidr[:ports]>")
+				continue
+			}
+			if err := c.AllowExit(parts[1], parts[2]); err != nil {
+				c.xl.Errorf("Failed to allow exit: %v", err)
+			}
+		case "publish":
+			if len(parts) != 3 {
+				c.xl.Error("Usage: publish <name> <local_addr>")
+				continue
+			}
+			if err := c.PublishHTTP(parts[1], parts[2]); err != nil {
+				c.xl.Errorf("Failed to publish: %v", err)
+			}
+		case "sendfile":
+			if len(parts) != 3 {
+				c.xl.Error("Usage: sendfile <peer_id> <path>")
+				continue
+			}
+			go func(peerID, path string) {
+				if err := c.SendFile(peerID, path); err != nil {
+					c.xl.Errorf("Failed to send %s: %v", path, err)
+				}
+			}(parts[1], parts[2])
+		case "recvdir":
+			if len(parts) != 2 {
+				c.xl.Error("Usage: recvdir <dir>")
+				continue
+			}
+			if err := c.SetRecvDir(parts[1]); err != nil {
+				c.xl.Errorf("Failed to set receive directory: %v", err)
+			}
+		case "transfers":
+			c.handleTransfersCommand()
 		case "exit":
 			c.xl.Info("Exiting...")
 			return
@@ -688,6 +928,29 @@ func (c *Client) handleListCommand() {
 	}
 }
 
+func (c *Client) handleTransfersCommand() {
+	transfers := c.Transfers()
+	if len(transfers) == 0 {
+		c.xl.Info("No file transfers")
+		return
+	}
+	for _, t := range transfers {
+		direction := "from"
+		if t.Outgoing {
+			direction = "to"
+		}
+		percent := 100.0
+		if t.Size > 0 {
+			percent = float64(t.Offset) * 100 / float64(t.Size)
+		}
+		line := fmt.Sprintf("#%s %s %s %s: %d/%d bytes (%.1f%%) %s", t.ID, t.Name, direction, t.PeerID, t.Offset, t.Size, percent, t.State)
+		if t.Error != "" {
+			line += ": " + t.Error
+		}
+		c.xl.Info(line)
+	}
+}
+
 func (c *Client) handleConnectCommand(peerID string) {
 	if peerID == c.clientID {
 		c.xl.Warn("Cannot connect to self")
@@ -717,7 +980,7 @@ func (c *Client) handleSendCommand(peerID, message string) {
 		message = fmt.Sprintf(`{"message": "%s"}`, message)
 	}
 
-	conn := peerConn.(net.Conn)
+	conn := peerConn.(*hole.Conn)
 	msg := &hole.Message{
 		Type:    hole.TypeMessage,
 		From:    c.clientID,
@@ -725,39 +988,77 @@ func (c *Client) handleSendCommand(peerID, message string) {
 		Payload: []byte(message),
 	}
 
-	data, err := json.Marshal(msg)
-	if err != nil {
-		c.xl.Errorf("Failed to marshal message: %v", err)
-		return
-	}
-
-	_, err = conn.Write(append(data, '\n'))
-	if err != nil {
+	if err := conn.WriteMessage(msg); err != nil {
 		c.xl.Errorf("Failed to send message: %v", err)
 		return
 	}
 
-	c.addP2PBytesSent(int64(len(data)))
-
 	c.xl.Infof("Message sent to %s: %s", peerID, message)
 }
 
-func (c *Client) register() error {
+func (c *Client) register(conn *hole.Conn) (*hole.RegisterAckPayload, error) {
 	// 注册客户端信息
 	c.xl.Infof("Registering client (ID: %s, Name: %s)...", c.clientID, c.name)
+	payload := hole.RegisterPayload{
+		ClientID:    c.clientID,
+		Name:        c.name,
+		PublicAddr:  c.listener.Addr().String(),
+		PrivateAddr: c.listener.Addr().String(),
+		Version:     hole.ProtocolVersion,
+		NATType:     string(c.natType),
+		PublicKey:   c.identity.PublicKey(),
+	}
+	// 使用探测到的反射地址
+	if c.publicAddr != "" {
+		payload.PublicAddr = c.publicAddr
+	}
+	if _, privateAddr := c.udpAddrs(); privateAddr != "" {
+		payload.PrivateAddr = privateAddr
+	}
+	if c.token != "" {
+		if err := payload.Sign(c.token); err != nil {
+			return nil, fmt.Errorf("failed to sign register payload: %v", err)
+		}
+	}
+	payloadBytes, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal register payload: %v", err)
+	}
+
 	msg := &hole.Message{
-		Type: hole.TypeRegister,
-		From: c.clientID,
-		Payload: []byte(`{
-			"client_id": "` + c.clientID + `",
-			"name": "` + c.name + `"
-		}`),
-	}
-	packet, _ := hole.CreateHolePacket(msg)
-	if err := protocol.NewPacketIO(nil, c.serverConn).WritePacket(packet); err != nil {
-		c.xl.Errorf("Failed to register with server: %v", err)
-		return fmt.Errorf("register to server error: %v", err)
-	}
-	c.xl.Info("Client registered successfully")
-	return nil
+		Type:    hole.TypeRegister,
+		From:    c.clientID,
+		To:      "server",
+		Payload: payloadBytes,
+	}
+	if err := conn.WriteMessage(msg); err != nil {
+		return nil, fmt.Errorf("failed to send register message: %v", err)
+	}
+
+	// 等待注册响应
+	respMsg, err := conn.ReadMessage()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read register response: %v", err)
+	}
+	if respMsg.Type == hole.TypeError {
+		var rejected hole.ErrorPayload
+		if err := json.Unmarshal(respMsg.Payload, &rejected); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal error response: %v", err)
+		}
+		return nil, fmt.Errorf("registration rejected: %w", &rejected)
+	}
+	if respMsg.Type != hole.TypeRegister {
+		return nil, fmt.Errorf("unexpected response type: %s", respMsg.Type)
+	}
+
+	var ack hole.RegisterAckPayload
+	if len(respMsg.Payload) > 0 {
+		if err := json.Unmarshal(respMsg.Payload, &ack); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal register ack: %v", err)
+		}
+	}
+	if ack.Version != 0 && ack.Version != hole.ProtocolVersion {
+		return nil, fmt.Errorf("unsupported protocol version: %d", ack.Version)
+	}
+	return &ack, nil
 }
@@ -1,13 +1,29 @@
 package client
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
 	"encoding/json"
+	"fmt"
+	"io"
 	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/liuscraft/spider-network/pkg/config"
 	"github.com/liuscraft/spider-network/pkg/protocol"
 	"github.com/liuscraft/spider-network/pkg/protocol/hole"
+	"github.com/liuscraft/spider-network/pkg/punch"
+	"github.com/liuscraft/spider-network/pkg/punch/natsim"
+	"github.com/liuscraft/spider-network/pkg/secure"
+	"github.com/liuscraft/spider-network/pkg/tlsutil"
+	"github.com/liuscraft/spider-network/server/client_mgr"
+	"github.com/liuscraft/spider-network/server/relay_mgr"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -16,6 +32,22 @@ import (
 type mockServer struct {
 	listener net.Listener
 	clients  map[string]net.Conn
+	keys     sync.Map // 客户端ID -> 注册时发布的静态公钥
+
+	// UDP 绑定服务，为 nil 时不支持 UDP 打洞
+	udpConn  net.PacketConn
+	udpAddrs sync.Map
+
+	// 中继服务，blockP2P 时把候选地址替换为不可达地址以模拟打洞失败
+	relayMgr *relay_mgr.RelayManager
+	blockP2P bool
+
+	// 虚拟网络地址分配，为 nil 时不分配虚拟 IP
+	ipam *client_mgr.IPAM
+
+	// 注册次数，silent 时不再处理注册后的消息以模拟服务端失去响应
+	registers atomic.Int32
+	silent    atomic.Bool
 }
 
 func newMockServer(t *testing.T) *mockServer {
@@ -32,6 +64,78 @@ func newMockServer(t *testing.T) *mockServer {
 	return server
 }
 
+// newMockTLSServer 创建信令通道使用 TLS 的模拟服务器
+func newMockTLSServer(t *testing.T, tlsConfig *tls.Config) *mockServer {
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", tlsConfig)
+	require.NoError(t, err)
+
+	server := &mockServer{
+		listener: listener,
+		clients:  make(map[string]net.Conn),
+	}
+	go server.start(t)
+	return server
+}
+
+// newMockUDPServer 创建同时支持 UDP 绑定的模拟服务器
+func newMockUDPServer(t *testing.T) *mockServer {
+	server := newMockServer(t)
+	udpConn, err := net.ListenPacket("udp4", server.listener.Addr().String())
+	require.NoError(t, err)
+	server.udpConn = udpConn
+
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := udpConn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			txn, clientID, token, err := punch.DecodeBind(buf[:n])
+			if err != nil || token != "udp-"+clientID {
+				continue
+			}
+			server.udpAddrs.Store(clientID, addr.String())
+			udpConn.WriteTo(punch.EncodeBindAck(txn, addr.String()), addr)
+		}
+	}()
+	return server
+}
+
+// newMockRelayServer 创建对等端之间无法直连、只能通过中继通信的模拟服务器
+func newMockRelayServer(t *testing.T, cfg config.RelayConfig) *mockServer {
+	server := newMockServer(t)
+	server.relayMgr = relay_mgr.NewRelayManager(cfg)
+	server.blockP2P = true
+	return server
+}
+
+// publicKey 返回客户端注册时发布的静态公钥
+func (s *mockServer) publicKey(clientID string) string {
+	if key, ok := s.keys.Load(clientID); ok {
+		return key.(string)
+	}
+	return ""
+}
+
+// fillPeerInfo 填写发送方的静态公钥，并使用观察到的 UDP 地址作为公网候选地址
+func (s *mockServer) fillPeerInfo(msg *hole.Message) {
+	var payload hole.PunchPayload
+	if json.Unmarshal(msg.Payload, &payload) != nil {
+		return
+	}
+	payload.PublicKey = s.publicKey(msg.From)
+
+	if s.blockP2P {
+		payload.Network = hole.NetworkTCP
+		payload.PublicAddr = "127.0.0.1:1"
+		payload.PrivateAddr = "127.0.0.1:1"
+	} else if addr, ok := s.udpAddrs.Load(msg.From); ok && payload.Network == hole.NetworkUDP {
+		payload.PublicAddr = addr.(string)
+	}
+	msg.Payload, _ = json.Marshal(payload)
+}
+
 func (s *mockServer) start(t *testing.T) {
 	for {
 		conn, err := s.listener.Accept()
@@ -46,30 +150,52 @@ func (s *mockServer) start(t *testing.T) {
 func (s *mockServer) handleClient(t *testing.T, conn net.Conn) {
 	defer conn.Close()
 
-	// 等待注册消息
+	// 等待注册消息，TLS 握手失败的连接直接关闭
 	packet, err := protocol.NewPacketIO(conn, nil).ReadPacket()
-	require.NoError(t, err)
+	if err != nil {
+		return
+	}
 
 	var msg hole.Message
 	_, err = packet.Read(&msg)
 	require.NoError(t, err)
-	require.Equal(t, hole.TypeRegister, msg.Type)
 
-	var payload struct {
-		ClientID string `json:"client_id"`
-		Name     string `json:"name"`
+	// 中继连接绑定后只转发字节流
+	if msg.Type == hole.TypeRelayBind && s.relayMgr != nil {
+		var relay hole.RelayPayload
+		require.NoError(t, json.Unmarshal(msg.Payload, &relay))
+		s.relayMgr.Bind(relay.ChannelID, msg.From, hole.NewConn(conn))
+		return
 	}
+	require.Equal(t, hole.TypeRegister, msg.Type)
+
+	var payload hole.RegisterPayload
 	err = json.Unmarshal(msg.Payload, &payload)
 	require.NoError(t, err)
 
 	// 保存客户端连接
+	s.registers.Add(1)
 	s.clients[payload.ClientID] = conn
+	s.keys.Store(payload.ClientID, payload.PublicKey)
 
 	// 发送注册确认
+	ack := hole.RegisterAckPayload{Version: hole.ProtocolVersion}
+	if s.udpConn != nil {
+		ack.UDPPort = s.udpConn.LocalAddr().(*net.UDPAddr).Port
+		ack.UDPToken = "udp-" + payload.ClientID
+	}
+	if s.ipam != nil {
+		ip, err := s.ipam.Assign(payload.ClientID)
+		require.NoError(t, err)
+		ack.VirtualIP = s.ipam.CIDR(ip)
+	}
+	ackBytes, err := json.Marshal(ack)
+	require.NoError(t, err)
 	response := &hole.Message{
-		Type: hole.TypeRegister,
-		From: "server",
-		To:   payload.ClientID,
+		Type:    hole.TypeRegister,
+		From:    "server",
+		To:      payload.ClientID,
+		Payload: ackBytes,
 	}
 	packet, err = hole.CreateHolePacket(response)
 	require.NoError(t, err)
@@ -86,8 +212,17 @@ func (s *mockServer) handleClient(t *testing.T, conn net.Conn) {
 
 		_, err = packet.Read(&msg)
 		require.NoError(t, err)
+		if s.silent.Load() {
+			continue
+		}
 
 		switch msg.Type {
+		case hole.TypeHeartbeat:
+			// 回复心跳确认
+			packet, _ = hole.CreateHolePacket(&hole.Message{Type: hole.TypeHeartbeat, From: "server", To: msg.From})
+			err = protocol.NewPacketIO(nil, conn).WritePacket(packet)
+			require.NoError(t, err)
+
 		case hole.TypePunch:
 			// 转发打洞消息给目标客户端
 			targetConn := s.clients[msg.To]
@@ -95,6 +230,7 @@ func (s *mockServer) handleClient(t *testing.T, conn net.Conn) {
 				continue
 			}
 
+			s.fillPeerInfo(&msg)
 			readyMsg := &hole.Message{
 				Type:    hole.TypePunchReady,
 				From:    msg.From,
@@ -111,15 +247,55 @@ func (s *mockServer) handleClient(t *testing.T, conn net.Conn) {
 			if targetConn == nil {
 				continue
 			}
+			s.fillPeerInfo(&msg)
 			packet, _ = hole.CreateHolePacket(&msg)
 			err = protocol.NewPacketIO(nil, targetConn).WritePacket(packet)
 			require.NoError(t, err)
+
+		case hole.TypePeerKey:
+			// 返回目标客户端的静态公钥
+			reply := &hole.Message{Type: hole.TypePeerKey, From: msg.To, To: msg.From}
+			reply.Payload, _ = json.Marshal(hole.PeerKeyPayload{PublicKey: s.publicKey(msg.To)})
+			packet, _ = hole.CreateHolePacket(reply)
+			err = protocol.NewPacketIO(nil, conn).WritePacket(packet)
+			require.NoError(t, err)
+
+		case hole.TypeResolve:
+			// 返回虚拟 IP 所属的客户端
+			var resolve hole.ResolvePayload
+			require.NoError(t, json.Unmarshal(msg.Payload, &resolve))
+			resolve.ClientID, _ = s.ipam.Lookup(net.ParseIP(resolve.VirtualIP))
+			reply := &hole.Message{Type: hole.TypeResolve, From: "server", To: msg.From}
+			reply.Payload, _ = json.Marshal(resolve)
+			packet, _ = hole.CreateHolePacket(reply)
+			err = protocol.NewPacketIO(nil, conn).WritePacket(packet)
+			require.NoError(t, err)
+
+		case hole.TypeRelay:
+			// 分配中继通道并通知双方
+			channelID, created, err := s.relayMgr.Allocate(msg.From, msg.To)
+			require.NoError(t, err)
+			if !created {
+				continue
+			}
+			for _, notify := range []*hole.Message{
+				{Type: hole.TypeRelay, From: msg.To, To: msg.From},
+				{Type: hole.TypeRelay, From: msg.From, To: msg.To},
+			} {
+				notify.Payload, _ = json.Marshal(hole.RelayPayload{ChannelID: channelID, PublicKey: s.publicKey(notify.From)})
+				packet, _ = hole.CreateHolePacket(notify)
+				err = protocol.NewPacketIO(nil, s.clients[notify.To]).WritePacket(packet)
+				require.NoError(t, err)
+			}
 		}
 	}
 }
 
 func (s *mockServer) close() {
 	s.listener.Close()
+	if s.udpConn != nil {
+		s.udpConn.Close()
+	}
 	for _, conn := range s.clients {
 		conn.Close()
 	}
@@ -129,7 +305,7 @@ func TestClientRegistration(t *testing.T) {
 	server := newMockServer(t)
 	defer server.close()
 
-	client := NewClient("test-1", "Test Client 1")
+	client := NewClient("test-1", "Test Client 1", "")
 	err := client.Connect(server.listener.Addr().String())
 	require.NoError(t, err)
 	defer client.Close()
@@ -147,12 +323,12 @@ func TestPeerConnection(t *testing.T) {
 	defer server.close()
 
 	// 创建两个客户端
-	client1 := NewClient("test-1", "Test Client 1")
+	client1 := NewClient("test-1", "Test Client 1", "")
 	err := client1.Connect(server.listener.Addr().String())
 	require.NoError(t, err)
 	defer client1.Close()
 
-	client2 := NewClient("test-2", "Test Client 2")
+	client2 := NewClient("test-2", "Test Client 2", "")
 	err = client2.Connect(server.listener.Addr().String())
 	require.NoError(t, err)
 	defer client2.Close()
@@ -185,12 +361,16 @@ func TestMessageExchange(t *testing.T) {
 	defer server.close()
 
 	// 创建两个客户端
-	client1 := NewClient("test-1", "Test Client 1")
+	client1 := NewClient("test-1", "Test Client 1", "")
 	err := client1.Connect(server.listener.Addr().String())
 	require.NoError(t, err)
 	defer client1.Close()
 
-	client2 := NewClient("test-2", "Test Client 2")
+	client2 := NewClient("test-2", "Test Client 2", "")
+	received := make(chan string, 1)
+	client2.OnMessage(func(peerID string, payload []byte) {
+		received <- peerID + ": " + string(payload)
+	})
 	err = client2.Connect(server.listener.Addr().String())
 	require.NoError(t, err)
 	defer client2.Close()
@@ -209,10 +389,892 @@ func TestMessageExchange(t *testing.T) {
 	testMessage := "Hello, test message!"
 	client1.handleSendCommand("test-2", testMessage)
 
-	// 等待消息传递
+	select {
+	case msg := <-received:
+		assert.Equal(t, `test-1: {"message":"`+testMessage+`"}`, msg)
+	case <-time.After(5 * time.Second):
+		t.Fatal("message not received")
+	}
+}
+
+func TestPeerEvents(t *testing.T) {
+	server := newMockServer(t)
+	defer server.close()
+
+	client1 := NewClient("test-1", "Test Client 1", "")
+	connected := make(chan string, 4)
+	disconnected := make(chan string, 4)
+	client1.OnPeerConnected(func(peerID string) { connected <- peerID })
+	client1.OnPeerDisconnected(func(peerID string, err error) { disconnected <- peerID })
+	require.NoError(t, client1.Connect(server.listener.Addr().String()))
+	defer client1.Close()
+
+	client2 := NewClient("test-2", "Test Client 2", "")
+	received := make(chan []byte, 1)
+	client2.OnMessage(func(peerID string, payload []byte) {
+		if peerID == "test-1" {
+			received <- payload
+		}
+	})
+	require.NoError(t, client2.Connect(server.listener.Addr().String()))
+
+	// 未连接时返回错误
+	err := client1.Send(context.Background(), "test-2", []byte("hello"))
+	assert.ErrorIs(t, err, ErrPeerNotConnected)
+
+	time.Sleep(100 * time.Millisecond)
+	require.NoError(t, client1.ConnectToPeer("test-2"))
+	select {
+	case peerID := <-connected:
+		assert.Equal(t, "test-2", peerID)
+	case <-time.After(5 * time.Second):
+		t.Fatal("peer not connected")
+	}
+
+	// 二进制数据原样送达
+	data := []byte{0x00, 0xff, '"', '\n'}
+	require.NoError(t, client1.Send(context.Background(), "test-2", data))
+	select {
+	case payload := <-received:
+		assert.Equal(t, data, payload)
+	case <-time.After(5 * time.Second):
+		t.Fatal("data not received")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.ErrorIs(t, client1.Send(ctx, "test-2", data), context.Canceled)
+
+	client2.Close()
+	select {
+	case peerID := <-disconnected:
+		assert.Equal(t, "test-2", peerID)
+	case <-time.After(5 * time.Second):
+		t.Fatal("peer disconnect not reported")
+	}
+}
+
+func TestSlowMessageHandler(t *testing.T) {
+	server := newMockServer(t)
+	defer server.close()
+
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer echo.Close()
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	client1 := NewClient("test-1", "Test Client 1", "")
+	connected := make(chan string, 1)
+	client1.OnPeerConnected(func(peerID string) { connected <- peerID })
+	require.NoError(t, client1.Connect(server.listener.Addr().String()))
+	defer client1.Close()
+
+	// 回调一直阻塞到 release 关闭
+	client2 := NewClient("test-2", "Test Client 2", "")
+	release := make(chan struct{})
+	received := make(chan string, 3)
+	client2.OnMessage(func(peerID string, payload []byte) {
+		<-release
+		received <- string(payload)
+	})
+	require.NoError(t, client2.Connect(server.listener.Addr().String()))
+	defer client2.Close()
+
+	time.Sleep(100 * time.Millisecond)
+	require.NoError(t, client1.ConnectToPeer("test-2"))
+	select {
+	case <-connected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("peer not connected")
+	}
+	for _, message := range []string{"1", "2", "3"} {
+		require.NoError(t, client1.Send(context.Background(), "test-2", []byte(message)))
+	}
+
+	// 回调阻塞期间同一对等连接上的流仍可收发
+	client1.Expose("test-2", echo.Addr().String())
+	listener, err := client2.Forward("127.0.0.1:0", "test-1", echo.Addr().String())
+	require.NoError(t, err)
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	data := bytes.Repeat([]byte{'a'}, 64*1024)
+	go conn.Write(data)
+	reply := make([]byte, len(data))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = io.ReadFull(conn, reply)
+	require.NoError(t, err)
+	assert.Equal(t, data, reply)
+
+	// 消息按发送顺序回调
+	close(release)
+	for _, message := range []string{"1", "2", "3"} {
+		select {
+		case payload := <-received:
+			assert.Equal(t, message, payload)
+		case <-time.After(5 * time.Second):
+			t.Fatal("message not received")
+		}
+	}
+}
+
+func TestUDPPeerConnectionThroughNAT(t *testing.T) {
+	server := newMockUDPServer(t)
+	defer server.close()
+
+	// 两个客户端分别位于端口受限锥形 NAT 之后
+	newNATClient := func(id, name string) *Client {
+		c := NewClient(id, name, "")
+		c.listenPacket = natsim.New(natsim.PortRestrictedCone, 0).ListenPacket
+		require.NoError(t, c.Connect(server.listener.Addr().String()))
+		require.True(t, c.udpReady())
+		return c
+	}
+	client1 := newNATClient("test-1", "Test Client 1")
+	defer client1.Close()
+	client2 := newNATClient("test-2", "Test Client 2")
+	defer client2.Close()
+
+	// NAT 后的内网地址与服务器观察到的地址不同
+	assert.NotEqual(t, client1.udpPrivateAddr, client1.udpPublicAddr)
+
 	time.Sleep(100 * time.Millisecond)
+	require.NoError(t, client1.ConnectToPeer("test-2"))
+
+	require.Eventually(t, func() bool {
+		_, ok1 := client1.peers.Load("test-2")
+		_, ok2 := client2.peers.Load("test-1")
+		return ok1 && ok2
+	}, 3*time.Second, 50*time.Millisecond)
+
+	conn, _ := client1.peers.Load("test-2")
+	_, isSession := conn.(*hole.Conn).Conn.(*secure.Conn).Conn.(*countingConn).Conn.(*punch.Session)
+	assert.True(t, isSession)
+
+	client1.SendMessage("test-2", "Hello over udp!")
+	require.Eventually(t, func() bool {
+		_, _, _, p2pRecv := client2.getStats()
+		return p2pRecv > 0
+	}, time.Second, 20*time.Millisecond)
+}
+
+func TestRelayFallback(t *testing.T) {
+	server := newMockRelayServer(t, config.RelayConfig{})
+	defer server.close()
+
+	client1 := NewClient("test-1", "Test Client 1", "")
+	require.NoError(t, client1.Connect(server.listener.Addr().String()))
+	defer client1.Close()
+
+	client2 := NewClient("test-2", "Test Client 2", "")
+	require.NoError(t, client2.Connect(server.listener.Addr().String()))
+	defer client2.Close()
+
+	time.Sleep(100 * time.Millisecond)
+	require.NoError(t, client1.ConnectToPeer("test-2"))
+
+	// 直连失败后通过中继建立连接
+	require.Eventually(t, func() bool {
+		_, ok1 := client1.peers.Load("test-2")
+		_, ok2 := client2.peers.Load("test-1")
+		return ok1 && ok2
+	}, 5*time.Second, 50*time.Millisecond)
+
+	client1.SendMessage("test-2", "Hello via relay!")
+	require.Eventually(t, func() bool {
+		sent, _, _ := server.relayMgr.Stats("test-1")
+		_, recv, _ := server.relayMgr.Stats("test-2")
+		return sent > 0 && recv == sent
+	}, time.Second, 20*time.Millisecond)
+
+	// 中继流量不计入点对点流量
+	_, _, p2pSent, p2pRecv := client1.getStats()
+	assert.Zero(t, p2pSent+p2pRecv)
+	client1.stats.mutex.Lock()
+	assert.Greater(t, client1.stats.relayBytesSent, int64(0))
+	client1.stats.mutex.Unlock()
+
+	_, _, channels := server.relayMgr.Stats("test-1")
+	assert.Equal(t, 1, channels)
+}
+
+func TestPeerConnectionEncrypted(t *testing.T) {
+	server := newMockServer(t)
+	defer server.close()
+
+	client1 := NewClient("test-1", "Test Client 1", "")
+	require.NoError(t, client1.Connect(server.listener.Addr().String()))
+	defer client1.Close()
+
+	client2 := NewClient("test-2", "Test Client 2", "")
+	require.NoError(t, client2.Connect(server.listener.Addr().String()))
+	defer client2.Close()
+
+	time.Sleep(100 * time.Millisecond)
+	require.NoError(t, client1.ConnectToPeer("test-2"))
+	require.Eventually(t, func() bool {
+		_, ok1 := client1.peers.Load("test-2")
+		_, ok2 := client2.peers.Load("test-1")
+		return ok1 && ok2
+	}, 3*time.Second, 50*time.Millisecond)
+
+	conn, _ := client2.peers.Load("test-1")
+	_, encrypted := conn.(*hole.Conn).Conn.(*secure.Conn)
+	assert.True(t, encrypted)
+
+	// 冒充 test-1 但不持有其私钥的连接无法通过握手
+	mallory, err := secure.GenerateIdentity()
+	require.NoError(t, err)
+	rawConn, err := net.Dial("tcp", client2.listener.Addr().String())
+	require.NoError(t, err)
+	defer rawConn.Close()
+	client2Key, err := secure.ParsePublicKey(client2.identity.PublicKey())
+	require.NoError(t, err)
+	_, err = secure.Client(rawConn, mallory, "test-1", "test-2", client2Key)
+	assert.Error(t, err)
+
+	current, _ := client2.peers.Load("test-1")
+	assert.Same(t, conn, current)
+
+	// 已连接时对方再次建立的连接被关闭，保留原有连接
+	rawConn2, err := net.Dial("tcp", client2.listener.Addr().String())
+	require.NoError(t, err)
+	defer rawConn2.Close()
+	dup, err := secure.Client(rawConn2, client1.identity, "test-1", "test-2", client2Key)
+	require.NoError(t, err)
+	dup.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err = dup.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF)
+	current, _ = client2.peers.Load("test-1")
+	assert.Same(t, conn, current)
+}
+
+func TestConnectWithoutPeerKey(t *testing.T) {
+	server := newMockServer(t)
+	defer server.close()
+
+	client1 := NewClient("test-1", "Test Client 1", "")
+	require.NoError(t, client1.Connect(server.listener.Addr().String()))
+	defer client1.Close()
+
+	client2 := NewClient("test-2", "Test Client 2", "")
+	require.NoError(t, client2.Connect(server.listener.Addr().String()))
+	defer client2.Close()
+
+	time.Sleep(100 * time.Millisecond)
+
+	// 连接消息不带公钥，握手需要通过信令查询，查询结果由同一个信令读取协程接收
+	payload, err := json.Marshal(client2.localPunchPayload(hole.NetworkTCP))
+	require.NoError(t, err)
+	packet, err := hole.CreateHolePacket(&hole.Message{Type: hole.TypeConnect, From: "test-2", To: "test-1", Payload: payload})
+	require.NoError(t, err)
+	require.NoError(t, protocol.NewPacketIO(nil, server.clients["test-1"]).WritePacket(packet))
+
+	require.Eventually(t, func() bool {
+		_, ok1 := client1.peers.Load("test-2")
+		_, ok2 := client2.peers.Load("test-1")
+		return ok1 && ok2
+	}, peerKeyTimeout/2, 50*time.Millisecond)
+}
+
+func TestConnectTLSPinned(t *testing.T) {
+	ca, err := tlsutil.NewCA("test CA")
+	require.NoError(t, err)
+	certPEM, keyPEM, err := ca.Issue("server", []string{"127.0.0.1"}, false)
+	require.NoError(t, err)
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	require.NoError(t, err)
+	pin, err := tlsutil.CertificatePin(certPEM)
+	require.NoError(t, err)
+
+	server := newMockTLSServer(t, &tls.Config{Certificates: []tls.Certificate{cert}})
+	defer server.close()
+
+	// 指纹匹配的自签名证书无需 CA 即可连接
+	tlsConfig, err := tlsutil.ClientConfig(tlsutil.ClientOptions{PinnedKey: pin})
+	require.NoError(t, err)
+	client := NewClient("test-1", "Test Client 1", "", WithTLSConfig(tlsConfig))
+	require.NoError(t, client.Connect(server.listener.Addr().String()))
+	defer client.Close()
+	_, ok := client.server().Conn.(*countingConn).Conn.(*tls.Conn)
+	assert.True(t, ok)
+
+	// 指纹不匹配时立即失败，不再重试
+	tlsConfig, err = tlsutil.ClientConfig(tlsutil.ClientOptions{PinnedKey: tlsutil.PublicKeyPin(ca.Cert)})
+	require.NoError(t, err)
+	client2 := NewClient("test-2", "Test Client 2", "", WithTLSConfig(tlsConfig))
+	defer client2.Close()
+	err = client2.Connect(server.listener.Addr().String())
+	assert.ErrorIs(t, err, tlsutil.ErrPinMismatch)
+}
+
+// fakeTUN 内存中的 TUN 设备，in 为本机发出的报文，out 为写入本机的报文
+type fakeTUN struct {
+	in        chan []byte
+	out       chan []byte
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newFakeTUN() *fakeTUN {
+	return &fakeTUN{
+		in:     make(chan []byte, 16),
+		out:    make(chan []byte, 16),
+		closed: make(chan struct{}),
+	}
+}
+
+func (d *fakeTUN) Read(b []byte) (int, error) {
+	select {
+	case packet := <-d.in:
+		return copy(b, packet), nil
+	case <-d.closed:
+		return 0, net.ErrClosed
+	}
+}
+
+func (d *fakeTUN) Write(b []byte) (int, error) {
+	d.out <- append([]byte(nil), b...)
+	return len(b), nil
+}
+
+func (d *fakeTUN) Close() error {
+	d.closeOnce.Do(func() { close(d.closed) })
+	return nil
+}
+
+func (d *fakeTUN) Name() string {
+	return "fake0"
+}
+
+// ipv4Packet 构造只包含首部和负载的 IPv4 报文
+func ipv4Packet(src, dst string, payload []byte) []byte {
+	packet := make([]byte, 20, 20+len(payload))
+	packet[0] = 0x45
+	copy(packet[12:16], net.ParseIP(src).To4())
+	copy(packet[16:20], net.ParseIP(dst).To4())
+	return append(packet, payload...)
+}
+
+func TestTUNForwarding(t *testing.T) {
+	server := newMockServer(t)
+	defer server.close()
+	ipam, err := client_mgr.NewIPAM(config.NetworkConfig{CIDR: "10.10.0.0/24"})
+	require.NoError(t, err)
+	server.ipam = ipam
+
+	client1 := NewClient("test-1", "Test Client 1", "")
+	require.NoError(t, client1.Connect(server.listener.Addr().String()))
+	defer client1.Close()
+	client2 := NewClient("test-2", "Test Client 2", "")
+	require.NoError(t, client2.Connect(server.listener.Addr().String()))
+	defer client2.Close()
+	assert.Equal(t, "10.10.0.1/24", client1.VirtualIP())
+	assert.Equal(t, "10.10.0.2/24", client2.VirtualIP())
+
+	dev1, dev2 := newFakeTUN(), newFakeTUN()
+	require.NoError(t, client1.startTUN(dev1, client1.VirtualIP()))
+	require.NoError(t, client2.startTUN(dev2, client2.VirtualIP()))
+
+	// 首个报文触发地址查询和对等连接，之后的报文经对等连接送达
+	transfer := func(from, to *fakeTUN, packet []byte) {
+		deadline := time.After(10 * time.Second)
+		ticker := time.NewTicker(100 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case received := <-to.out:
+				assert.Equal(t, packet, received)
+				return
+			case <-ticker.C:
+				from.in <- packet
+			case <-deadline:
+				t.Fatal("packet not delivered")
+			}
+		}
+	}
+	transfer(dev1, dev2, ipv4Packet("10.10.0.1", "10.10.0.2", []byte("ping")))
+	transfer(dev2, dev1, ipv4Packet("10.10.0.2", "10.10.0.1", []byte("pong")))
+
+	// 冒用其它节点地址的报文被丢弃
+	route, ok := client2.routes.Load("10.10.0.1")
+	require.True(t, ok)
+	assert.Equal(t, "test-1", route)
+	dev1.in <- ipv4Packet("10.10.0.9", "10.10.0.2", []byte("spoofed"))
+	select {
+	case packet := <-dev2.out:
+		t.Fatalf("spoofed packet delivered: %v", packet)
+	case <-time.After(300 * time.Millisecond):
+	}
+}
+
+func TestPortForwarding(t *testing.T) {
+	server := newMockServer(t)
+	defer server.close()
+
+	// client1 一侧的本地回显服务
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer echo.Close()
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	client1 := NewClient("test-1", "Test Client 1", "")
+	require.NoError(t, client1.Connect(server.listener.Addr().String()))
+	defer client1.Close()
+	client2 := NewClient("test-2", "Test Client 2", "")
+	require.NoError(t, client2.Connect(server.listener.Addr().String()))
+	defer client2.Close()
+
+	client1.Expose("test-2", echo.Addr().String())
+	listener, err := client2.Forward("127.0.0.1:0", "test-1", echo.Addr().String())
+	require.NoError(t, err)
+
+	// 多个连接同时经同一对等连接转发
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			conn, err := net.Dial("tcp", listener.Addr().String())
+			require.NoError(t, err)
+			defer conn.Close()
+
+			data := bytes.Repeat([]byte{byte('a' + i)}, 64*1024)
+			go conn.Write(data)
+			received := make([]byte, len(data))
+			conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+			_, err = io.ReadFull(conn, received)
+			require.NoError(t, err)
+			assert.Equal(t, data, received)
+		}(i)
+	}
+	wg.Wait()
+
+	// 未暴露的服务被拒绝
+	refused, err := client2.Forward("127.0.0.1:0", "test-1", server.listener.Addr().String())
+	require.NoError(t, err)
+	conn, err := net.Dial("tcp", refused.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestFileTransfer(t *testing.T) {
+	server := newMockServer(t)
+	defer server.close()
+
+	client1 := NewClient("test-1", "Test Client 1", "")
+	require.NoError(t, client1.Connect(server.listener.Addr().String()))
+	defer client1.Close()
+	client2 := NewClient("test-2", "Test Client 2", "")
+	require.NoError(t, client2.Connect(server.listener.Addr().String()))
+	defer client2.Close()
+
+	data := make([]byte, 1024*1024+123)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	src := filepath.Join(t.TempDir(), "data.bin")
+	require.NoError(t, os.WriteFile(src, data, 0644))
+
+	// 未设置接收目录时拒绝
+	assert.ErrorIs(t, client2.SendFile("test-1", src), errStreamRefused)
+
+	recvDir := t.TempDir()
+	require.NoError(t, client1.SetRecvDir(recvDir))
+	require.NoError(t, client2.SendFile("test-1", src))
+	received, err := os.ReadFile(filepath.Join(recvDir, "data.bin"))
+	require.NoError(t, err)
+	assert.Equal(t, data, received)
+
+	// 已有的临时文件作为续传位置，同名文件不被覆盖
+	f, err := os.Open(src)
+	require.NoError(t, err)
+	manifest, err := fileManifest(f)
+	f.Close()
+	require.NoError(t, err)
+	part := partialPath(recvDir, manifest)
+	require.NoError(t, os.WriteFile(part, data[:300*1024], 0644))
+	require.NoError(t, client2.SendFile("test-1", src))
+	received, err = os.ReadFile(filepath.Join(recvDir, "data.1.bin"))
+	require.NoError(t, err)
+	assert.Equal(t, data, received)
+
+	transfers := client2.Transfers()
+	require.Len(t, transfers, 3)
+	last := transfers[2]
+	assert.Equal(t, TransferDone, last.State)
+	assert.Equal(t, int64(300*1024), last.Resumed)
+	assert.Equal(t, int64(len(data)), last.Offset)
+
+	// 损坏的临时文件导致校验失败，临时文件被删除
+	require.NoError(t, os.WriteFile(part, bytes.Repeat([]byte{0xff}, 1024), 0644))
+	assert.ErrorContains(t, client2.SendFile("test-1", src), "checksum mismatch")
+	_, err = os.Stat(part)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestFileTransferResume(t *testing.T) {
+	server := newMockServer(t)
+	defer server.close()
+
+	client1 := NewClient("test-1", "Test Client 1", "")
+	require.NoError(t, client1.Connect(server.listener.Addr().String()))
+	defer client1.Close()
+	client2 := NewClient("test-2", "Test Client 2", "")
+	require.NoError(t, client2.Connect(server.listener.Addr().String()))
+	defer client2.Close()
+
+	data := bytes.Repeat([]byte("spider-network"), 2*1024*1024)
+	src := filepath.Join(t.TempDir(), "big.bin")
+	require.NoError(t, os.WriteFile(src, data, 0644))
+	recvDir := t.TempDir()
+	require.NoError(t, client1.SetRecvDir(recvDir))
+
+	done := make(chan error, 1)
+	go func() { done <- client2.SendFile("test-1", src) }()
+
+	// 接收开始后断开对等连接，发送方重新连接并从已写入的位置续传
+	require.Eventually(t, func() bool {
+		transfers := client1.Transfers()
+		return len(transfers) > 0 && transfers[0].Offset > 0
+	}, 5*time.Second, time.Millisecond)
+	peer, ok := client1.peers.Load("test-2")
+	require.True(t, ok)
+	peer.(*hole.Conn).Close()
+
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(30 * time.Second):
+		t.Fatal("transfer not finished")
+	}
+	transfers := client2.Transfers()
+	require.Len(t, transfers, 1)
+	assert.Equal(t, TransferDone, transfers[0].State)
+	assert.Greater(t, transfers[0].Resumed, int64(0))
+
+	received, err := os.ReadFile(filepath.Join(recvDir, "big.bin"))
+	require.NoError(t, err)
+	assert.Equal(t, data, received)
+}
+
+func TestUDPForwarding(t *testing.T) {
+	idle := udpIdleTimeout
+	udpIdleTimeout = 300 * time.Millisecond
+	defer func() { udpIdleTimeout = idle }()
+
+	server := newMockServer(t)
+	defer server.close()
+
+	// client1 一侧的 UDP 回显服务
+	echo, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, addr, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	client1 := NewClient("test-1", "Test Client 1", "")
+	require.NoError(t, client1.Connect(server.listener.Addr().String()))
+	defer client1.Close()
+	client2 := NewClient("test-2", "Test Client 2", "")
+	require.NoError(t, client2.Connect(server.listener.Addr().String()))
+	defer client2.Close()
+
+	require.NoError(t, client1.ApplyForwardConfig(&config.ClientConfig{
+		Expose: []config.ExposeConfig{{Network: "udp", PeerID: "test-2", Addr: echo.LocalAddr().String()}},
+	}))
+	forward, err := client2.ForwardUDP("127.0.0.1:0", "test-1", echo.LocalAddr().String())
+	require.NoError(t, err)
+
+	// 不同源地址各自收到自己的回复
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("udp", forward.LocalAddr().String())
+		require.NoError(t, err)
+		defer conn.Close()
+
+		msg := []byte(fmt.Sprintf("datagram-%d", i))
+		buf := make([]byte, 2048)
+		// 首个报文可能在对等连接建立前被丢弃，由调用方重发
+		require.Eventually(t, func() bool {
+			conn.Write(msg)
+			conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+			n, err := conn.Read(buf)
+			return err == nil && bytes.Equal(buf[:n], msg)
+		}, 10*time.Second, 10*time.Millisecond)
+	}
+
+	// 空闲的会话被关闭
+	peer, ok := client2.peers.Load("test-1")
+	require.True(t, ok)
+	require.Eventually(t, func() bool {
+		return peer.(*hole.Conn).Session().NumStreams() == 0
+	}, 5*time.Second, 50*time.Millisecond)
+
+	assert.Error(t, client1.ApplyForwardConfig(&config.ClientConfig{
+		Expose: []config.ExposeConfig{{Network: "sctp", PeerID: "test-2", Addr: "127.0.0.1:1"}},
+	}))
+}
+
+// socksConnect 通过 SOCKS5 代理发起 CONNECT，返回连接和应答码
+func socksConnect(t *testing.T, proxyAddr, host string, port int) (net.Conn, byte) {
+	conn, err := net.Dial("tcp", proxyAddr)
+	require.NoError(t, err)
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	_, err = conn.Write([]byte{0x05, 0x01, 0x00})
+	require.NoError(t, err)
+	reply := make([]byte, 10)
+	_, err = io.ReadFull(conn, reply[:2])
+	require.NoError(t, err)
+	require.Equal(t, []byte{0x05, 0x00}, reply[:2])
+
+	req := []byte{0x05, 0x01, 0x00, 0x03, byte(len(host))}
+	req = append(req, host...)
+	req = append(req, byte(port>>8), byte(port))
+	_, err = conn.Write(req)
+	require.NoError(t, err)
+	_, err = io.ReadFull(conn, reply)
+	require.NoError(t, err)
+	conn.SetDeadline(time.Time{})
+	return conn, reply[1]
+}
+
+func TestSOCKSExit(t *testing.T) {
+	server := newMockServer(t)
+	defer server.close()
+
+	// 出口一侧的回显服务
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer echo.Close()
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	port := echo.Addr().(*net.TCPAddr).Port
+
+	client1 := NewClient("test-1", "Test Client 1", "")
+	require.NoError(t, client1.Connect(server.listener.Addr().String()))
+	defer client1.Close()
+	client2 := NewClient("test-2", "Test Client 2", "")
+	require.NoError(t, client2.Connect(server.listener.Addr().String()))
+	defer client2.Close()
+
+	proxy, err := client2.SOCKS("127.0.0.1:0", "test-1")
+	require.NoError(t, err)
+
+	// 未设置允许列表时拒绝
+	conn, rep := socksConnect(t, proxy.Addr().String(), "127.0.0.1", port)
+	conn.Close()
+	assert.Equal(t, socksNotAllowed, rep)
+
+	require.NoError(t, client1.AllowExit("test-2", fmt.Sprintf("127.0.0.0/8:%d", port)))
+	conn, rep = socksConnect(t, proxy.Addr().String(), "127.0.0.1", port)
+	defer conn.Close()
+	require.Equal(t, socksSucceeded, rep)
+	_, err = conn.Write([]byte("through the exit"))
+	require.NoError(t, err)
+	buf := make([]byte, 16)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "through the exit", string(buf))
+
+	// 端口不在允许范围内
+	conn, rep = socksConnect(t, proxy.Addr().String(), "127.0.0.1", port+1)
+	conn.Close()
+	assert.Equal(t, socksNotAllowed, rep)
+
+	// 允许的地址上没有服务
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	closedPort := closed.Addr().(*net.TCPAddr).Port
+	closed.Close()
+	require.NoError(t, client1.AllowExit("test-2", fmt.Sprintf("127.0.0.1/32:%d", closedPort)))
+	conn, rep = socksConnect(t, proxy.Addr().String(), "127.0.0.1", closedPort)
+	conn.Close()
+	assert.Equal(t, socksConnRefused, rep)
+}
+
+func TestParseExitRule(t *testing.T) {
+	rule, err := parseExitRule("10.0.0.0/8")
+	require.NoError(t, err)
+	assert.True(t, rule.allows(net.ParseIP("10.1.2.3"), 22))
+	assert.False(t, rule.allows(net.ParseIP("192.168.1.1"), 22))
+
+	rule, err = parseExitRule("fd00::/8:8000-8100")
+	require.NoError(t, err)
+	assert.True(t, rule.allows(net.ParseIP("fd12::1"), 8080))
+	assert.False(t, rule.allows(net.ParseIP("fd12::1"), 443))
+
+	for _, invalid := range []string{"10.0.0.1", "10.0.0.0/8:0", "10.0.0.0/8:443-80", "10.0.0.0/33"} {
+		_, err := parseExitRule(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestServerFailover(t *testing.T) {
+	primary := newMockServer(t)
+	defer primary.close()
+	backup := newMockServer(t)
+	defer backup.close()
+	servers := primary.listener.Addr().String() + "," + backup.listener.Addr().String()
+
+	client1 := NewClient("test-1", "Test Client 1", "")
+	require.NoError(t, client1.Connect(servers))
+	defer client1.Close()
+	client2 := NewClient("test-2", "Test Client 2", "")
+	require.NoError(t, client2.Connect(servers))
+	defer client2.Close()
+	assert.Equal(t, primary.listener.Addr().String(), client1.ServerAddr())
+
+	time.Sleep(100 * time.Millisecond)
+	require.NoError(t, client1.ConnectToPeer("test-2"))
+	require.Eventually(t, func() bool {
+		_, ok := client1.peers.Load("test-2")
+		return ok
+	}, 5*time.Second, 20*time.Millisecond)
+	peer, _ := client1.peers.Load("test-2")
+
+	// 主服务端下线后切换到备用服务端并重新注册，对等连接保持不变
+	primary.close()
+	for _, c := range []*Client{client1, client2} {
+		assert.Eventually(t, func() bool {
+			return c.ServerAddr() == backup.listener.Addr().String() && c.server() != nil
+		}, 5*time.Second, 20*time.Millisecond)
+	}
+	current, ok := client1.peers.Load("test-2")
+	require.True(t, ok)
+	assert.Same(t, peer, current)
+
+	// 新的信令连接可以继续转发打洞消息
+	client3 := NewClient("test-3", "Test Client 3", "")
+	require.NoError(t, client3.Connect(backup.listener.Addr().String()))
+	defer client3.Close()
+	time.Sleep(100 * time.Millisecond)
+	require.NoError(t, client1.ConnectToPeer("test-3"))
+	assert.Eventually(t, func() bool {
+		_, ok := client3.peers.Load("test-1")
+		return ok
+	}, 5*time.Second, 20*time.Millisecond)
+}
+
+func TestReconnectOnMissedHeartbeats(t *testing.T) {
+	server := newMockServer(t)
+	defer server.close()
+
+	client := NewClient("test-1", "Test Client 1", "", WithHeartbeatInterval(50*time.Millisecond))
+	events := make(chan ServerStateEvent, 16)
+	client.OnServerStateChange(func(event ServerStateEvent) {
+		events <- event
+	})
+	require.NoError(t, client.Connect(server.listener.Addr().String()))
+	defer client.Close()
+	assert.Equal(t, ServerConnecting, (<-events).State)
+	assert.Equal(t, ServerConnected, (<-events).State)
+	require.Eventually(t, client.heartbeatAcked.Load, 5*time.Second, 20*time.Millisecond)
+
+	// 服务端不再回复心跳，超时后重新连接并注册
+	server.silent.Store(true)
+	event := <-events
+	assert.Equal(t, ServerReconnecting, event.State)
+	assert.Equal(t, server.listener.Addr().String(), event.ServerAddr)
+	server.silent.Store(false)
+	select {
+	case event = <-events:
+		assert.Equal(t, ServerConnected, event.State)
+	case <-time.After(5 * time.Second):
+		t.Fatal("client did not reconnect")
+	}
+	assert.Equal(t, int32(2), server.registers.Load())
+	assert.Equal(t, ServerConnected, client.ServerState())
+
+	client.Close()
+	assert.Equal(t, ServerDisconnected, (<-events).State)
+}
+
+func TestNewClientFromConfig(t *testing.T) {
+	_, err := NewClientFromConfig(&config.ClientConfig{})
+	assert.Error(t, err)
+
+	c, err := NewClientFromConfig(&config.ClientConfig{
+		ClientID:          "test-1",
+		ListenAddr:        "127.0.0.1:0",
+		HeartbeatInterval: 20,
+		Backoff:           config.BackoffConfig{Min: 2},
+	}, WithDialTimeout(time.Second))
+	require.NoError(t, err)
+	assert.Equal(t, 20*time.Second, c.heartbeatInterval)
+	assert.Equal(t, 60*time.Second, c.heartbeatTimeout)
+	assert.Equal(t, time.Second, c.dialTimeout)
+	assert.Equal(t, 2*time.Second, c.minBackoff)
+	assert.Equal(t, defaultMaxBackoff, c.maxBackoff)
+	assert.Nil(t, c.tlsConfig)
+
+	// 设置了证书但没有启用 TLS
+	_, err = NewClientFromConfig(&config.ClientConfig{
+		ClientID: "test-1",
+		TLS:      config.ClientTLSConfig{CertFile: "client.pem", KeyFile: "client-key.pem"},
+	})
+	assert.Error(t, err)
+
+	// 启用 TLS 但没有指定 CA 和指纹时使用系统根证书
+	c, err = NewClientFromConfig(&config.ClientConfig{
+		ClientID: "test-1",
+		TLS:      config.ClientTLSConfig{Enabled: true},
+	})
+	require.NoError(t, err)
+	require.NotNil(t, c.tlsConfig)
+	assert.Nil(t, c.tlsConfig.RootCAs)
+	assert.False(t, c.tlsConfig.InsecureSkipVerify)
+}
+
+func TestResolveServers(t *testing.T) {
+	servers, err := resolveServers([]string{" a:1", "", "b:2 "})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a:1", "b:2"}, servers)
 
-	// TODO: 添加消息接收验证
-	// 由于消息处理是异步的，这里需要一个机制来验证消息是否被正确接收
-	// 可以通过添加消息回调或消息队列来实现
+	_, err = resolveServers([]string{""})
+	assert.Error(t, err)
 }
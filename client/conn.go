@@ -0,0 +1,34 @@
+package client
+
+import "net"
+
+// countingConn 统计连接上读写的字节数
+type countingConn struct {
+	net.Conn
+	onWrite func(int64)
+	onRead  func(int64)
+}
+
+func newCountingConn(conn net.Conn, onWrite, onRead func(int64)) net.Conn {
+	return &countingConn{
+		Conn:    conn,
+		onWrite: onWrite,
+		onRead:  onRead,
+	}
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.onRead(int64(n))
+	}
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.onWrite(int64(n))
+	}
+	return n, err
+}
@@ -0,0 +1,108 @@
+package client
+
+// ServerState 信令连接状态
+type ServerState int32
+
+const (
+	ServerDisconnected ServerState = iota // 未连接或重连失败
+	ServerConnecting                      // 首次连接中
+	ServerConnected                       // 已连接并注册
+	ServerReconnecting                    // 连接断开，正在重连
+)
+
+func (s ServerState) String() string {
+	switch s {
+	case ServerConnecting:
+		return "connecting"
+	case ServerConnected:
+		return "connected"
+	case ServerReconnecting:
+		return "reconnecting"
+	default:
+		return "disconnected"
+	}
+}
+
+// ServerStateEvent 信令连接状态变化事件
+type ServerStateEvent struct {
+	State      ServerState
+	ServerAddr string // 当前或最后连接的服务端地址
+	Err        error  // 断开或重连失败的原因
+}
+
+// 除 OnMessage 外，以下回调都在连接或读取协程中同步执行，不应阻塞
+
+// OnServerStateChange 注册信令连接状态变化回调
+func (c *Client) OnServerStateChange(handler func(ServerStateEvent)) {
+	c.handlersMu.Lock()
+	defer c.handlersMu.Unlock()
+	c.stateHandlers = append(c.stateHandlers, handler)
+}
+
+// OnPeerConnected 注册对等连接建立回调，直连、UDP 打洞和中继连接都会触发
+func (c *Client) OnPeerConnected(handler func(peerID string)) {
+	c.handlersMu.Lock()
+	defer c.handlersMu.Unlock()
+	c.connectedHandlers = append(c.connectedHandlers, handler)
+}
+
+// OnPeerDisconnected 注册对等连接断开回调，err 为读取错误，正常关闭时为 nil
+// 在该连接已收到的消息全部回调完成后触发
+func (c *Client) OnPeerDisconnected(handler func(peerID string, err error)) {
+	c.handlersMu.Lock()
+	defer c.handlersMu.Unlock()
+	c.disconnectedHandlers = append(c.disconnectedHandlers, handler)
+}
+
+// OnMessage 注册对等端消息回调，payload 为 Send 发送的数据或 SendMessage 发送的文本
+// 每个对等连接的消息在单独的协程中按接收顺序依次回调，不同对等端之间并发执行
+// 回调阻塞不影响该连接上的流，积压的消息超过队列长度后才会暂停读取
+func (c *Client) OnMessage(handler func(peerID string, payload []byte)) {
+	c.handlersMu.Lock()
+	defer c.handlersMu.Unlock()
+	c.messageHandlers = append(c.messageHandlers, handler)
+}
+
+// ServerState 返回当前信令连接状态
+func (c *Client) ServerState() ServerState {
+	return ServerState(c.state.Load())
+}
+
+func (c *Client) setServerState(state ServerState, err error) {
+	c.state.Store(int32(state))
+	event := ServerStateEvent{State: state, ServerAddr: c.ServerAddr(), Err: err}
+
+	c.handlersMu.RLock()
+	handlers := c.stateHandlers
+	c.handlersMu.RUnlock()
+	for _, handler := range handlers {
+		handler(event)
+	}
+}
+
+func (c *Client) emitPeerConnected(peerID string) {
+	c.handlersMu.RLock()
+	handlers := c.connectedHandlers
+	c.handlersMu.RUnlock()
+	for _, handler := range handlers {
+		handler(peerID)
+	}
+}
+
+func (c *Client) emitPeerDisconnected(peerID string, err error) {
+	c.handlersMu.RLock()
+	handlers := c.disconnectedHandlers
+	c.handlersMu.RUnlock()
+	for _, handler := range handlers {
+		handler(peerID, err)
+	}
+}
+
+func (c *Client) emitMessage(peerID string, payload []byte) {
+	c.handlersMu.RLock()
+	handlers := c.messageHandlers
+	c.handlersMu.RUnlock()
+	for _, handler := range handlers {
+		handler(peerID, payload)
+	}
+}
@@ -0,0 +1,181 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/liuscraft/spider-network/pkg/protocol/hole"
+	"github.com/liuscraft/spider-network/pkg/tlsutil"
+)
+
+var errClientClosed = errors.New("client closed")
+
+// resolveServers 展开服务端地址列表，srv: 地址按 SRV 记录的优先级和权重排列
+func resolveServers(addrs []string) ([]string, error) {
+	var servers []string
+	for _, addr := range addrs {
+		addr = strings.TrimSpace(addr)
+		if addr == "" {
+			continue
+		}
+		name, ok := strings.CutPrefix(addr, "srv:")
+		if !ok {
+			servers = append(servers, addr)
+			continue
+		}
+		_, records, err := net.LookupSRV("", "", name)
+		if err != nil {
+			return nil, fmt.Errorf("lookup srv %s error: %v", name, err)
+		}
+		for _, r := range records {
+			servers = append(servers, net.JoinHostPort(strings.TrimSuffix(r.Target, "."), strconv.Itoa(int(r.Port))))
+		}
+	}
+	if len(servers) == 0 {
+		return nil, errors.New("no server address")
+	}
+	return servers, nil
+}
+
+// connectServers 从 servers[start] 开始依次连接并注册，一轮都失败后指数退避重试
+// 所有服务端都明确拒绝（证书校验失败或注册被拒绝）时不再重试
+func (c *Client) connectServers(start int) (*hole.Conn, error) {
+	backoff := c.minBackoff
+	for {
+		var rejected error
+		rejectedCount := 0
+		for i := range c.servers {
+			if c.closed.Load() {
+				return nil, errClientClosed
+			}
+			idx := (start + i) % len(c.servers)
+			conn, err := c.connectServer(c.servers[idx])
+			if err == nil {
+				c.serverIdx = idx
+				return conn, nil
+			}
+			c.xl.Errorf("Failed to connect to server %s: %v", c.servers[idx], err)
+			var refused *hole.ErrorPayload
+			if tlsutil.IsVerificationError(err) || errors.As(err, &refused) {
+				rejected = err
+				rejectedCount++
+			}
+		}
+		if rejectedCount == len(c.servers) {
+			return nil, rejected
+		}
+
+		select {
+		case <-c.done:
+			return nil, errClientClosed
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > c.maxBackoff {
+			backoff = c.maxBackoff
+		}
+	}
+}
+
+// connectServer 连接服务端并注册，成功后替换当前的信令连接
+func (c *Client) connectServer(serverAddr string) (*hole.Conn, error) {
+	rawConn, err := c.dialServer(serverAddr)
+	if err != nil {
+		// 服务端证书校验失败时重试没有意义
+		if tlsutil.IsVerificationError(err) {
+			return nil, fmt.Errorf("failed to verify server: %w", err)
+		}
+		return nil, err
+	}
+	conn := hole.NewConn(newCountingConn(rawConn, c.addBytesSent, c.addBytesRecv))
+	conn.EnableSession(true)
+	c.xl.Infof("Connected to server %s", serverAddr)
+
+	// 发送注册消息并等待确认
+	ack, err := c.register(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	c.xl.Infof("Successfully registered with server %s", serverAddr)
+
+	c.serverMu.Lock()
+	oldIP := c.virtualIP
+	c.virtualIP = ack.VirtualIP
+	c.serverMu.Unlock()
+	if oldIP != "" && ack.VirtualIP != oldIP && c.vnet.Load() != nil {
+		c.xl.Warnf("Virtual ip changed from %s to %s, restart tun to apply", oldIP, ack.VirtualIP)
+	}
+	c.heartbeatAcked.Store(false)
+	c.serverSeen.Store(time.Now().UnixNano())
+
+	// 获取 UDP 反射地址，失败时仅使用 TCP 打洞
+	if err := c.setupUDP(serverAddr, ack.UDPPort, ack.UDPToken); err != nil {
+		c.xl.Warnf("UDP punching disabled: %v", err)
+	}
+
+	c.serverMu.Lock()
+	c.serverAddr = serverAddr
+	c.serverConn = conn
+	c.serverMu.Unlock()
+	// 与 Close 并发时由后完成的一方关闭连接
+	if c.closed.Load() {
+		conn.Close()
+		return nil, errClientClosed
+	}
+	go c.acceptServerStreams(conn.Session())
+	return conn, nil
+}
+
+// superviseServer 处理信令消息，连接断开（读取失败或心跳超时）后从下一个服务端开始重新连接并注册
+// 已建立的对等连接不受影响，重连成功后重新上报对等端并发布 HTTP 服务
+func (c *Client) superviseServer(conn *hole.Conn) {
+	for {
+		err := c.handleServerMessages(conn)
+		c.serverMu.Lock()
+		if c.serverConn == conn {
+			c.serverConn = nil
+		}
+		c.serverMu.Unlock()
+		if c.closed.Load() {
+			c.setServerState(ServerDisconnected, nil)
+			return
+		}
+		c.xl.Warnf("Lost connection to server %s, reconnecting", c.ServerAddr())
+		c.setServerState(ServerReconnecting, err)
+
+		conn, err = c.connectServers((c.serverIdx + 1) % len(c.servers))
+		if err != nil {
+			if errors.Is(err, errClientClosed) {
+				err = nil
+			} else {
+				c.xl.Errorf("Failed to reconnect to any server: %v", err)
+			}
+			c.setServerState(ServerDisconnected, err)
+			return
+		}
+		c.xl.Infof("Signaling moved to server %s", c.ServerAddr())
+		c.setServerState(ServerConnected, nil)
+		go c.reannounce()
+	}
+}
+
+// reannounce 重连后立即上报当前对等端，并重新发布 HTTP 服务
+func (c *Client) reannounce() {
+	c.sendHeartbeat()
+	c.republish()
+}
+
+// republish 在新的服务端上重新发布 HTTP 服务
+func (c *Client) republish() {
+	c.published.Range(func(key, value interface{}) bool {
+		if err := c.requestPublish(key.(string)); err != nil {
+			c.xl.Errorf("Failed to republish %s: %v", key, err)
+		}
+		return true
+	})
+}
@@ -0,0 +1,126 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/liuscraft/spider-network/pkg/config"
+	"github.com/liuscraft/spider-network/pkg/protocol"
+	"github.com/liuscraft/spider-network/pkg/protocol/hole"
+)
+
+func exposeKey(network, peerID, addr string) string {
+	return network + "/" + peerID + "/" + addr
+}
+
+// Expose 允许对等端通过端口转发访问本地 TCP 服务 addr
+func (c *Client) Expose(peerID, addr string) {
+	c.exposed.Store(exposeKey("tcp", peerID, addr), struct{}{})
+	c.xl.Infof("Exposed %s to peer %s", addr, peerID)
+}
+
+// ApplyForwardConfig 按配置暴露本地服务，启动转发和 SOCKS5 代理，发布 HTTP 服务
+func (c *Client) ApplyForwardConfig(cfg *config.ClientConfig) error {
+	for _, e := range cfg.Expose {
+		switch e.Network {
+		case "", "tcp":
+			c.Expose(e.PeerID, e.Addr)
+		case "udp":
+			c.ExposeUDP(e.PeerID, e.Addr)
+		default:
+			return fmt.Errorf("unsupported network %s for %s", e.Network, e.Addr)
+		}
+	}
+	for _, f := range cfg.Forward {
+		var err error
+		switch f.Network {
+		case "", "tcp":
+			_, err = c.Forward(f.ListenAddr, f.PeerID, f.RemoteAddr)
+		case "udp":
+			_, err = c.ForwardUDP(f.ListenAddr, f.PeerID, f.RemoteAddr)
+		default:
+			err = fmt.Errorf("unsupported network %s", f.Network)
+		}
+		if err != nil {
+			return fmt.Errorf("forward %s error: %v", f.ListenAddr, err)
+		}
+	}
+	for _, e := range cfg.Exit {
+		for _, rule := range e.Allow {
+			if err := c.AllowExit(e.PeerID, rule); err != nil {
+				return err
+			}
+		}
+	}
+	for _, s := range cfg.Socks {
+		if _, err := c.SOCKS(s.ListenAddr, s.PeerID); err != nil {
+			return fmt.Errorf("socks %s error: %v", s.ListenAddr, err)
+		}
+	}
+	for _, p := range cfg.Publish {
+		if err := c.PublishHTTP(p.Name, p.Addr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Forward 在本地监听 listenAddr，把每个连接经对等连接转发到对方暴露的 remoteAddr
+func (c *Client) Forward(listenAddr, peerID, remoteAddr string) (net.Listener, error) {
+	listener, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		return nil, err
+	}
+	c.forwards.Store(listener, struct{}{})
+	c.xl.Infof("Forwarding %s to %s of peer %s", listener.Addr(), remoteAddr, peerID)
+
+	go func() {
+		defer c.forwards.Delete(listener)
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				if !errors.Is(err, net.ErrClosed) {
+					c.xl.Errorf("Failed to accept forward connection: %v", err)
+				}
+				return
+			}
+			go c.forwardConn(conn, peerID, remoteAddr)
+		}
+	}()
+	return listener, nil
+}
+
+// forwardConn 为本地连接打开转发流，对方连接目标服务后开始转发数据
+func (c *Client) forwardConn(local net.Conn, peerID, target string) {
+	stream, err := c.openStream(peerID, &hole.StreamHeader{Service: hole.StreamForward, Target: target})
+	if err != nil {
+		c.xl.Errorf("Failed to forward to %s of peer %s: %v", target, peerID, err)
+		local.Close()
+		return
+	}
+	pipe(local, stream)
+}
+
+// acceptForward 处理对方的转发请求，只允许访问暴露给该对等端的服务
+func (c *Client) acceptForward(peerID string, stream *protocol.Stream, header *hole.StreamHeader) {
+	if _, ok := c.exposed.Load(exposeKey("tcp", peerID, header.Target)); !ok {
+		c.xl.Warnf("Peer %s tried to access unexposed %s", peerID, header.Target)
+		hole.WriteStreamHeader(stream, &hole.StreamHeader{Error: fmt.Sprintf("%s is not exposed", header.Target)})
+		stream.Close()
+		return
+	}
+
+	local, err := net.DialTimeout("tcp", header.Target, c.dialTimeout)
+	if err != nil {
+		hole.WriteStreamHeader(stream, &hole.StreamHeader{Error: err.Error()})
+		stream.Close()
+		return
+	}
+	if err := hole.WriteStreamHeader(stream, &hole.StreamHeader{}); err != nil {
+		local.Close()
+		stream.Close()
+		return
+	}
+	pipe(stream, local)
+}
@@ -0,0 +1,106 @@
+package client
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/liuscraft/spider-network/pkg/config"
+	"github.com/liuscraft/spider-network/pkg/tlsutil"
+)
+
+// Option 修改客户端的连接参数，零值参数保持默认值
+type Option func(*Client)
+
+// WithListenAddr 设置对等连接的监听地址，默认 127.0.0.1:0
+func WithListenAddr(addr string) Option {
+	return func(c *Client) {
+		if addr != "" {
+			c.listenAddr = addr
+		}
+	}
+}
+
+// WithDialTimeout 设置连接服务端、对等端和本地服务的超时，默认 5 秒
+func WithDialTimeout(d time.Duration) Option {
+	return func(c *Client) {
+		if d > 0 {
+			c.dialTimeout = d
+		}
+	}
+}
+
+// WithHeartbeatInterval 设置心跳间隔，默认 10 秒，连续三个间隔没有收到服务端消息时重连
+func WithHeartbeatInterval(d time.Duration) Option {
+	return func(c *Client) {
+		if d > 0 {
+			c.heartbeatInterval = d
+			c.heartbeatTimeout = 3 * d
+		}
+	}
+}
+
+// WithBackoff 设置所有服务端都不可用时的重试间隔，从 min 开始每轮翻倍直到 max，默认 1 秒到 30 秒
+func WithBackoff(min, max time.Duration) Option {
+	return func(c *Client) {
+		if min > 0 {
+			c.minBackoff = min
+		}
+		if max > 0 {
+			c.maxBackoff = max
+		}
+		if c.maxBackoff < c.minBackoff {
+			c.maxBackoff = c.minBackoff
+		}
+	}
+}
+
+// WithTLSConfig 信令通道使用 TLS，为 nil 时使用明文 TCP
+func WithTLSConfig(tlsConfig *tls.Config) Option {
+	return func(c *Client) {
+		c.tlsConfig = tlsConfig
+	}
+}
+
+// NewClientFromConfig 根据配置文件创建客户端，extra 在配置之后应用
+// 服务端地址由调用方通过 ConnectServers 连接
+func NewClientFromConfig(cfg *config.ClientConfig, extra ...Option) (*Client, error) {
+	if cfg.ClientID == "" {
+		return nil, errors.New("client id is required")
+	}
+	options := []Option{
+		WithListenAddr(cfg.ListenAddr),
+		WithDialTimeout(time.Duration(cfg.DialTimeout) * time.Second),
+		WithHeartbeatInterval(time.Duration(cfg.HeartbeatInterval) * time.Second),
+		WithBackoff(time.Duration(cfg.Backoff.Min)*time.Second, time.Duration(cfg.Backoff.Max)*time.Second),
+	}
+	tlsCfg := cfg.TLS
+	if !tlsCfg.Enabled && tlsCfg != (config.ClientTLSConfig{}) {
+		return nil, errors.New("tls options are set but tls is not enabled")
+	}
+	if tlsCfg.Enabled {
+		tlsConfig, err := tlsutil.ClientConfig(tlsutil.ClientOptions{
+			CAFile:     tlsCfg.CAFile,
+			CertFile:   tlsCfg.CertFile,
+			KeyFile:    tlsCfg.KeyFile,
+			ServerName: tlsCfg.ServerName,
+			PinnedKey:  tlsCfg.PinnedKey,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to load tls config: %v", err)
+		}
+		options = append(options, WithTLSConfig(tlsConfig))
+	}
+	return NewClient(cfg.ClientID, cfg.Name, cfg.Token, append(options, extra...)...), nil
+}
+
+// dialServer 建立到服务端的连接，配置了 TLS 时完成握手
+func (c *Client) dialServer(addr string) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: c.dialTimeout}
+	if c.tlsConfig == nil {
+		return dialer.Dial("tcp", addr)
+	}
+	return tls.DialWithDialer(dialer, "tcp", addr, c.tlsConfig)
+}
@@ -0,0 +1,117 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/liuscraft/spider-network/pkg/protocol"
+	"github.com/liuscraft/spider-network/pkg/protocol/hole"
+)
+
+// PublishHTTP 在服务端以 name 发布本地 HTTP 服务 localAddr
+// 服务端按 Host 头把请求经信令连接转发到本机，再由本机连接 localAddr
+func (c *Client) PublishHTTP(name, localAddr string) error {
+	name = strings.ToLower(name)
+	c.published.Store(name, localAddr)
+	if err := c.requestPublish(name); err != nil {
+		c.published.Delete(name)
+		return err
+	}
+	c.xl.Infof("Published http %s as %s", localAddr, name)
+	return nil
+}
+
+// requestPublish 向服务端发送发布请求并等待结果
+func (c *Client) requestPublish(name string) error {
+	payload, err := json.Marshal(hole.PublishPayload{Name: name})
+	if err != nil {
+		return fmt.Errorf("marshal publish payload error: %v", err)
+	}
+	result := make(chan *hole.PublishPayload, 1)
+	c.publishWaiters.Store(name, result)
+	defer c.publishWaiters.Delete(name)
+
+	if err := c.sendToServer(&hole.Message{
+		Type:    hole.TypePublish,
+		From:    c.clientID,
+		To:      "server",
+		Payload: payload,
+	}); err != nil {
+		return fmt.Errorf("send publish request error: %v", err)
+	}
+
+	select {
+	case reply := <-result:
+		if reply.Error != "" {
+			return fmt.Errorf("publish %s rejected: %s", name, reply.Error)
+		}
+		return nil
+	case <-time.After(streamOpenTimeout):
+		return fmt.Errorf("publish %s timeout", name)
+	}
+}
+
+func (c *Client) handlePublishMessage(msg *hole.Message) {
+	var payload hole.PublishPayload
+	if err := json.Unmarshal(msg.Payload, &payload); err != nil {
+		c.xl.Errorf("Failed to unmarshal publish payload: %v", err)
+		return
+	}
+	if ch, ok := c.publishWaiters.Load(payload.Name); ok {
+		select {
+		case ch.(chan *hole.PublishPayload) <- &payload:
+		default:
+		}
+	}
+}
+
+// acceptServerStreams 接受服务端在信令连接上打开的流，只处理发布的 HTTP 服务
+func (c *Client) acceptServerStreams(session *protocol.Session) {
+	for {
+		stream, err := session.AcceptStream()
+		if err != nil {
+			return
+		}
+		go c.handleServerStream(stream)
+	}
+}
+
+func (c *Client) handleServerStream(stream *protocol.Stream) {
+	refuse := func(reason string) {
+		hole.WriteStreamHeader(stream, &hole.StreamHeader{Error: reason})
+		stream.Close()
+	}
+
+	stream.SetReadDeadline(time.Now().Add(streamOpenTimeout))
+	header, err := hole.ReadStreamHeader(stream)
+	if err != nil {
+		c.xl.Errorf("Failed to read stream header from server: %v", err)
+		stream.Close()
+		return
+	}
+	stream.SetReadDeadline(time.Time{})
+
+	if header.Service != hole.StreamHTTP {
+		refuse(fmt.Sprintf("unsupported service %s", header.Service))
+		return
+	}
+	addr, ok := c.published.Load(header.Target)
+	if !ok {
+		refuse(fmt.Sprintf("%s is not published", header.Target))
+		return
+	}
+	local, err := net.DialTimeout("tcp", addr.(string), c.dialTimeout)
+	if err != nil {
+		refuse(err.Error())
+		return
+	}
+	if err := hole.WriteStreamHeader(stream, &hole.StreamHeader{}); err != nil {
+		local.Close()
+		stream.Close()
+		return
+	}
+	pipe(stream, local)
+}
@@ -0,0 +1,172 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/liuscraft/spider-network/pkg/protocol/hole"
+	"github.com/liuscraft/spider-network/pkg/punch"
+)
+
+const (
+	udpBindTimeout  = 3 * time.Second
+	udpPunchTimeout = 10 * time.Second
+)
+
+// setupUDP 创建 UDP 打洞端点并向服务器绑定，获取本端的 UDP 反射地址
+func (c *Client) setupUDP(serverAddr string, udpPort int, token string) error {
+	if udpPort == 0 {
+		return fmt.Errorf("server does not support udp punching")
+	}
+
+	host, _, err := net.SplitHostPort(serverAddr)
+	if err != nil {
+		return err
+	}
+	serverUDPAddr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(host, strconv.Itoa(udpPort)))
+	if err != nil {
+		return err
+	}
+
+	if err := c.ensureEndpoint(); err != nil {
+		return err
+	}
+
+	endpoint := c.udpEndpoint()
+	ctx, cancel := context.WithTimeout(context.Background(), udpBindTimeout)
+	defer cancel()
+	publicAddr, err := endpoint.Bind(ctx, serverUDPAddr, token)
+	if err != nil {
+		return err
+	}
+
+	privateAddr := privateUDPAddr(endpoint.LocalAddr(), serverUDPAddr)
+	c.serverMu.Lock()
+	c.udpPublicAddr = publicAddr
+	c.udpPrivateAddr = privateAddr
+	c.serverMu.Unlock()
+	c.xl.Infof("UDP punching enabled: public=%s, private=%s", publicAddr, privateAddr)
+	return nil
+}
+
+// ensureEndpoint 创建 UDP 打洞端点，反射地址发现和打洞共用同一个套接字
+func (c *Client) ensureEndpoint() error {
+	c.serverMu.Lock()
+	defer c.serverMu.Unlock()
+	if c.endpoint != nil {
+		return nil
+	}
+	pc, err := c.listenPacket()
+	if err != nil {
+		return fmt.Errorf("failed to create udp socket: %v", err)
+	}
+	c.endpoint = punch.NewEndpoint(pc, c.clientID)
+	return nil
+}
+
+// udpEndpoint 返回 UDP 打洞端点，未创建时返回 nil
+func (c *Client) udpEndpoint() *punch.Endpoint {
+	c.serverMu.RLock()
+	defer c.serverMu.RUnlock()
+	return c.endpoint
+}
+
+// udpAddrs 返回本端的 UDP 公网和内网候选地址，未完成绑定时公网地址为空
+func (c *Client) udpAddrs() (publicAddr, privateAddr string) {
+	c.serverMu.RLock()
+	defer c.serverMu.RUnlock()
+	return c.udpPublicAddr, c.udpPrivateAddr
+}
+
+// privateUDPAddr 计算本地内网候选地址，监听在通配地址时使用通往服务器的出口网卡地址
+func privateUDPAddr(local net.Addr, server *net.UDPAddr) string {
+	udpAddr, ok := local.(*net.UDPAddr)
+	if !ok || !udpAddr.IP.IsUnspecified() {
+		return local.String()
+	}
+
+	conn, err := net.DialUDP("udp", nil, server)
+	if err != nil {
+		return local.String()
+	}
+	defer conn.Close()
+	ip := conn.LocalAddr().(*net.UDPAddr).IP
+	return net.JoinHostPort(ip.String(), strconv.Itoa(udpAddr.Port))
+}
+
+// udpReady 是否可以进行 UDP 打洞
+func (c *Client) udpReady() bool {
+	c.serverMu.RLock()
+	defer c.serverMu.RUnlock()
+	return c.endpoint != nil && c.udpPublicAddr != ""
+}
+
+// localPunchPayload 本端的打洞候选地址，优先使用 UDP
+func (c *Client) localPunchPayload(network string) hole.PunchPayload {
+	if network == hole.NetworkUDP && c.udpReady() {
+		publicAddr, privateAddr := c.udpAddrs()
+		return hole.PunchPayload{
+			Network:     hole.NetworkUDP,
+			PublicAddr:  publicAddr,
+			PrivateAddr: privateAddr,
+		}
+	}
+	return hole.PunchPayload{
+		Network:     hole.NetworkTCP,
+		PublicAddr:  c.listener.Addr().String(),
+		PrivateAddr: c.listener.Addr().String(),
+	}
+}
+
+// sendConnect 通过服务器把本端的候选地址发送给对方
+func (c *Client) sendConnect(peerID string, payload hole.PunchPayload) error {
+	payloadBytes, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to marshal connect payload: %v", err)
+	}
+	msg := &hole.Message{
+		Type:    hole.TypeConnect,
+		From:    c.clientID,
+		To:      peerID,
+		Payload: payloadBytes,
+	}
+	if err := c.sendToServer(msg); err != nil {
+		return fmt.Errorf("failed to send connect message: %v", err)
+	}
+	return nil
+}
+
+// punchUDP 向对方的候选地址同时发送探测，打通后把会话作为对等连接
+func (c *Client) punchUDP(peerID string, payload *hole.PunchPayload) {
+	candidates := []string{payload.PublicAddr}
+	if payload.PrivateAddr != "" && payload.PrivateAddr != payload.PublicAddr {
+		candidates = append(candidates, payload.PrivateAddr)
+	}
+	c.xl.Infof("Punching udp path to %s via %v", peerID, candidates)
+
+	ctx, cancel := context.WithTimeout(context.Background(), udpPunchTimeout)
+	defer cancel()
+	session, err := c.udpEndpoint().Punch(ctx, peerID, candidates)
+	if err != nil {
+		c.xl.Errorf("Failed to punch udp path to peer %s: %v", peerID, err)
+		c.requestRelay(peerID)
+		return
+	}
+
+	conn, _, err := c.secureHandshake(c.newPeerConn(session), peerID, c.isInitiator(peerID))
+	if err != nil {
+		c.xl.Errorf("Failed to secure udp path to peer %s: %v", peerID, err)
+		return
+	}
+	if _, loaded := c.peers.LoadOrStore(peerID, conn); loaded {
+		c.xl.Infof("Already connected to peer %s", peerID)
+		conn.Close()
+		return
+	}
+	c.xl.Infof("Successfully connected to peer %s over udp (%s)", peerID, session.RemoteAddr())
+	c.startPeerMessageHandler(peerID, conn)
+}
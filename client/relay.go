@@ -0,0 +1,103 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/liuscraft/spider-network/pkg/protocol/hole"
+)
+
+const relayBindTimeout = 15 * time.Second
+
+// requestRelay 打洞失败时请求服务端分配中继通道
+func (c *Client) requestRelay(peerID string) {
+	if _, exists := c.peers.Load(peerID); exists {
+		return
+	}
+	c.xl.Infof("Requesting relay to peer %s", peerID)
+
+	msg := &hole.Message{
+		Type: hole.TypeRelay,
+		From: c.clientID,
+		To:   peerID,
+	}
+	if err := c.sendToServer(msg); err != nil {
+		c.xl.Errorf("Failed to send relay request: %v", err)
+	}
+}
+
+// handleRelayMessage 处理服务端的中继通道分配结果
+func (c *Client) handleRelayMessage(msg *hole.Message) {
+	var payload hole.RelayPayload
+	if err := json.Unmarshal(msg.Payload, &payload); err != nil {
+		c.xl.Errorf("Failed to unmarshal relay payload: %v", err)
+		return
+	}
+	if payload.Error != "" {
+		c.xl.Errorf("Relay to peer %s rejected: %s", msg.From, payload.Error)
+		return
+	}
+	c.storePeerKey(msg.From, payload.PublicKey)
+	if _, exists := c.peers.Load(msg.From); exists {
+		c.xl.Infof("Already connected to peer %s", msg.From)
+		return
+	}
+
+	go func() {
+		if err := c.bindRelay(msg.From, payload.ChannelID); err != nil {
+			c.xl.Errorf("Failed to relay to peer %s: %v", msg.From, err)
+		}
+	}()
+}
+
+// bindRelay 建立到服务端的中继连接，绑定成功后作为对等连接使用
+func (c *Client) bindRelay(peerID, channelID string) error {
+	rawConn, err := c.dialServer(c.ServerAddr())
+	if err != nil {
+		return err
+	}
+	relayConn := hole.NewConn(rawConn)
+
+	payload, err := json.Marshal(hole.RelayPayload{ChannelID: channelID})
+	if err != nil {
+		rawConn.Close()
+		return fmt.Errorf("failed to marshal relay payload: %v", err)
+	}
+	if err := relayConn.WriteMessage(&hole.Message{
+		Type:    hole.TypeRelayBind,
+		From:    c.clientID,
+		To:      "server",
+		Payload: payload,
+	}); err != nil {
+		rawConn.Close()
+		return fmt.Errorf("failed to send relay bind: %v", err)
+	}
+
+	// 等待对方也完成绑定
+	rawConn.SetReadDeadline(time.Now().Add(relayBindTimeout))
+	ack, err := relayConn.ReadMessage()
+	if err != nil {
+		rawConn.Close()
+		return fmt.Errorf("failed to read relay bind ack: %v", err)
+	}
+	if ack.Type != hole.TypeRelayBind {
+		rawConn.Close()
+		return fmt.Errorf("unexpected response type: %s", ack.Type)
+	}
+	rawConn.SetReadDeadline(time.Time{})
+
+	// 确认之后的字节流由服务端原样转发，流量单独统计，服务端无法解密
+	conn, _, err := c.secureHandshake(newCountingConn(relayConn, c.addRelayBytesSent, c.addRelayBytesRecv), peerID, c.isInitiator(peerID))
+	if err != nil {
+		return err
+	}
+	if _, loaded := c.peers.LoadOrStore(peerID, conn); loaded {
+		c.xl.Infof("Already connected to peer %s", peerID)
+		conn.Close()
+		return nil
+	}
+	c.xl.Infof("Successfully connected to peer %s via relay %s", peerID, channelID)
+	c.startPeerMessageHandler(peerID, conn)
+	return nil
+}
@@ -0,0 +1,106 @@
+package client
+
+import (
+	"crypto/ecdh"
+	"encoding/json"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/liuscraft/spider-network/pkg/protocol/hole"
+	"github.com/liuscraft/spider-network/pkg/secure"
+)
+
+const peerKeyTimeout = 5 * time.Second
+
+// storePeerKey 记录服务端下发的对等端静态公钥
+func (c *Client) storePeerKey(peerID, encoded string) {
+	if encoded != "" {
+		key, err := secure.ParsePublicKey(encoded)
+		if err != nil {
+			c.xl.Warnf("Invalid public key of peer %s: %v", peerID, err)
+		} else {
+			c.peerKeys.Store(peerID, key)
+		}
+	}
+	// 无论查询成功与否都唤醒等待者
+	if ch, ok := c.keyWaiters.LoadAndDelete(peerID); ok {
+		close(ch.(chan struct{}))
+	}
+}
+
+// peerKey 获取对等端的静态公钥，本地没有时向服务端查询
+func (c *Client) peerKey(peerID string) (*ecdh.PublicKey, error) {
+	if key, ok := c.peerKeys.Load(peerID); ok {
+		return key.(*ecdh.PublicKey), nil
+	}
+
+	ch, loaded := c.keyWaiters.LoadOrStore(peerID, make(chan struct{}))
+	if !loaded {
+		if err := c.sendToServer(&hole.Message{
+			Type: hole.TypePeerKey,
+			From: c.clientID,
+			To:   peerID,
+		}); err != nil {
+			c.keyWaiters.Delete(peerID)
+			return nil, fmt.Errorf("failed to query public key: %v", err)
+		}
+	}
+	// 注册等待者之前可能已经收到
+	if key, ok := c.peerKeys.Load(peerID); ok {
+		return key.(*ecdh.PublicKey), nil
+	}
+
+	select {
+	case <-ch.(chan struct{}):
+	case <-time.After(peerKeyTimeout):
+		c.keyWaiters.CompareAndDelete(peerID, ch)
+		return nil, fmt.Errorf("public key query timeout")
+	}
+	if key, ok := c.peerKeys.Load(peerID); ok {
+		return key.(*ecdh.PublicKey), nil
+	}
+	return nil, fmt.Errorf("public key of peer %s not available", peerID)
+}
+
+// handlePeerKeyMessage 处理服务端返回的公钥查询结果
+func (c *Client) handlePeerKeyMessage(msg *hole.Message) {
+	var payload hole.PeerKeyPayload
+	if err := json.Unmarshal(msg.Payload, &payload); err != nil {
+		c.xl.Errorf("Failed to unmarshal peer key payload: %v", err)
+		return
+	}
+	if payload.Error != "" {
+		c.xl.Warnf("Failed to get public key of peer %s: %s", msg.From, payload.Error)
+	}
+	c.storePeerKey(msg.From, payload.PublicKey)
+}
+
+// secureHandshake 在对等连接上完成加密握手并返回消息连接与已认证的对方身份
+// 作为响应方且 peerID 为空时，由握手确定对方身份
+func (c *Client) secureHandshake(conn net.Conn, peerID string, initiator bool) (*hole.Conn, string, error) {
+	var sc *secure.Conn
+	var err error
+	if initiator {
+		var key *ecdh.PublicKey
+		key, err = c.peerKey(peerID)
+		if err == nil {
+			sc, err = secure.Client(conn, c.identity, c.clientID, peerID, key)
+		}
+	} else {
+		sc, err = secure.Server(conn, c.identity, c.clientID, c.peerKey)
+		if err == nil && peerID != "" && sc.PeerID() != peerID {
+			err = secure.ErrPeerMismatch
+		}
+	}
+	if err != nil {
+		conn.Close()
+		return nil, "", fmt.Errorf("secure handshake failed: %w", err)
+	}
+	return hole.NewPeerConn(sc, initiator), sc.PeerID(), nil
+}
+
+// isInitiator 对称建立的连接（UDP 打洞、中继）由客户端ID较小的一方发起握手
+func (c *Client) isInitiator(peerID string) bool {
+	return c.clientID < peerID
+}
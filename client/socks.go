@@ -0,0 +1,303 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/liuscraft/spider-network/pkg/protocol"
+	"github.com/liuscraft/spider-network/pkg/protocol/hole"
+)
+
+const (
+	socksHandshakeTimeout = 10 * time.Second
+	exitDialTimeout       = 10 * time.Second
+)
+
+// SOCKS5 应答码
+const (
+	socksSucceeded          byte = 0x00
+	socksGeneralFailure     byte = 0x01
+	socksNotAllowed         byte = 0x02
+	socksHostUnreachable    byte = 0x04
+	socksConnRefused        byte = 0x05
+	socksCommandUnsupported byte = 0x07
+	socksAddrUnsupported    byte = 0x08
+)
+
+// exitRule 出口允许规则，目标地址在网段内且端口在范围内时允许连接
+type exitRule struct {
+	network *net.IPNet
+	minPort uint16
+	maxPort uint16
+}
+
+// parseExitRule 解析 CIDR[:端口或端口范围]，如 10.0.0.0/8、0.0.0.0/0:443、fd00::/8:8000-8100
+func parseExitRule(s string) (*exitRule, error) {
+	slash := strings.LastIndex(s, "/")
+	if slash < 0 {
+		return nil, fmt.Errorf("invalid exit rule %q: missing prefix length", s)
+	}
+	cidr, ports := s, ""
+	if i := strings.Index(s[slash:], ":"); i >= 0 {
+		cidr, ports = s[:slash+i], s[slash+i+1:]
+	}
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid exit rule %q: %v", s, err)
+	}
+
+	rule := &exitRule{network: network, minPort: 1, maxPort: 65535}
+	if ports == "" {
+		return rule, nil
+	}
+	lo, hi, ranged := strings.Cut(ports, "-")
+	if !ranged {
+		hi = lo
+	}
+	min, err1 := strconv.ParseUint(lo, 10, 16)
+	max, err2 := strconv.ParseUint(hi, 10, 16)
+	if err1 != nil || err2 != nil || min == 0 || min > max {
+		return nil, fmt.Errorf("invalid exit rule %q: bad port range %s", s, ports)
+	}
+	rule.minPort, rule.maxPort = uint16(min), uint16(max)
+	return rule, nil
+}
+
+func (r *exitRule) allows(ip net.IP, port uint16) bool {
+	return r.network.Contains(ip) && port >= r.minPort && port <= r.maxPort
+}
+
+// AllowExit 允许对等端经本机访问匹配 rule 的目标，未设置任何规则的对等端不能使用本机作为出口
+func (c *Client) AllowExit(peerID, rule string) error {
+	r, err := parseExitRule(rule)
+	if err != nil {
+		return err
+	}
+	c.exitMu.Lock()
+	defer c.exitMu.Unlock()
+	if c.exitRules == nil {
+		c.exitRules = make(map[string][]*exitRule)
+	}
+	c.exitRules[peerID] = append(c.exitRules[peerID], r)
+	c.xl.Infof("Allowed peer %s to exit to %s", peerID, rule)
+	return nil
+}
+
+// SOCKS 在本地监听 SOCKS5 代理，CONNECT 请求经对等端 peerID 连接目标
+func (c *Client) SOCKS(listenAddr, peerID string) (net.Listener, error) {
+	listener, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		return nil, err
+	}
+	c.forwards.Store(listener, struct{}{})
+	c.xl.Infof("SOCKS5 proxy on %s exits through peer %s", listener.Addr(), peerID)
+
+	go func() {
+		defer c.forwards.Delete(listener)
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				if !errors.Is(err, net.ErrClosed) {
+					c.xl.Errorf("Failed to accept socks connection: %v", err)
+				}
+				return
+			}
+			go c.serveSOCKS(conn, peerID)
+		}
+	}()
+	return listener, nil
+}
+
+func (c *Client) serveSOCKS(conn net.Conn, peerID string) {
+	conn.SetDeadline(time.Now().Add(socksHandshakeTimeout))
+	target, err := socksHandshake(conn)
+	if err != nil {
+		c.xl.Debugf("SOCKS handshake with %s failed: %v", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+
+	stream, err := c.openStream(peerID, &hole.StreamHeader{Service: hole.StreamExit, Target: target})
+	if err != nil {
+		c.xl.Errorf("Failed to connect %s through peer %s: %v", target, peerID, err)
+		writeSOCKSReply(conn, socksReplyCode(err))
+		conn.Close()
+		return
+	}
+	if err := writeSOCKSReply(conn, socksSucceeded); err != nil {
+		stream.Close()
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	pipe(conn, stream)
+}
+
+// socksHandshake 完成无认证的 SOCKS5 协商并读取 CONNECT 请求，返回目标地址
+// 不支持的请求会先回复对应的应答码
+func socksHandshake(conn net.Conn) (string, error) {
+	buf := make([]byte, 256)
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return "", err
+	}
+	if buf[0] != 0x05 {
+		return "", fmt.Errorf("unsupported socks version %d", buf[0])
+	}
+	methods := buf[:buf[1]]
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return "", err
+	}
+	if !bytes.Contains(methods, []byte{0x00}) {
+		conn.Write([]byte{0x05, 0xff})
+		return "", errors.New("no acceptable auth method")
+	}
+	if _, err := conn.Write([]byte{0x05, 0x00}); err != nil {
+		return "", err
+	}
+
+	// VER CMD RSV ATYP
+	if _, err := io.ReadFull(conn, buf[:4]); err != nil {
+		return "", err
+	}
+	if buf[0] != 0x05 {
+		return "", fmt.Errorf("unsupported socks version %d", buf[0])
+	}
+	cmd := buf[1]
+	var host string
+	switch buf[3] {
+	case 0x01, 0x04:
+		ip := make(net.IP, net.IPv4len)
+		if buf[3] == 0x04 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case 0x03:
+		if _, err := io.ReadFull(conn, buf[:1]); err != nil {
+			return "", err
+		}
+		name := buf[:buf[0]]
+		if _, err := io.ReadFull(conn, name); err != nil {
+			return "", err
+		}
+		host = string(name)
+	default:
+		writeSOCKSReply(conn, socksAddrUnsupported)
+		return "", fmt.Errorf("unsupported address type %d", buf[3])
+	}
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return "", err
+	}
+	port := int(buf[0])<<8 | int(buf[1])
+
+	if cmd != 0x01 {
+		writeSOCKSReply(conn, socksCommandUnsupported)
+		return "", fmt.Errorf("unsupported socks command %d", cmd)
+	}
+	return net.JoinHostPort(host, strconv.Itoa(port)), nil
+}
+
+// writeSOCKSReply 回复应答码，绑定地址固定为 0.0.0.0:0
+func writeSOCKSReply(w io.Writer, rep byte) error {
+	_, err := w.Write([]byte{0x05, rep, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+// socksReplyCode 把出口端的拒绝原因转换为 SOCKS5 应答码
+func socksReplyCode(err error) byte {
+	var refused *hole.ErrorPayload
+	if errors.As(err, &refused) {
+		switch refused.Code {
+		case hole.ErrCodeNotAllowed:
+			return socksNotAllowed
+		case hole.ErrCodeUnreachable:
+			return socksHostUnreachable
+		case hole.ErrCodeConnRefused:
+			return socksConnRefused
+		}
+	}
+	return socksGeneralFailure
+}
+
+// acceptExit 作为出口为对等端连接目标，只允许连接该对等端允许列表中的地址
+func (c *Client) acceptExit(peerID string, stream *protocol.Stream, header *hole.StreamHeader) {
+	refuse := func(code hole.ErrorCode, err error) {
+		hole.WriteStreamHeader(stream, &hole.StreamHeader{Code: code, Error: err.Error()})
+		stream.Close()
+	}
+
+	addr, code, err := c.resolveExit(peerID, header.Target)
+	if err != nil {
+		c.xl.Warnf("Peer %s exit to %s refused: %v", peerID, header.Target, err)
+		refuse(code, err)
+		return
+	}
+	local, err := net.DialTimeout("tcp", addr, exitDialTimeout)
+	if err != nil {
+		code := hole.ErrCodeUnreachable
+		if errors.Is(err, syscall.ECONNREFUSED) {
+			code = hole.ErrCodeConnRefused
+		}
+		refuse(code, err)
+		return
+	}
+	if err := hole.WriteStreamHeader(stream, &hole.StreamHeader{}); err != nil {
+		local.Close()
+		stream.Close()
+		return
+	}
+	pipe(stream, local)
+}
+
+// resolveExit 在本机解析目标并检查允许列表，返回实际连接的地址
+// 连接检查通过的 IP 而不是重新解析域名，避免检查后解析结果改变
+func (c *Client) resolveExit(peerID, target string) (string, hole.ErrorCode, error) {
+	host, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		return "", hole.ErrCodeBadRequest, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return "", hole.ErrCodeBadRequest, fmt.Errorf("invalid port %s", portStr)
+	}
+
+	c.exitMu.RLock()
+	rules := c.exitRules[peerID]
+	c.exitMu.RUnlock()
+	if len(rules) == 0 {
+		return "", hole.ErrCodeNotAllowed, errors.New("exit is not allowed")
+	}
+
+	var ips []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IP{ip}
+	} else {
+		ctx, cancel := context.WithTimeout(context.Background(), exitDialTimeout)
+		defer cancel()
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return "", hole.ErrCodeUnreachable, err
+		}
+		for _, addr := range addrs {
+			ips = append(ips, addr.IP)
+		}
+	}
+	for _, ip := range ips {
+		for _, rule := range rules {
+			if rule.allows(ip, uint16(port)) {
+				return net.JoinHostPort(ip.String(), portStr), "", nil
+			}
+		}
+	}
+	return "", hole.ErrCodeNotAllowed, fmt.Errorf("%s is not allowed", target)
+}
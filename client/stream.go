@@ -0,0 +1,127 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/liuscraft/spider-network/pkg/protocol"
+	"github.com/liuscraft/spider-network/pkg/protocol/hole"
+)
+
+// streamOpenTimeout 打开流时等待对等连接建立和对方回复的超时时间
+const streamOpenTimeout = 10 * time.Second
+
+// errStreamRefused 对方拒绝了流请求，重试不会成功
+var errStreamRefused = errors.New("stream refused")
+
+// openStream 在与对等端的连接上打开一个流并请求服务，对方拒绝时返回错误
+func (c *Client) openStream(peerID string, header *hole.StreamHeader) (*protocol.Stream, error) {
+	peer, err := c.waitPeer(peerID)
+	if err != nil {
+		return nil, err
+	}
+	stream, err := peer.Session().OpenStream()
+	if err != nil {
+		return nil, err
+	}
+	if err := hole.WriteStreamHeader(stream, header); err != nil {
+		stream.Close()
+		return nil, err
+	}
+
+	stream.SetReadDeadline(time.Now().Add(streamOpenTimeout))
+	reply, err := hole.ReadStreamHeader(stream)
+	if err != nil {
+		stream.Close()
+		return nil, fmt.Errorf("read stream reply error: %v", err)
+	}
+	stream.SetReadDeadline(time.Time{})
+	if reply.Error != "" {
+		stream.Close()
+		return nil, fmt.Errorf("%w: %w", errStreamRefused, &hole.ErrorPayload{Code: reply.Code, Message: reply.Error})
+	}
+	return stream, nil
+}
+
+// acceptStreams 接受对等端打开的流，会话关闭时退出
+func (c *Client) acceptStreams(peerID string, session *protocol.Session) {
+	for {
+		stream, err := session.AcceptStream()
+		if err != nil {
+			return
+		}
+		go c.handleStream(peerID, stream)
+	}
+}
+
+// handleStream 读取流头部并交给对应的服务处理
+func (c *Client) handleStream(peerID string, stream *protocol.Stream) {
+	stream.SetReadDeadline(time.Now().Add(streamOpenTimeout))
+	header, err := hole.ReadStreamHeader(stream)
+	if err != nil {
+		c.xl.Errorf("Failed to read stream header from peer %s: %v", peerID, err)
+		stream.Close()
+		return
+	}
+	stream.SetReadDeadline(time.Time{})
+
+	switch header.Service {
+	case hole.StreamForward:
+		c.acceptForward(peerID, stream, header)
+	case hole.StreamUDPForward:
+		c.acceptUDPForward(peerID, stream, header)
+	case hole.StreamExit:
+		c.acceptExit(peerID, stream, header)
+	case hole.StreamFile:
+		c.receiveFile(peerID, stream)
+	default:
+		c.xl.Warnf("Unsupported stream service from peer %s: %s", peerID, header.Service)
+		hole.WriteStreamHeader(stream, &hole.StreamHeader{Error: fmt.Sprintf("unsupported service %s", header.Service)})
+		stream.Close()
+	}
+}
+
+// pipe 在两个连接之间双向转发数据
+// 一个方向正常结束时只关闭对端的写入，出错或两个方向都结束后关闭两个连接
+func pipe(a, b net.Conn) {
+	done := make(chan struct{}, 2)
+	transfer := func(dst, src net.Conn) {
+		_, err := io.Copy(dst, src)
+		if cw, ok := dst.(interface{ CloseWrite() error }); ok && err == nil {
+			cw.CloseWrite()
+		} else {
+			a.Close()
+			b.Close()
+		}
+		done <- struct{}{}
+	}
+	go transfer(a, b)
+	go transfer(b, a)
+	<-done
+	<-done
+	a.Close()
+	b.Close()
+}
+
+// waitPeer 返回与对等端的连接，尚未连接时发起连接并等待建立
+// 等待期间按 throttle 的间隔重试，避免刚断开时的连接请求被限流后一直等待
+func (c *Client) waitPeer(peerID string) (*hole.Conn, error) {
+	deadline := time.Now().Add(streamOpenTimeout)
+	for {
+		if conn, ok := c.peers.Load(peerID); ok {
+			return conn.(*hole.Conn), nil
+		}
+		if !time.Now().Before(deadline) {
+			return nil, fmt.Errorf("connect to peer %s timeout", peerID)
+		}
+		if c.throttle("peer:" + peerID) {
+			if err := c.ConnectToPeer(peerID); err != nil {
+				return nil, err
+			}
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
@@ -0,0 +1,100 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/liuscraft/spider-network/pkg/protocol/hole"
+	"github.com/liuscraft/spider-network/pkg/punch"
+)
+
+const natDiscoverTimeout = 5 * time.Second
+
+// discoverNAT 通过反射地址发现服务获取本端的公网地址和 NAT 类型
+// 先进行 TCP 查询确认服务可用，再通过 UDP 探测 NAT 类型
+func (c *Client) discoverNAT(serverAddr string) {
+	stunAddr := c.stunAddr
+	if stunAddr == "" {
+		host, _, err := net.SplitHostPort(serverAddr)
+		if err != nil {
+			return
+		}
+		stunAddr = net.JoinHostPort(host, strconv.Itoa(punch.DefaultStunPort))
+	}
+
+	tcpMapped, err := c.tcpBinding(stunAddr)
+	if err != nil {
+		c.xl.Warnf("Reflexive address discovery unavailable: %v", err)
+		return
+	}
+
+	c.natType = punch.NATBlocked
+	if host, _, err := net.SplitHostPort(tcpMapped); err == nil {
+		_, port, _ := net.SplitHostPort(c.listener.Addr().String())
+		c.publicAddr = net.JoinHostPort(host, port)
+	}
+
+	if err := c.ensureEndpoint(); err != nil {
+		c.xl.Warnf("NAT type discovery skipped: %v", err)
+		return
+	}
+	udpAddr, err := net.ResolveUDPAddr("udp", stunAddr)
+	if err != nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), natDiscoverTimeout)
+	defer cancel()
+	endpoint := c.udpEndpoint()
+	info, err := punch.DiscoverNAT(ctx, endpoint, udpAddr)
+	if err != nil {
+		c.xl.Warnf("NAT type discovery failed: %v", err)
+		return
+	}
+
+	c.natType = info.Type
+	if info.MappedAddr != "" {
+		c.publicAddr = info.MappedAddr
+		privateAddr := privateUDPAddr(endpoint.LocalAddr(), udpAddr)
+		c.serverMu.Lock()
+		c.udpPrivateAddr = privateAddr
+		c.serverMu.Unlock()
+	}
+	c.xl.Infof("NAT type: %s, public address: %s", c.natType, c.publicAddr)
+}
+
+// tcpBinding 通过 TCP 查询服务端观察到的本端地址
+func (c *Client) tcpBinding(stunAddr string) (string, error) {
+	rawConn, err := net.DialTimeout("tcp", stunAddr, 5*time.Second)
+	if err != nil {
+		return "", err
+	}
+	defer rawConn.Close()
+	rawConn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	conn := hole.NewConn(rawConn)
+	if err := conn.WriteMessage(&hole.Message{
+		Type: hole.TypeBinding,
+		From: c.clientID,
+		To:   "server",
+	}); err != nil {
+		return "", err
+	}
+
+	resp, err := conn.ReadMessage()
+	if err != nil {
+		return "", err
+	}
+	if resp.Type != hole.TypeBinding {
+		return "", fmt.Errorf("unexpected response type: %s", resp.Type)
+	}
+	var payload hole.BindingPayload
+	if err := json.Unmarshal(resp.Payload, &payload); err != nil {
+		return "", err
+	}
+	return payload.MappedAddr, nil
+}
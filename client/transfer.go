@@ -0,0 +1,417 @@
+package client
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/liuscraft/spider-network/pkg/protocol"
+	"github.com/liuscraft/spider-network/pkg/protocol/hole"
+)
+
+const (
+	fileChunkSize  = 32 * 1024
+	fileAckWindow  = 16 // 已发送但未确认的分块数上限
+	fileAckTimeout = 30 * time.Second
+	fileRetries    = 5
+	fileRetryDelay = 2 * time.Second
+)
+
+// TransferState 文件传输状态
+type TransferState string
+
+const (
+	TransferRunning TransferState = "running"
+	TransferDone    TransferState = "done"
+	TransferFailed  TransferState = "failed"
+)
+
+// Transfer 文件传输进度
+type Transfer struct {
+	ID        string        `json:"id"`
+	PeerID    string        `json:"peer_id"`
+	Name      string        `json:"name"`
+	Size      int64         `json:"size"`
+	Outgoing  bool          `json:"outgoing"`
+	Offset    int64         `json:"offset"`  // 发送方为对方已确认的字节数，接收方为已写入的字节数
+	Resumed   int64         `json:"resumed"` // 最近一次续传时跳过的字节数
+	State     TransferState `json:"state"`
+	Error     string        `json:"error,omitempty"`
+	StartedAt time.Time     `json:"started_at"`
+	UpdatedAt time.Time     `json:"updated_at"`
+}
+
+type transfer struct {
+	mu   sync.Mutex
+	info Transfer
+}
+
+func (c *Client) newTransfer(peerID, name string, size int64, outgoing bool) *transfer {
+	now := time.Now()
+	t := &transfer{info: Transfer{
+		ID:        strconv.FormatUint(uint64(c.transferSeq.Add(1)), 10),
+		PeerID:    peerID,
+		Name:      name,
+		Size:      size,
+		Outgoing:  outgoing,
+		State:     TransferRunning,
+		StartedAt: now,
+		UpdatedAt: now,
+	}}
+	c.transfers.Store(t.info.ID, t)
+	return t
+}
+
+func (t *transfer) resume(offset int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.info.Offset = offset
+	t.info.Resumed = offset
+	t.info.UpdatedAt = time.Now()
+}
+
+func (t *transfer) progress(offset int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.info.Offset = offset
+	t.info.UpdatedAt = time.Now()
+}
+
+func (t *transfer) finish(err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.info.State = TransferDone
+	if err != nil {
+		t.info.State = TransferFailed
+		t.info.Error = err.Error()
+	}
+	t.info.UpdatedAt = time.Now()
+}
+
+func (t *transfer) snapshot() Transfer {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.info
+}
+
+// Transfers 返回所有文件传输的进度，按开始时间排序
+// 传输的数据计入对等连接的流量统计，随心跳上报
+func (c *Client) Transfers() []Transfer {
+	var transfers []Transfer
+	c.transfers.Range(func(_, value interface{}) bool {
+		transfers = append(transfers, value.(*transfer).snapshot())
+		return true
+	})
+	sort.Slice(transfers, func(i, j int) bool { return transfers[i].StartedAt.Before(transfers[j].StartedAt) })
+	return transfers
+}
+
+// SetRecvDir 设置接收文件的目录，为空时拒绝对等端发送的文件
+func (c *Client) SetRecvDir(dir string) error {
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+	c.recvDir.Store(dir)
+	return nil
+}
+
+// SendFile 把文件发送给对等端并等待对方校验完成
+// 连接中断时重新连接，从对方已写入的位置续传
+func (c *Client) SendFile(peerID, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	manifest, err := fileManifest(f)
+	if err != nil {
+		return fmt.Errorf("hash file error: %v", err)
+	}
+
+	t := c.newTransfer(peerID, manifest.Name, manifest.Size, true)
+	c.xl.Infof("Sending %s (%d bytes) to peer %s", manifest.Name, manifest.Size, peerID)
+	for attempt := 1; ; attempt++ {
+		err = c.sendFileOnce(peerID, f, manifest, t)
+		if err == nil || errors.Is(err, errStreamRefused) || attempt > fileRetries {
+			break
+		}
+		c.xl.Warnf("Transfer of %s to peer %s interrupted, retrying: %v", manifest.Name, peerID, err)
+		time.Sleep(fileRetryDelay)
+	}
+	t.finish(err)
+	if err != nil {
+		return err
+	}
+	c.xl.Infof("Sent %s to peer %s in %s", manifest.Name, peerID, time.Since(t.snapshot().StartedAt).Round(time.Millisecond))
+	return nil
+}
+
+// sendFileOnce 打开文件流，从对方返回的位置开始发送，等待对方完成校验
+func (c *Client) sendFileOnce(peerID string, f *os.File, manifest *hole.FileManifest, t *transfer) error {
+	stream, err := c.openStream(peerID, &hole.StreamHeader{Service: hole.StreamFile})
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	if err := hole.WriteStreamJSON(stream, manifest); err != nil {
+		return err
+	}
+	ack, err := readFileAck(stream)
+	if err != nil {
+		return err
+	}
+	if ack.Offset < 0 || ack.Offset > manifest.Size {
+		return fmt.Errorf("%w: invalid resume offset %d", errStreamRefused, ack.Offset)
+	}
+	t.resume(ack.Offset)
+	if _, err := f.Seek(ack.Offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	// 确认由单独的协程读取，发送方最多领先 fileAckWindow 个分块
+	var acked atomic.Int64
+	acked.Store(ack.Offset)
+	notify := make(chan struct{}, 1)
+	result := make(chan error, 1)
+	go func() {
+		for {
+			ack, err := readFileAck(stream)
+			if err != nil {
+				result <- err
+				return
+			}
+			acked.Store(ack.Offset)
+			t.progress(ack.Offset)
+			if ack.Done {
+				result <- nil
+				return
+			}
+			select {
+			case notify <- struct{}{}:
+			default:
+			}
+		}
+	}()
+
+	pio := protocol.NewPacketIO(stream, stream)
+	buf := make([]byte, fileChunkSize)
+	for sent := ack.Offset; sent < manifest.Size; {
+		for sent-acked.Load() >= fileAckWindow*fileChunkSize {
+			select {
+			case <-notify:
+			case err := <-result:
+				if err == nil {
+					err = errors.New("transfer finished before all data sent")
+				}
+				return err
+			}
+		}
+		chunk := buf
+		if remaining := manifest.Size - sent; remaining < int64(len(chunk)) {
+			chunk = chunk[:remaining]
+		}
+		n, err := io.ReadFull(f, chunk)
+		if err != nil {
+			return fmt.Errorf("%w: read file error: %v", errStreamRefused, err)
+		}
+		packet := protocol.NewBytesPacket()
+		packet.Write(chunk[:n])
+		if err := pio.WritePacket(packet); err != nil {
+			return err
+		}
+		sent += int64(n)
+	}
+	return <-result
+}
+
+// readFileAck 读取接收方的确认，接收方报告的错误不再重试
+func readFileAck(stream *protocol.Stream) (*hole.FileAck, error) {
+	stream.SetReadDeadline(time.Now().Add(fileAckTimeout))
+	var ack hole.FileAck
+	if err := hole.ReadStreamJSON(stream, &ack); err != nil {
+		return nil, err
+	}
+	if ack.Error != "" {
+		return nil, fmt.Errorf("%w: %s", errStreamRefused, ack.Error)
+	}
+	return &ack, nil
+}
+
+// receiveFile 接收对等端发送的文件
+func (c *Client) receiveFile(peerID string, stream *protocol.Stream) {
+	defer stream.Close()
+
+	dir, _ := c.recvDir.Load().(string)
+	if dir == "" {
+		c.xl.Warnf("Peer %s tried to send a file but receiving is disabled", peerID)
+		hole.WriteStreamHeader(stream, &hole.StreamHeader{Error: "file receiving is disabled"})
+		return
+	}
+	if err := hole.WriteStreamHeader(stream, &hole.StreamHeader{}); err != nil {
+		return
+	}
+
+	stream.SetReadDeadline(time.Now().Add(fileAckTimeout))
+	var manifest hole.FileManifest
+	if err := hole.ReadStreamJSON(stream, &manifest); err != nil {
+		c.xl.Errorf("Failed to read file manifest from peer %s: %v", peerID, err)
+		return
+	}
+	if err := validateManifest(&manifest); err != nil {
+		c.xl.Warnf("Invalid file manifest from peer %s: %v", peerID, err)
+		hole.WriteStreamJSON(stream, &hole.FileAck{Error: err.Error()})
+		return
+	}
+
+	t := c.newTransfer(peerID, manifest.Name, manifest.Size, false)
+	path, err := c.receiveFileData(dir, stream, &manifest, t)
+	t.finish(err)
+	if err != nil {
+		c.xl.Errorf("Failed to receive %s from peer %s: %v", manifest.Name, peerID, err)
+		return
+	}
+	c.xl.Infof("Received %s (%d bytes) from peer %s", path, manifest.Size, peerID)
+}
+
+// receiveFileData 把数据写入接收目录下的临时文件，已有的临时文件作为续传位置
+// 全部数据校验通过后改为原文件名，校验失败时删除临时文件
+func (c *Client) receiveFileData(dir string, stream *protocol.Stream, manifest *hole.FileManifest, t *transfer) (string, error) {
+	// 无法通过重试恢复的错误需要告知发送方
+	refuse := func(err error) (string, error) {
+		hole.WriteStreamJSON(stream, &hole.FileAck{Error: err.Error()})
+		return "", err
+	}
+
+	part := partialPath(dir, manifest)
+	if _, busy := c.receiving.LoadOrStore(part, struct{}{}); busy {
+		return refuse(fmt.Errorf("%s is being received", manifest.Name))
+	}
+	defer c.receiving.Delete(part)
+
+	f, err := os.OpenFile(part, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return refuse(err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return refuse(err)
+	}
+	offset := info.Size()
+	if offset > manifest.Size {
+		if err := f.Truncate(0); err != nil {
+			return refuse(err)
+		}
+		offset = 0
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return refuse(err)
+	}
+	t.resume(offset)
+	if err := hole.WriteStreamJSON(stream, &hole.FileAck{Offset: offset}); err != nil {
+		return "", err
+	}
+
+	pio := protocol.NewPacketIO(stream, stream)
+	for offset < manifest.Size {
+		stream.SetReadDeadline(time.Now().Add(fileAckTimeout))
+		packet, err := pio.ReadPacket()
+		if err != nil {
+			return "", err
+		}
+		var chunk []byte
+		if packet.PacketType() != protocol.BytesType {
+			return refuse(fmt.Errorf("unexpected packet type: %s", packet.PacketType()))
+		}
+		packet.Read(&chunk)
+		if int64(len(chunk)) > manifest.Size-offset {
+			return refuse(errors.New("data exceeds file size"))
+		}
+		if _, err := f.Write(chunk); err != nil {
+			return refuse(err)
+		}
+		offset += int64(len(chunk))
+		t.progress(offset)
+		if err := hole.WriteStreamJSON(stream, &hole.FileAck{Offset: offset}); err != nil {
+			return "", err
+		}
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return refuse(err)
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return refuse(err)
+	}
+	f.Close()
+	if hex.EncodeToString(h.Sum(nil)) != manifest.SHA256 {
+		os.Remove(part)
+		return refuse(errors.New("checksum mismatch"))
+	}
+	path := uniquePath(filepath.Join(dir, manifest.Name))
+	if err := os.Rename(part, path); err != nil {
+		return refuse(err)
+	}
+	return path, hole.WriteStreamJSON(stream, &hole.FileAck{Offset: offset, Done: true})
+}
+
+// fileManifest 计算文件大小和 SHA-256
+func fileManifest(f *os.File) (*hole.FileManifest, error) {
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return nil, err
+	}
+	return &hole.FileManifest{
+		Name:   filepath.Base(f.Name()),
+		Size:   size,
+		SHA256: hex.EncodeToString(h.Sum(nil)),
+	}, nil
+}
+
+// validateManifest 只接受不含路径的文件名，防止写到接收目录之外
+func validateManifest(m *hole.FileManifest) error {
+	if m.Name == "" || m.Name == "." || m.Name == ".." || filepath.Base(m.Name) != m.Name {
+		return fmt.Errorf("invalid file name %q", m.Name)
+	}
+	if m.Size < 0 {
+		return fmt.Errorf("invalid file size %d", m.Size)
+	}
+	if sum, err := hex.DecodeString(m.SHA256); err != nil || len(sum) != sha256.Size {
+		return fmt.Errorf("invalid sha256 %q", m.SHA256)
+	}
+	return nil
+}
+
+// partialPath 接收中的临时文件，同名同内容的文件续传时使用同一个临时文件
+func partialPath(dir string, m *hole.FileManifest) string {
+	return filepath.Join(dir, fmt.Sprintf(".%s.%s.part", m.Name, m.SHA256[:16]))
+}
+
+// uniquePath 目标文件已存在时在扩展名前加序号，不覆盖已有文件
+func uniquePath(path string) string {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return path
+	}
+	ext := filepath.Ext(path)
+	stem := path[:len(path)-len(ext)]
+	for i := 1; ; i++ {
+		candidate := fmt.Sprintf("%s.%d%s", stem, i, ext)
+		if _, err := os.Stat(candidate); os.IsNotExist(err) {
+			return candidate
+		}
+	}
+}
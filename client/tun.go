@@ -0,0 +1,191 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/liuscraft/spider-network/pkg/protocol/hole"
+	"github.com/liuscraft/spider-network/pkg/tun"
+)
+
+// tunRetryInterval 同一地址查询或对等端连接的最短重试间隔，期间的报文直接丢弃
+const tunRetryInterval = 3 * time.Second
+
+// virtualNet 已启用的虚拟网卡
+type virtualNet struct {
+	dev     tun.Device
+	network *net.IPNet
+}
+
+// VirtualIP 返回服务端分配的虚拟 IP（CIDR 格式），未分配时为空
+func (c *Client) VirtualIP() string {
+	c.serverMu.RLock()
+	defer c.serverMu.RUnlock()
+	return c.virtualIP
+}
+
+// StartTUN 创建 TUN 设备并通过对等连接转发虚拟网络报文，name 为空时由系统分配设备名
+func (c *Client) StartTUN(name string) error {
+	virtualIP := c.VirtualIP()
+	if virtualIP == "" {
+		return errors.New("no virtual ip assigned by server")
+	}
+	dev, err := tun.Open(name)
+	if err != nil {
+		return err
+	}
+	if err := tun.Configure(dev.Name(), virtualIP, tun.DefaultMTU); err != nil {
+		dev.Close()
+		return err
+	}
+	if err := c.startTUN(dev, virtualIP); err != nil {
+		dev.Close()
+		return err
+	}
+	c.xl.Infof("TUN device %s up with %s", dev.Name(), virtualIP)
+	return nil
+}
+
+// startTUN 在已配置好的设备上开始转发
+func (c *Client) startTUN(dev tun.Device, virtualIP string) error {
+	_, network, err := net.ParseCIDR(virtualIP)
+	if err != nil {
+		return fmt.Errorf("invalid virtual ip %s: %v", virtualIP, err)
+	}
+	vnet := &virtualNet{dev: dev, network: network}
+	if !c.vnet.CompareAndSwap(nil, vnet) {
+		return errors.New("tun already started")
+	}
+	go c.readTUN(vnet)
+	return nil
+}
+
+// readTUN 读取本机发往虚拟网络的报文并转发给目的地址所属的对等端
+func (c *Client) readTUN(vnet *virtualNet) {
+	buf := make([]byte, 65535)
+	for {
+		n, err := vnet.dev.Read(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) && !errors.Is(err, os.ErrClosed) {
+				c.xl.Errorf("Failed to read from tun device: %v", err)
+			}
+			return
+		}
+		_, dst, ok := tun.IPv4Header(buf[:n])
+		if !ok || !vnet.network.Contains(dst) {
+			continue
+		}
+		if err := c.sendPacket(dst.String(), buf[:n]); err != nil {
+			c.xl.Debugf("Drop packet to %s: %v", dst, err)
+		}
+	}
+}
+
+// sendPacket 把报文发给目的地址所属的对等端
+// 路由未知或尚未连接时丢弃报文，同时发起地址查询或连接，由上层协议重传
+func (c *Client) sendPacket(dst string, packet []byte) error {
+	peerID, ok := c.routes.Load(dst)
+	if !ok {
+		c.resolve(dst)
+		return errors.New("route not resolved")
+	}
+	conn, ok := c.peers.Load(peerID)
+	if !ok {
+		if c.throttle("peer:" + peerID.(string)) {
+			if err := c.ConnectToPeer(peerID.(string)); err != nil {
+				return err
+			}
+		}
+		return fmt.Errorf("peer %s not connected", peerID)
+	}
+
+	payload, err := json.Marshal(packet)
+	if err != nil {
+		return err
+	}
+	return conn.(*hole.Conn).WriteMessage(&hole.Message{
+		Type:    hole.TypePacket,
+		From:    c.clientID,
+		To:      peerID.(string),
+		Payload: payload,
+	})
+}
+
+// handlePacketMessage 把对等端发来的报文写入 TUN 设备
+// 只接受源地址属于该对等端的报文，防止冒用其它节点的地址
+func (c *Client) handlePacketMessage(peerID string, msg *hole.Message) {
+	vnet := c.vnet.Load()
+	if vnet == nil {
+		return
+	}
+	var packet []byte
+	if err := json.Unmarshal(msg.Payload, &packet); err != nil {
+		c.xl.Errorf("Failed to unmarshal packet from peer %s: %v", peerID, err)
+		return
+	}
+	src, dst, ok := tun.IPv4Header(packet)
+	if !ok || !vnet.network.Contains(dst) {
+		return
+	}
+
+	owner, ok := c.routes.Load(src.String())
+	if !ok {
+		c.resolve(src.String())
+		return
+	}
+	if owner != peerID {
+		c.xl.Warnf("Peer %s sent packet from %s which belongs to %s", peerID, src, owner)
+		return
+	}
+	if _, err := vnet.dev.Write(packet); err != nil {
+		c.xl.Errorf("Failed to write to tun device: %v", err)
+	}
+}
+
+// resolve 向服务端查询虚拟 IP 所属的客户端
+func (c *Client) resolve(ip string) {
+	if !c.throttle("ip:" + ip) {
+		return
+	}
+	payload, err := json.Marshal(hole.ResolvePayload{VirtualIP: ip})
+	if err != nil {
+		return
+	}
+	if err := c.sendToServer(&hole.Message{
+		Type:    hole.TypeResolve,
+		From:    c.clientID,
+		To:      "server",
+		Payload: payload,
+	}); err != nil {
+		c.xl.Errorf("Failed to send resolve request: %v", err)
+	}
+}
+
+// handleResolveMessage 记录虚拟 IP 查询结果
+func (c *Client) handleResolveMessage(msg *hole.Message) {
+	var payload hole.ResolvePayload
+	if err := json.Unmarshal(msg.Payload, &payload); err != nil {
+		c.xl.Errorf("Failed to unmarshal resolve payload: %v", err)
+		return
+	}
+	if payload.Error != "" {
+		c.xl.Debugf("Failed to resolve %s: %s", payload.VirtualIP, payload.Error)
+		return
+	}
+	c.routes.Store(payload.VirtualIP, payload.ClientID)
+	c.pending.Delete("ip:" + payload.VirtualIP)
+}
+
+// throttle 限制同一操作的重试频率，返回本次是否可以执行
+func (c *Client) throttle(key string) bool {
+	now := time.Now()
+	if last, ok := c.pending.Load(key); ok && now.Sub(last.(time.Time)) < tunRetryInterval {
+		return false
+	}
+	c.pending.Store(key, now)
+	return true
+}
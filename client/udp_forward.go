@@ -0,0 +1,190 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/liuscraft/spider-network/pkg/protocol"
+	"github.com/liuscraft/spider-network/pkg/protocol/hole"
+)
+
+const (
+	udpMaxDatagram = 65535
+	udpQueueSize   = 64 // 等待发送的报文数，超出时丢弃
+)
+
+// udpIdleTimeout UDP 会话双向都没有报文多久后关闭
+var udpIdleTimeout = 60 * time.Second
+
+// udpSession 转发监听端一个源地址的会话，对应一个多路复用流
+type udpSession struct {
+	src   net.Addr
+	queue chan []byte
+}
+
+// ExposeUDP 允许对等端通过端口转发访问本地 UDP 服务 addr
+func (c *Client) ExposeUDP(peerID, addr string) {
+	c.exposed.Store(exposeKey("udp", peerID, addr), struct{}{})
+	c.xl.Infof("Exposed udp %s to peer %s", addr, peerID)
+}
+
+// ForwardUDP 在本地监听 UDP 地址 listenAddr，把报文经对等连接转发到对方暴露的 remoteAddr
+// 每个源地址使用独立的会话，对方的回复发回对应的源地址
+func (c *Client) ForwardUDP(listenAddr, peerID, remoteAddr string) (net.PacketConn, error) {
+	pc, err := net.ListenPacket("udp", listenAddr)
+	if err != nil {
+		return nil, err
+	}
+	c.forwards.Store(pc, struct{}{})
+	c.xl.Infof("Forwarding udp %s to %s of peer %s", pc.LocalAddr(), remoteAddr, peerID)
+	go c.serveUDPForward(pc, peerID, remoteAddr)
+	return pc, nil
+}
+
+func (c *Client) serveUDPForward(pc net.PacketConn, peerID, remoteAddr string) {
+	var sessions sync.Map // 源地址 -> *udpSession
+	stop := make(chan struct{})
+	defer func() {
+		c.forwards.Delete(pc)
+		close(stop)
+	}()
+
+	buf := make([]byte, udpMaxDatagram)
+	for {
+		n, src, err := pc.ReadFrom(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				c.xl.Errorf("Failed to read udp forward packet: %v", err)
+			}
+			return
+		}
+		value, loaded := sessions.LoadOrStore(src.String(), &udpSession{
+			src:   src,
+			queue: make(chan []byte, udpQueueSize),
+		})
+		s := value.(*udpSession)
+		if !loaded {
+			go c.runUDPSession(pc, &sessions, s, peerID, remoteAddr, stop)
+		}
+		select {
+		case s.queue <- append([]byte(nil), buf[:n]...):
+		default:
+		}
+	}
+}
+
+// runUDPSession 为源地址打开转发流，会话空闲或流关闭后结束
+func (c *Client) runUDPSession(pc net.PacketConn, sessions *sync.Map, s *udpSession, peerID, target string, stop <-chan struct{}) {
+	defer sessions.Delete(s.src.String())
+
+	stream, err := c.openStream(peerID, &hole.StreamHeader{Service: hole.StreamUDPForward, Target: target})
+	if err != nil {
+		c.xl.Errorf("Failed to forward udp to %s of peer %s: %v", target, peerID, err)
+		return
+	}
+	c.relayDatagrams(stream, s.queue, stop, func(data []byte) error {
+		_, err := pc.WriteTo(data, s.src)
+		return err
+	})
+}
+
+// acceptUDPForward 处理对方的 UDP 转发请求，只允许访问暴露给该对等端的服务
+func (c *Client) acceptUDPForward(peerID string, stream *protocol.Stream, header *hole.StreamHeader) {
+	if _, ok := c.exposed.Load(exposeKey("udp", peerID, header.Target)); !ok {
+		c.xl.Warnf("Peer %s tried to access unexposed udp %s", peerID, header.Target)
+		hole.WriteStreamHeader(stream, &hole.StreamHeader{Error: fmt.Sprintf("udp %s is not exposed", header.Target)})
+		stream.Close()
+		return
+	}
+
+	conn, err := net.Dial("udp", header.Target)
+	if err != nil {
+		hole.WriteStreamHeader(stream, &hole.StreamHeader{Error: err.Error()})
+		stream.Close()
+		return
+	}
+	defer conn.Close()
+	if err := hole.WriteStreamHeader(stream, &hole.StreamHeader{}); err != nil {
+		stream.Close()
+		return
+	}
+
+	// 目标服务的回复，连接关闭后退出
+	replies := make(chan []byte, udpQueueSize)
+	go func() {
+		buf := make([]byte, udpMaxDatagram)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
+				// ICMP 不可达等错误不影响后续报文
+				continue
+			}
+			select {
+			case replies <- append([]byte(nil), buf[:n]...):
+			default:
+			}
+		}
+	}()
+	c.relayDatagrams(stream, replies, nil, func(data []byte) error {
+		_, err := conn.Write(data)
+		return err
+	})
+}
+
+// relayDatagrams 把 recv 中的报文写入流，把流中的报文交给 send
+// 双向都空闲 udpIdleTimeout 后、流关闭或 stop 关闭时返回，返回前关闭流
+func (c *Client) relayDatagrams(stream *protocol.Stream, recv <-chan []byte, stop <-chan struct{}, send func([]byte) error) {
+	defer stream.Close()
+
+	var active atomic.Int64
+	touch := func() { active.Store(time.Now().UnixNano()) }
+	touch()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		pio := protocol.NewPacketIO(stream, nil)
+		for {
+			packet, err := pio.ReadPacket()
+			if err != nil || packet.PacketType() != protocol.BytesType {
+				return
+			}
+			var data []byte
+			packet.Read(&data)
+			touch()
+			if err := send(data); err != nil {
+				c.xl.Debugf("Failed to deliver udp packet: %v", err)
+			}
+		}
+	}()
+
+	pio := protocol.NewPacketIO(nil, stream)
+	ticker := time.NewTicker(udpIdleTimeout / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case data := <-recv:
+			touch()
+			packet := protocol.NewBytesPacket()
+			packet.Write(data)
+			if err := pio.WritePacket(packet); err != nil {
+				return
+			}
+		case <-ticker.C:
+			if time.Since(time.Unix(0, active.Load())) >= udpIdleTimeout {
+				return
+			}
+		case <-done:
+			return
+		case <-stop:
+			return
+		}
+	}
+}
@@ -1,22 +1,117 @@
+/*
+	spider 客户端
+
+	spider -id office -servers hole1.example.com:19730,hole2.example.com:19730 -config client.yaml
+
+	配置文件可以是 JSON 或 YAML，命令行参数优先于配置文件
+*/
+
 package main
 
 import (
+	"flag"
+	"os"
+	"strings"
+
 	"github.com/liuscraft/spider-network/client"
+	"github.com/liuscraft/spider-network/pkg/config"
 	"github.com/liuscraft/spider-network/pkg/xlog"
 )
 
 func main() {
+	configFile := flag.String("config", "", "配置文件，JSON 或 YAML")
+	clientID := flag.String("id", "", "客户端ID，默认使用主机名")
+	name := flag.String("name", "", "客户端名称，默认与客户端ID相同")
+	token := flag.String("token", os.Getenv("SPIDER_TOKEN"), "服务端配置的预共享令牌")
+	// 逗号分隔的多个服务端地址，信令连接断开后按顺序切换
+	servers := flag.String("servers", os.Getenv("SPIDER_SERVERS"), "服务端地址，逗号分隔，默认 127.0.0.1:19730")
+	listenAddr := flag.String("listen", "127.0.0.1:0", "对等连接监听地址")
+	heartbeat := flag.Duration("heartbeat", 0, "心跳间隔，默认 10s")
+	dialTimeout := flag.Duration("dial-timeout", 0, "连接超时，默认 5s")
+	backoffMin := flag.Duration("backoff-min", 0, "服务端都不可用时的初始重试间隔，默认 1s")
+	backoffMax := flag.Duration("backoff-max", 0, "服务端都不可用时的最大重试间隔，默认 30s")
+	// 服务端启用 TLS 时，通过 CA 或证书公钥指纹校验服务端，都不指定时使用系统根证书
+	tlsEnabled := flag.Bool("tls", os.Getenv("SPIDER_TLS") == "true", "信令通道使用 TLS")
+	tlsCA := flag.String("tls-ca", os.Getenv("SPIDER_TLS_CA"), "校验服务端证书的 CA")
+	tlsPin := flag.String("tls-pin", os.Getenv("SPIDER_TLS_PIN"), "服务端证书公钥指纹")
+	tlsCert := flag.String("tls-cert", os.Getenv("SPIDER_TLS_CERT"), "双向 TLS 的客户端证书")
+	tlsKey := flag.String("tls-key", os.Getenv("SPIDER_TLS_KEY"), "双向 TLS 的客户端私钥")
+	flag.Parse()
+
 	xl := xlog.New()
 	xl.Info("Starting spider client...")
-	uid := "test-client-1"
-	xl = xlog.WithLogId(xl, uid)
-	cli := client.NewClient(uid, "Test Client 1")
-	if err := cli.Connect("127.0.0.1:19730"); err != nil {
+
+	// 可选的配置文件，声明需要暴露和转发的服务，兼容以第一个参数指定
+	if *configFile == "" && flag.NArg() > 0 {
+		*configFile = flag.Arg(0)
+	}
+	cfg := &config.ClientConfig{}
+	if *configFile != "" {
+		if err := config.LoadFile(cfg, *configFile); err != nil {
+			xl.Errorf("Failed to load config: %v", err)
+			return
+		}
+	}
+
+	// 显式指定或配置文件中没有的参数使用命令行的值
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	override := func(flagName string, field *string, value string) {
+		if set[flagName] || (*field == "" && value != "") {
+			*field = value
+		}
+	}
+	override("id", &cfg.ClientID, *clientID)
+	override("name", &cfg.Name, *name)
+	override("token", &cfg.Token, *token)
+	override("listen", &cfg.ListenAddr, *listenAddr)
+	if set["tls"] || *tlsEnabled {
+		cfg.TLS.Enabled = *tlsEnabled
+	}
+	override("tls-ca", &cfg.TLS.CAFile, *tlsCA)
+	override("tls-pin", &cfg.TLS.PinnedKey, *tlsPin)
+	override("tls-cert", &cfg.TLS.CertFile, *tlsCert)
+	override("tls-key", &cfg.TLS.KeyFile, *tlsKey)
+	// 没有指定客户端ID时使用主机名，避免多个客户端使用同一个ID互相挤占
+	if cfg.ClientID == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			xl.Errorf("Failed to get hostname, set -id or clientId in config: %v", err)
+			return
+		}
+		cfg.ClientID = hostname
+	}
+	if cfg.Name == "" {
+		cfg.Name = cfg.ClientID
+	}
+	if *servers != "" && (set["servers"] || len(cfg.Servers) == 0) {
+		cfg.Servers = strings.Split(*servers, ",")
+	}
+	if len(cfg.Servers) == 0 {
+		cfg.Servers = []string{"127.0.0.1:19730"}
+	}
+
+	xl = xlog.WithLogId(xl, cfg.ClientID)
+	cli, err := client.NewClientFromConfig(cfg,
+		client.WithHeartbeatInterval(*heartbeat),
+		client.WithDialTimeout(*dialTimeout),
+		client.WithBackoff(*backoffMin, *backoffMax),
+	)
+	if err != nil {
+		xl.Errorf("Failed to create client: %v", err)
+		return
+	}
+	if err := cli.ConnectServers(cfg.Servers); err != nil {
 		xl.Errorf("Failed to connect to server: %v", err)
 		return
 	}
 	xl.Info("Connected to server successfully")
 
+	if err := cli.ApplyForwardConfig(cfg); err != nil {
+		xl.Errorf("Failed to apply config: %v", err)
+		return
+	}
+
 	// 启动命令行界面
 	cli.StartCLI()
 }
@@ -0,0 +1,119 @@
+/*
+	spidercert 生成自签名 CA 以及服务端、客户端证书，无需外部 PKI
+
+	spidercert -dir certs -hosts example.com,1.2.3.4 -clients client-1,client-2
+
+	已存在的 CA 会被复用，因此可以重复执行为新客户端签发证书
+*/
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/liuscraft/spider-network/pkg/tlsutil"
+	"github.com/liuscraft/spider-network/pkg/xlog"
+)
+
+func main() {
+	dir := flag.String("dir", "certs", "证书输出目录")
+	hosts := flag.String("hosts", "localhost,127.0.0.1", "服务端证书的域名或 IP，逗号分隔")
+	clients := flag.String("clients", "", "需要签发客户端证书的客户端ID，逗号分隔")
+	flag.Parse()
+
+	xl := xlog.New()
+	if err := os.MkdirAll(*dir, 0o700); err != nil {
+		xl.Fatalf("Failed to create directory: %v", err)
+	}
+
+	ca, err := loadOrCreateCA(*dir)
+	if err != nil {
+		xl.Fatalf("Failed to prepare ca: %v", err)
+	}
+
+	serverHosts := splitList(*hosts)
+	if !exists(filepath.Join(*dir, "server.pem")) {
+		certPEM, keyPEM, err := ca.Issue("spider-hole", serverHosts, false)
+		if err != nil {
+			xl.Fatalf("Failed to issue server certificate: %v", err)
+		}
+		if err := writePair(*dir, "server", certPEM, keyPEM); err != nil {
+			xl.Fatalf("Failed to write server certificate: %v", err)
+		}
+		xl.Infof("Issued server certificate for %v", serverHosts)
+	}
+
+	// 客户端证书的 CommonName 即客户端ID，服务端会校验两者一致
+	for _, clientID := range splitList(*clients) {
+		certPEM, keyPEM, err := ca.Issue(clientID, nil, true)
+		if err != nil {
+			xl.Fatalf("Failed to issue certificate for %s: %v", clientID, err)
+		}
+		if err := writePair(*dir, "client-"+clientID, certPEM, keyPEM); err != nil {
+			xl.Fatalf("Failed to write certificate for %s: %v", clientID, err)
+		}
+		xl.Infof("Issued client certificate for %s", clientID)
+	}
+
+	serverCert, err := os.ReadFile(filepath.Join(*dir, "server.pem"))
+	if err != nil {
+		xl.Fatalf("Failed to read server certificate: %v", err)
+	}
+	pin, err := tlsutil.CertificatePin(serverCert)
+	if err != nil {
+		xl.Fatalf("Failed to compute server pin: %v", err)
+	}
+	xl.Infof("Server public key pin (sha256): %s", pin)
+}
+
+func loadOrCreateCA(dir string) (*tlsutil.CA, error) {
+	certFile := filepath.Join(dir, "ca.pem")
+	keyFile := filepath.Join(dir, "ca-key.pem")
+	if exists(certFile) {
+		certPEM, err := os.ReadFile(certFile)
+		if err != nil {
+			return nil, err
+		}
+		keyPEM, err := os.ReadFile(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		return tlsutil.LoadCA(certPEM, keyPEM)
+	}
+
+	ca, err := tlsutil.NewCA("spider-network CA")
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := ca.KeyPEM()
+	if err != nil {
+		return nil, err
+	}
+	return ca, writePair(dir, "ca", ca.CertPEM(), keyPEM)
+}
+
+func writePair(dir, name string, certPEM, keyPEM []byte) error {
+	if err := os.WriteFile(filepath.Join(dir, name+".pem"), certPEM, 0o644); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, name+"-key.pem"), keyPEM, 0o600)
+}
+
+func exists(file string) bool {
+	_, err := os.Stat(file)
+	return !errors.Is(err, os.ErrNotExist)
+}
+
+func splitList(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
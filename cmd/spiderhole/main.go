@@ -1,6 +1,8 @@
 package main
 
 import (
+	"os"
+
 	"github.com/liuscraft/spider-network/pkg/config"
 	"github.com/liuscraft/spider-network/pkg/xlog"
 	"github.com/liuscraft/spider-network/server"
@@ -13,9 +15,26 @@ func main() {
 	// 加载配置
 	cfg := &config.ServerConfig{
 		HoleConfig: config.HoleConfig{
-			BindAddr: ":19730",
+			BindAddr:    ":19730",
+			BanFile:     "bans.json",
+			RegistryDir: "registry",
+			// 客户端执行 tun 命令后使用该网段的虚拟 IP 互相访问
+			NetworkConfig: config.NetworkConfig{
+				CIDR:      "10.10.0.0/24",
+				LeaseFile: "leases.json",
+			},
+		},
+		StunConfig: config.StunConfig{
+			BindAddr:    ":3478",
+			AltBindAddr: ":3479",
 		},
 	}
+	// 可选的配置文件，例如开启信令通道 TLS
+	if len(os.Args) > 1 {
+		if err := config.LoadFile(cfg, os.Args[1]); err != nil {
+			xl.Fatalf("Failed to load config: %v", err)
+		}
+	}
 
 	// 创建服务
 	srv, err := server.NewService(cfg)
@@ -24,7 +43,7 @@ func main() {
 	}
 
 	// 启动服务
-	xl.Info("Starting server on :19730")
+	xl.Infof("Starting server on %s", cfg.HoleConfig.BindAddr)
 	if err := srv.Start(); err != nil {
 		xl.Fatalf("Failed to start server: %v", err)
 	}
@@ -0,0 +1,71 @@
+package config
+
+// ClientConfig for spider client
+type ClientConfig struct {
+	ClientID string          `json:"clientId,omitempty"`
+	Name     string          `json:"name,omitempty"`
+	Token    string          `json:"token,omitempty"`   // 服务端配置的预共享令牌
+	Servers  []string        `json:"servers,omitempty"` // 按优先级排列的服务端地址，支持 srv: 前缀
+	TLS      ClientTLSConfig `json:"tls,omitempty"`
+
+	ListenAddr        string        `json:"listenAddr,omitempty"`        // 对等连接监听地址，默认 127.0.0.1:0
+	DialTimeout       int           `json:"dialTimeout,omitempty"`       // 连接超时（秒），默认 5
+	HeartbeatInterval int           `json:"heartbeatInterval,omitempty"` // 心跳间隔（秒），默认 10
+	Backoff           BackoffConfig `json:"backoff,omitempty"`
+
+	Expose  []ExposeConfig  `json:"expose,omitempty"`
+	Forward []ForwardConfig `json:"forward,omitempty"`
+	Socks   []SocksConfig   `json:"socks,omitempty"`
+	Exit    []ExitConfig    `json:"exit,omitempty"`
+	Publish []PublishConfig `json:"publish,omitempty"`
+}
+
+// ExposeConfig 允许对等端通过端口转发访问的本地服务
+type ExposeConfig struct {
+	Network string `json:"network,omitempty"` // tcp 或 udp，默认 tcp
+	PeerID  string `json:"peerId"`
+	Addr    string `json:"addr"`
+}
+
+// ForwardConfig 本地监听并转发到对等端暴露的服务
+type ForwardConfig struct {
+	Network    string `json:"network,omitempty"` // tcp 或 udp，默认 tcp
+	ListenAddr string `json:"listenAddr"`
+	PeerID     string `json:"peerId"`
+	RemoteAddr string `json:"remoteAddr"`
+}
+
+// SocksConfig 本地 SOCKS5 代理，CONNECT 请求经对等端 PeerID 访问目标
+type SocksConfig struct {
+	ListenAddr string `json:"listenAddr"`
+	PeerID     string `json:"peerId"`
+}
+
+// ExitConfig 允许对等端经本机访问的目标，格式为 CIDR[:端口或端口范围]，如 10.0.0.0/8:80-443
+type ExitConfig struct {
+	PeerID string   `json:"peerId"`
+	Allow  []string `json:"allow"`
+}
+
+// PublishConfig 通过服务端发布的本地 HTTP 服务，以 <Name>.<服务端域名> 访问
+type PublishConfig struct {
+	Name string `json:"name"`
+	Addr string `json:"addr"`
+}
+
+// ClientTLSConfig 信令通道 TLS，Enabled 为 false 时使用明文 TCP，此时不能设置其他选项
+// 启用后 CAFile 和 PinnedKey 都为空时使用系统根证书校验服务端
+type ClientTLSConfig struct {
+	Enabled    bool   `json:"enabled,omitempty"`
+	CAFile     string `json:"caFile,omitempty"`
+	CertFile   string `json:"certFile,omitempty"` // 双向 TLS 的客户端证书
+	KeyFile    string `json:"keyFile,omitempty"`
+	ServerName string `json:"serverName,omitempty"`
+	PinnedKey  string `json:"pinnedKey,omitempty"` // 服务端证书公钥指纹
+}
+
+// BackoffConfig 所有服务端都不可用时的重试间隔（秒），从 Min 开始每轮翻倍直到 Max
+type BackoffConfig struct {
+	Min int `json:"min,omitempty"` // 默认 1
+	Max int `json:"max,omitempty"` // 默认 30
+}
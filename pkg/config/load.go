@@ -2,13 +2,31 @@ package config
 
 import (
 	"encoding/json"
+	"fmt"
 	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
 )
 
+// LoadFile 加载配置文件，.yaml/.yml 按 YAML 解析，其他按 JSON 解析
+// YAML 的字段名与 JSON 相同
 func LoadFile(config interface{}, configFileName string) (err error) {
 	file, err := os.ReadFile(configFileName)
 	if err != nil {
 		return
 	}
+	switch strings.ToLower(filepath.Ext(configFileName)) {
+	case ".yaml", ".yml":
+		// 先解析为通用结构再转换为 JSON，复用结构体上的 json 标签
+		var doc interface{}
+		if err := yaml.Unmarshal(file, &doc); err != nil {
+			return fmt.Errorf("parse yaml error: %v", err)
+		}
+		if file, err = json.Marshal(doc); err != nil {
+			return fmt.Errorf("convert yaml error: %v", err)
+		}
+	}
 	return json.Unmarshal(file, config)
 }
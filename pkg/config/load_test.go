@@ -13,4 +13,31 @@ func TestLoadFile(t *testing.T) {
 			t.Errorf("LoadFile() error = %v", err)
 		}
 	})
+	t.Run("Load ClientConfig", func(t *testing.T) {
+		cliConf := &ClientConfig{}
+		if err := LoadFile(cliConf, "testdata/client.conf"); err != nil {
+			t.Fatalf("LoadFile() error = %v", err)
+		}
+		if len(cliConf.Expose) != 1 || cliConf.Expose[0].Network != "udp" {
+			t.Errorf("LoadFile() expose = %+v", cliConf.Expose)
+		}
+		if len(cliConf.Forward) != 1 || cliConf.Forward[0].RemoteAddr != "127.0.0.1:80" {
+			t.Errorf("LoadFile() forward = %+v", cliConf.Forward)
+		}
+	})
+	t.Run("Load ClientConfig from yaml", func(t *testing.T) {
+		cliConf := &ClientConfig{}
+		if err := LoadFile(cliConf, "testdata/client.yaml"); err != nil {
+			t.Fatalf("LoadFile() error = %v", err)
+		}
+		if cliConf.ClientID != "office" || len(cliConf.Servers) != 2 || cliConf.HeartbeatInterval != 15 {
+			t.Errorf("LoadFile() client = %+v", cliConf)
+		}
+		if cliConf.Backoff.Min != 2 || cliConf.Backoff.Max != 60 || !cliConf.TLS.Enabled || cliConf.TLS.PinnedKey != "abcdef" {
+			t.Errorf("LoadFile() backoff = %+v, tls = %+v", cliConf.Backoff, cliConf.TLS)
+		}
+		if len(cliConf.Forward) != 1 || cliConf.Forward[0].ListenAddr != "127.0.0.1:8080" {
+			t.Errorf("LoadFile() forward = %+v", cliConf.Forward)
+		}
+	})
 }
@@ -4,13 +4,88 @@ package config
 type ServerConfig struct {
 	BindAddr   string     `json:"bindAddr,omitempty"`
 	HoleConfig HoleConfig `json:"holeConfig,omitempty"`
+	StunConfig StunConfig `json:"stunConfig,omitempty"`
+	HTTPConfig HTTPConfig `json:"httpConfig,omitempty"`
+	WebConfig  WebConfig  `json:"webConfig,omitempty"`
 }
 
 type HoleConfig struct {
-	BindAddr        string          `json:"bindAddr,omitempty"`
-	MaxConn         int             `json:"maxConn,omitempty"`
-	Timeout         int             `json:"timeout,omitempty"`
-	AcceptTimeout   int             `json:"acceptTimeout,omitempty"`
-	IOTimeoutConfig IOTimeoutConfig `json:"ioTimeoutConfig,omitempty"`
-	IOBufferConfig  IOBufferConfig  `json:"ioBufferConfig,omitempty"`
+	BindAddr         string           `json:"bindAddr,omitempty"`
+	MaxConn          int              `json:"maxConn,omitempty"`
+	Timeout          int              `json:"timeout,omitempty"`
+	AcceptTimeout    int              `json:"acceptTimeout,omitempty"`
+	IOTimeoutConfig  IOTimeoutConfig  `json:"ioTimeoutConfig,omitempty"`
+	IOBufferConfig   IOBufferConfig   `json:"ioBufferConfig,omitempty"`
+	RelayConfig      RelayConfig      `json:"relayConfig,omitempty"`
+	AuthConfig       AuthConfig       `json:"authConfig,omitempty"`
+	TLSConfig        TLSConfig        `json:"tlsConfig,omitempty"`
+	NetworkConfig    NetworkConfig    `json:"networkConfig,omitempty"`
+	FederationConfig FederationConfig `json:"federationConfig,omitempty"`
+	BanFile          string           `json:"banFile,omitempty"`     // 封禁列表持久化文件，为空时只保存在内存中
+	RegistryDir      string           `json:"registryDir,omitempty"` // 客户端注册表持久化目录，为空时只保存在内存中
+}
+
+// FederationConfig 多区域互联，ServerID 为空时不启用
+// 各区域服务端使用相同的 Token 互相认证，交换客户端注册表并转发打洞信令
+// 注册表不会转发给第三方服务端，需要互通的区域之间都要建立连接
+type FederationConfig struct {
+	ServerID string           `json:"serverId,omitempty"`
+	Token    string           `json:"token,omitempty"`
+	Peers    []FederationPeer `json:"peers,omitempty"` // 主动连接的其他区域，双方互相配置时只保留一条连接
+}
+
+// FederationPeer 其他区域服务端的信令地址
+type FederationPeer struct {
+	Addr      string `json:"addr"`
+	TLS       bool   `json:"tls,omitempty"`       // 对方信令通道启用了 TLS
+	CAFile    string `json:"caFile,omitempty"`    // 校验对方证书的 CA，为空时使用系统根证书
+	PinnedKey string `json:"pinnedKey,omitempty"` // 对方证书公钥指纹
+}
+
+// NetworkConfig 虚拟网络配置，CIDR 为空时不分配虚拟 IP
+type NetworkConfig struct {
+	CIDR         string            `json:"cidr,omitempty"`         // 虚拟网段，如 10.10.0.0/24
+	LeaseFile    string            `json:"leaseFile,omitempty"`    // 动态租约持久化文件，为空时只保存在内存中
+	Reservations map[string]string `json:"reservations,omitempty"` // 静态保留：客户端ID -> 虚拟 IP
+}
+
+// TLSConfig 信令通道 TLS 配置，CertFile 为空时不启用
+// 设置 ClientCAFile 后要求客户端证书（双向 TLS），证书 CommonName 必须与客户端ID一致
+type TLSConfig struct {
+	CertFile     string `json:"certFile,omitempty"`
+	KeyFile      string `json:"keyFile,omitempty"`
+	ClientCAFile string `json:"clientCAFile,omitempty"`
+}
+
+// AuthConfig 客户端注册认证，Credentials 为空时不启用
+type AuthConfig struct {
+	Credentials  map[string]string `json:"credentials,omitempty"`  // 客户端ID -> 预共享令牌
+	MaxClockSkew int               `json:"maxClockSkew,omitempty"` // 允许的时间偏差（秒），默认 300
+}
+
+// RelayConfig 中继配置，打洞失败时由服务端转发对等端之间的流量
+type RelayConfig struct {
+	Disabled  bool  `json:"disabled,omitempty"`
+	Bandwidth int64 `json:"bandwidth,omitempty"` // 每个客户端的中继带宽（字节/秒），0 表示不限制
+	Quota     int64 `json:"quota,omitempty"`     // 每个客户端的中继流量配额（字节），0 表示不限制
+}
+
+// StunConfig 反射地址发现服务，BindAddr 为空时不启用
+type StunConfig struct {
+	BindAddr    string `json:"bindAddr,omitempty"`    // 主地址，同时提供 UDP 与 TCP 绑定
+	AltBindAddr string `json:"altBindAddr,omitempty"` // 备用地址，用于 NAT 类型探测
+}
+
+// HTTPConfig HTTP 反向代理，按 Host 头把请求转发给发布该服务的客户端，BindAddr 为空时不启用
+// 设置 Domain 后只接受 <服务名>.<Domain> 形式的 Host，否则 Host 的第一段即为服务名
+type HTTPConfig struct {
+	BindAddr string `json:"bindAddr,omitempty"`
+	Domain   string `json:"domain,omitempty"` // 如 spider.example.com
+}
+
+// WebConfig Web 控制台，断开、封禁等管理接口通过 Authorization: Bearer <AdminToken> 认证
+// AdminToken 为空时管理接口只接受本机请求
+type WebConfig struct {
+	BindAddr   string `json:"bindAddr,omitempty"` // 默认 :8080
+	AdminToken string `json:"adminToken,omitempty"`
 }
@@ -0,0 +1,68 @@
+package hole
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"time"
+)
+
+// ErrorCode 错误码
+type ErrorCode string
+
+const (
+	ErrCodeBadRequest   ErrorCode = "bad_request"  // 消息格式错误
+	ErrCodeUnauthorized ErrorCode = "unauthorized" // 认证失败
+	ErrCodeReplay       ErrorCode = "replay"       // 重放的注册请求
+	ErrCodeKicked       ErrorCode = "kicked"       // 被管理员断开
+	ErrCodeBanned       ErrorCode = "banned"       // 客户端ID或来源地址被封禁
+	// 流请求被拒绝的原因
+	ErrCodeNotAllowed  ErrorCode = "not_allowed"  // 目标不在允许列表中
+	ErrCodeUnreachable ErrorCode = "unreachable"  // 目标无法访问
+	ErrCodeConnRefused ErrorCode = "conn_refused" // 目标拒绝连接
+)
+
+// ErrorPayload 错误响应负载，同时实现 error 接口
+type ErrorPayload struct {
+	Code    ErrorCode `json:"code"`
+	Message string    `json:"message"`
+}
+
+func (e *ErrorPayload) Error() string {
+	return string(e.Code) + ": " + e.Message
+}
+
+// NewError 创建错误响应
+func NewError(code ErrorCode, message string) *ErrorPayload {
+	return &ErrorPayload{Code: code, Message: message}
+}
+
+// SignRegister 计算注册签名：HMAC-SHA256(token, clientID \n timestamp \n nonce [\n publicKey])
+// 发布了静态公钥时一并签名，防止中间人替换公钥后转发注册消息
+func SignRegister(token, clientID string, timestamp int64, nonce, publicKey string) string {
+	mac := hmac.New(sha256.New, []byte(token))
+	mac.Write([]byte(clientID))
+	mac.Write([]byte{'\n'})
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte{'\n'})
+	mac.Write([]byte(nonce))
+	if publicKey != "" {
+		mac.Write([]byte{'\n'})
+		mac.Write([]byte(publicKey))
+	}
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Sign 使用预共享令牌为注册消息填写认证信息，需要在填写 PublicKey 之后调用
+func (p *RegisterPayload) Sign(token string) error {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	p.Timestamp = time.Now().Unix()
+	p.Nonce = hex.EncodeToString(nonce)
+	p.Signature = SignRegister(token, p.ClientID, p.Timestamp, p.Nonce, p.PublicKey)
+	return nil
+}
@@ -0,0 +1,177 @@
+package hole
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/liuscraft/spider-network/pkg/protocol"
+)
+
+const (
+	ProtocolVersionLegacy = 1 // 换行分隔的 JSON 消息
+	ProtocolVersion       = 2 // 基于 PacketIO 的帧格式
+)
+
+// Conn 打洞消息连接，所有 Message 都通过 protocol.PacketIO 读写
+// 服务端通过 NewServerConn 创建时，会根据首字节兼容旧版换行 JSON 客户端
+type Conn struct {
+	net.Conn
+	reader *bufio.Reader
+	pio    *protocol.PacketIO
+	wmu    sync.Mutex
+	// 多路复用会话，为 nil 时收到的多路复用帧视为错误
+	session *protocol.Session
+
+	detect   bool // 首次读取时是否检测协议格式
+	detected bool
+	legacy   bool
+}
+
+// NewConn 创建使用帧格式的消息连接
+func NewConn(conn net.Conn) *Conn {
+	reader := bufio.NewReader(conn)
+	return &Conn{
+		Conn:     conn,
+		reader:   reader,
+		pio:      protocol.NewPacketIO(reader, conn),
+		detected: true,
+	}
+}
+
+// NewPeerConn 创建对等连接，消息和多路复用流共用同一连接
+// 连接两端的 initiator 必须不同，用于区分双方打开的流ID
+func NewPeerConn(conn net.Conn, initiator bool) *Conn {
+	c := NewConn(conn)
+	c.EnableSession(initiator)
+	return c
+}
+
+// NewServerConn 创建服务端消息连接，首次读取时识别旧版换行 JSON 客户端
+func NewServerConn(conn net.Conn) *Conn {
+	c := NewConn(conn)
+	c.detect = true
+	c.detected = false
+	return c
+}
+
+// EnableSession 在消息连接上启用多路复用，必须在开始读取消息前或读取协程中调用
+// 信令连接由客户端一侧作为 client，服务端通过会话向客户端打开流
+func (c *Conn) EnableSession(client bool) {
+	if c.session == nil {
+		c.session = protocol.NewSession(c, client)
+	}
+}
+
+// Session 返回连接的多路复用会话，未启用时返回 nil
+func (c *Conn) Session() *protocol.Session {
+	return c.session
+}
+
+// Close 关闭多路复用会话和底层连接
+func (c *Conn) Close() error {
+	if c.session != nil {
+		c.session.Close()
+	}
+	return c.Conn.Close()
+}
+
+// Legacy 是否为旧版换行 JSON 连接
+func (c *Conn) Legacy() bool {
+	return c.legacy
+}
+
+// Version 返回连接所使用的协议版本
+func (c *Conn) Version() int {
+	if c.legacy {
+		return ProtocolVersionLegacy
+	}
+	return ProtocolVersion
+}
+
+func (c *Conn) detectFormat() error {
+	if c.detected {
+		return nil
+	}
+	b, err := c.reader.Peek(1)
+	if err != nil {
+		return err
+	}
+	// 帧格式首字节为 PacketType，旧版 JSON 消息以 '{' 开头
+	c.legacy = b[0] == '{'
+	c.detected = true
+	return nil
+}
+
+// Read 读取原始字节流，优先返回已缓冲的数据
+// 握手完成后可以把连接作为透明字节流使用（如中继通道）
+func (c *Conn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+// ReadMessage 读取一条消息，期间收到的多路复用帧交给会话处理
+func (c *Conn) ReadMessage() (*Message, error) {
+	if err := c.detectFormat(); err != nil {
+		return nil, err
+	}
+
+	var msg Message
+	if c.legacy {
+		data, err := c.reader.ReadBytes('\n')
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(data, &msg); err != nil {
+			return nil, fmt.Errorf("unmarshal legacy message error: %v", err)
+		}
+		return &msg, nil
+	}
+
+	packet, err := c.pio.ReadPacket()
+	for err == nil && packet.PacketType() == protocol.MuxType && c.session != nil {
+		if err := c.session.HandlePacket(packet); err != nil {
+			return nil, fmt.Errorf("handle mux packet error: %v", err)
+		}
+		packet, err = c.pio.ReadPacket()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if packet.PacketType() != protocol.JsonType {
+		return nil, fmt.Errorf("unexpected packet type: %s", packet.PacketType())
+	}
+	if _, err := packet.Read(&msg); err != nil {
+		return nil, fmt.Errorf("unmarshal message error: %v", err)
+	}
+	return &msg, nil
+}
+
+// WriteMessage 写入一条消息，可被多个协程并发调用
+func (c *Conn) WriteMessage(msg *Message) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	if c.legacy {
+		data, err := json.Marshal(msg)
+		if err != nil {
+			return err
+		}
+		_, err = c.Conn.Write(append(data, '\n'))
+		return err
+	}
+
+	packet, err := CreateHolePacket(msg)
+	if err != nil {
+		return err
+	}
+	return c.pio.WritePacket(packet)
+}
+
+// WritePacket 写入一个数据包，与 WriteMessage 共用写锁
+func (c *Conn) WritePacket(packet protocol.Packet) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	return c.pio.WritePacket(packet)
+}
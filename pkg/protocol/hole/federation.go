@@ -0,0 +1,57 @@
+package hole
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// FederatePayload 服务端互联握手，双方各自对另一方的随机数签名：
+//  1. 发起方发送 ServerID 和 Nonce
+//  2. 接受方回复 ServerID、Nonce 和对发起方随机数的签名
+//  3. 发起方回复对接受方随机数的签名
+type FederatePayload struct {
+	ServerID  string `json:"server_id"`
+	Nonce     string `json:"nonce,omitempty"`
+	Signature string `json:"signature,omitempty"`
+}
+
+// FederatedClient 同步给其他区域的客户端信息
+type FederatedClient struct {
+	ClientID  string `json:"client_id"`
+	Name      string `json:"name"`
+	PublicKey string `json:"public_key,omitempty"`
+	NATType   string `json:"nat_type,omitempty"`
+}
+
+// SyncPayload 客户端注册表同步，Full 为 true 时替换发送方此前同步的全部客户端
+type SyncPayload struct {
+	Full    bool              `json:"full,omitempty"`
+	Clients []FederatedClient `json:"clients,omitempty"`
+	Removed []string          `json:"removed,omitempty"`
+}
+
+// NewNonce 生成握手随机数
+func NewNonce() (string, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(nonce), nil
+}
+
+// SignFederate 计算互联签名：HMAC-SHA256(token, "federate" \n serverID \n nonce)
+func SignFederate(token, serverID, nonce string) string {
+	mac := hmac.New(sha256.New, []byte(token))
+	mac.Write([]byte("federate\n"))
+	mac.Write([]byte(serverID))
+	mac.Write([]byte{'\n'})
+	mac.Write([]byte(nonce))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyFederate 校验对方对 nonce 的签名
+func VerifyFederate(token, serverID, nonce, signature string) bool {
+	return hmac.Equal([]byte(SignFederate(token, serverID, nonce)), []byte(signature))
+}
@@ -16,6 +16,18 @@ const (
 	TypeConnect    MessageType = "connect"     // 连接请求
 	TypeHeartbeat  MessageType = "heartbeat"   // 心跳消息
 	TypeMessage    MessageType = "message"     // 消息
+	TypeData       MessageType = "data"        // 二进制数据，负载为 base64 编码的 JSON 字符串
+	TypeBinding    MessageType = "binding"     // 反射地址查询
+	TypeRelay      MessageType = "relay"       // 中继请求/中继通道分配
+	TypeRelayBind  MessageType = "relay_bind"  // 绑定中继通道
+	TypeError      MessageType = "error"       // 错误响应
+	TypePeerKey    MessageType = "peer_key"    // 查询对等端静态公钥
+	TypeResolve    MessageType = "resolve"     // 查询虚拟 IP 所属的客户端
+	TypePacket     MessageType = "packet"      // 虚拟网络 IP 报文
+	TypePublish    MessageType = "publish"     // 发布 HTTP 服务
+	TypeFederate   MessageType = "federate"    // 服务端互联握手
+	TypeSync       MessageType = "sync"        // 服务端之间同步客户端注册表
+	TypeRevoke     MessageType = "revoke"      // 客户端被管理员移除，对等端断开与其的连接
 )
 
 // Message 打洞消息
@@ -32,12 +44,77 @@ type RegisterPayload struct {
 	Name        string `json:"name"`
 	PublicAddr  string `json:"public_addr"`
 	PrivateAddr string `json:"private_addr"`
+	Version     int    `json:"version,omitempty"`    // 客户端支持的最高协议版本
+	NATType     string `json:"nat_type,omitempty"`   // 客户端探测到的 NAT 类型
+	PublicKey   string `json:"public_key,omitempty"` // 端到端加密的静态公钥（base64）
+	// 认证信息，见 SignRegister
+	Timestamp int64  `json:"timestamp,omitempty"`
+	Nonce     string `json:"nonce,omitempty"`
+	Signature string `json:"signature,omitempty"`
 }
 
+// RegisterAckPayload 注册确认负载
+type RegisterAckPayload struct {
+	Version int `json:"version"`            // 协商后的协议版本
+	UDPPort int `json:"udp_port,omitempty"` // 服务端 UDP 绑定端口，0 表示不支持 UDP 打洞
+	// UDP 绑定令牌，每次注册重新生成，绑定请求需要携带，见 punch.EncodeBind
+	UDPToken string `json:"udp_token,omitempty"`
+	// 分配的虚拟 IP（CIDR 格式，如 10.10.0.2/24），服务端未启用虚拟网络时为空
+	VirtualIP string `json:"virtual_ip,omitempty"`
+}
+
+const (
+	NetworkTCP = "tcp"
+	NetworkUDP = "udp"
+)
+
 // PunchPayload 打洞消息负载
+// Network 为 udp 时，PublicAddr 为服务端观察到的 UDP 反射地址，PrivateAddr 为本地网卡地址
+// PublicKey 由服务端填写为发送方注册时发布的静态公钥
 type PunchPayload struct {
+	Network     string `json:"network,omitempty"` // 打洞方式，默认为 tcp
 	PublicAddr  string `json:"public_addr"`
 	PrivateAddr string `json:"private_addr"`
+	PublicKey   string `json:"public_key,omitempty"`
+}
+
+// BindingPayload 反射地址查询结果
+type BindingPayload struct {
+	MappedAddr string `json:"mapped_addr"` // 服务端观察到的地址
+}
+
+// RelayPayload 中继消息负载
+// 客户端请求中继时为空；服务端分配通道后分别通知双方，失败时填写 Error
+type RelayPayload struct {
+	ChannelID string `json:"channel_id,omitempty"`
+	PublicKey string `json:"public_key,omitempty"` // 对方的静态公钥
+	Error     string `json:"error,omitempty"`
+}
+
+// PeerKeyPayload 对等端静态公钥查询结果，From 为被查询的客户端
+type PeerKeyPayload struct {
+	PublicKey string `json:"public_key,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// ResolvePayload 虚拟 IP 查询，服务端填写 ClientID 后原样返回
+type ResolvePayload struct {
+	VirtualIP string `json:"virtual_ip"`
+	ClientID  string `json:"client_id,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// PublishPayload 发布 HTTP 服务，服务端确认时原样返回，失败时填写 Error
+// 服务端按请求 Host 头中的 Name 把 HTTP 请求经信令连接上的流转发给客户端
+type PublishPayload struct {
+	Name  string `json:"name"`
+	Error string `json:"error,omitempty"`
+}
+
+// RevokePayload 通知对等端断开与被移除客户端的连接
+type RevokePayload struct {
+	ClientID string `json:"client_id"`
+	Reason   string `json:"reason,omitempty"`
 }
 
 // HeartbeatPayload 心跳消息负载
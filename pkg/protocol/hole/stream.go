@@ -0,0 +1,80 @@
+package hole
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/liuscraft/spider-network/pkg/protocol"
+)
+
+// StreamService 多路复用流承载的服务
+type StreamService string
+
+const (
+	StreamForward    StreamService = "forward"     // TCP 端口转发
+	StreamFile       StreamService = "file"        // 文件传输
+	StreamUDPForward StreamService = "udp_forward" // UDP 端口转发，每个报文作为一个数据包
+	StreamExit       StreamService = "exit"        // 由对方连接任意允许的目标，用于 SOCKS5 代理
+	StreamHTTP       StreamService = "http"        // 服务端转发的 HTTP 请求，Target 为发布的服务名
+)
+
+// StreamHeader 多路复用流的首个数据包，打开方说明请求的服务，接受方以同样格式回复结果
+type StreamHeader struct {
+	Service StreamService `json:"service,omitempty"`
+	Target  string        `json:"target,omitempty"` // 端口转发时为对方暴露的服务地址，HTTP 服务为服务名
+	Code    ErrorCode     `json:"code,omitempty"`   // 拒绝原因，Error 不为空时填写
+	Error   string        `json:"error,omitempty"`
+}
+
+// FileManifest 文件传输清单，发送方在流头部之后发送
+type FileManifest struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"` // 十六进制
+}
+
+// FileAck 接收方的确认，Offset 为已写入的字节数
+// 收到清单后的首个确认给出续传位置，全部数据校验通过后 Done 为 true
+type FileAck struct {
+	Offset int64  `json:"offset"`
+	Done   bool   `json:"done,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// WriteStreamHeader 在流上写入头部
+func WriteStreamHeader(w io.Writer, header *StreamHeader) error {
+	return WriteStreamJSON(w, header)
+}
+
+// ReadStreamHeader 从流上读取头部，不会读取头部之后的数据
+func ReadStreamHeader(r io.Reader) (*StreamHeader, error) {
+	var header StreamHeader
+	if err := ReadStreamJSON(r, &header); err != nil {
+		return nil, err
+	}
+	return &header, nil
+}
+
+// WriteStreamJSON 在流上写入一个 JSON 数据包
+func WriteStreamJSON(w io.Writer, v interface{}) error {
+	packet := protocol.NewJSONPacket()
+	if _, err := packet.Write(v); err != nil {
+		return err
+	}
+	return protocol.NewPacketIO(nil, w).WritePacket(packet)
+}
+
+// ReadStreamJSON 从流上读取一个 JSON 数据包
+func ReadStreamJSON(r io.Reader, v interface{}) error {
+	packet, err := protocol.NewPacketIO(r, nil).ReadPacket()
+	if err != nil {
+		return err
+	}
+	if packet.PacketType() != protocol.JsonType {
+		return fmt.Errorf("unexpected packet type: %s", packet.PacketType())
+	}
+	if _, err := packet.Read(v); err != nil {
+		return fmt.Errorf("unmarshal stream packet error: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,563 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// 多路复用帧格式：1 字节命令 + 4 字节流ID + 数据，整体作为 MuxType 数据包传输
+const (
+	muxSYN    byte = iota + 1 // 打开流
+	muxData                   // 流数据
+	muxWindow                 // 窗口更新，数据为 4 字节增量
+	muxFIN                    // 本端不再发送数据
+	muxRST                    // 异常终止流
+)
+
+const (
+	muxFrameHeaderSize = 5
+	// MuxWindowSize 每个流的接收窗口，对方最多发送这么多未被读取的数据
+	MuxWindowSize = 256 * 1024
+	// MuxFrameSize 单个数据帧的最大长度，避免大块写入长时间占用连接
+	MuxFrameSize     = 16 * 1024
+	muxAcceptBacklog = 64
+)
+
+var (
+	ErrSessionClosed = errors.New("mux session closed")
+	ErrStreamClosed  = errors.New("mux stream closed")
+	ErrStreamReset   = errors.New("mux stream reset by peer")
+)
+
+// MuxPacket 多路复用帧数据包
+type MuxPacket struct {
+	data []byte
+}
+
+func (p *MuxPacket) Read(v interface{}) (n int, err error) {
+	if b, ok := v.(*[]byte); ok {
+		*b = append(*b, p.data...)
+		return len(p.data), nil
+	}
+	return 0, ErrInvalidPacket
+}
+
+func (p *MuxPacket) Write(v interface{}) (n int, err error) {
+	if b, ok := v.([]byte); ok {
+		p.data = append(p.data, b...)
+		return len(b), nil
+	}
+	return 0, ErrInvalidPacket
+}
+
+func (p *MuxPacket) Bytes() []byte {
+	header := EncodeHeader(MuxType, uint32(len(p.data)))
+	return append(header, p.data...)
+}
+
+func (p *MuxPacket) PacketSize() int {
+	return HeaderSize + len(p.data)
+}
+
+func (p *MuxPacket) PacketType() PacketType {
+	return MuxType
+}
+
+func (p *MuxPacket) Clear() {
+	p.data = p.data[:0]
+}
+
+// MuxCreator 多路复用帧创建器
+type MuxCreator struct{}
+
+func (c *MuxCreator) NewPacket() Packet {
+	return &MuxPacket{
+		data: make([]byte, 0),
+	}
+}
+
+func (c *MuxCreator) PacketType() PacketType {
+	return MuxType
+}
+
+// MuxConn 多路复用会话的底层连接，WritePacket 需要支持并发调用
+type MuxConn interface {
+	WritePacket(packet Packet) error
+	LocalAddr() net.Addr
+	RemoteAddr() net.Addr
+}
+
+// Session 在一条连接上复用多个双向字节流
+// 会话不负责读取底层连接，由连接的读取方把收到的 MuxType 数据包交给 HandlePacket，
+// 因此同一连接上可以同时传输其它类型的数据包
+type Session struct {
+	conn    MuxConn
+	mu      sync.Mutex
+	nextID  uint32
+	streams map[uint32]*Stream
+	accept  chan *Stream
+
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// NewSession 创建多路复用会话，连接两端的 client 必须不同
+// client 一端打开的流使用奇数ID，另一端使用偶数ID，避免同时打开时冲突
+func NewSession(conn MuxConn, client bool) *Session {
+	s := &Session{
+		conn:    conn,
+		nextID:  2,
+		streams: make(map[uint32]*Stream),
+		accept:  make(chan *Stream, muxAcceptBacklog),
+		closed:  make(chan struct{}),
+	}
+	if client {
+		s.nextID = 1
+	}
+	return s
+}
+
+// OpenStream 打开一个新的流，不等待对方确认
+func (s *Session) OpenStream() (*Stream, error) {
+	s.mu.Lock()
+	select {
+	case <-s.closed:
+		s.mu.Unlock()
+		return nil, ErrSessionClosed
+	default:
+	}
+	id := s.nextID
+	s.nextID += 2
+	stream := newStream(s, id)
+	s.streams[id] = stream
+	s.mu.Unlock()
+
+	if err := s.writeFrame(muxSYN, id, nil); err != nil {
+		s.removeStream(id)
+		return nil, err
+	}
+	return stream, nil
+}
+
+// AcceptStream 等待对方打开的流
+func (s *Session) AcceptStream() (*Stream, error) {
+	select {
+	case stream := <-s.accept:
+		return stream, nil
+	case <-s.closed:
+		return nil, ErrSessionClosed
+	}
+}
+
+// NumStreams 返回当前打开的流数量
+func (s *Session) NumStreams() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.streams)
+}
+
+// Close 关闭会话，所有流的读写随之失败，不关闭底层连接
+func (s *Session) Close() error {
+	s.closeOnce.Do(func() {
+		s.mu.Lock()
+		close(s.closed)
+		streams := s.streams
+		s.streams = make(map[uint32]*Stream)
+		s.mu.Unlock()
+		for _, stream := range streams {
+			stream.notifyRead()
+			stream.notifyWrite()
+		}
+	})
+	return nil
+}
+
+// IsClosed 会话是否已关闭
+func (s *Session) IsClosed() bool {
+	select {
+	case <-s.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// HandlePacket 处理对方发来的多路复用帧，不会阻塞等待流的读取方
+func (s *Session) HandlePacket(packet Packet) error {
+	if packet.PacketType() != MuxType {
+		return ErrUnsupportedType
+	}
+	var frame []byte
+	if _, err := packet.Read(&frame); err != nil {
+		return err
+	}
+	if len(frame) < muxFrameHeaderSize {
+		return ErrInvalidPacket
+	}
+	cmd := frame[0]
+	id := binary.BigEndian.Uint32(frame[1:muxFrameHeaderSize])
+	data := frame[muxFrameHeaderSize:]
+
+	if cmd == muxSYN {
+		return s.handleSYN(id)
+	}
+	s.mu.Lock()
+	stream, ok := s.streams[id]
+	s.mu.Unlock()
+	if !ok {
+		// 本端已关闭的流，通知对方停止发送
+		if cmd == muxData {
+			go s.writeFrame(muxRST, id, nil)
+		}
+		return nil
+	}
+
+	switch cmd {
+	case muxData:
+		if !stream.receive(data) {
+			// 对方超出窗口发送，终止该流
+			stream.reset()
+			go s.writeFrame(muxRST, id, nil)
+		}
+	case muxWindow:
+		if len(data) != 4 {
+			return ErrInvalidPacket
+		}
+		if !stream.grow(binary.BigEndian.Uint32(data)) {
+			// 对方归还的窗口超过了本端可用的最大窗口，终止该流
+			stream.reset()
+			go s.writeFrame(muxRST, id, nil)
+		}
+	case muxFIN:
+		stream.remoteClose()
+	case muxRST:
+		stream.reset()
+	default:
+		return ErrInvalidPacket
+	}
+	return nil
+}
+
+func (s *Session) handleSYN(id uint32) error {
+	s.mu.Lock()
+	if s.IsClosed() {
+		s.mu.Unlock()
+		return ErrSessionClosed
+	}
+	// 对方只能使用与本端奇偶性不同的ID
+	if _, exists := s.streams[id]; exists || id%2 == s.nextID%2 {
+		s.mu.Unlock()
+		go s.writeFrame(muxRST, id, nil)
+		return nil
+	}
+	stream := newStream(s, id)
+	select {
+	case s.accept <- stream:
+		s.streams[id] = stream
+		s.mu.Unlock()
+	default:
+		// 等待接受的流过多，拒绝新的流
+		s.mu.Unlock()
+		go s.writeFrame(muxRST, id, nil)
+	}
+	return nil
+}
+
+func (s *Session) removeStream(id uint32) {
+	s.mu.Lock()
+	delete(s.streams, id)
+	s.mu.Unlock()
+}
+
+func (s *Session) writeFrame(cmd byte, id uint32, data []byte) error {
+	if s.IsClosed() {
+		return ErrSessionClosed
+	}
+	packet := &MuxPacket{data: make([]byte, muxFrameHeaderSize, muxFrameHeaderSize+len(data))}
+	packet.data[0] = cmd
+	binary.BigEndian.PutUint32(packet.data[1:], id)
+	packet.data = append(packet.data, data...)
+	return s.conn.WritePacket(packet)
+}
+
+// Stream 多路复用流，实现 net.Conn
+type Stream struct {
+	id      uint32
+	session *Session
+
+	mu         sync.Mutex
+	buf        bytes.Buffer
+	consumed   uint32 // 已读取但尚未通知对方的字节数
+	sendWindow uint32
+	localFin   bool // 本端已发送 FIN
+	remoteFin  bool // 对方已发送 FIN
+	closed     bool
+	rst        bool
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+	readCh        chan struct{}
+	writeCh       chan struct{}
+}
+
+func newStream(session *Session, id uint32) *Stream {
+	return &Stream{
+		id:         id,
+		session:    session,
+		sendWindow: MuxWindowSize,
+		readCh:     make(chan struct{}, 1),
+		writeCh:    make(chan struct{}, 1),
+	}
+}
+
+// ID 返回流ID
+func (s *Stream) ID() uint32 {
+	return s.id
+}
+
+// Read 读取对方发来的数据，对方关闭写入后返回 io.EOF
+func (s *Stream) Read(b []byte) (int, error) {
+	for {
+		s.mu.Lock()
+		if s.buf.Len() > 0 {
+			n, _ := s.buf.Read(b)
+			// 读取过半个窗口后再通知对方，减少窗口更新帧
+			s.consumed += uint32(n)
+			delta := uint32(0)
+			if s.consumed >= MuxWindowSize/2 {
+				delta, s.consumed = s.consumed, 0
+			}
+			s.mu.Unlock()
+			if delta > 0 {
+				update := make([]byte, 4)
+				binary.BigEndian.PutUint32(update, delta)
+				s.session.writeFrame(muxWindow, s.id, update)
+			}
+			return n, nil
+		}
+		err := s.readErr()
+		deadline := s.readDeadline
+		s.mu.Unlock()
+		if err != nil {
+			return 0, err
+		}
+		if err := s.wait(s.readCh, deadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (s *Stream) readErr() error {
+	switch {
+	case s.closed:
+		return ErrStreamClosed
+	case s.remoteFin:
+		return io.EOF
+	case s.rst:
+		return ErrStreamReset
+	case s.session.IsClosed():
+		return ErrSessionClosed
+	}
+	return nil
+}
+
+// Write 在对方的接收窗口内发送数据，窗口用尽时阻塞等待窗口更新
+func (s *Stream) Write(b []byte) (int, error) {
+	total := 0
+	for len(b) > 0 {
+		s.mu.Lock()
+		var err error
+		switch {
+		case s.closed || s.localFin:
+			err = ErrStreamClosed
+		case s.rst:
+			err = ErrStreamReset
+		case s.session.IsClosed():
+			err = ErrSessionClosed
+		}
+		if err != nil {
+			s.mu.Unlock()
+			return total, err
+		}
+		if s.sendWindow == 0 {
+			deadline := s.writeDeadline
+			s.mu.Unlock()
+			if err := s.wait(s.writeCh, deadline); err != nil {
+				return total, err
+			}
+			continue
+		}
+		n := len(b)
+		if n > MuxFrameSize {
+			n = MuxFrameSize
+		}
+		if uint32(n) > s.sendWindow {
+			n = int(s.sendWindow)
+		}
+		s.sendWindow -= uint32(n)
+		s.mu.Unlock()
+
+		if err := s.session.writeFrame(muxData, s.id, b[:n]); err != nil {
+			return total, err
+		}
+		total += n
+		b = b[n:]
+	}
+	return total, nil
+}
+
+// wait 等待通知、会话关闭或超时
+func (s *Stream) wait(ch chan struct{}, deadline time.Time) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return os.ErrDeadlineExceeded
+		}
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-ch:
+		return nil
+	case <-s.session.closed:
+		return nil
+	case <-timeout:
+		return os.ErrDeadlineExceeded
+	}
+}
+
+// CloseWrite 关闭写入方向，对方读完已发送的数据后得到 io.EOF
+func (s *Stream) CloseWrite() error {
+	s.mu.Lock()
+	if s.localFin || s.rst {
+		s.mu.Unlock()
+		return nil
+	}
+	s.localFin = true
+	done := s.remoteFin
+	s.mu.Unlock()
+
+	if done {
+		s.session.removeStream(s.id)
+	}
+	s.notifyWrite()
+	return s.session.writeFrame(muxFIN, s.id, nil)
+}
+
+// Close 关闭流，之后收到的数据会被丢弃并通知对方终止
+func (s *Stream) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	sendFin := !s.localFin && !s.rst
+	s.localFin = true
+	s.buf.Reset()
+	s.mu.Unlock()
+
+	s.session.removeStream(s.id)
+	s.notifyRead()
+	s.notifyWrite()
+	if sendFin {
+		return s.session.writeFrame(muxFIN, s.id, nil)
+	}
+	return nil
+}
+
+func (s *Stream) receive(data []byte) bool {
+	s.mu.Lock()
+	if s.buf.Len()+len(data) > MuxWindowSize {
+		s.mu.Unlock()
+		return false
+	}
+	s.buf.Write(data)
+	s.mu.Unlock()
+	s.notifyRead()
+	return true
+}
+
+// grow 增加发送窗口，增加后超过 MuxWindowSize 时返回 false
+func (s *Stream) grow(delta uint32) bool {
+	s.mu.Lock()
+	if uint64(s.sendWindow)+uint64(delta) > MuxWindowSize {
+		s.mu.Unlock()
+		return false
+	}
+	s.sendWindow += delta
+	s.mu.Unlock()
+	s.notifyWrite()
+	return true
+}
+
+func (s *Stream) remoteClose() {
+	s.mu.Lock()
+	s.remoteFin = true
+	done := s.localFin
+	s.mu.Unlock()
+	if done {
+		s.session.removeStream(s.id)
+	}
+	s.notifyRead()
+}
+
+func (s *Stream) reset() {
+	s.mu.Lock()
+	s.rst = true
+	s.mu.Unlock()
+	s.session.removeStream(s.id)
+	s.notifyRead()
+	s.notifyWrite()
+}
+
+func (s *Stream) notifyRead() {
+	select {
+	case s.readCh <- struct{}{}:
+	default:
+	}
+}
+
+func (s *Stream) notifyWrite() {
+	select {
+	case s.writeCh <- struct{}{}:
+	default:
+	}
+}
+
+func (s *Stream) LocalAddr() net.Addr {
+	return s.session.conn.LocalAddr()
+}
+
+func (s *Stream) RemoteAddr() net.Addr {
+	return s.session.conn.RemoteAddr()
+}
+
+func (s *Stream) SetDeadline(t time.Time) error {
+	s.SetReadDeadline(t)
+	return s.SetWriteDeadline(t)
+}
+
+func (s *Stream) SetReadDeadline(t time.Time) error {
+	s.mu.Lock()
+	s.readDeadline = t
+	s.mu.Unlock()
+	s.notifyRead()
+	return nil
+}
+
+func (s *Stream) SetWriteDeadline(t time.Time) error {
+	s.mu.Lock()
+	s.writeDeadline = t
+	s.mu.Unlock()
+	s.notifyWrite()
+	return nil
+}
@@ -0,0 +1,180 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// pipeConn 测试用的底层连接，读取协程把 MuxType 数据包交给会话
+type pipeConn struct {
+	net.Conn
+	pio *PacketIO
+	wmu sync.Mutex
+}
+
+func (c *pipeConn) WritePacket(packet Packet) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	return c.pio.WritePacket(packet)
+}
+
+func newSessionPair(t *testing.T) (*Session, *Session) {
+	a, b := net.Pipe()
+	serve := func(conn net.Conn, client bool) *Session {
+		pc := &pipeConn{Conn: conn, pio: NewPacketIO(conn, conn)}
+		session := NewSession(pc, client)
+		go func() {
+			defer session.Close()
+			for {
+				packet, err := pc.pio.ReadPacket()
+				if err != nil {
+					return
+				}
+				session.HandlePacket(packet)
+			}
+		}()
+		t.Cleanup(func() { conn.Close() })
+		return session
+	}
+	return serve(a, true), serve(b, false)
+}
+
+func TestSessionConcurrentStreams(t *testing.T) {
+	client, server := newSessionPair(t)
+
+	// 服务端回显所有流
+	go func() {
+		for {
+			stream, err := server.AcceptStream()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer stream.Close()
+				io.Copy(stream, stream)
+			}()
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			stream, err := client.OpenStream()
+			require.NoError(t, err)
+			defer stream.Close()
+			assert.Equal(t, uint32(1), stream.ID()%2)
+
+			// 超过接收窗口的数据需要依靠窗口更新才能发完
+			data := bytes.Repeat([]byte{byte('a' + i)}, 3*MuxWindowSize)
+			go func() {
+				stream.Write(data)
+				stream.CloseWrite()
+			}()
+			stream.SetReadDeadline(time.Now().Add(10 * time.Second))
+			received, err := io.ReadAll(stream)
+			require.NoError(t, err)
+			assert.Equal(t, data, received)
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestStreamFlowControl(t *testing.T) {
+	client, server := newSessionPair(t)
+
+	stream, err := client.OpenStream()
+	require.NoError(t, err)
+	remote, err := server.AcceptStream()
+	require.NoError(t, err)
+
+	// 对方不读取时，最多只能写入一个窗口
+	stream.SetWriteDeadline(time.Now().Add(200 * time.Millisecond))
+	n, err := stream.Write(make([]byte, 2*MuxWindowSize))
+	assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+	assert.Equal(t, MuxWindowSize, n)
+
+	// 读取后窗口恢复
+	stream.SetWriteDeadline(time.Time{})
+	done := make(chan error, 1)
+	go func() {
+		_, err := stream.Write(make([]byte, MuxWindowSize))
+		done <- err
+	}()
+	_, err = io.ReadFull(remote, make([]byte, 2*MuxWindowSize))
+	require.NoError(t, err)
+	require.NoError(t, <-done)
+
+	// 读取超时
+	remote.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	_, err = remote.Read(make([]byte, 1))
+	var netErr net.Error
+	require.True(t, errors.As(err, &netErr))
+	assert.True(t, netErr.Timeout())
+}
+
+func TestStreamWindowOverflow(t *testing.T) {
+	client, server := newSessionPair(t)
+
+	stream, err := client.OpenStream()
+	require.NoError(t, err)
+	remote, err := server.AcceptStream()
+	require.NoError(t, err)
+
+	// 发送窗口已满时对方仍归还窗口，累加后会溢出，终止该流
+	update := make([]byte, 4)
+	binary.BigEndian.PutUint32(update, math.MaxUint32)
+	require.NoError(t, server.writeFrame(muxWindow, remote.ID(), update))
+
+	require.Eventually(t, func() bool {
+		_, err := stream.Write([]byte("data"))
+		return errors.Is(err, ErrStreamReset)
+	}, 2*time.Second, 10*time.Millisecond)
+	require.Eventually(t, func() bool {
+		_, err := remote.Write([]byte("data"))
+		return errors.Is(err, ErrStreamReset)
+	}, 2*time.Second, 10*time.Millisecond)
+	assert.Equal(t, 0, client.NumStreams())
+}
+
+func TestStreamClose(t *testing.T) {
+	client, server := newSessionPair(t)
+
+	stream, err := client.OpenStream()
+	require.NoError(t, err)
+	remote, err := server.AcceptStream()
+	require.NoError(t, err)
+
+	// 关闭后对方读到 EOF，继续写入会被对方终止
+	_, err = stream.Write([]byte("bye"))
+	require.NoError(t, err)
+	require.NoError(t, stream.Close())
+	received, err := io.ReadAll(remote)
+	require.NoError(t, err)
+	assert.Equal(t, "bye", string(received))
+
+	require.Eventually(t, func() bool {
+		_, err := remote.Write([]byte("late"))
+		return errors.Is(err, ErrStreamReset)
+	}, 2*time.Second, 10*time.Millisecond)
+	assert.Equal(t, 0, client.NumStreams())
+
+	// 会话关闭后不能再打开或接受流
+	client.Close()
+	_, err = client.OpenStream()
+	assert.ErrorIs(t, err, ErrSessionClosed)
+	_, err = client.AcceptStream()
+	assert.ErrorIs(t, err, ErrSessionClosed)
+}
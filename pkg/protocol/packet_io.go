@@ -75,7 +75,7 @@ func ReceivePacket(r io.Reader) (Packet, error) {
 			return nil, err
 		}
 		// 其他错误处理
-		return nil, fmt.Errorf("read packet error: %v", err)
+		return nil, fmt.Errorf("read packet error: %w", err)
 	}
 	return packet, nil
 }
@@ -84,6 +84,7 @@ func init() {
 	// 注册默认的协议创建器
 	RegisterCreator(&BytesCreator{})
 	RegisterCreator(&JSONCreator{})
+	RegisterCreator(&MuxCreator{})
 }
 
 // PacketIO 包装了读写操作
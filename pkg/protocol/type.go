@@ -10,6 +10,7 @@ type PacketType uint8
 const (
 	BytesType PacketType = iota
 	JsonType
+	MuxType // 多路复用帧，见 Session
 )
 
 // Packet 定义数据包接口
@@ -43,6 +44,8 @@ func (t PacketType) String() string {
 		return "bytes"
 	case JsonType:
 		return "json"
+	case MuxType:
+		return "mux"
 	default:
 		return "unknown"
 	}
@@ -0,0 +1,282 @@
+/*
+	Endpoint 在单个 UDP 套接字上复用以下流量：
+	1. 与打洞服务器之间的绑定请求，用于获取公网（反射）地址
+	2. 与对等端之间的同时探测（打洞）
+	3. 打洞成功后的可靠会话数据
+*/
+
+package punch
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/liuscraft/spider-network/pkg/xlog"
+)
+
+const (
+	probeInterval = 100 * time.Millisecond
+	bindInterval  = 300 * time.Millisecond
+	maxDatagram   = 64 * 1024
+)
+
+// Endpoint UDP 打洞端点
+type Endpoint struct {
+	pc      net.PacketConn
+	localID string
+	xl      xlog.Logger
+
+	mu       sync.Mutex
+	sessions map[string]*Session    // 远端地址 -> 会话
+	binds    map[uint32]chan string // 绑定事务 -> 观察到的地址
+	bindings map[uint32]chan *BindingResponse
+	punches  map[string]chan net.Addr // 对等端ID -> 探测确认地址
+
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// NewEndpoint 创建打洞端点并开始读取数据报
+func NewEndpoint(pc net.PacketConn, localID string) *Endpoint {
+	e := &Endpoint{
+		pc:       pc,
+		localID:  localID,
+		xl:       xlog.New(),
+		sessions: make(map[string]*Session),
+		binds:    make(map[uint32]chan string),
+		bindings: make(map[uint32]chan *BindingResponse),
+		punches:  make(map[string]chan net.Addr),
+		closed:   make(chan struct{}),
+	}
+	go e.readLoop()
+	return e
+}
+
+// LocalAddr 返回本地监听地址
+func (e *Endpoint) LocalAddr() net.Addr {
+	return e.pc.LocalAddr()
+}
+
+// Bind 向服务器发送绑定请求，返回服务器观察到的本端地址，token 为注册时获得的绑定令牌
+func (e *Endpoint) Bind(ctx context.Context, server net.Addr, token string) (string, error) {
+	txn := rand.Uint32()
+	ch := make(chan string, 1)
+
+	e.mu.Lock()
+	e.binds[txn] = ch
+	e.mu.Unlock()
+	defer func() {
+		e.mu.Lock()
+		delete(e.binds, txn)
+		e.mu.Unlock()
+	}()
+
+	req := EncodeBind(txn, e.localID, token)
+	ticker := time.NewTicker(bindInterval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := e.pc.WriteTo(req, server); err != nil {
+			e.xl.Debugf("send bind request to %s error: %v", server, err)
+		}
+		select {
+		case addr := <-ch:
+			return addr, nil
+		case <-ticker.C:
+		case <-ctx.Done():
+			return "", ErrBindTimeout
+		case <-e.closed:
+			return "", net.ErrClosed
+		}
+	}
+}
+
+// Punch 向对等端的候选地址同时发送探测，直到收到对方的确认
+// 双方需要同时调用 Punch，收到确认说明双向路径均已打通
+func (e *Endpoint) Punch(ctx context.Context, peerID string, candidates []string) (*Session, error) {
+	addrs := make([]net.Addr, 0, len(candidates))
+	for _, candidate := range candidates {
+		addr, err := net.ResolveUDPAddr("udp", candidate)
+		if err != nil {
+			e.xl.Warnf("resolve candidate %s of %s error: %v", candidate, peerID, err)
+			continue
+		}
+		addrs = append(addrs, addr)
+	}
+	if len(addrs) == 0 {
+		return nil, ErrPunchTimeout
+	}
+
+	ch := make(chan net.Addr, 1)
+	e.mu.Lock()
+	e.punches[peerID] = ch
+	e.mu.Unlock()
+	defer func() {
+		e.mu.Lock()
+		if e.punches[peerID] == ch {
+			delete(e.punches, peerID)
+		}
+		e.mu.Unlock()
+	}()
+
+	probe := encodeProbe(KindProbe, e.localID, peerID)
+	ticker := time.NewTicker(probeInterval)
+	defer ticker.Stop()
+
+	for {
+		for _, addr := range addrs {
+			e.pc.WriteTo(probe, addr)
+		}
+		select {
+		case addr := <-ch:
+			e.xl.Infof("punched path to %s via %s", peerID, addr)
+			return e.session(addr, peerID), nil
+		case <-ticker.C:
+		case <-ctx.Done():
+			return nil, ErrPunchTimeout
+		case <-e.closed:
+			return nil, net.ErrClosed
+		}
+	}
+}
+
+// session 获取或创建到指定地址的会话
+func (e *Endpoint) session(addr net.Addr, peerID string) *Session {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if s, ok := e.sessions[addr.String()]; ok {
+		return s
+	}
+	s := newSession(e, addr, peerID)
+	e.sessions[addr.String()] = s
+	return s
+}
+
+func (e *Endpoint) removeSession(s *Session) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.sessions[s.remote.String()] == s {
+		delete(e.sessions, s.remote.String())
+	}
+}
+
+func (e *Endpoint) writeTo(b []byte, addr net.Addr) error {
+	_, err := e.pc.WriteTo(b, addr)
+	return err
+}
+
+func (e *Endpoint) readLoop() {
+	buf := make([]byte, maxDatagram)
+	for {
+		n, addr, err := e.pc.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-e.closed:
+				return
+			default:
+			}
+			if errors.Is(err, net.ErrClosed) {
+				e.Close()
+				return
+			}
+			e.xl.Debugf("read datagram error: %v", err)
+			continue
+		}
+		if n == 0 {
+			continue
+		}
+		e.dispatch(buf[:n], addr)
+	}
+}
+
+func (e *Endpoint) dispatch(b []byte, addr net.Addr) {
+	switch b[0] {
+	case KindBindAck:
+		txn, observed, err := DecodeBindAck(b)
+		if err != nil {
+			return
+		}
+		e.mu.Lock()
+		ch, ok := e.binds[txn]
+		e.mu.Unlock()
+		if ok {
+			select {
+			case ch <- observed:
+			default:
+			}
+		}
+	case KindBindingResp:
+		resp, err := DecodeBindingResponse(b)
+		if err != nil {
+			return
+		}
+		e.mu.Lock()
+		ch, ok := e.bindings[resp.Txn]
+		e.mu.Unlock()
+		if ok {
+			select {
+			case ch <- resp:
+			default:
+			}
+		}
+	case KindProbe:
+		from, to, err := decodeProbe(b)
+		if err != nil || to != e.localID {
+			return
+		}
+		e.pc.WriteTo(encodeProbe(KindProbeAck, e.localID, from), addr)
+
+		// 正在向该对等端打洞时，把探测来源作为新的候选地址（对端反射地址）
+		e.mu.Lock()
+		_, punching := e.punches[from]
+		e.mu.Unlock()
+		if punching {
+			e.pc.WriteTo(encodeProbe(KindProbe, e.localID, from), addr)
+		}
+	case KindProbeAck:
+		from, to, err := decodeProbe(b)
+		if err != nil || to != e.localID {
+			return
+		}
+		e.mu.Lock()
+		ch, ok := e.punches[from]
+		e.mu.Unlock()
+		if ok {
+			select {
+			case ch <- addr:
+			default:
+			}
+		}
+	case KindData, KindAck, KindPing, KindClose:
+		e.mu.Lock()
+		s, ok := e.sessions[addr.String()]
+		e.mu.Unlock()
+		if ok {
+			s.handleDatagram(b)
+		}
+	}
+}
+
+// Close 关闭端点及其所有会话
+func (e *Endpoint) Close() error {
+	var err error
+	e.closeOnce.Do(func() {
+		close(e.closed)
+		err = e.pc.Close()
+
+		e.mu.Lock()
+		sessions := make([]*Session, 0, len(e.sessions))
+		for _, s := range e.sessions {
+			sessions = append(sessions, s)
+		}
+		e.mu.Unlock()
+		for _, s := range sessions {
+			s.fail(net.ErrClosed)
+		}
+	})
+	return err
+}
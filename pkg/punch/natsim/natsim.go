@@ -0,0 +1,232 @@
+/*
+	natsim 用户态 NAT 模拟器，用于在单机上测试打洞
+	内部连接的私有地址位于 192.0.2.0/24（TEST-NET-1），外部不可达；
+	所有出站流量经由 127.0.0.1 上的映射套接字转发，并按 NAT 类型过滤入站流量
+*/
+
+package natsim
+
+import (
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Type NAT 类型
+type Type int
+
+const (
+	FullCone           Type = iota // 任意外部地址均可通过映射访问
+	RestrictedCone                 // 仅允许内部主动发送过的 IP
+	PortRestrictedCone             // 仅允许内部主动发送过的 IP:端口
+	Symmetric                      // 每个目的地址使用独立映射
+)
+
+func (t Type) String() string {
+	switch t {
+	case FullCone:
+		return "full-cone"
+	case RestrictedCone:
+		return "restricted-cone"
+	case PortRestrictedCone:
+		return "port-restricted-cone"
+	case Symmetric:
+		return "symmetric"
+	default:
+		return "unknown"
+	}
+}
+
+var (
+	privateNet  = &net.IPNet{IP: net.IPv4(192, 0, 2, 0), Mask: net.CIDRMask(24, 32)}
+	privatePort atomic.Uint32
+)
+
+func init() {
+	privatePort.Store(40000)
+}
+
+type datagram struct {
+	data []byte
+	from net.Addr
+}
+
+// NAT 模拟的 NAT 设备
+type NAT struct {
+	typ  Type
+	loss float64
+}
+
+// New 创建指定类型的 NAT，loss 为出站丢包率（0 表示不丢包）
+func New(typ Type, loss float64) *NAT {
+	return &NAT{typ: typ, loss: loss}
+}
+
+// ListenPacket 在 NAT 内部创建一个 UDP 连接
+func (n *NAT) ListenPacket() (net.PacketConn, error) {
+	return &insideConn{
+		nat: n,
+		private: &net.UDPAddr{
+			IP:   net.IPv4(192, 0, 2, 1),
+			Port: int(privatePort.Add(1)),
+		},
+		mappings: make(map[string]*net.UDPConn),
+		permits:  make(map[string]bool),
+		readCh:   make(chan datagram, 1024),
+		closed:   make(chan struct{}),
+	}, nil
+}
+
+// insideConn NAT 内部的 UDP 连接
+type insideConn struct {
+	nat     *NAT
+	private *net.UDPAddr
+
+	mu       sync.Mutex
+	mappings map[string]*net.UDPConn // 映射键 -> 外部套接字
+	permits  map[string]bool         // 允许的入站来源
+	deadline time.Time
+
+	readCh    chan datagram
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// mappingKey 端点无关映射共用一个外部套接字，对称 NAT 按目的地址区分
+func (c *insideConn) mappingKey(dst *net.UDPAddr) string {
+	if c.nat.typ == Symmetric {
+		return dst.String()
+	}
+	return ""
+}
+
+// permitKey 入站过滤所使用的键
+func (c *insideConn) permitKey(src *net.UDPAddr) string {
+	switch c.nat.typ {
+	case RestrictedCone:
+		return src.IP.String()
+	case PortRestrictedCone, Symmetric:
+		return src.String()
+	default:
+		return ""
+	}
+}
+
+func (c *insideConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	dst, err := net.ResolveUDPAddr("udp", addr.String())
+	if err != nil {
+		return 0, err
+	}
+	select {
+	case <-c.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+
+	// 私有网段不可达
+	if privateNet.Contains(dst.IP) {
+		return len(b), nil
+	}
+
+	c.mu.Lock()
+	key := c.mappingKey(dst)
+	ext, ok := c.mappings[key]
+	if !ok {
+		ext, err = net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			c.mu.Unlock()
+			return 0, err
+		}
+		c.mappings[key] = ext
+		go c.forward(ext, dst)
+	}
+	c.permits[c.permitKey(dst)] = true
+	c.mu.Unlock()
+
+	if c.nat.loss > 0 && rand.Float64() < c.nat.loss {
+		return len(b), nil
+	}
+	return ext.WriteTo(b, dst)
+}
+
+// forward 将外部套接字收到的数据按过滤规则转发给内部连接
+func (c *insideConn) forward(ext *net.UDPConn, dst *net.UDPAddr) {
+	buf := make([]byte, 64*1024)
+	for {
+		n, src, err := ext.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+
+		c.mu.Lock()
+		allowed := c.permits[c.permitKey(src)]
+		c.mu.Unlock()
+		if c.nat.typ == Symmetric {
+			allowed = src.String() == dst.String()
+		}
+		if !allowed {
+			continue
+		}
+
+		select {
+		case c.readCh <- datagram{data: append([]byte(nil), buf[:n]...), from: src}:
+		default:
+		}
+	}
+}
+
+func (c *insideConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	c.mu.Lock()
+	deadline := c.deadline
+	c.mu.Unlock()
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case d := <-c.readCh:
+		return copy(b, d.data), d.from, nil
+	case <-c.closed:
+		return 0, nil, net.ErrClosed
+	case <-timeout:
+		return 0, nil, os.ErrDeadlineExceeded
+	}
+}
+
+func (c *insideConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.mu.Lock()
+		for _, ext := range c.mappings {
+			ext.Close()
+		}
+		c.mu.Unlock()
+	})
+	return nil
+}
+
+func (c *insideConn) LocalAddr() net.Addr {
+	return c.private
+}
+
+func (c *insideConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *insideConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.deadline = t
+	return nil
+}
+
+func (c *insideConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
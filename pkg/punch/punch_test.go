@@ -0,0 +1,146 @@
+package punch
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/liuscraft/spider-network/pkg/punch/natsim"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startBindServer 启动一个只应答绑定请求的服务器
+func startBindServer(t *testing.T) net.PacketConn {
+	pc, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			txn, _, _, err := DecodeBind(buf[:n])
+			if err != nil {
+				continue
+			}
+			pc.WriteTo(EncodeBindAck(txn, addr.String()), addr)
+		}
+	}()
+	return pc
+}
+
+func newNATEndpoint(t *testing.T, typ natsim.Type, loss float64, id string) *Endpoint {
+	pc, err := natsim.New(typ, loss).ListenPacket()
+	require.NoError(t, err)
+	return NewEndpoint(pc, id)
+}
+
+func bind(t *testing.T, e *Endpoint, server net.PacketConn) string {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	addr, err := e.Bind(ctx, server.LocalAddr(), "")
+	require.NoError(t, err)
+	return addr
+}
+
+// punchPair 双方同时打洞，返回各自的会话
+func punchPair(a, b *Endpoint, aCandidates, bCandidates []string, timeout time.Duration) (*Session, *Session, error, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	type result struct {
+		s   *Session
+		err error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		s, err := b.Punch(ctx, "a", aCandidates)
+		ch <- result{s, err}
+	}()
+	sa, errA := a.Punch(ctx, "b", bCandidates)
+	rb := <-ch
+	return sa, rb.s, errA, rb.err
+}
+
+func TestPunchThroughNAT(t *testing.T) {
+	server := startBindServer(t)
+	defer server.Close()
+
+	cases := []struct {
+		a, b    natsim.Type
+		success bool
+	}{
+		{natsim.FullCone, natsim.PortRestrictedCone, true},
+		{natsim.PortRestrictedCone, natsim.PortRestrictedCone, true},
+		{natsim.RestrictedCone, natsim.Symmetric, true},
+		{natsim.Symmetric, natsim.Symmetric, false},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.a.String()+"/"+tc.b.String(), func(t *testing.T) {
+			a := newNATEndpoint(t, tc.a, 0, "a")
+			defer a.Close()
+			b := newNATEndpoint(t, tc.b, 0, "b")
+			defer b.Close()
+
+			aCandidates := []string{bind(t, a, server), a.LocalAddr().String()}
+			bCandidates := []string{bind(t, b, server), b.LocalAddr().String()}
+
+			sa, sb, errA, errB := punchPair(a, b, aCandidates, bCandidates, time.Second)
+			if !tc.success {
+				assert.ErrorIs(t, errA, ErrPunchTimeout)
+				return
+			}
+			require.NoError(t, errA)
+			require.NoError(t, errB)
+			defer sa.Close()
+			defer sb.Close()
+
+			_, err := sa.Write([]byte("ping"))
+			require.NoError(t, err)
+			buf := make([]byte, 4)
+			sb.SetReadDeadline(time.Now().Add(time.Second))
+			_, err = io.ReadFull(sb, buf)
+			require.NoError(t, err)
+			assert.Equal(t, "ping", string(buf))
+		})
+	}
+}
+
+func TestSessionReliableTransfer(t *testing.T) {
+	server := startBindServer(t)
+	defer server.Close()
+
+	// 双方都有丢包，验证重传和乱序重组
+	a := newNATEndpoint(t, natsim.PortRestrictedCone, 0.1, "a")
+	defer a.Close()
+	b := newNATEndpoint(t, natsim.FullCone, 0.1, "b")
+	defer b.Close()
+
+	sa, sb, errA, errB := punchPair(a, b,
+		[]string{bind(t, a, server)}, []string{bind(t, b, server)}, 2*time.Second)
+	require.NoError(t, errA)
+	require.NoError(t, errB)
+
+	data := make([]byte, 256*1024)
+	rand.Read(data)
+
+	go func() {
+		sa.Write(data)
+		sa.Close()
+	}()
+
+	sb.SetReadDeadline(time.Now().Add(10 * time.Second))
+	received, err := io.ReadAll(sb)
+	require.NoError(t, err)
+	assert.Equal(t, len(data), len(received))
+	assert.True(t, bytes.Equal(data, received))
+	sb.Close()
+}
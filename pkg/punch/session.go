@@ -0,0 +1,321 @@
+package punch
+
+import (
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	segmentSize   = 1200 // 单个数据报最大负载，避免 IP 分片
+	windowSize    = 128  // 发送窗口（未确认的数据报数量）
+	retransmitRTO = 300 * time.Millisecond
+	maxRetries    = 20
+	tickInterval  = 50 * time.Millisecond
+	pingInterval  = 5 * time.Second
+	idleTimeout   = 30 * time.Second
+	lingerTimeout = 30 * time.Second
+)
+
+type segment struct {
+	seq     uint32
+	data    []byte
+	sentAt  time.Time
+	retries int
+}
+
+// Session 打洞成功后基于 UDP 的可靠有序字节流，实现 net.Conn
+// 使用累计确认和超时重传，适合承载 PacketIO 等流式协议
+type Session struct {
+	ep     *Endpoint
+	remote net.Addr
+	peerID string
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	sendSeq uint32
+	unacked []*segment
+	recvSeq uint32
+	ooo     map[uint32][]byte
+	readBuf []byte
+
+	lastRecv     time.Time
+	lastSend     time.Time
+	closing      bool
+	closingAt    time.Time
+	remoteClosed bool
+	closed       bool
+	err          error
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+func newSession(ep *Endpoint, remote net.Addr, peerID string) *Session {
+	now := time.Now()
+	s := &Session{
+		ep:       ep,
+		remote:   remote,
+		peerID:   peerID,
+		ooo:      make(map[uint32][]byte),
+		lastRecv: now,
+		lastSend: now,
+	}
+	s.cond = sync.NewCond(&s.mu)
+	go s.loop()
+	return s
+}
+
+// PeerID 返回会话对端的客户端ID
+func (s *Session) PeerID() string {
+	return s.peerID
+}
+
+func (s *Session) Read(b []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for len(s.readBuf) == 0 {
+		switch {
+		case s.closed && s.err != nil && !s.remoteClosed:
+			return 0, s.err
+		case s.remoteClosed:
+			return 0, io.EOF
+		case s.closing || s.closed:
+			return 0, net.ErrClosed
+		case deadlineExceeded(s.readDeadline):
+			return 0, os.ErrDeadlineExceeded
+		}
+		s.cond.Wait()
+	}
+
+	n := copy(b, s.readBuf)
+	s.readBuf = s.readBuf[n:]
+	return n, nil
+}
+
+func (s *Session) Write(b []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	written := 0
+	for written < len(b) {
+		for len(s.unacked) >= windowSize {
+			if err := s.writeErr(); err != nil {
+				return written, err
+			}
+			s.cond.Wait()
+		}
+		if err := s.writeErr(); err != nil {
+			return written, err
+		}
+
+		end := written + segmentSize
+		if end > len(b) {
+			end = len(b)
+		}
+		seg := &segment{
+			seq:    s.sendSeq,
+			data:   append([]byte(nil), b[written:end]...),
+			sentAt: time.Now(),
+		}
+		s.sendSeq++
+		s.unacked = append(s.unacked, seg)
+		s.send(encodeSeq(KindData, seg.seq, seg.data))
+		written = end
+	}
+	return written, nil
+}
+
+func (s *Session) writeErr() error {
+	switch {
+	case s.closed && s.err != nil:
+		return s.err
+	case s.closing || s.closed || s.remoteClosed:
+		return net.ErrClosed
+	case deadlineExceeded(s.writeDeadline):
+		return os.ErrDeadlineExceeded
+	}
+	return nil
+}
+
+// send 发送数据报，调用方需持有锁
+func (s *Session) send(b []byte) {
+	s.lastSend = time.Now()
+	s.ep.writeTo(b, s.remote)
+}
+
+func (s *Session) handleDatagram(b []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	s.lastRecv = time.Now()
+
+	switch b[0] {
+	case KindData:
+		seq, payload, err := decodeSeq(b)
+		if err != nil {
+			return
+		}
+		if seq == s.recvSeq {
+			s.readBuf = append(s.readBuf, payload...)
+			s.recvSeq++
+			for {
+				data, ok := s.ooo[s.recvSeq]
+				if !ok {
+					break
+				}
+				delete(s.ooo, s.recvSeq)
+				s.readBuf = append(s.readBuf, data...)
+				s.recvSeq++
+			}
+		} else if seqBefore(s.recvSeq, seq) && seq-s.recvSeq < 2*windowSize {
+			s.ooo[seq] = append([]byte(nil), payload...)
+		}
+		s.send(encodeSeq(KindAck, s.recvSeq, nil))
+	case KindAck:
+		ack, _, err := decodeSeq(b)
+		if err != nil {
+			return
+		}
+		i := 0
+		for i < len(s.unacked) && seqBefore(s.unacked[i].seq, ack) {
+			i++
+		}
+		s.unacked = s.unacked[i:]
+	case KindPing:
+		s.send(encodeSeq(KindAck, s.recvSeq, nil))
+	case KindClose:
+		s.remoteClosed = true
+		s.unacked = nil
+	}
+	s.cond.Broadcast()
+}
+
+// loop 负责超时重传、保活以及关闭时的数据排空
+func (s *Session) loop() {
+	ticker := time.NewTicker(tickInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			return
+		}
+		now := time.Now()
+
+		for _, seg := range s.unacked {
+			backoff := retransmitRTO << min(seg.retries, 4)
+			if now.Sub(seg.sentAt) < backoff {
+				continue
+			}
+			if seg.retries >= maxRetries {
+				s.mu.Unlock()
+				s.fail(ErrPeerTimeout)
+				return
+			}
+			seg.retries++
+			seg.sentAt = now
+			s.send(encodeSeq(KindData, seg.seq, seg.data))
+		}
+
+		if s.closing && (len(s.unacked) == 0 || s.remoteClosed || now.Sub(s.closingAt) > lingerTimeout) {
+			s.send([]byte{KindClose})
+			s.send([]byte{KindClose})
+			s.mu.Unlock()
+			s.fail(net.ErrClosed)
+			return
+		}
+
+		if now.Sub(s.lastRecv) > idleTimeout {
+			s.mu.Unlock()
+			s.fail(ErrPeerTimeout)
+			return
+		}
+		if now.Sub(s.lastSend) > pingInterval {
+			s.send([]byte{KindPing})
+		}
+		s.mu.Unlock()
+	}
+}
+
+// fail 终止会话并从端点移除
+func (s *Session) fail(err error) {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.closed = true
+	if err != net.ErrClosed {
+		s.err = err
+	}
+	s.cond.Broadcast()
+	s.mu.Unlock()
+
+	s.ep.removeSession(s)
+}
+
+// Close 关闭会话，未确认的数据会在后台继续重传直至确认或超时
+func (s *Session) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closing || s.closed {
+		return nil
+	}
+	s.closing = true
+	s.closingAt = time.Now()
+	s.cond.Broadcast()
+	return nil
+}
+
+func (s *Session) LocalAddr() net.Addr {
+	return s.ep.LocalAddr()
+}
+
+func (s *Session) RemoteAddr() net.Addr {
+	return s.remote
+}
+
+func (s *Session) SetDeadline(t time.Time) error {
+	s.SetReadDeadline(t)
+	return s.SetWriteDeadline(t)
+}
+
+func (s *Session) SetReadDeadline(t time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.readDeadline = t
+	s.wakeAt(t)
+	return nil
+}
+
+func (s *Session) SetWriteDeadline(t time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.writeDeadline = t
+	s.wakeAt(t)
+	return nil
+}
+
+// wakeAt 在截止时间到达时唤醒等待中的读写，调用方需持有锁
+func (s *Session) wakeAt(t time.Time) {
+	s.cond.Broadcast()
+	if t.IsZero() {
+		return
+	}
+	time.AfterFunc(time.Until(t), func() {
+		s.mu.Lock()
+		s.cond.Broadcast()
+		s.mu.Unlock()
+	})
+}
+
+func deadlineExceeded(t time.Time) bool {
+	return !t.IsZero() && !time.Now().Before(t)
+}
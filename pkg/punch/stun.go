@@ -0,0 +1,230 @@
+package punch
+
+import (
+	"context"
+	"encoding/binary"
+	"math/rand"
+	"net"
+	"strings"
+	"time"
+)
+
+// 类 STUN 的绑定请求，用于发现反射地址和判断 NAT 类型
+const (
+	KindBinding     byte = 0x03 // [kind][txn 4][flags 1]
+	KindBindingResp byte = 0x04 // [kind][txn 4][len 1][mapped addr][other addr]
+
+	FlagChangeAddr byte = 0x01 // 要求服务端从备用地址回复
+)
+
+const (
+	DefaultStunPort = 3478
+	bindingRetry    = 200 * time.Millisecond
+	bindingTimeout  = time.Second
+)
+
+// NATType NAT 类型
+type NATType string
+
+const (
+	NATUnknown        NATType = "unknown"
+	NATBlocked        NATType = "udp-blocked"          // UDP 不可用
+	NATOpen           NATType = "open"                 // 公网地址，无 NAT
+	NATFullCone       NATType = "full-cone"            // 完全锥形
+	NATRestrictedCone NATType = "restricted-cone"      // 地址受限锥形
+	NATPortRestricted NATType = "port-restricted-cone" // 端口受限锥形
+	NATSymmetric      NATType = "symmetric"            // 对称型
+)
+
+// BindingResponse 绑定响应
+type BindingResponse struct {
+	Txn        uint32
+	MappedAddr string // 服务端观察到的地址
+	OtherAddr  string // 服务端备用地址
+}
+
+// NATInfo NAT 探测结果
+type NATInfo struct {
+	Type       NATType
+	MappedAddr string
+}
+
+// EncodeBindingRequest 编码绑定请求
+func EncodeBindingRequest(txn uint32, flags byte) []byte {
+	buf := make([]byte, 6)
+	buf[0] = KindBinding
+	binary.BigEndian.PutUint32(buf[1:5], txn)
+	buf[5] = flags
+	return buf
+}
+
+// DecodeBindingRequest 解码绑定请求
+func DecodeBindingRequest(b []byte) (txn uint32, flags byte, err error) {
+	if len(b) < 6 || b[0] != KindBinding {
+		return 0, 0, ErrShortDatagram
+	}
+	return binary.BigEndian.Uint32(b[1:5]), b[5], nil
+}
+
+// EncodeBindingResponse 编码绑定响应
+func EncodeBindingResponse(resp *BindingResponse) []byte {
+	buf := make([]byte, 6+len(resp.MappedAddr)+len(resp.OtherAddr))
+	buf[0] = KindBindingResp
+	binary.BigEndian.PutUint32(buf[1:5], resp.Txn)
+	buf[5] = byte(len(resp.MappedAddr))
+	copy(buf[6:], resp.MappedAddr)
+	copy(buf[6+len(resp.MappedAddr):], resp.OtherAddr)
+	return buf
+}
+
+// DecodeBindingResponse 解码绑定响应
+func DecodeBindingResponse(b []byte) (*BindingResponse, error) {
+	if len(b) < 6 || b[0] != KindBindingResp || len(b) < 6+int(b[5]) {
+		return nil, ErrShortDatagram
+	}
+	n := 6 + int(b[5])
+	return &BindingResponse{
+		Txn:        binary.BigEndian.Uint32(b[1:5]),
+		MappedAddr: string(b[6:n]),
+		OtherAddr:  string(b[n:]),
+	}, nil
+}
+
+// DiscoverNAT 通过服务端的主、备两个地址探测 NAT 类型
+//  1. 向主地址请求，得到映射地址 M1；无响应说明 UDP 不可用
+//  2. 映射地址即本机地址，说明没有 NAT
+//  3. 要求主地址从备用地址回复，能收到说明过滤与端口无关
+//  4. 向备用地址请求得到 M2，M1 != M2 说明是对称型 NAT
+//
+// 主备地址 IP 相同时无法区分完全锥形与地址受限锥形，此时按地址受限锥形报告；
+// IP 不同时无法区分地址受限与端口受限，此时按端口受限报告
+func DiscoverNAT(ctx context.Context, e *Endpoint, server net.Addr) (*NATInfo, error) {
+	resp, err := e.bindingWithTimeout(ctx, server, 0)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return &NATInfo{Type: NATBlocked}, nil
+	}
+	info := &NATInfo{Type: NATUnknown, MappedAddr: resp.MappedAddr}
+
+	if isLocalAddr(resp.MappedAddr, e.LocalAddr()) {
+		info.Type = NATOpen
+		return info, nil
+	}
+
+	if resp.OtherAddr == "" {
+		return info, nil
+	}
+	other, err := net.ResolveUDPAddr("udp", resp.OtherAddr)
+	if err != nil {
+		return info, nil
+	}
+	// 备用地址监听在通配地址时，使用主地址的 IP
+	if other.IP == nil || other.IP.IsUnspecified() {
+		serverAddr, err := net.ResolveUDPAddr("udp", server.String())
+		if err != nil {
+			return info, nil
+		}
+		other.IP = serverAddr.IP
+	}
+	sameIP := sameHost(server.String(), other.String())
+
+	// 注意顺序：必须在向备用地址发送数据之前测试过滤行为
+	if _, err := e.bindingWithTimeout(ctx, server, FlagChangeAddr); err == nil {
+		if sameIP {
+			info.Type = NATRestrictedCone
+		} else {
+			info.Type = NATFullCone
+		}
+		return info, nil
+	}
+
+	resp2, err := e.bindingWithTimeout(ctx, other, 0)
+	if err != nil {
+		return info, nil
+	}
+	if resp2.MappedAddr != resp.MappedAddr {
+		info.Type = NATSymmetric
+	} else {
+		info.Type = NATPortRestricted
+	}
+	return info, nil
+}
+
+func (e *Endpoint) bindingWithTimeout(ctx context.Context, server net.Addr, flags byte) (*BindingResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, bindingTimeout)
+	defer cancel()
+	return e.Binding(ctx, server, flags)
+}
+
+// Binding 发送绑定请求并等待响应
+func (e *Endpoint) Binding(ctx context.Context, server net.Addr, flags byte) (*BindingResponse, error) {
+	txn := rand.Uint32()
+	ch := make(chan *BindingResponse, 1)
+
+	e.mu.Lock()
+	e.bindings[txn] = ch
+	e.mu.Unlock()
+	defer func() {
+		e.mu.Lock()
+		delete(e.bindings, txn)
+		e.mu.Unlock()
+	}()
+
+	req := EncodeBindingRequest(txn, flags)
+	ticker := time.NewTicker(bindingRetry)
+	defer ticker.Stop()
+
+	for {
+		e.pc.WriteTo(req, server)
+		select {
+		case resp := <-ch:
+			return resp, nil
+		case <-ticker.C:
+		case <-ctx.Done():
+			return nil, ErrBindTimeout
+		case <-e.closed:
+			return nil, net.ErrClosed
+		}
+	}
+}
+
+// isLocalAddr 判断映射地址是否为本机地址
+func isLocalAddr(mapped string, local net.Addr) bool {
+	mappedAddr, err := net.ResolveUDPAddr("udp", mapped)
+	if err != nil {
+		return false
+	}
+	localAddr, ok := local.(*net.UDPAddr)
+	if !ok || localAddr.Port != mappedAddr.Port {
+		return false
+	}
+	if !localAddr.IP.IsUnspecified() {
+		return localAddr.IP.Equal(mappedAddr.IP)
+	}
+
+	ifaceAddrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range ifaceAddrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(mappedAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+func sameHost(a, b string) bool {
+	hostA, _, errA := net.SplitHostPort(a)
+	hostB, _, errB := net.SplitHostPort(b)
+	if errA != nil || errB != nil {
+		return false
+	}
+	ipA, ipB := net.ParseIP(hostA), net.ParseIP(hostB)
+	if ipA != nil && ipB != nil {
+		return ipA.Equal(ipB)
+	}
+	return strings.EqualFold(hostA, hostB)
+}
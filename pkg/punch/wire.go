@@ -0,0 +1,102 @@
+package punch
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// 数据报类型，每个 UDP 数据报的首字节
+const (
+	KindBind     byte = 0x01 // 客户端 -> 服务端：绑定请求，服务端记录观察到的源地址
+	KindBindAck  byte = 0x02 // 服务端 -> 客户端：返回观察到的地址
+	KindProbe    byte = 0x10 // 对等端之间的打洞探测
+	KindProbeAck byte = 0x11 // 打洞探测确认
+	KindData     byte = 0x20 // 会话数据
+	KindAck      byte = 0x21 // 会话累计确认
+	KindPing     byte = 0x22 // 会话保活
+	KindClose    byte = 0x23 // 会话关闭
+)
+
+var (
+	ErrShortDatagram = errors.New("punch: short datagram")
+	ErrPunchTimeout  = errors.New("punch: no path to peer")
+	ErrBindTimeout   = errors.New("punch: bind timeout")
+	ErrPeerTimeout   = errors.New("punch: peer timeout")
+)
+
+// EncodeBind 编码绑定请求: [kind][txn 4][len(client id) 1][client id][token]
+// token 为服务端在注册确认中下发的绑定令牌，防止他人冒用客户端ID绑定地址
+func EncodeBind(txn uint32, clientID, token string) []byte {
+	buf := make([]byte, 6+len(clientID)+len(token))
+	buf[0] = KindBind
+	binary.BigEndian.PutUint32(buf[1:5], txn)
+	buf[5] = byte(len(clientID))
+	copy(buf[6:], clientID)
+	copy(buf[6+len(clientID):], token)
+	return buf
+}
+
+// DecodeBind 解码绑定请求
+func DecodeBind(b []byte) (txn uint32, clientID, token string, err error) {
+	if len(b) < 6 || b[0] != KindBind || len(b) < 6+int(b[5]) {
+		return 0, "", "", ErrShortDatagram
+	}
+	n := 6 + int(b[5])
+	return binary.BigEndian.Uint32(b[1:5]), string(b[6:n]), string(b[n:]), nil
+}
+
+// EncodeBindAck 编码绑定确认: [kind][txn 4][observed addr]
+func EncodeBindAck(txn uint32, addr string) []byte {
+	buf := make([]byte, 5+len(addr))
+	buf[0] = KindBindAck
+	binary.BigEndian.PutUint32(buf[1:5], txn)
+	copy(buf[5:], addr)
+	return buf
+}
+
+// DecodeBindAck 解码绑定确认
+func DecodeBindAck(b []byte) (txn uint32, addr string, err error) {
+	if len(b) < 5 || b[0] != KindBindAck {
+		return 0, "", ErrShortDatagram
+	}
+	return binary.BigEndian.Uint32(b[1:5]), string(b[5:]), nil
+}
+
+// encodeProbe 编码探测及其确认: [kind][len(from) 1][from][to]
+func encodeProbe(kind byte, from, to string) []byte {
+	buf := make([]byte, 2+len(from)+len(to))
+	buf[0] = kind
+	buf[1] = byte(len(from))
+	copy(buf[2:], from)
+	copy(buf[2+len(from):], to)
+	return buf
+}
+
+func decodeProbe(b []byte) (from, to string, err error) {
+	if len(b) < 2 || len(b) < 2+int(b[1]) {
+		return "", "", ErrShortDatagram
+	}
+	n := 2 + int(b[1])
+	return string(b[2:n]), string(b[n:]), nil
+}
+
+// encodeSeq 编码带序号的会话数据报: [kind][seq 4][payload]
+func encodeSeq(kind byte, seq uint32, payload []byte) []byte {
+	buf := make([]byte, 5+len(payload))
+	buf[0] = kind
+	binary.BigEndian.PutUint32(buf[1:5], seq)
+	copy(buf[5:], payload)
+	return buf
+}
+
+func decodeSeq(b []byte) (seq uint32, payload []byte, err error) {
+	if len(b) < 5 {
+		return 0, nil, ErrShortDatagram
+	}
+	return binary.BigEndian.Uint32(b[1:5]), b[5:], nil
+}
+
+// seqBefore 判断序号 a 是否在 b 之前（考虑回绕）
+func seqBefore(a, b uint32) bool {
+	return int32(a-b) < 0
+}
@@ -0,0 +1,115 @@
+package secure
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+)
+
+const maxRecordSize = 64 * 1024
+
+// Conn 加密的对等连接，实现 net.Conn
+type Conn struct {
+	net.Conn
+	peerID string
+
+	wmu       sync.Mutex
+	sendAEAD  cipher.AEAD
+	sendNonce uint64
+
+	rmu       sync.Mutex
+	recvAEAD  cipher.AEAD
+	recvNonce uint64
+	readBuf   []byte
+}
+
+func newConn(conn net.Conn, sendKey, recvKey []byte, peerID string) (*Conn, error) {
+	sendAEAD, err := newAEAD(sendKey)
+	if err != nil {
+		return nil, err
+	}
+	recvAEAD, err := newAEAD(recvKey)
+	if err != nil {
+		return nil, err
+	}
+	return &Conn{
+		Conn:     conn,
+		peerID:   peerID,
+		sendAEAD: sendAEAD,
+		recvAEAD: recvAEAD,
+	}, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// PeerID 返回握手认证的对方身份
+func (c *Conn) PeerID() string {
+	return c.peerID
+}
+
+func nonce(counter uint64) []byte {
+	n := make([]byte, 12)
+	binary.BigEndian.PutUint64(n[4:], counter)
+	return n
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	written := 0
+	for written < len(b) {
+		end := written + maxRecordSize - c.sendAEAD.Overhead()
+		if end > len(b) {
+			end = len(b)
+		}
+		record := make([]byte, 4, 4+end-written+c.sendAEAD.Overhead())
+		record = c.sendAEAD.Seal(record, nonce(c.sendNonce), b[written:end], nil)
+		binary.BigEndian.PutUint32(record[:4], uint32(len(record)-4))
+		c.sendNonce++
+		if _, err := c.Conn.Write(record); err != nil {
+			return written, err
+		}
+		written = end
+	}
+	return written, nil
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+
+	for len(c.readBuf) == 0 {
+		header := make([]byte, 4)
+		if _, err := io.ReadFull(c.Conn, header); err != nil {
+			return 0, err
+		}
+		size := binary.BigEndian.Uint32(header)
+		if size > maxRecordSize {
+			return 0, ErrRecordTooLarge
+		}
+		record := make([]byte, size)
+		if _, err := io.ReadFull(c.Conn, record); err != nil {
+			return 0, err
+		}
+		plain, err := c.recvAEAD.Open(record[:0], nonce(c.recvNonce), record, nil)
+		if err != nil {
+			return 0, ErrAuthFailed
+		}
+		c.recvNonce++
+		c.readBuf = plain
+	}
+
+	n := copy(b, c.readBuf)
+	c.readBuf = c.readBuf[n:]
+	return n, nil
+}
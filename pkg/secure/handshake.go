@@ -0,0 +1,241 @@
+/*
+	secure 对等连接的端到端加密
+	握手参考 Noise KK 模式，双方事先通过打洞服务器得到对方的静态公钥：
+	1. 发起方 -> 响应方：[0x01][len(id)][id][临时公钥 e_i]
+	2. 响应方 -> 发起方：[0x02][len(id)][id][临时公钥 e_r]
+	3. 双方计算 DH(e_i, e_r) || DH(s_i, e_r) || DH(e_i, s_r)，以握手记录的哈希为盐派生双向密钥
+	4. 双方各发送一条加密的确认记录（握手哈希），解密成功即证明对方持有静态私钥
+
+	之后的数据使用 AES-256-GCM 加密，每条记录为 [长度 4][密文]，随机数为递增计数器
+*/
+
+package secure
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+const (
+	msgInitiator byte = 0x01
+	msgResponder byte = 0x02
+
+	protocolName     = "spider-secure-v1"
+	handshakeTimeout = 10 * time.Second
+)
+
+var (
+	ErrUnknownPeer    = errors.New("secure: unknown peer")
+	ErrPeerMismatch   = errors.New("secure: unexpected peer identity")
+	ErrHandshake      = errors.New("secure: handshake failed")
+	ErrAuthFailed     = errors.New("secure: message authentication failed")
+	ErrInvalidKey     = errors.New("secure: invalid public key")
+	ErrRecordTooLarge = errors.New("secure: record too large")
+)
+
+// Identity 客户端的静态密钥对
+type Identity struct {
+	priv *ecdh.PrivateKey
+}
+
+// GenerateIdentity 生成新的静态密钥对
+func GenerateIdentity() (*Identity, error) {
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &Identity{priv: priv}, nil
+}
+
+// PublicKey 返回 base64 编码的静态公钥，用于注册时发布
+func (id *Identity) PublicKey() string {
+	return base64.StdEncoding.EncodeToString(id.priv.PublicKey().Bytes())
+}
+
+// ParsePublicKey 解析 base64 编码的静态公钥
+func ParsePublicKey(s string) (*ecdh.PublicKey, error) {
+	data, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, ErrInvalidKey
+	}
+	key, err := ecdh.X25519().NewPublicKey(data)
+	if err != nil {
+		return nil, ErrInvalidKey
+	}
+	return key, nil
+}
+
+// KeyLookup 根据对方的客户端ID查找其静态公钥
+type KeyLookup func(peerID string) (*ecdh.PublicKey, error)
+
+// Client 作为发起方完成握手，peerID 为期望的对方身份
+func Client(conn net.Conn, id *Identity, localID, peerID string, peerKey *ecdh.PublicKey) (*Conn, error) {
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	hello := encodeHello(msgInitiator, localID, ephemeral.PublicKey())
+	if _, err := conn.Write(hello); err != nil {
+		return nil, err
+	}
+
+	respID, respEphemeral, reply, err := readHello(conn, msgResponder)
+	if err != nil {
+		return nil, err
+	}
+	if respID != peerID {
+		return nil, ErrPeerMismatch
+	}
+
+	dh1, err := ephemeral.ECDH(respEphemeral)
+	if err != nil {
+		return nil, ErrHandshake
+	}
+	dh2, err := id.priv.ECDH(respEphemeral)
+	if err != nil {
+		return nil, ErrHandshake
+	}
+	dh3, err := ephemeral.ECDH(peerKey)
+	if err != nil {
+		return nil, ErrHandshake
+	}
+
+	h := transcript(hello, reply, id.priv.PublicKey(), peerKey)
+	sendKey, recvKey := deriveKeys(h, dh1, dh2, dh3)
+	return finish(conn, h, sendKey, recvKey, peerID)
+}
+
+// Server 作为响应方完成握手，返回已认证的对方身份
+func Server(conn net.Conn, id *Identity, localID string, lookup KeyLookup) (*Conn, error) {
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	peerID, initEphemeral, hello, err := readHello(conn, msgInitiator)
+	if err != nil {
+		return nil, err
+	}
+	peerKey, err := lookup(peerID)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", ErrUnknownPeer, peerID, err)
+	}
+
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	reply := encodeHello(msgResponder, localID, ephemeral.PublicKey())
+	if _, err := conn.Write(reply); err != nil {
+		return nil, err
+	}
+
+	dh1, err := ephemeral.ECDH(initEphemeral)
+	if err != nil {
+		return nil, ErrHandshake
+	}
+	dh2, err := ephemeral.ECDH(peerKey)
+	if err != nil {
+		return nil, ErrHandshake
+	}
+	dh3, err := id.priv.ECDH(initEphemeral)
+	if err != nil {
+		return nil, ErrHandshake
+	}
+
+	h := transcript(hello, reply, peerKey, id.priv.PublicKey())
+	recvKey, sendKey := deriveKeys(h, dh1, dh2, dh3)
+	return finish(conn, h, sendKey, recvKey, peerID)
+}
+
+// finish 交换加密的确认记录
+func finish(conn net.Conn, h, sendKey, recvKey []byte, peerID string) (*Conn, error) {
+	c, err := newConn(conn, sendKey, recvKey, peerID)
+	if err != nil {
+		return nil, err
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := c.Write(h)
+		errCh <- err
+	}()
+
+	confirm := make([]byte, len(h))
+	if _, err := io.ReadFull(c, confirm); err != nil {
+		return nil, ErrHandshake
+	}
+	if !hmac.Equal(confirm, h) {
+		return nil, ErrHandshake
+	}
+	if err := <-errCh; err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func encodeHello(kind byte, localID string, ephemeral *ecdh.PublicKey) []byte {
+	buf := bytes.NewBuffer(make([]byte, 0, 2+len(localID)+32))
+	buf.WriteByte(kind)
+	buf.WriteByte(byte(len(localID)))
+	buf.WriteString(localID)
+	buf.Write(ephemeral.Bytes())
+	return buf.Bytes()
+}
+
+func readHello(r io.Reader, kind byte) (string, *ecdh.PublicKey, []byte, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return "", nil, nil, err
+	}
+	if header[0] != kind {
+		return "", nil, nil, ErrHandshake
+	}
+	body := make([]byte, int(header[1])+32)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return "", nil, nil, err
+	}
+	ephemeral, err := ecdh.X25519().NewPublicKey(body[header[1]:])
+	if err != nil {
+		return "", nil, nil, ErrHandshake
+	}
+	return string(body[:header[1]]), ephemeral, append(header, body...), nil
+}
+
+// transcript 握手哈希，绑定双方的握手消息和静态公钥
+func transcript(hello, reply []byte, initiatorKey, responderKey *ecdh.PublicKey) []byte {
+	h := sha256.New()
+	h.Write([]byte(protocolName))
+	h.Write(hello)
+	h.Write(reply)
+	h.Write(initiatorKey.Bytes())
+	h.Write(responderKey.Bytes())
+	return h.Sum(nil)
+}
+
+// deriveKeys 使用 HKDF-SHA256 派生发起方到响应方、响应方到发起方两个方向的密钥
+func deriveKeys(salt []byte, secrets ...[]byte) (initiatorKey, responderKey []byte) {
+	extract := hmac.New(sha256.New, salt)
+	for _, secret := range secrets {
+		extract.Write(secret)
+	}
+	prk := extract.Sum(nil)
+
+	expand := func(info string) []byte {
+		mac := hmac.New(sha256.New, prk)
+		mac.Write([]byte(info))
+		mac.Write([]byte{1})
+		return mac.Sum(nil)
+	}
+	return expand(protocolName + " initiator"), expand(protocolName + " responder")
+}
@@ -0,0 +1,130 @@
+package secure
+
+import (
+	"crypto/ecdh"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func mustIdentity(t *testing.T) *Identity {
+	id, err := GenerateIdentity()
+	require.NoError(t, err)
+	return id
+}
+
+func mustKey(t *testing.T, id *Identity) *ecdh.PublicKey {
+	key, err := ParsePublicKey(id.PublicKey())
+	require.NoError(t, err)
+	return key
+}
+
+// handshake 在 a、b 之间完成握手，b 通过 keys 查找对方公钥
+func handshake(t *testing.T, a, b net.Conn, idA, idB *Identity, bKeyForA *ecdh.PublicKey, keys map[string]*ecdh.PublicKey) (*Conn, *Conn, error, error) {
+	type result struct {
+		c   *Conn
+		err error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		c, err := Server(b, idB, "b", func(peerID string) (*ecdh.PublicKey, error) {
+			key, ok := keys[peerID]
+			if !ok {
+				return nil, ErrUnknownPeer
+			}
+			return key, nil
+		})
+		if err != nil {
+			b.Close()
+		}
+		ch <- result{c, err}
+	}()
+	ca, errA := Client(a, idA, "a", "b", bKeyForA)
+	if errA != nil {
+		a.Close()
+	}
+	rb := <-ch
+	return ca, rb.c, errA, rb.err
+}
+
+func TestHandshakeAndTransfer(t *testing.T) {
+	idA, idB := mustIdentity(t), mustIdentity(t)
+	a, b := net.Pipe()
+
+	ca, cb, errA, errB := handshake(t, a, b, idA, idB, mustKey(t, idB), map[string]*ecdh.PublicKey{"a": mustKey(t, idA)})
+	require.NoError(t, errA)
+	require.NoError(t, errB)
+	assert.Equal(t, "b", ca.PeerID())
+	assert.Equal(t, "a", cb.PeerID())
+
+	// 大于单条记录的数据会被拆分
+	data := make([]byte, 3*maxRecordSize)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	go ca.Write(data)
+	got := make([]byte, len(data))
+	_, err := io.ReadFull(cb, got)
+	require.NoError(t, err)
+	assert.Equal(t, data, got)
+
+	go cb.Write([]byte("pong"))
+	got = make([]byte, 4)
+	_, err = io.ReadFull(ca, got)
+	require.NoError(t, err)
+	assert.Equal(t, "pong", string(got))
+}
+
+func TestHandshakeRejectsWrongKey(t *testing.T) {
+	idA, idB, mallory := mustIdentity(t), mustIdentity(t), mustIdentity(t)
+
+	// 响应方记录的发起方公钥与其实际持有的私钥不符
+	a, b := net.Pipe()
+	_, _, errA, errB := handshake(t, a, b, mallory, idB, mustKey(t, idB), map[string]*ecdh.PublicKey{"a": mustKey(t, idA)})
+	assert.Error(t, errA)
+	assert.Error(t, errB)
+
+	// 发起方期望的响应方公钥不符
+	a, b = net.Pipe()
+	_, _, errA, errB = handshake(t, a, b, idA, idB, mustKey(t, mallory), map[string]*ecdh.PublicKey{"a": mustKey(t, idA)})
+	assert.Error(t, errA)
+	assert.Error(t, errB)
+
+	// 响应方不认识发起方
+	a, b = net.Pipe()
+	_, _, errA, errB = handshake(t, a, b, idA, idB, mustKey(t, idB), nil)
+	assert.Error(t, errA)
+	assert.ErrorIs(t, errB, ErrUnknownPeer)
+}
+
+// tamperConn 翻转写出数据的最后一个字节
+type tamperConn struct {
+	net.Conn
+	tamper bool
+}
+
+func (c *tamperConn) Write(b []byte) (int, error) {
+	if c.tamper {
+		b = append([]byte(nil), b...)
+		b[len(b)-1] ^= 0xff
+	}
+	return c.Conn.Write(b)
+}
+
+func TestTamperDetected(t *testing.T) {
+	idA, idB := mustIdentity(t), mustIdentity(t)
+	a, b := net.Pipe()
+	ta := &tamperConn{Conn: a}
+
+	ca, cb, errA, errB := handshake(t, ta, b, idA, idB, mustKey(t, idB), map[string]*ecdh.PublicKey{"a": mustKey(t, idA)})
+	require.NoError(t, errA)
+	require.NoError(t, errB)
+
+	ta.tamper = true
+	go ca.Write([]byte("hello"))
+	_, err := cb.Read(make([]byte, 5))
+	assert.ErrorIs(t, err, ErrAuthFailed)
+}
@@ -0,0 +1,151 @@
+/*
+	tlsutil 信令通道的 TLS 配置
+	1. 服务端证书、可选的客户端证书校验（双向 TLS）
+	2. 客户端按 CA 或证书公钥指纹（pinning）校验服务端
+	3. 自签名 CA 的生成与证书签发，供没有外部 PKI 的小团队使用
+*/
+
+package tlsutil
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/liuscraft/spider-network/pkg/config"
+)
+
+var ErrPinMismatch = errors.New("tls: server certificate does not match pinned key")
+
+// ServerConfig 根据配置创建服务端 TLS 配置，未启用时返回 nil
+func ServerConfig(cfg config.TLSConfig) (*tls.Config, error) {
+	if cfg.CertFile == "" {
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("load server certificate error: %v", err)
+	}
+
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if cfg.ClientCAFile != "" {
+		pool, err := loadCertPool(cfg.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConfig, nil
+}
+
+// ClientOptions 客户端 TLS 选项
+type ClientOptions struct {
+	CAFile     string // 校验服务端证书的 CA，为空时使用系统根证书
+	CertFile   string // 双向 TLS 的客户端证书
+	KeyFile    string
+	ServerName string // 为空时使用连接地址中的主机名
+	// PinnedKey 服务端证书公钥指纹（SPKI 的 SHA-256，十六进制），见 PublicKeyPin
+	// 仅设置指纹时不再校验证书链，适用于自签名证书
+	PinnedKey string
+}
+
+// ClientConfig 根据选项创建客户端 TLS 配置
+func ClientConfig(opts ClientOptions) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName: opts.ServerName,
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if opts.CAFile != "" {
+		pool, err := loadCertPool(opts.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if opts.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(opts.CertFile, opts.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load client certificate error: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if opts.PinnedKey != "" {
+		pin := strings.ToLower(strings.ReplaceAll(opts.PinnedKey, ":", ""))
+		if opts.CAFile == "" {
+			// 指纹已经唯一确定了服务端，跳过证书链校验
+			tlsConfig.InsecureSkipVerify = true
+		}
+		tlsConfig.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return ErrPinMismatch
+			}
+			leaf, err := x509.ParseCertificate(rawCerts[0])
+			if err != nil {
+				return err
+			}
+			if PublicKeyPin(leaf) != pin {
+				return ErrPinMismatch
+			}
+			return nil
+		}
+	}
+	return tlsConfig, nil
+}
+
+// PublicKeyPin 计算证书公钥指纹
+func PublicKeyPin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return hex.EncodeToString(sum[:])
+}
+
+// CertificatePin 计算 PEM 证书的公钥指纹
+func CertificatePin(certPEM []byte) (string, error) {
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		return "", errors.New("invalid certificate pem data")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return "", err
+	}
+	return PublicKeyPin(cert), nil
+}
+
+// PeerCommonName 返回双向 TLS 连接中客户端证书的 CommonName，非 TLS 或无证书时返回空
+func PeerCommonName(state *tls.ConnectionState) string {
+	if state == nil || len(state.PeerCertificates) == 0 {
+		return ""
+	}
+	return state.PeerCertificates[0].Subject.CommonName
+}
+
+// IsVerificationError 是否为服务端证书校验失败（证书链或指纹不匹配）
+func IsVerificationError(err error) bool {
+	var verifyErr *tls.CertificateVerificationError
+	return errors.Is(err, ErrPinMismatch) || errors.As(err, &verifyErr)
+}
+
+func loadCertPool(file string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("read ca file error: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %s", file)
+	}
+	return pool, nil
+}
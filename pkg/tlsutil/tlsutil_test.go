@@ -0,0 +1,145 @@
+package tlsutil
+
+import (
+	"crypto/tls"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/liuscraft/spider-network/pkg/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeCerts 生成 CA、服务端证书以及 CommonName 为 clientID 的客户端证书
+func writeCerts(t *testing.T, clientID string) string {
+	dir := t.TempDir()
+	ca, err := NewCA("test CA")
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "ca.pem"), ca.CertPEM(), 0o600))
+
+	write := func(name string, certPEM, keyPEM []byte) {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name+".pem"), certPEM, 0o600))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name+"-key.pem"), keyPEM, 0o600))
+	}
+	certPEM, keyPEM, err := ca.Issue("server", []string{"127.0.0.1"}, false)
+	require.NoError(t, err)
+	write("server", certPEM, keyPEM)
+	certPEM, keyPEM, err = ca.Issue(clientID, nil, true)
+	require.NoError(t, err)
+	write("client", certPEM, keyPEM)
+	return dir
+}
+
+// handshake 在本地回环上完成一次 TLS 握手，返回服务端看到的客户端证书名
+func handshake(t *testing.T, serverConfig, clientConfig *tls.Config) (string, error) {
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", serverConfig)
+	require.NoError(t, err)
+	defer listener.Close()
+
+	names := make(chan string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		tlsConn := conn.(*tls.Conn)
+		if tlsConn.Handshake() != nil {
+			names <- ""
+			return
+		}
+		state := tlsConn.ConnectionState()
+		names <- PeerCommonName(&state)
+		// 等待客户端读取结果
+		conn.Write([]byte{1})
+	}()
+
+	conn, err := tls.Dial("tcp", listener.Addr().String(), clientConfig)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	if _, err := conn.Read(make([]byte, 1)); err != nil {
+		return "", err
+	}
+	return <-names, nil
+}
+
+func TestClientConfig(t *testing.T) {
+	dir := writeCerts(t, "client-1")
+	serverConfig, err := ServerConfig(config.TLSConfig{
+		CertFile: filepath.Join(dir, "server.pem"),
+		KeyFile:  filepath.Join(dir, "server-key.pem"),
+	})
+	require.NoError(t, err)
+
+	serverPEM, err := os.ReadFile(filepath.Join(dir, "server.pem"))
+	require.NoError(t, err)
+	pin, err := CertificatePin(serverPEM)
+	require.NoError(t, err)
+
+	t.Run("ca", func(t *testing.T) {
+		clientConfig, err := ClientConfig(ClientOptions{CAFile: filepath.Join(dir, "ca.pem")})
+		require.NoError(t, err)
+		_, err = handshake(t, serverConfig, clientConfig)
+		assert.NoError(t, err)
+	})
+
+	t.Run("untrusted", func(t *testing.T) {
+		clientConfig, err := ClientConfig(ClientOptions{})
+		require.NoError(t, err)
+		_, err = handshake(t, serverConfig, clientConfig)
+		assert.True(t, IsVerificationError(err), "unexpected error: %v", err)
+	})
+
+	t.Run("pinned", func(t *testing.T) {
+		clientConfig, err := ClientConfig(ClientOptions{PinnedKey: pin})
+		require.NoError(t, err)
+		_, err = handshake(t, serverConfig, clientConfig)
+		assert.NoError(t, err)
+	})
+
+	t.Run("pin mismatch", func(t *testing.T) {
+		other, err := NewCA("other")
+		require.NoError(t, err)
+		clientConfig, err := ClientConfig(ClientOptions{PinnedKey: PublicKeyPin(other.Cert)})
+		require.NoError(t, err)
+		_, err = handshake(t, serverConfig, clientConfig)
+		assert.ErrorIs(t, err, ErrPinMismatch)
+		assert.True(t, IsVerificationError(err))
+	})
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir := writeCerts(t, "client-1")
+	serverConfig, err := ServerConfig(config.TLSConfig{
+		CertFile:     filepath.Join(dir, "server.pem"),
+		KeyFile:      filepath.Join(dir, "server-key.pem"),
+		ClientCAFile: filepath.Join(dir, "ca.pem"),
+	})
+	require.NoError(t, err)
+
+	// 携带客户端证书时服务端可以取得客户端身份
+	clientConfig, err := ClientConfig(ClientOptions{
+		CAFile:   filepath.Join(dir, "ca.pem"),
+		CertFile: filepath.Join(dir, "client.pem"),
+		KeyFile:  filepath.Join(dir, "client-key.pem"),
+	})
+	require.NoError(t, err)
+	name, err := handshake(t, serverConfig, clientConfig)
+	require.NoError(t, err)
+	assert.Equal(t, "client-1", name)
+
+	// 没有客户端证书时握手失败
+	clientConfig, err = ClientConfig(ClientOptions{CAFile: filepath.Join(dir, "ca.pem")})
+	require.NoError(t, err)
+	_, err = handshake(t, serverConfig, clientConfig)
+	assert.Error(t, err)
+}
+
+func TestServerConfigDisabled(t *testing.T) {
+	cfg, err := ServerConfig(config.TLSConfig{})
+	assert.NoError(t, err)
+	assert.Nil(t, cfg)
+}
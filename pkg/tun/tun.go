@@ -0,0 +1,31 @@
+/*
+	tun 虚拟网卡，客户端通过 TUN 设备收发虚拟网络中的 IP 报文
+	目前只支持 Linux，其它平台的 Open 返回 ErrNotSupported
+*/
+
+package tun
+
+import (
+	"errors"
+	"io"
+	"net"
+)
+
+// DefaultMTU 为加密与封装留出余量
+const DefaultMTU = 1400
+
+var ErrNotSupported = errors.New("tun: not supported on this platform")
+
+// Device TUN 设备，每次读写都是一个完整的 IP 报文
+type Device interface {
+	io.ReadWriteCloser
+	Name() string
+}
+
+// IPv4Header 解析 IPv4 报文的源地址和目的地址，非 IPv4 报文返回 false
+func IPv4Header(packet []byte) (src, dst net.IP, ok bool) {
+	if len(packet) < 20 || packet[0]>>4 != 4 {
+		return nil, nil, false
+	}
+	return net.IP(packet[12:16]), net.IP(packet[16:20]), true
+}
@@ -0,0 +1,89 @@
+//go:build linux
+
+package tun
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	cloneDevice = "/dev/net/tun"
+	iffTun      = 0x0001
+	iffNoPI     = 0x1000
+	tunSetIff   = 0x400454ca
+)
+
+type ifReq struct {
+	name  [syscall.IFNAMSIZ]byte
+	flags uint16
+	_     [22]byte
+}
+
+type device struct {
+	file *os.File
+	name string
+}
+
+// Open 创建 TUN 设备，name 为空时由内核分配名称
+func Open(name string) (Device, error) {
+	fd, err := syscall.Open(cloneDevice, syscall.O_RDWR|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("open %s error: %v", cloneDevice, err)
+	}
+
+	var req ifReq
+	copy(req.name[:syscall.IFNAMSIZ-1], name)
+	req.flags = iffTun | iffNoPI
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), tunSetIff, uintptr(unsafe.Pointer(&req))); errno != 0 {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("create tun device error: %v", errno)
+	}
+
+	// 非阻塞模式交给 runtime 轮询，Close 可以打断阻塞中的 Read
+	if err := syscall.SetNonblock(fd, true); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	return &device{
+		file: os.NewFile(uintptr(fd), cloneDevice),
+		name: strings.TrimRight(string(req.name[:]), "\x00"),
+	}, nil
+}
+
+func (d *device) Name() string {
+	return d.name
+}
+
+func (d *device) Read(b []byte) (int, error) {
+	return d.file.Read(b)
+}
+
+func (d *device) Write(b []byte) (int, error) {
+	return d.file.Write(b)
+}
+
+func (d *device) Close() error {
+	return d.file.Close()
+}
+
+// Configure 为设备设置地址（CIDR 格式）和 MTU 并启用
+func Configure(name, cidr string, mtu int) error {
+	if err := run("ip", "addr", "replace", cidr, "dev", name); err != nil {
+		return err
+	}
+	return run("ip", "link", "set", "dev", name, "mtu", strconv.Itoa(mtu), "up")
+}
+
+func run(name string, args ...string) error {
+	out, err := exec.Command(name, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s %s error: %v: %s", name, strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+//go:build linux
+
+package tun
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// 需要 CAP_NET_ADMIN，可在独立的网络命名空间中运行：unshare -rn go test ./pkg/tun
+func TestDeviceReadsRoutedPackets(t *testing.T) {
+	dev, err := Open("")
+	if err != nil {
+		t.Skipf("tun device not available: %v", err)
+	}
+	defer dev.Close()
+	if err := Configure(dev.Name(), "10.251.0.1/24", DefaultMTU); err != nil {
+		t.Skipf("configure tun device failed: %v", err)
+	}
+
+	// 发往虚拟网段的报文由内核交给 TUN 设备
+	conn, err := net.Dial("udp4", "10.251.0.2:9999")
+	require.NoError(t, err)
+	defer conn.Close()
+
+	packets := make(chan []byte, 16)
+	go func() {
+		buf := make([]byte, DefaultMTU)
+		for {
+			n, err := dev.Read(buf)
+			if err != nil {
+				close(packets)
+				return
+			}
+			packets <- append([]byte(nil), buf[:n]...)
+		}
+	}()
+
+	_, err = conn.Write([]byte("hello"))
+	require.NoError(t, err)
+
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case packet, ok := <-packets:
+			require.True(t, ok, "device closed")
+			src, dst, ok := IPv4Header(packet)
+			if !ok || !dst.Equal(net.ParseIP("10.251.0.2")) {
+				continue
+			}
+			assert.True(t, src.Equal(net.ParseIP("10.251.0.1")))
+			assert.Equal(t, "hello", string(packet[28:]))
+			return
+		case <-timeout:
+			t.Fatal("packet not received from tun device")
+		}
+	}
+}
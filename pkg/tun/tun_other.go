@@ -0,0 +1,13 @@
+//go:build !linux
+
+package tun
+
+// Open 当前平台不支持 TUN 设备
+func Open(name string) (Device, error) {
+	return nil, ErrNotSupported
+}
+
+// Configure 当前平台不支持 TUN 设备
+func Configure(name, cidr string, mtu int) error {
+	return ErrNotSupported
+}
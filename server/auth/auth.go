@@ -0,0 +1,102 @@
+/*
+	Authenticator 客户端注册认证
+	1. 客户端使用预共享令牌对 客户端ID + 时间戳 + 随机数（+ 静态公钥）计算 HMAC
+	2. 服务端从凭据库取出令牌重新计算并比较
+	3. 时间戳超出允许偏差或随机数已使用过的请求视为重放
+*/
+
+package auth
+
+import (
+	"crypto/hmac"
+	"sync"
+	"time"
+
+	"github.com/liuscraft/spider-network/pkg/config"
+	"github.com/liuscraft/spider-network/pkg/protocol/hole"
+)
+
+const defaultClockSkew = 5 * time.Minute
+
+// CredentialStore 凭据库
+type CredentialStore interface {
+	// Token 返回客户端的预共享令牌
+	Token(clientID string) (string, bool)
+}
+
+// StaticCredentials 配置文件中的静态凭据
+type StaticCredentials map[string]string
+
+func (c StaticCredentials) Token(clientID string) (string, bool) {
+	token, ok := c[clientID]
+	return token, ok
+}
+
+// Authenticator 注册认证器
+type Authenticator struct {
+	store CredentialStore
+	skew  time.Duration
+	now   func() time.Time
+
+	mu     sync.Mutex
+	nonces map[string]time.Time // 客户端ID/随机数 -> 过期时间
+}
+
+// NewAuthenticator 根据配置创建认证器，未配置凭据时返回 nil 表示不启用认证
+func NewAuthenticator(cfg config.AuthConfig) *Authenticator {
+	if len(cfg.Credentials) == 0 {
+		return nil
+	}
+	return NewAuthenticatorWithStore(StaticCredentials(cfg.Credentials), time.Duration(cfg.MaxClockSkew)*time.Second)
+}
+
+// NewAuthenticatorWithStore 使用自定义凭据库创建认证器
+func NewAuthenticatorWithStore(store CredentialStore, skew time.Duration) *Authenticator {
+	if skew <= 0 {
+		skew = defaultClockSkew
+	}
+	return &Authenticator{
+		store:  store,
+		skew:   skew,
+		now:    time.Now,
+		nonces: make(map[string]time.Time),
+	}
+}
+
+// Verify 校验注册消息，失败时返回 *hole.ErrorPayload
+func (a *Authenticator) Verify(payload *hole.RegisterPayload) error {
+	if payload.Signature == "" || payload.Nonce == "" {
+		return hole.NewError(hole.ErrCodeUnauthorized, "missing credentials")
+	}
+	token, ok := a.store.Token(payload.ClientID)
+	if !ok {
+		return hole.NewError(hole.ErrCodeUnauthorized, "unknown client")
+	}
+	expected := hole.SignRegister(token, payload.ClientID, payload.Timestamp, payload.Nonce, payload.PublicKey)
+	if !hmac.Equal([]byte(expected), []byte(payload.Signature)) {
+		return hole.NewError(hole.ErrCodeUnauthorized, "invalid signature")
+	}
+
+	now := a.now()
+	ts := time.Unix(payload.Timestamp, 0)
+	if ts.Before(now.Add(-a.skew)) || ts.After(now.Add(a.skew)) {
+		return hole.NewError(hole.ErrCodeReplay, "timestamp out of range")
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	// 清理过期的随机数，时间窗口之外的请求已被时间戳校验拒绝
+	for key, expiry := range a.nonces {
+		if now.After(expiry) {
+			delete(a.nonces, key)
+		}
+	}
+
+	key := payload.ClientID + "/" + payload.Nonce
+	if _, used := a.nonces[key]; used {
+		return hole.NewError(hole.ErrCodeReplay, "nonce already used")
+	}
+	a.nonces[key] = ts.Add(a.skew)
+	return nil
+}
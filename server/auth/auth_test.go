@@ -0,0 +1,80 @@
+package auth
+
+import (
+	"testing"
+	"time"
+
+	"github.com/liuscraft/spider-network/pkg/config"
+	"github.com/liuscraft/spider-network/pkg/protocol/hole"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func signedPayload(t *testing.T, clientID, token string) *hole.RegisterPayload {
+	payload := &hole.RegisterPayload{ClientID: clientID, Name: clientID}
+	require.NoError(t, payload.Sign(token))
+	return payload
+}
+
+func assertCode(t *testing.T, err error, code hole.ErrorCode) {
+	var rejected *hole.ErrorPayload
+	require.ErrorAs(t, err, &rejected)
+	assert.Equal(t, code, rejected.Code)
+}
+
+func TestAuthenticator(t *testing.T) {
+	assert.Nil(t, NewAuthenticator(config.AuthConfig{}))
+
+	a := NewAuthenticator(config.AuthConfig{
+		Credentials: map[string]string{"node-1": "secret-1"},
+	})
+	require.NotNil(t, a)
+
+	t.Run("valid", func(t *testing.T) {
+		assert.NoError(t, a.Verify(signedPayload(t, "node-1", "secret-1")))
+	})
+
+	t.Run("missing credentials", func(t *testing.T) {
+		assertCode(t, a.Verify(&hole.RegisterPayload{ClientID: "node-1"}), hole.ErrCodeUnauthorized)
+	})
+
+	t.Run("wrong token", func(t *testing.T) {
+		assertCode(t, a.Verify(signedPayload(t, "node-1", "guess")), hole.ErrCodeUnauthorized)
+	})
+
+	t.Run("unknown client", func(t *testing.T) {
+		assertCode(t, a.Verify(signedPayload(t, "node-2", "secret-1")), hole.ErrCodeUnauthorized)
+	})
+
+	t.Run("client id swapped", func(t *testing.T) {
+		payload := signedPayload(t, "node-1", "secret-1")
+		payload.ClientID = "node-2"
+		assertCode(t, a.Verify(payload), hole.ErrCodeUnauthorized)
+	})
+
+	t.Run("public key swapped", func(t *testing.T) {
+		payload := &hole.RegisterPayload{ClientID: "node-1", PublicKey: "client-key"}
+		require.NoError(t, payload.Sign("secret-1"))
+		payload.PublicKey = "attacker-key"
+		assertCode(t, a.Verify(payload), hole.ErrCodeUnauthorized)
+
+		payload.PublicKey = "client-key"
+		assert.NoError(t, a.Verify(payload))
+	})
+
+	t.Run("replayed nonce", func(t *testing.T) {
+		payload := signedPayload(t, "node-1", "secret-1")
+		require.NoError(t, a.Verify(payload))
+		assertCode(t, a.Verify(payload), hole.ErrCodeReplay)
+	})
+
+	t.Run("stale timestamp", func(t *testing.T) {
+		payload := &hole.RegisterPayload{
+			ClientID:  "node-1",
+			Timestamp: time.Now().Add(-time.Hour).Unix(),
+			Nonce:     "00112233",
+		}
+		payload.Signature = hole.SignRegister("secret-1", payload.ClientID, payload.Timestamp, payload.Nonce, "")
+		assertCode(t, a.Verify(payload), hole.ErrCodeReplay)
+	})
+}
@@ -0,0 +1,239 @@
+package client_mgr
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/liuscraft/spider-network/pkg/utils"
+	"github.com/liuscraft/spider-network/pkg/xlog"
+)
+
+var (
+	ErrBanNotFound = errors.New("ban not found")
+	ErrInvalidBan  = errors.New("ban must specify either client id or cidr")
+	ErrInvalidCIDR = errors.New("invalid cidr")
+)
+
+// Ban 封禁记录，按客户端ID或来源地址段封禁，ExpiresAt 为零值时永久有效
+type Ban struct {
+	ID        string    `json:"id"`
+	ClientID  string    `json:"client_id,omitempty"`
+	CIDR      string    `json:"cidr,omitempty"`
+	Reason    string    `json:"reason,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at,omitempty"`
+
+	network *net.IPNet
+}
+
+// Expired 封禁是否已过期
+func (b *Ban) Expired(now time.Time) bool {
+	return !b.ExpiresAt.IsZero() && now.After(b.ExpiresAt)
+}
+
+// Matches 判断客户端ID或来源地址是否命中该封禁
+func (b *Ban) Matches(clientID string, ip net.IP) bool {
+	if b.ClientID != "" {
+		return b.ClientID == clientID
+	}
+	return ip != nil && b.network != nil && b.network.Contains(ip)
+}
+
+// Message 返回给被拒绝客户端的说明
+func (b *Ban) Message() string {
+	msg := "banned"
+	if b.Reason != "" {
+		msg += ": " + b.Reason
+	}
+	if !b.ExpiresAt.IsZero() {
+		msg += fmt.Sprintf(" (until %s)", b.ExpiresAt.Format(time.RFC3339))
+	}
+	return msg
+}
+
+// BanList 封禁列表，保存在 banFile 中，服务重启后保持不变
+type BanList struct {
+	mu      sync.Mutex
+	banFile string
+	bans    map[string]*Ban // 封禁ID -> 封禁
+	xl      xlog.Logger
+}
+
+// NewBanList 创建封禁列表，banFile 为空时只保存在内存中
+func NewBanList(banFile string) (*BanList, error) {
+	l := &BanList{
+		banFile: banFile,
+		bans:    make(map[string]*Ban),
+		xl:      xlog.New(),
+	}
+	if err := l.load(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// parseCIDR 解析地址段，单个地址按主机地址处理
+func parseCIDR(s string) (*net.IPNet, error) {
+	if _, network, err := net.ParseCIDR(s); err == nil {
+		return network, nil
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("%w %s", ErrInvalidCIDR, s)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+// load 加载持久化的封禁，丢弃已过期或无效的记录
+func (l *BanList) load() error {
+	if l.banFile == "" {
+		return nil
+	}
+	data, err := os.ReadFile(l.banFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("read ban file error: %v", err)
+	}
+	var bans []*Ban
+	if err := json.Unmarshal(data, &bans); err != nil {
+		return fmt.Errorf("parse ban file error: %v", err)
+	}
+
+	now := time.Now()
+	for _, ban := range bans {
+		if ban.Expired(now) {
+			continue
+		}
+		if ban.CIDR != "" {
+			if ban.network, err = parseCIDR(ban.CIDR); err != nil {
+				l.xl.Warnf("Drop ban %s: %v", ban.ID, err)
+				continue
+			}
+		}
+		l.bans[ban.ID] = ban
+	}
+	return nil
+}
+
+// save 持久化封禁列表，先写临时文件再替换
+func (l *BanList) save() error {
+	if l.banFile == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(l.list(), "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(l.banFile), ".bans-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), l.banFile)
+}
+
+// Add 添加封禁，ClientID 和 CIDR 必须且只能指定一个，duration 为 0 时永久封禁
+func (l *BanList) Add(clientID, cidr, reason string, duration time.Duration) (*Ban, error) {
+	if (clientID == "") == (cidr == "") {
+		return nil, ErrInvalidBan
+	}
+	now := time.Now()
+	ban := &Ban{
+		ID:        utils.RandString(12),
+		ClientID:  clientID,
+		Reason:    reason,
+		CreatedAt: now,
+	}
+	if cidr != "" {
+		network, err := parseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		ban.CIDR = network.String()
+		ban.network = network
+	}
+	if duration > 0 {
+		ban.ExpiresAt = now.Add(duration)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.bans[ban.ID] = ban
+	// 保存失败时撤销，避免重启后封禁丢失
+	if err := l.save(); err != nil {
+		delete(l.bans, ban.ID)
+		return nil, err
+	}
+	return ban, nil
+}
+
+// Remove 解除封禁
+func (l *BanList) Remove(id string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.bans[id]; !ok {
+		return ErrBanNotFound
+	}
+	delete(l.bans, id)
+	return l.save()
+}
+
+// Check 查找命中客户端ID或来源地址的有效封禁
+func (l *BanList) Check(clientID string, ip net.IP) (*Ban, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	for id, ban := range l.bans {
+		if ban.Expired(now) {
+			delete(l.bans, id)
+			continue
+		}
+		if ban.Matches(clientID, ip) {
+			return ban, true
+		}
+	}
+	return nil, false
+}
+
+// List 返回按创建时间排序的有效封禁
+func (l *BanList) List() []Ban {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	bans := l.list()
+	result := make([]Ban, 0, len(bans))
+	for _, ban := range bans {
+		result = append(result, *ban)
+	}
+	return result
+}
+
+func (l *BanList) list() []*Ban {
+	now := time.Now()
+	bans := make([]*Ban, 0, len(l.bans))
+	for _, ban := range l.bans {
+		if !ban.Expired(now) {
+			bans = append(bans, ban)
+		}
+	}
+	sort.Slice(bans, func(i, j int) bool { return bans[i].CreatedAt.Before(bans[j].CreatedAt) })
+	return bans
+}
@@ -0,0 +1,68 @@
+package client_mgr
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBanList(t *testing.T) {
+	banFile := filepath.Join(t.TempDir(), "bans.json")
+	bans, err := NewBanList(banFile)
+	require.NoError(t, err)
+
+	_, err = bans.Add("", "", "", 0)
+	assert.ErrorIs(t, err, ErrInvalidBan)
+	_, err = bans.Add("client-1", "10.0.0.0/8", "", 0)
+	assert.ErrorIs(t, err, ErrInvalidBan)
+	_, err = bans.Add("", "not-an-ip", "", 0)
+	assert.ErrorIs(t, err, ErrInvalidCIDR)
+
+	byID, err := bans.Add("client-1", "", "spam", 0)
+	require.NoError(t, err)
+	byIP, err := bans.Add("", "192.0.2.7", "", time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, "192.0.2.7/32", byIP.CIDR)
+	expired, err := bans.Add("client-2", "", "", time.Nanosecond)
+	require.NoError(t, err)
+	time.Sleep(time.Millisecond)
+
+	ban, ok := bans.Check("client-1", net.ParseIP("198.51.100.1"))
+	assert.True(t, ok)
+	assert.Equal(t, byID.ID, ban.ID)
+	assert.Equal(t, "banned: spam", ban.Message())
+	ban, ok = bans.Check("client-3", net.ParseIP("192.0.2.7"))
+	assert.True(t, ok)
+	assert.Equal(t, byIP.ID, ban.ID)
+	_, ok = bans.Check("client-2", net.ParseIP("192.0.2.8"))
+	assert.False(t, ok, "expired ban %s", expired.ID)
+
+	// 重启后加载未过期的封禁
+	reloaded, err := NewBanList(banFile)
+	require.NoError(t, err)
+	assert.Len(t, reloaded.List(), 2)
+	_, ok = reloaded.Check("client-4", net.ParseIP("192.0.2.7"))
+	assert.True(t, ok)
+
+	require.NoError(t, reloaded.Remove(byIP.ID))
+	assert.ErrorIs(t, reloaded.Remove(byIP.ID), ErrBanNotFound)
+	reloaded, err = NewBanList(banFile)
+	require.NoError(t, err)
+	assert.Len(t, reloaded.List(), 1)
+}
+
+func TestBanListSaveError(t *testing.T) {
+	// 封禁文件所在目录不存在，保存失败
+	bans, err := NewBanList(filepath.Join(t.TempDir(), "missing", "bans.json"))
+	require.NoError(t, err)
+
+	_, err = bans.Add("client-1", "", "", 0)
+	assert.Error(t, err)
+	assert.Empty(t, bans.List())
+	_, ok := bans.Check("client-1", nil)
+	assert.False(t, ok)
+}
@@ -1,38 +1,93 @@
 package client_mgr
 
 import (
-	"net"
+	"crypto/subtle"
+	"errors"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/liuscraft/spider-network/pkg/protocol/hole"
 	"github.com/liuscraft/spider-network/pkg/xlog"
 	"github.com/liuscraft/spider-network/server/types"
 )
 
+// ErrInvalidUDPToken UDP 绑定请求的客户端未注册或令牌不匹配
+var ErrInvalidUDPToken = errors.New("invalid udp bind token")
+
 // ClientManager 客户端管理器
 type ClientManager struct {
 	clients sync.Map
-	xl      xlog.Logger
+	// 保护已注册客户端中会被其他协程更新的字段：UDPAddr 和 Status
+	// 其他包读取这些字段时使用 ClientStatus、Snapshot 等返回副本的方法
+	stateMu sync.RWMutex
+	ipam    *IPAM // 为 nil 时不分配虚拟 IP
+	bans    *BanList
+	// 已发布的 HTTP 服务：服务名 -> *HTTPService
+	servicesMu  sync.RWMutex
+	services    map[string]*HTTPService
+	subscribers subscribers
+	// 持久化的客户端注册表，为 nil 时只保存在内存中
+	registryMu sync.Mutex
+	registry   *registry
+	// 心跳超时被判定离线的次数
+	heartbeatTimeouts atomic.Int64
+	xl                xlog.Logger
 }
 
 func NewClientManager() *ClientManager {
+	bans, _ := NewBanList("")
 	return &ClientManager{
-		xl: xlog.New(),
+		bans: bans,
+		xl:   xlog.New(),
 	}
 }
 
+// SetIPAM 启用虚拟网络地址分配
+func (m *ClientManager) SetIPAM(ipam *IPAM) {
+	m.ipam = ipam
+}
+
+// IPAM 返回虚拟网络地址分配器，未启用时为 nil
+func (m *ClientManager) IPAM() *IPAM {
+	return m.ipam
+}
+
+// SetBans 使用持久化的封禁列表
+func (m *ClientManager) SetBans(bans *BanList) {
+	m.bans = bans
+}
+
+// Bans 返回封禁列表
+func (m *ClientManager) Bans() *BanList {
+	return m.bans
+}
+
 // AddClient 添加客户端
 func (m *ClientManager) AddClient(client *types.ClientInfo) {
 	m.clients.Store(client.ClientID, client)
 	m.xl.Infof("Client added: %s (%s)", client.ClientID, client.Name)
+	m.emitClient(EventClientRegistered, client)
 }
 
-// RemoveClient 移除客户端
+// RemoveClient 关闭客户端连接并移除客户端及其发布的服务
 func (m *ClientManager) RemoveClient(clientID string) {
 	if client, ok := m.GetClient(clientID); ok {
-		client.Conn.Close()
 		m.clients.Delete(clientID)
+		if client.Conn != nil {
+			client.Conn.Close()
+		}
+		m.removeServices(clientID)
 		m.xl.Infof("Client removed: %s", clientID)
+
+		status, _ := m.statusOf(client)
+		m.emitTopology(clientID, status.Peers, nil)
+		for id, other := range m.GetClients() {
+			if status, _ := m.statusOf(other); contains(status.Peers, clientID) {
+				m.emit(Event{Type: EventTopology, ClientID: id, Removed: []Edge{{From: id, To: clientID}}})
+			}
+		}
+		m.emit(Event{Type: EventClientRemoved, ClientID: clientID})
 	}
 }
 
@@ -44,7 +99,85 @@ func (m *ClientManager) GetClient(clientID string) (*types.ClientInfo, bool) {
 	return nil, false
 }
 
-// GetClients 获取所有客户端
+// SetUDPAddr 校验绑定令牌并更新客户端的 UDP 反射地址，地址变化时返回 true
+func (m *ClientManager) SetUDPAddr(clientID, token, addr string) (bool, error) {
+	client, ok := m.GetClient(clientID)
+	if !ok || client.UDPToken == "" || subtle.ConstantTimeCompare([]byte(client.UDPToken), []byte(token)) != 1 {
+		return false, ErrInvalidUDPToken
+	}
+	m.stateMu.Lock()
+	defer m.stateMu.Unlock()
+	if client.UDPAddr == addr {
+		return false, nil
+	}
+	client.UDPAddr = addr
+	return true, nil
+}
+
+// UDPAddr 返回客户端的 UDP 反射地址
+func (m *ClientManager) UDPAddr(clientID string) string {
+	client, ok := m.GetClient(clientID)
+	if !ok {
+		return ""
+	}
+	m.stateMu.RLock()
+	defer m.stateMu.RUnlock()
+	return client.UDPAddr
+}
+
+// statusOf 返回客户端状态的副本
+func (m *ClientManager) statusOf(client *types.ClientInfo) (types.ClientStatus, bool) {
+	m.stateMu.RLock()
+	defer m.stateMu.RUnlock()
+	status := client.Status
+	status.Peers = append([]string(nil), status.Peers...)
+	return status, true
+}
+
+// ClientStatus 返回客户端状态的副本
+func (m *ClientManager) ClientStatus(clientID string) (types.ClientStatus, bool) {
+	client, ok := m.GetClient(clientID)
+	if !ok {
+		return types.ClientStatus{}, false
+	}
+	return m.statusOf(client)
+}
+
+// Online 判断客户端是否在线
+func (m *ClientManager) Online(client *types.ClientInfo) bool {
+	m.stateMu.RLock()
+	defer m.stateMu.RUnlock()
+	return client.Status.Connected
+}
+
+// snapshot 复制客户端信息，Conn 仍指向同一连接
+func (m *ClientManager) snapshot(client *types.ClientInfo) *types.ClientInfo {
+	m.stateMu.RLock()
+	defer m.stateMu.RUnlock()
+	c := *client
+	c.Status.Peers = append([]string(nil), client.Status.Peers...)
+	return &c
+}
+
+// Snapshot 返回客户端信息的副本
+func (m *ClientManager) Snapshot(clientID string) (*types.ClientInfo, bool) {
+	client, ok := m.GetClient(clientID)
+	if !ok {
+		return nil, false
+	}
+	return m.snapshot(client), true
+}
+
+// Snapshots 返回所有客户端信息的副本
+func (m *ClientManager) Snapshots() map[string]*types.ClientInfo {
+	clients := m.GetClients()
+	for id, client := range clients {
+		clients[id] = m.snapshot(client)
+	}
+	return clients
+}
+
+// GetClients 获取所有客户端，返回的客户端状态可能被其他协程更新，读取 Status 时使用 Snapshots
 func (m *ClientManager) GetClients() map[string]*types.ClientInfo {
 	clients := make(map[string]*types.ClientInfo)
 	m.clients.Range(func(key, value interface{}) bool {
@@ -62,17 +195,6 @@ func (m *ClientManager) UpdateClientStatus(clientID string, status types.ClientS
 		return
 	}
 
-	// 计算传输速率
-	timeSinceLastUpdate := status.LastSeen.Sub(client.Status.LastSeen)
-	if timeSinceLastUpdate > 0 {
-		bytesDelta := (status.BytesSent + status.BytesRecv) - (client.Status.BytesSent + client.Status.BytesRecv)
-		status.BytesRate = float64(bytesDelta) / timeSinceLastUpdate.Seconds()
-	}
-
-	// 保持错误信息
-	status.LastError = client.Status.LastError
-	status.LastErrorTime = client.Status.LastErrorTime
-
 	// 验证并更新 peers 列表
 	validPeers := make([]string, 0)
 	for _, peerID := range status.Peers {
@@ -85,11 +207,27 @@ func (m *ClientManager) UpdateClientStatus(clientID string, status types.ClientS
 	}
 	status.Peers = validPeers
 
+	m.stateMu.Lock()
+	// 计算传输速率
+	timeSinceLastUpdate := status.LastSeen.Sub(client.Status.LastSeen)
+	if timeSinceLastUpdate > 0 {
+		bytesDelta := (status.BytesSent + status.BytesRecv) - (client.Status.BytesSent + client.Status.BytesRecv)
+		status.BytesRate = float64(bytesDelta) / timeSinceLastUpdate.Seconds()
+	}
+
+	// 保持错误信息
+	status.LastError = client.Status.LastError
+	status.LastErrorTime = client.Status.LastErrorTime
+
 	// 更新状态
+	before := client.Status.Peers
 	client.Status = status
+	m.stateMu.Unlock()
+	m.emitTopology(clientID, before, status.Peers)
+	m.emitClient(EventClientStatus, client)
 
 	m.xl.Debugf("Client status updated: %s, connected=%v, peers=%v",
-		clientID, client.Status.Connected, client.Status.Peers)
+		clientID, status.Connected, status.Peers)
 }
 
 // UpdateClientError 更新客户端错误状态
@@ -101,8 +239,11 @@ func (m *ClientManager) UpdateClientError(clientID string, err error) {
 	}
 
 	// 更新错误信息
+	m.stateMu.Lock()
 	client.Status.LastError = err.Error()
 	client.Status.LastErrorTime = time.Now()
+	m.stateMu.Unlock()
+	m.emitClient(EventClientStatus, client)
 
 	m.xl.Debugf("Updated client error: %s, error=%v", clientID, err)
 }
@@ -117,43 +258,54 @@ func (m *ClientManager) StartHeartbeat() {
 			now := time.Now()
 			timeout := 30 * time.Second
 
-			m.clients.Range(func(key, value interface{}) bool {
-				client := value.(*types.ClientInfo)
-				if !client.Status.Connected {
-					return true
-				}
-
-				// 检查最后一次心跳时间
-				if now.Sub(client.Status.LastSeen) > timeout {
-					// 计算连接持续时间
-					duration := now.Sub(client.Status.ConnectedAt)
-
-					m.xl.Warnf("Client %s (%s) timed out after %v",
-						client.ClientID,
-						client.Name,
-						duration.Round(time.Second))
-
-					// 更新客户端状态
-					client.Status.Connected = false
-					client.Status.LastSeen = now
-					client.Status.LastError = "Connection timed out"
-					client.Status.LastErrorTime = now
-					client.Status.BytesRate = 0
-					client.Status.P2PBytesRate = 0
-					client.Status.Latency = 0
-
-					// 清空对等节点列表
-					client.Status.Peers = make([]string, 0)
-				}
-
-				return true
-			})
+			for _, client := range m.GetClients() {
+				m.checkTimeout(client, now, timeout)
+			}
 		}
 	}()
 }
 
-// HandleDisconnect 处理客户端断开连接
-func (m *ClientManager) HandleDisconnect(conn net.Conn) {
+// checkTimeout 超过 timeout 没有心跳的在线客户端标记为离线
+func (m *ClientManager) checkTimeout(client *types.ClientInfo, now time.Time, timeout time.Duration) {
+	m.stateMu.Lock()
+	// 检查最后一次心跳时间
+	if !client.Status.Connected || now.Sub(client.Status.LastSeen) <= timeout {
+		m.stateMu.Unlock()
+		return
+	}
+	// 计算连接持续时间
+	duration := now.Sub(client.Status.ConnectedAt)
+
+	// 更新客户端状态
+	client.Status.Connected = false
+	client.Status.LastSeen = now
+	client.Status.LastError = "Connection timed out"
+	client.Status.LastErrorTime = now
+	client.Status.BytesRate = 0
+	client.Status.P2PBytesRate = 0
+	client.Status.Latency = 0
+
+	// 清空对等节点列表
+	peers := client.Status.Peers
+	client.Status.Peers = make([]string, 0)
+	m.stateMu.Unlock()
+
+	m.xl.Warnf("Client %s (%s) timed out after %v",
+		client.ClientID,
+		client.Name,
+		duration.Round(time.Second))
+	m.heartbeatTimeouts.Add(1)
+	m.emitTopology(client.ClientID, peers, nil)
+	m.emitClient(EventClientDisconnected, client)
+}
+
+// HeartbeatTimeouts 返回心跳超时被判定离线的次数
+func (m *ClientManager) HeartbeatTimeouts() int64 {
+	return m.heartbeatTimeouts.Load()
+}
+
+// HandleDisconnect 处理客户端断开连接，返回断开的客户端ID，连接上没有注册客户端时返回空
+func (m *ClientManager) HandleDisconnect(conn *hole.Conn) string {
 	var disconnectedClient *types.ClientInfo
 	var clientID string
 
@@ -169,40 +321,41 @@ func (m *ClientManager) HandleDisconnect(conn net.Conn) {
 	})
 
 	if disconnectedClient == nil {
-		return
+		return ""
 	}
 
+	type peerChange struct {
+		peerID        string
+		before, after []string
+	}
+	var changes []peerChange
+
 	// 更新客户端状态
 	now := time.Now()
+	m.stateMu.Lock()
 	disconnectedClient.Status.Connected = false
 	disconnectedClient.Status.LastSeen = now
 
 	// 计算连接持续时间
 	duration := now.Sub(disconnectedClient.Status.ConnectedAt)
 
-	// 记录断开连接事件
-	m.xl.Warnf("Client %s (%s) disconnected after %v",
-		disconnectedClient.ClientID,
-		disconnectedClient.Name,
-		duration.Round(time.Second))
-
 	// 通知相关的对等节点
 	for _, peerID := range disconnectedClient.Status.Peers {
 		if peer, ok := m.GetClient(peerID); ok {
 			// 从对等节点的列表中移除断开连接的客户端
-			newPeers := make([]string, 0, len(peer.Status.Peers)-1)
+			newPeers := make([]string, 0, len(peer.Status.Peers))
 			for _, id := range peer.Status.Peers {
 				if id != clientID {
 					newPeers = append(newPeers, id)
 				}
 			}
+			changes = append(changes, peerChange{peerID, peer.Status.Peers, newPeers})
 			peer.Status.Peers = newPeers
-			m.xl.Debugf("Removed disconnected client %s from peer %s's peer list",
-				clientID, peerID)
 		}
 	}
 
 	// 清空断开连接客户端的对等节点列表
+	peers := disconnectedClient.Status.Peers
 	disconnectedClient.Status.Peers = make([]string, 0)
 
 	// 添加错误信息
@@ -215,4 +368,20 @@ func (m *ClientManager) HandleDisconnect(conn net.Conn) {
 	disconnectedClient.Status.BytesRate = 0
 	disconnectedClient.Status.P2PBytesRate = 0
 	disconnectedClient.Status.Latency = 0
+	m.stateMu.Unlock()
+
+	// 记录断开连接事件
+	m.xl.Warnf("Client %s (%s) disconnected after %v",
+		disconnectedClient.ClientID,
+		disconnectedClient.Name,
+		duration.Round(time.Second))
+	for _, change := range changes {
+		m.emitTopology(change.peerID, change.before, change.after)
+		m.xl.Debugf("Removed disconnected client %s from peer %s's peer list",
+			clientID, change.peerID)
+	}
+	m.emitTopology(clientID, peers, nil)
+	m.removeServices(clientID)
+	m.emitClient(EventClientDisconnected, disconnectedClient)
+	return clientID
 }
@@ -0,0 +1,90 @@
+package client_mgr
+
+import (
+	"sync"
+
+	"github.com/liuscraft/spider-network/server/types"
+)
+
+// EventType 客户端变化事件类型
+type EventType string
+
+const (
+	EventClientRegistered   EventType = "client_registered"   // 客户端注册或重新注册
+	EventClientDisconnected EventType = "client_disconnected" // 客户端断开或心跳超时，记录仍保留
+	EventClientRemoved      EventType = "client_removed"      // 客户端记录被移除
+	EventClientStatus       EventType = "client_status"       // 心跳上报或错误更新了客户端状态
+	EventTopology           EventType = "topology"            // 客户端之间的连接发生变化
+)
+
+// Edge 拓扑中的一条连接，From 上报了与 To 相连
+type Edge struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// Event 客户端变化事件，Client 为事件发生时客户端信息的副本
+type Event struct {
+	Type     EventType         `json:"type"`
+	ClientID string            `json:"client_id"`
+	Client   *types.ClientInfo `json:"client,omitempty"`
+	Added    []Edge            `json:"added,omitempty"`   // 新增的连接，仅 topology 事件
+	Removed  []Edge            `json:"removed,omitempty"` // 断开的连接，仅 topology 事件
+}
+
+// subscribers 事件订阅者
+type subscribers struct {
+	mu       sync.RWMutex
+	handlers []func(Event)
+}
+
+// Subscribe 订阅客户端变化事件，回调在更新客户端的协程中同步执行，不应阻塞
+func (m *ClientManager) Subscribe(handler func(Event)) {
+	m.subscribers.mu.Lock()
+	defer m.subscribers.mu.Unlock()
+	m.subscribers.handlers = append(m.subscribers.handlers, handler)
+}
+
+func (m *ClientManager) emit(event Event) {
+	m.subscribers.mu.RLock()
+	handlers := m.subscribers.handlers
+	m.subscribers.mu.RUnlock()
+	for _, handler := range handlers {
+		handler(event)
+	}
+}
+
+// emitClient 发送携带客户端副本的事件
+func (m *ClientManager) emitClient(eventType EventType, client *types.ClientInfo) {
+	m.stateMu.RLock()
+	snapshot := *client
+	m.stateMu.RUnlock()
+	m.emit(Event{Type: eventType, ClientID: client.ClientID, Client: &snapshot})
+}
+
+// emitTopology 比较客户端前后的对等节点列表，有变化时发送拓扑事件
+func (m *ClientManager) emitTopology(clientID string, before, after []string) {
+	event := Event{Type: EventTopology, ClientID: clientID}
+	for _, peerID := range after {
+		if !contains(before, peerID) {
+			event.Added = append(event.Added, Edge{From: clientID, To: peerID})
+		}
+	}
+	for _, peerID := range before {
+		if !contains(after, peerID) {
+			event.Removed = append(event.Removed, Edge{From: clientID, To: peerID})
+		}
+	}
+	if len(event.Added) > 0 || len(event.Removed) > 0 {
+		m.emit(event)
+	}
+}
+
+func contains(ids []string, id string) bool {
+	for _, v := range ids {
+		if v == id {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,73 @@
+package client_mgr
+
+import (
+	"testing"
+	"time"
+
+	"github.com/liuscraft/spider-network/server/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEvents(t *testing.T) {
+	m := NewClientManager()
+	var events []Event
+	m.Subscribe(func(event Event) { events = append(events, event) })
+
+	now := time.Now()
+	for _, id := range []string{"client-1", "client-2"} {
+		m.AddClient(&types.ClientInfo{ClientID: id, Status: types.ClientStatus{Connected: true, LastSeen: now}})
+	}
+	require.Len(t, events, 2)
+	assert.Equal(t, EventClientRegistered, events[0].Type)
+	assert.Equal(t, "client-1", events[0].Client.ClientID)
+
+	// 心跳上报新的对等节点
+	events = nil
+	m.UpdateClientStatus("client-1", types.ClientStatus{Connected: true, LastSeen: now, Peers: []string{"client-2"}})
+	require.Len(t, events, 2)
+	assert.Equal(t, EventTopology, events[0].Type)
+	assert.Equal(t, []Edge{{From: "client-1", To: "client-2"}}, events[0].Added)
+	assert.Empty(t, events[0].Removed)
+	assert.Equal(t, EventClientStatus, events[1].Type)
+
+	// 对等节点未变化时只有状态事件
+	events = nil
+	m.UpdateClientStatus("client-1", types.ClientStatus{Connected: true, LastSeen: now, Peers: []string{"client-2"}})
+	require.Len(t, events, 1)
+	assert.Equal(t, EventClientStatus, events[0].Type)
+
+	// 事件中的客户端是副本
+	client, _ := m.GetClient("client-1")
+	client.Name = "changed"
+	assert.Empty(t, events[0].Client.Name)
+
+	// 移除客户端时断开对方上报的连接
+	events = nil
+	m.RemoveClient("client-2")
+	require.Len(t, events, 2)
+	assert.Equal(t, EventTopology, events[0].Type)
+	assert.Equal(t, []Edge{{From: "client-1", To: "client-2"}}, events[0].Removed)
+	assert.Equal(t, Event{Type: EventClientRemoved, ClientID: "client-2"}, events[1])
+}
+
+func TestHeartbeatTimeout(t *testing.T) {
+	m := NewClientManager()
+	var events []Event
+	m.Subscribe(func(event Event) { events = append(events, event) })
+	now := time.Now()
+	m.AddClient(&types.ClientInfo{ClientID: "client-1", Status: types.ClientStatus{Connected: true, LastSeen: now.Add(-time.Minute)}})
+	client, _ := m.GetClient("client-1")
+
+	// 同一客户端只判定一次超时
+	events = nil
+	m.checkTimeout(client, now, 30*time.Second)
+	m.checkTimeout(client, now, 30*time.Second)
+	assert.Equal(t, int64(1), m.HeartbeatTimeouts())
+	require.Len(t, events, 1)
+	assert.Equal(t, EventClientDisconnected, events[0].Type)
+	status, ok := m.ClientStatus("client-1")
+	require.True(t, ok)
+	assert.False(t, status.Connected)
+	assert.Equal(t, "Connection timed out", status.LastError)
+}
@@ -0,0 +1,255 @@
+package client_mgr
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/liuscraft/spider-network/pkg/config"
+	"github.com/liuscraft/spider-network/pkg/xlog"
+)
+
+var (
+	ErrPoolExhausted = errors.New("virtual ip pool exhausted")
+	ErrLeaseNotFound = errors.New("lease not found")
+	ErrStaticLease   = errors.New("static reservation cannot be released")
+)
+
+// Lease 虚拟 IP 租约
+type Lease struct {
+	ClientID   string    `json:"client_id"`
+	IP         string    `json:"ip"`
+	Static     bool      `json:"static"` // 配置文件中的静态保留地址
+	AssignedAt time.Time `json:"assigned_at"`
+}
+
+// IPAM 虚拟网络地址分配，同一客户端ID始终分配相同的地址
+// 动态租约保存在 LeaseFile 中，服务重启后保持不变
+type IPAM struct {
+	mu        sync.Mutex
+	network   *net.IPNet
+	first     uint32 // 第一个可分配的主机地址
+	last      uint32 // 最后一个可分配的主机地址
+	leaseFile string
+	leases    map[string]*Lease // 客户端ID -> 租约
+	owners    map[uint32]string // 地址 -> 客户端ID
+	xl        xlog.Logger
+}
+
+// NewIPAM 创建地址分配器，只支持 IPv4 网段，不分配网络地址和广播地址
+func NewIPAM(cfg config.NetworkConfig) (*IPAM, error) {
+	_, network, err := net.ParseCIDR(cfg.CIDR)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cidr %s: %v", cfg.CIDR, err)
+	}
+	ip := network.IP.To4()
+	ones, bits := network.Mask.Size()
+	if ip == nil || bits != 32 || ones > 30 {
+		return nil, fmt.Errorf("unsupported virtual network: %s", cfg.CIDR)
+	}
+
+	base := binary.BigEndian.Uint32(ip)
+	size := uint32(1) << (32 - ones)
+	p := &IPAM{
+		network:   network,
+		first:     base + 1,
+		last:      base + size - 2,
+		leaseFile: cfg.LeaseFile,
+		leases:    make(map[string]*Lease),
+		owners:    make(map[uint32]string),
+		xl:        xlog.New(),
+	}
+
+	// 静态保留优先于持久化的动态租约
+	for clientID, reserved := range cfg.Reservations {
+		addr, err := p.parseHost(reserved)
+		if err != nil {
+			return nil, fmt.Errorf("invalid reservation for %s: %v", clientID, err)
+		}
+		if owner, used := p.owners[addr]; used {
+			return nil, fmt.Errorf("address %s reserved for both %s and %s", reserved, owner, clientID)
+		}
+		p.add(&Lease{ClientID: clientID, IP: toIP(addr).String(), Static: true}, addr)
+	}
+	if err := p.load(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// parseHost 解析网段内可分配的主机地址
+func (p *IPAM) parseHost(s string) (uint32, error) {
+	ip := net.ParseIP(s).To4()
+	if ip == nil {
+		return 0, fmt.Errorf("invalid ipv4 address: %s", s)
+	}
+	addr := binary.BigEndian.Uint32(ip)
+	if addr < p.first || addr > p.last {
+		return 0, fmt.Errorf("address %s is not a host of %s", s, p.network)
+	}
+	return addr, nil
+}
+
+func (p *IPAM) add(lease *Lease, addr uint32) {
+	p.leases[lease.ClientID] = lease
+	p.owners[addr] = lease.ClientID
+}
+
+// load 加载持久化的动态租约，与静态保留或当前网段冲突的租约被丢弃
+func (p *IPAM) load() error {
+	if p.leaseFile == "" {
+		return nil
+	}
+	data, err := os.ReadFile(p.leaseFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("read lease file error: %v", err)
+	}
+	var leases []*Lease
+	if err := json.Unmarshal(data, &leases); err != nil {
+		return fmt.Errorf("parse lease file error: %v", err)
+	}
+
+	for _, lease := range leases {
+		addr, err := p.parseHost(lease.IP)
+		if err != nil {
+			p.xl.Warnf("Drop lease of %s: %v", lease.ClientID, err)
+			continue
+		}
+		if _, exists := p.leases[lease.ClientID]; exists {
+			continue
+		}
+		if owner, used := p.owners[addr]; used {
+			p.xl.Warnf("Drop lease of %s: %s is reserved for %s", lease.ClientID, lease.IP, owner)
+			continue
+		}
+		lease.Static = false
+		p.add(lease, addr)
+	}
+	return nil
+}
+
+// save 持久化动态租约，先写临时文件再替换，避免写入中断损坏租约文件
+func (p *IPAM) save() error {
+	if p.leaseFile == "" {
+		return nil
+	}
+	leases := make([]*Lease, 0, len(p.leases))
+	for _, lease := range p.leases {
+		if !lease.Static {
+			leases = append(leases, lease)
+		}
+	}
+	sort.Slice(leases, func(i, j int) bool { return leases[i].ClientID < leases[j].ClientID })
+
+	data, err := json.MarshalIndent(leases, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(p.leaseFile), ".leases-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), p.leaseFile)
+}
+
+// Network 返回虚拟网段
+func (p *IPAM) Network() *net.IPNet {
+	return p.network
+}
+
+// Assign 为客户端分配地址，已有租约或静态保留的客户端返回原地址
+func (p *IPAM) Assign(clientID string) (net.IP, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if lease, ok := p.leases[clientID]; ok {
+		return net.ParseIP(lease.IP).To4(), nil
+	}
+	for addr := p.first; addr <= p.last; addr++ {
+		if _, used := p.owners[addr]; used {
+			continue
+		}
+		ip := toIP(addr)
+		p.add(&Lease{ClientID: clientID, IP: ip.String(), AssignedAt: time.Now()}, addr)
+		if err := p.save(); err != nil {
+			p.xl.Errorf("Failed to save leases: %v", err)
+		}
+		return ip, nil
+	}
+	return nil, ErrPoolExhausted
+}
+
+// Release 释放客户端的动态租约
+func (p *IPAM) Release(clientID string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	lease, ok := p.leases[clientID]
+	if !ok {
+		return ErrLeaseNotFound
+	}
+	if lease.Static {
+		return ErrStaticLease
+	}
+	addr, _ := p.parseHost(lease.IP)
+	delete(p.leases, clientID)
+	delete(p.owners, addr)
+	return p.save()
+}
+
+// Lookup 查询地址所属的客户端
+func (p *IPAM) Lookup(ip net.IP) (string, bool) {
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return "", false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	clientID, ok := p.owners[binary.BigEndian.Uint32(ip4)]
+	return clientID, ok
+}
+
+// Leases 返回按地址排序的租约表
+func (p *IPAM) Leases() []Lease {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	leases := make([]Lease, 0, len(p.leases))
+	for _, lease := range p.leases {
+		leases = append(leases, *lease)
+	}
+	sort.Slice(leases, func(i, j int) bool {
+		return binary.BigEndian.Uint32(net.ParseIP(leases[i].IP).To4()) < binary.BigEndian.Uint32(net.ParseIP(leases[j].IP).To4())
+	})
+	return leases
+}
+
+// CIDR 返回带前缀长度的地址，如 10.10.0.2/24
+func (p *IPAM) CIDR(ip net.IP) string {
+	ones, _ := p.network.Mask.Size()
+	return fmt.Sprintf("%s/%d", ip, ones)
+}
+
+func toIP(addr uint32) net.IP {
+	ip := make(net.IP, 4)
+	binary.BigEndian.PutUint32(ip, addr)
+	return ip
+}
@@ -0,0 +1,115 @@
+package client_mgr
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/liuscraft/spider-network/pkg/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIPAMAssign(t *testing.T) {
+	ipam, err := NewIPAM(config.NetworkConfig{CIDR: "10.10.0.0/24"})
+	require.NoError(t, err)
+
+	ip1, err := ipam.Assign("client-1")
+	require.NoError(t, err)
+	assert.Equal(t, "10.10.0.1", ip1.String())
+	assert.Equal(t, "10.10.0.1/24", ipam.CIDR(ip1))
+
+	ip2, err := ipam.Assign("client-2")
+	require.NoError(t, err)
+	assert.Equal(t, "10.10.0.2", ip2.String())
+
+	// 同一客户端始终获得相同地址
+	again, err := ipam.Assign("client-1")
+	require.NoError(t, err)
+	assert.True(t, again.Equal(ip1))
+
+	owner, ok := ipam.Lookup(net.ParseIP("10.10.0.2"))
+	assert.True(t, ok)
+	assert.Equal(t, "client-2", owner)
+	_, ok = ipam.Lookup(net.ParseIP("10.10.0.3"))
+	assert.False(t, ok)
+}
+
+func TestIPAMExhausted(t *testing.T) {
+	// /30 只有两个可用地址
+	ipam, err := NewIPAM(config.NetworkConfig{CIDR: "10.10.0.0/30"})
+	require.NoError(t, err)
+	for _, clientID := range []string{"client-1", "client-2"} {
+		_, err := ipam.Assign(clientID)
+		require.NoError(t, err)
+	}
+	_, err = ipam.Assign("client-3")
+	assert.ErrorIs(t, err, ErrPoolExhausted)
+
+	_, err = NewIPAM(config.NetworkConfig{CIDR: "fd00::/64"})
+	assert.Error(t, err)
+}
+
+func TestIPAMReservations(t *testing.T) {
+	ipam, err := NewIPAM(config.NetworkConfig{
+		CIDR:         "10.10.0.0/24",
+		Reservations: map[string]string{"gateway": "10.10.0.1"},
+	})
+	require.NoError(t, err)
+
+	// 动态分配跳过保留地址
+	ip, err := ipam.Assign("client-1")
+	require.NoError(t, err)
+	assert.Equal(t, "10.10.0.2", ip.String())
+	ip, err = ipam.Assign("gateway")
+	require.NoError(t, err)
+	assert.Equal(t, "10.10.0.1", ip.String())
+
+	assert.ErrorIs(t, ipam.Release("gateway"), ErrStaticLease)
+	assert.NoError(t, ipam.Release("client-1"))
+	assert.ErrorIs(t, ipam.Release("client-1"), ErrLeaseNotFound)
+
+	leases := ipam.Leases()
+	require.Len(t, leases, 1)
+	assert.True(t, leases[0].Static)
+
+	// 网段外或重复的保留地址无效
+	_, err = NewIPAM(config.NetworkConfig{
+		CIDR:         "10.10.0.0/24",
+		Reservations: map[string]string{"client-1": "10.20.0.1"},
+	})
+	assert.Error(t, err)
+	_, err = NewIPAM(config.NetworkConfig{
+		CIDR:         "10.10.0.0/24",
+		Reservations: map[string]string{"client-1": "10.10.0.5", "client-2": "10.10.0.5"},
+	})
+	assert.Error(t, err)
+}
+
+func TestIPAMPersistence(t *testing.T) {
+	cfg := config.NetworkConfig{
+		CIDR:      "10.10.0.0/24",
+		LeaseFile: filepath.Join(t.TempDir(), "leases.json"),
+	}
+	ipam, err := NewIPAM(cfg)
+	require.NoError(t, err)
+	for _, clientID := range []string{"client-1", "client-2", "client-3"} {
+		_, err := ipam.Assign(clientID)
+		require.NoError(t, err)
+	}
+	require.NoError(t, ipam.Release("client-1"))
+
+	// 重启后保持原有租约，新的静态保留覆盖冲突的动态租约
+	cfg.Reservations = map[string]string{"server": "10.10.0.3"}
+	restarted, err := NewIPAM(cfg)
+	require.NoError(t, err)
+	ip, err := restarted.Assign("client-2")
+	require.NoError(t, err)
+	assert.Equal(t, "10.10.0.2", ip.String())
+	owner, _ := restarted.Lookup(net.ParseIP("10.10.0.3"))
+	assert.Equal(t, "server", owner)
+
+	ip, err = restarted.Assign("client-3")
+	require.NoError(t, err)
+	assert.Equal(t, "10.10.0.1", ip.String())
+}
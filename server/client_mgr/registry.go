@@ -0,0 +1,156 @@
+package client_mgr
+
+import "time"
+
+// persistInterval 心跳更新的状态最多每隔该时间保存一次，注册和断开立即保存
+const persistInterval = time.Minute
+
+// registry 持久化的客户端注册表
+type registry struct {
+	store   Store
+	records map[string]*Record   // 客户端ID -> 记录
+	savedAt map[string]time.Time // 客户端ID -> 最后一次保存时间
+	dirty   map[string]bool      // 尚未保存最新状态的客户端
+}
+
+// clone 复制记录，保存后记录仍会被修改
+func (r *Record) clone() *Record {
+	c := *r
+	client := *r.Client
+	c.Client = &client
+	c.History = append([]HistoryEntry(nil), r.History...)
+	return &c
+}
+
+// SetStore 使用持久化的客户端注册表，之前保存的客户端以离线状态加载
+func (m *ClientManager) SetStore(store Store) error {
+	records, err := store.Load()
+	if err != nil {
+		return err
+	}
+
+	reg := &registry{
+		store:   store,
+		records: make(map[string]*Record, len(records)),
+		savedAt: make(map[string]time.Time),
+		dirty:   make(map[string]bool),
+	}
+	now := time.Now()
+	for _, record := range records {
+		record = record.clone()
+		// 上次服务退出时仍在线，按断开处理
+		if record.Client.Status.Connected {
+			record.Totals.add(record.Client.Status)
+			record.Client.Status.Connected = false
+			record.Client.Status.Peers = make([]string, 0)
+			record.Client.Status.BytesRate = 0
+			record.Client.Status.P2PBytesRate = 0
+			record.Client.Status.Latency = 0
+			record.appendHistory(HistoryEntry{Time: now, Event: EventClientDisconnected, Error: "server restarted"})
+			if err := store.Put(record.clone()); err != nil {
+				return err
+			}
+		}
+		reg.records[record.Client.ClientID] = record
+
+		client := *record.Client
+		m.clients.LoadOrStore(client.ClientID, &client)
+	}
+	m.xl.Infof("Loaded %d clients from registry", len(records))
+
+	m.registryMu.Lock()
+	m.registry = reg
+	m.registryMu.Unlock()
+	m.Subscribe(m.persist)
+	return nil
+}
+
+// GetRecord 获取客户端的持久化记录，未启用存储或客户端未注册过时返回 false
+func (m *ClientManager) GetRecord(clientID string) (*Record, bool) {
+	m.registryMu.Lock()
+	defer m.registryMu.Unlock()
+	if m.registry == nil {
+		return nil, false
+	}
+	record, ok := m.registry.records[clientID]
+	if !ok {
+		return nil, false
+	}
+	return record.clone(), true
+}
+
+// Close 保存尚未保存的状态后关闭客户端注册表存储
+func (m *ClientManager) Close() error {
+	m.registryMu.Lock()
+	defer m.registryMu.Unlock()
+	if m.registry == nil {
+		return nil
+	}
+	for clientID := range m.registry.dirty {
+		if err := m.registry.store.Put(m.registry.records[clientID].clone()); err != nil {
+			m.xl.Errorf("Failed to save client %s to registry: %v", clientID, err)
+		}
+	}
+	err := m.registry.store.Close()
+	m.registry = nil
+	return err
+}
+
+// persist 根据客户端变化事件更新注册表
+func (m *ClientManager) persist(event Event) {
+	m.registryMu.Lock()
+	defer m.registryMu.Unlock()
+	reg := m.registry
+	if reg == nil {
+		return
+	}
+
+	now := time.Now()
+	record := reg.records[event.ClientID]
+	switch event.Type {
+	case EventClientRegistered:
+		if record == nil {
+			record = &Record{FirstSeen: now}
+			reg.records[event.ClientID] = record
+		} else if record.Client.Status.Connected {
+			// 重连时旧连接没有断开事件，在这里累计旧连接的流量
+			record.Totals.add(record.Client.Status)
+		}
+		record.Client = event.Client
+		record.appendHistory(HistoryEntry{Time: now, Event: event.Type, PublicAddr: event.Client.PublicAddr})
+	case EventClientStatus:
+		if record == nil {
+			return
+		}
+		record.Client = event.Client
+		if now.Sub(reg.savedAt[event.ClientID]) < persistInterval {
+			reg.dirty[event.ClientID] = true
+			return
+		}
+	case EventClientDisconnected:
+		if record == nil {
+			return
+		}
+		if record.Client.Status.Connected {
+			record.Totals.add(event.Client.Status)
+		}
+		record.Client = event.Client
+		record.appendHistory(HistoryEntry{Time: now, Event: event.Type, Error: event.Client.Status.LastError})
+	case EventClientRemoved:
+		delete(reg.records, event.ClientID)
+		delete(reg.savedAt, event.ClientID)
+		delete(reg.dirty, event.ClientID)
+		if err := reg.store.Delete(event.ClientID); err != nil {
+			m.xl.Errorf("Failed to delete client %s from registry: %v", event.ClientID, err)
+		}
+		return
+	default:
+		return
+	}
+
+	reg.savedAt[event.ClientID] = now
+	delete(reg.dirty, event.ClientID)
+	if err := reg.store.Put(record.clone()); err != nil {
+		m.xl.Errorf("Failed to save client %s to registry: %v", event.ClientID, err)
+	}
+}
@@ -0,0 +1,91 @@
+package client_mgr
+
+import (
+	"errors"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/liuscraft/spider-network/server/types"
+)
+
+var (
+	ErrInvalidServiceName = errors.New("invalid service name")
+	ErrServiceTaken       = errors.New("service name already taken")
+)
+
+// 服务名作为域名的一段使用
+var serviceNamePattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+// HTTPService 客户端发布的 HTTP 服务
+type HTTPService struct {
+	Name        string    `json:"name"`
+	ClientID    string    `json:"client_id"`
+	PublishedAt time.Time `json:"published_at"`
+}
+
+// PublishService 把服务名分配给客户端，服务名被其他在线客户端占用时返回 ErrServiceTaken
+// 同一客户端重复发布时更新发布时间
+func (m *ClientManager) PublishService(name, clientID string) (*HTTPService, error) {
+	name = strings.ToLower(name)
+	if !serviceNamePattern.MatchString(name) {
+		return nil, ErrInvalidServiceName
+	}
+
+	m.servicesMu.Lock()
+	defer m.servicesMu.Unlock()
+	if old, ok := m.services[name]; ok && old.ClientID != clientID {
+		if owner, ok := m.GetClient(old.ClientID); ok && m.Online(owner) {
+			return nil, ErrServiceTaken
+		}
+	}
+	if m.services == nil {
+		m.services = make(map[string]*HTTPService)
+	}
+	service := &HTTPService{Name: name, ClientID: clientID, PublishedAt: time.Now()}
+	m.services[name] = service
+	m.xl.Infof("Client %s published service %s", clientID, name)
+	return service, nil
+}
+
+// LookupService 返回服务及其所属的在线客户端
+func (m *ClientManager) LookupService(name string) (*HTTPService, *types.ClientInfo, bool) {
+	m.servicesMu.RLock()
+	service, ok := m.services[strings.ToLower(name)]
+	m.servicesMu.RUnlock()
+	if !ok {
+		return nil, nil, false
+	}
+	client, ok := m.GetClient(service.ClientID)
+	if !ok || !m.Online(client) {
+		return service, nil, false
+	}
+	return service, client, true
+}
+
+// GetServices 返回所有已发布的服务，按服务名排序
+func (m *ClientManager) GetServices() []*HTTPService {
+	m.servicesMu.RLock()
+	services := make([]*HTTPService, 0, len(m.services))
+	for _, service := range m.services {
+		services = append(services, service)
+	}
+	m.servicesMu.RUnlock()
+	sort.Slice(services, func(i, j int) bool {
+		return services[i].Name < services[j].Name
+	})
+	return services
+}
+
+// removeServices 客户端断开后撤销其发布的服务，重连后由客户端重新发布
+func (m *ClientManager) removeServices(clientID string) {
+	m.servicesMu.Lock()
+	defer m.servicesMu.Unlock()
+	for name, service := range m.services {
+		if service.ClientID == clientID {
+			delete(m.services, name)
+			m.xl.Infof("Service %s of client %s removed", name, clientID)
+		}
+	}
+}
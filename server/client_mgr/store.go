@@ -0,0 +1,283 @@
+package client_mgr
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/liuscraft/spider-network/pkg/xlog"
+	"github.com/liuscraft/spider-network/server/types"
+)
+
+const (
+	maxHistory    = 100  // 每个客户端保留的历史记录数
+	maxWALEntries = 1000 // 日志超过该条数后合并到快照
+)
+
+// Totals 客户端历次连接的累计流量，不含当前连接
+type Totals struct {
+	BytesSent      int64 `json:"bytes_sent"`
+	BytesRecv      int64 `json:"bytes_recv"`
+	P2PBytesSent   int64 `json:"p2p_bytes_sent"`
+	P2PBytesRecv   int64 `json:"p2p_bytes_recv"`
+	RelayBytesSent int64 `json:"relay_bytes_sent"`
+	RelayBytesRecv int64 `json:"relay_bytes_recv"`
+}
+
+// add 累加一次连接上报的流量
+func (t *Totals) add(status types.ClientStatus) {
+	t.BytesSent += status.BytesSent
+	t.BytesRecv += status.BytesRecv
+	t.P2PBytesSent += status.P2PBytesSent
+	t.P2PBytesRecv += status.P2PBytesRecv
+	t.RelayBytesSent += status.RelayBytesSent
+	t.RelayBytesRecv += status.RelayBytesRecv
+}
+
+// HistoryEntry 客户端的一次注册或断开记录
+type HistoryEntry struct {
+	Time       time.Time `json:"time"`
+	Event      EventType `json:"event"`
+	PublicAddr string    `json:"public_addr,omitempty"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// Record 持久化的客户端记录，Client 为最后一次更新时的客户端信息，不含连接
+type Record struct {
+	Client    *types.ClientInfo `json:"client"`
+	FirstSeen time.Time         `json:"first_seen"`
+	Totals    Totals            `json:"totals"`
+	History   []HistoryEntry    `json:"history,omitempty"` // 按时间顺序，最多保留 maxHistory 条
+}
+
+// appendHistory 追加历史记录，超出上限时丢弃最早的记录
+func (r *Record) appendHistory(entry HistoryEntry) {
+	r.History = append(r.History, entry)
+	if len(r.History) > maxHistory {
+		r.History = append([]HistoryEntry(nil), r.History[len(r.History)-maxHistory:]...)
+	}
+}
+
+// Store 客户端注册表存储
+type Store interface {
+	// Load 返回所有已保存的记录
+	Load() ([]*Record, error)
+	// Put 保存或覆盖客户端记录
+	Put(record *Record) error
+	// Delete 删除客户端记录，记录不存在时不报错
+	Delete(clientID string) error
+	Close() error
+}
+
+// walEntry 日志中的一次修改
+type walEntry struct {
+	Op       string  `json:"op"` // put 或 delete
+	ClientID string  `json:"client_id"`
+	Record   *Record `json:"record,omitempty"`
+}
+
+// FileStore 基于文件的注册表存储，目录下保存 JSON 快照 clients.json 和追加写的日志 clients.wal
+// 每次修改只追加一行日志，打开时回放日志，日志过长时合并到快照
+type FileStore struct {
+	mu         sync.Mutex
+	dir        string
+	records    map[string]*Record // 客户端ID -> 记录
+	wal        *os.File
+	walEntries int
+	xl         xlog.Logger
+}
+
+// NewFileStore 打开 dir 下的注册表，目录不存在时创建
+func NewFileStore(dir string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("create registry dir error: %v", err)
+	}
+	s := &FileStore{
+		dir:     dir,
+		records: make(map[string]*Record),
+		xl:      xlog.New(),
+	}
+	if err := s.loadSnapshot(); err != nil {
+		return nil, err
+	}
+	if err := s.replay(); err != nil {
+		return nil, err
+	}
+	// 打开时合并一次，丢弃回放过的日志
+	if err := s.compact(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *FileStore) snapshotPath() string {
+	return filepath.Join(s.dir, "clients.json")
+}
+
+func (s *FileStore) walPath() string {
+	return filepath.Join(s.dir, "clients.wal")
+}
+
+func (s *FileStore) loadSnapshot() error {
+	data, err := os.ReadFile(s.snapshotPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("read registry snapshot error: %v", err)
+	}
+	var records []*Record
+	if err := json.Unmarshal(data, &records); err != nil {
+		return fmt.Errorf("parse registry snapshot error: %v", err)
+	}
+	for _, record := range records {
+		if record.Client != nil {
+			s.records[record.Client.ClientID] = record
+		}
+	}
+	return nil
+}
+
+// replay 回放日志，进程崩溃时最后一行可能不完整，忽略之后的内容
+func (s *FileStore) replay() error {
+	f, err := os.Open(s.walPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("open registry wal error: %v", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var entry walEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			s.xl.Warnf("Drop corrupted registry wal tail: %v", err)
+			return nil
+		}
+		s.apply(&entry)
+	}
+	if err := scanner.Err(); err != nil {
+		s.xl.Warnf("Drop unreadable registry wal tail: %v", err)
+	}
+	return nil
+}
+
+func (s *FileStore) apply(entry *walEntry) {
+	switch entry.Op {
+	case "put":
+		if entry.Record != nil && entry.Record.Client != nil {
+			s.records[entry.ClientID] = entry.Record
+		}
+	case "delete":
+		delete(s.records, entry.ClientID)
+	}
+}
+
+// compact 写入新快照并清空日志，先写临时文件再替换
+func (s *FileStore) compact() error {
+	records := make([]*Record, 0, len(s.records))
+	for _, record := range s.records {
+		records = append(records, record)
+	}
+	data, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(s.dir, ".clients-*")
+	if err != nil {
+		return fmt.Errorf("create registry snapshot error: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("write registry snapshot error: %v", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("sync registry snapshot error: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), s.snapshotPath()); err != nil {
+		return fmt.Errorf("replace registry snapshot error: %v", err)
+	}
+
+	// 快照替换成功后才能清空日志
+	if s.wal != nil {
+		s.wal.Close()
+	}
+	s.wal, err = os.OpenFile(s.walPath(), os.O_CREATE|os.O_WRONLY|os.O_TRUNC|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("open registry wal error: %v", err)
+	}
+	s.walEntries = 0
+	return nil
+}
+
+func (s *FileStore) write(entry *walEntry) error {
+	if s.wal == nil {
+		return os.ErrClosed
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if _, err := s.wal.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("write registry wal error: %v", err)
+	}
+	s.apply(entry)
+	if s.walEntries++; s.walEntries >= maxWALEntries {
+		return s.compact()
+	}
+	return nil
+}
+
+// Load 返回所有已保存的记录
+func (s *FileStore) Load() ([]*Record, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	records := make([]*Record, 0, len(s.records))
+	for _, record := range s.records {
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// Put 保存或覆盖客户端记录
+func (s *FileStore) Put(record *Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.write(&walEntry{Op: "put", ClientID: record.Client.ClientID, Record: record})
+}
+
+// Delete 删除客户端记录
+func (s *FileStore) Delete(clientID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.records[clientID]; !ok {
+		return nil
+	}
+	return s.write(&walEntry{Op: "delete", ClientID: clientID})
+}
+
+// Close 合并日志后关闭存储
+func (s *FileStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.wal == nil {
+		return nil
+	}
+	err := s.compact()
+	s.wal.Close()
+	s.wal = nil
+	return err
+}
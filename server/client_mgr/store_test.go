@@ -0,0 +1,102 @@
+package client_mgr
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/liuscraft/spider-network/server/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileStore(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewFileStore(dir)
+	require.NoError(t, err)
+
+	put := func(id, name string) {
+		require.NoError(t, store.Put(&Record{Client: &types.ClientInfo{ClientID: id, Name: name}}))
+	}
+	put("client-1", "one")
+	put("client-2", "two")
+	put("client-1", "one again")
+	require.NoError(t, store.Delete("client-2"))
+	require.NoError(t, store.Delete("missing"))
+
+	// 未合并时从快照加日志恢复，最后一行不完整时忽略
+	f, err := os.OpenFile(filepath.Join(dir, "clients.wal"), os.O_WRONLY|os.O_APPEND, 0o644)
+	require.NoError(t, err)
+	_, err = f.WriteString(`{"op":"put","client_id":"client-3","rec`)
+	require.NoError(t, err)
+	f.Close()
+
+	reopened, err := NewFileStore(dir)
+	require.NoError(t, err)
+	records, err := reopened.Load()
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	assert.Equal(t, "one again", records[0].Client.Name)
+
+	// 打开时已合并到快照
+	wal, err := os.ReadFile(filepath.Join(dir, "clients.wal"))
+	require.NoError(t, err)
+	assert.Empty(t, wal)
+	require.NoError(t, reopened.Close())
+	require.NoError(t, reopened.Close())
+	assert.Error(t, reopened.Put(&Record{Client: &types.ClientInfo{ClientID: "client-4"}}))
+}
+
+func TestRegistry(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewFileStore(dir)
+	require.NoError(t, err)
+	m := NewClientManager()
+	require.NoError(t, m.SetStore(store))
+
+	m.AddClient(&types.ClientInfo{ClientID: "client-1", Name: "one", PublicAddr: "192.0.2.1:4000", Status: types.ClientStatus{Connected: true, LastSeen: time.Now()}})
+	m.UpdateClientStatus("client-1", types.ClientStatus{Connected: true, LastSeen: time.Now(), BytesSent: 100})
+	// 重连时累计旧连接的流量
+	m.AddClient(&types.ClientInfo{ClientID: "client-1", Name: "one", PublicAddr: "192.0.2.1:4001", Status: types.ClientStatus{Connected: true, LastSeen: time.Now()}})
+	m.UpdateClientStatus("client-1", types.ClientStatus{Connected: true, LastSeen: time.Now(), BytesSent: 50})
+	m.UpdateClientError("client-1", assert.AnError)
+
+	record, ok := m.GetRecord("client-1")
+	require.True(t, ok)
+	assert.Equal(t, int64(100), record.Totals.BytesSent)
+	assert.Equal(t, int64(50), record.Client.Status.BytesSent)
+	require.Len(t, record.History, 2)
+	assert.Equal(t, "192.0.2.1:4001", record.History[1].PublicAddr)
+	firstSeen := record.FirstSeen
+
+	m.AddClient(&types.ClientInfo{ClientID: "client-2", Status: types.ClientStatus{Connected: true}})
+	m.RemoveClient("client-2")
+	_, ok = m.GetRecord("client-2")
+	assert.False(t, ok)
+
+	// 重启后以离线状态加载，仍在线的连接按断开处理
+	require.NoError(t, m.Close())
+	store, err = NewFileStore(dir)
+	require.NoError(t, err)
+	m = NewClientManager()
+	require.NoError(t, m.SetStore(store))
+	defer m.Close()
+
+	client, ok := m.GetClient("client-1")
+	require.True(t, ok)
+	assert.False(t, client.Status.Connected)
+	assert.Nil(t, client.Conn)
+	assert.Equal(t, "one", client.Name)
+	_, ok = m.GetClient("client-2")
+	assert.False(t, ok)
+
+	record, ok = m.GetRecord("client-1")
+	require.True(t, ok)
+	assert.True(t, firstSeen.Equal(record.FirstSeen))
+	assert.Equal(t, int64(150), record.Totals.BytesSent)
+	assert.Equal(t, assert.AnError.Error(), record.Client.Status.LastError)
+	require.Len(t, record.History, 3)
+	assert.Equal(t, EventClientDisconnected, record.History[2].Event)
+	assert.Equal(t, "server restarted", record.History[2].Error)
+}
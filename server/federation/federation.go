@@ -0,0 +1,456 @@
+/*
+	Federation 多区域互联
+	1. 服务端之间通过信令端口建立互联连接，使用共享令牌双向认证
+	2. 连接建立后发送本地客户端的完整注册表，之后增量同步注册和断开
+	3. 目标客户端注册在其他区域时，打洞和连接信令经互联连接转发给目标所在的服务端
+*/
+
+package federation
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/liuscraft/spider-network/pkg/config"
+	"github.com/liuscraft/spider-network/pkg/protocol/hole"
+	"github.com/liuscraft/spider-network/pkg/tlsutil"
+	"github.com/liuscraft/spider-network/pkg/xlog"
+	"github.com/liuscraft/spider-network/server/client_mgr"
+	"github.com/liuscraft/spider-network/server/types"
+)
+
+const (
+	dialTimeout      = 5 * time.Second
+	handshakeTimeout = 10 * time.Second
+	maxBackoff       = 30 * time.Second
+)
+
+var ErrDuplicateLink = errors.New("duplicate federation link")
+
+// Remote 其他区域的客户端及其所在的服务端
+type Remote struct {
+	hole.FederatedClient
+	ServerID string `json:"server_id"`
+}
+
+// link 与一个服务端的互联连接
+type link struct {
+	serverID string
+	dialer   string // 发起连接的服务端ID，重复连接时保留发起方ID较小的一条
+	conn     *hole.Conn
+}
+
+// Federation 互联管理器
+type Federation struct {
+	config    config.FederationConfig
+	clientMgr *client_mgr.ClientManager
+	deliver   func(msg *hole.Message) error // 把转发来的信令投递给本地客户端
+
+	syncMu  sync.Mutex // 保证完整注册表和增量同步按顺序发送
+	links   sync.Map   // 服务端ID -> *link
+	remotes sync.Map   // 客户端ID -> *Remote
+
+	closed    chan struct{}
+	closeOnce sync.Once
+	xl        xlog.Logger
+}
+
+// New 创建互联管理器，未配置 ServerID 时返回 nil 表示不启用
+func New(cfg config.FederationConfig, clientMgr *client_mgr.ClientManager, deliver func(msg *hole.Message) error) (*Federation, error) {
+	if cfg.ServerID == "" {
+		return nil, nil
+	}
+	if cfg.Token == "" {
+		return nil, errors.New("federation token is required")
+	}
+	return &Federation{
+		config:    cfg,
+		clientMgr: clientMgr,
+		deliver:   deliver,
+		closed:    make(chan struct{}),
+		xl:        xlog.NewWithLogId("spider-federation[" + cfg.ServerID + "]"),
+	}, nil
+}
+
+// ServerID 返回本服务端的ID
+func (f *Federation) ServerID() string {
+	return f.config.ServerID
+}
+
+// Start 连接配置的其他区域，断开后自动重连
+func (f *Federation) Start() {
+	for _, peer := range f.config.Peers {
+		go f.dialLoop(peer)
+	}
+}
+
+// Close 关闭所有互联连接并停止重连
+func (f *Federation) Close() {
+	f.closeOnce.Do(func() {
+		close(f.closed)
+		f.links.Range(func(_, value interface{}) bool {
+			value.(*link).conn.Close()
+			return true
+		})
+	})
+}
+
+func (f *Federation) dialLoop(peer config.FederationPeer) {
+	backoff := time.Second
+	for {
+		start := time.Now()
+		err := f.dialPeer(peer)
+		select {
+		case <-f.closed:
+			return
+		default:
+		}
+		// 连接保持了一段时间才断开时从最短间隔开始重连
+		if time.Since(start) > maxBackoff {
+			backoff = time.Second
+		}
+		if errors.Is(err, ErrDuplicateLink) {
+			f.xl.Debugf("Federation link to %s already exists", peer.Addr)
+		} else if err != nil {
+			f.xl.Warnf("Federation link to %s lost: %v", peer.Addr, err)
+		}
+
+		select {
+		case <-f.closed:
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// dialPeer 连接其他区域并完成握手，连接断开后返回
+func (f *Federation) dialPeer(peer config.FederationPeer) error {
+	dialer := &net.Dialer{Timeout: dialTimeout}
+	var raw net.Conn
+	var err error
+	if peer.TLS || peer.CAFile != "" || peer.PinnedKey != "" {
+		tlsConfig, cfgErr := tlsutil.ClientConfig(tlsutil.ClientOptions{CAFile: peer.CAFile, PinnedKey: peer.PinnedKey})
+		if cfgErr != nil {
+			return cfgErr
+		}
+		raw, err = tls.DialWithDialer(dialer, "tcp", peer.Addr, tlsConfig)
+	} else {
+		raw, err = dialer.Dial("tcp", peer.Addr)
+	}
+	if err != nil {
+		return err
+	}
+	conn := hole.NewConn(raw)
+
+	raw.SetDeadline(time.Now().Add(handshakeTimeout))
+	serverID, err := f.handshake(conn)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("federation handshake error: %v", err)
+	}
+	raw.SetDeadline(time.Time{})
+
+	return f.serve(&link{serverID: serverID, dialer: f.config.ServerID, conn: conn})
+}
+
+// handshake 发起方握手，返回对方的服务端ID
+func (f *Federation) handshake(conn *hole.Conn) (string, error) {
+	nonce, err := hole.NewNonce()
+	if err != nil {
+		return "", err
+	}
+	if err := f.writeFederate(conn, &hole.FederatePayload{ServerID: f.config.ServerID, Nonce: nonce}); err != nil {
+		return "", err
+	}
+
+	msg, err := conn.ReadMessage()
+	if err != nil {
+		return "", err
+	}
+	reply, err := readFederate(msg)
+	if err != nil {
+		return "", err
+	}
+	if reply.ServerID == "" || reply.ServerID == f.config.ServerID {
+		return "", fmt.Errorf("invalid server id %q", reply.ServerID)
+	}
+	if !hole.VerifyFederate(f.config.Token, reply.ServerID, nonce, reply.Signature) {
+		return "", fmt.Errorf("server %s failed authentication", reply.ServerID)
+	}
+
+	signature := hole.SignFederate(f.config.Token, f.config.ServerID, reply.Nonce)
+	if err := f.writeFederate(conn, &hole.FederatePayload{ServerID: f.config.ServerID, Signature: signature}); err != nil {
+		return "", err
+	}
+	return reply.ServerID, nil
+}
+
+// Accept 处理其他区域发起的互联连接，msg 为连接上的首条 TypeFederate 消息，连接断开后返回
+func (f *Federation) Accept(conn *hole.Conn, msg *hole.Message) error {
+	hello, err := readFederate(msg)
+	if err != nil {
+		return err
+	}
+	if hello.ServerID == "" || hello.ServerID == f.config.ServerID {
+		return fmt.Errorf("invalid server id %q", hello.ServerID)
+	}
+
+	nonce, err := hole.NewNonce()
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	if err := f.writeFederate(conn, &hole.FederatePayload{
+		ServerID:  f.config.ServerID,
+		Nonce:     nonce,
+		Signature: hole.SignFederate(f.config.Token, f.config.ServerID, hello.Nonce),
+	}); err != nil {
+		return err
+	}
+	msg, err = conn.ReadMessage()
+	if err != nil {
+		return err
+	}
+	proof, err := readFederate(msg)
+	if err != nil {
+		return err
+	}
+	if proof.ServerID != hello.ServerID || !hole.VerifyFederate(f.config.Token, hello.ServerID, nonce, proof.Signature) {
+		return fmt.Errorf("server %s failed authentication", hello.ServerID)
+	}
+	conn.SetDeadline(time.Time{})
+
+	return f.serve(&link{serverID: hello.ServerID, dialer: hello.ServerID, conn: conn})
+}
+
+func (f *Federation) writeFederate(conn *hole.Conn, payload *hole.FederatePayload) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("marshal federate payload error: %v", err)
+	}
+	return conn.WriteMessage(&hole.Message{
+		Type:    hole.TypeFederate,
+		From:    f.config.ServerID,
+		Payload: data,
+	})
+}
+
+func readFederate(msg *hole.Message) (*hole.FederatePayload, error) {
+	if msg.Type != hole.TypeFederate {
+		return nil, fmt.Errorf("unexpected message type: %s", msg.Type)
+	}
+	var payload hole.FederatePayload
+	if err := json.Unmarshal(msg.Payload, &payload); err != nil {
+		return nil, fmt.Errorf("unmarshal federate payload error: %v", err)
+	}
+	return &payload, nil
+}
+
+// serve 登记互联连接，发送完整注册表后处理对方的消息，直到连接断开
+func (f *Federation) serve(l *link) error {
+	defer l.conn.Close()
+	if !f.addLink(l) {
+		return ErrDuplicateLink
+	}
+	defer f.removeLink(l)
+	f.xl.Infof("Federation link with %s established", l.serverID)
+
+	if err := f.sendSnapshot(l); err != nil {
+		return err
+	}
+	for {
+		msg, err := l.conn.ReadMessage()
+		if err != nil {
+			if err == io.EOF || errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		switch msg.Type {
+		case hole.TypeSync:
+			var payload hole.SyncPayload
+			if err := json.Unmarshal(msg.Payload, &payload); err != nil {
+				return fmt.Errorf("unmarshal sync payload error: %v", err)
+			}
+			f.applySync(l.serverID, &payload)
+		case hole.TypePunch, hole.TypePunchReady, hole.TypeConnect:
+			// 只接受来自该服务端所登记客户端的信令
+			if remote, ok := f.Lookup(msg.From); !ok || remote.ServerID != l.serverID {
+				f.xl.Warnf("Drop %s message from %s: not registered on %s", msg.Type, msg.From, l.serverID)
+				continue
+			}
+			if err := f.deliver(msg); err != nil {
+				f.xl.Warnf("Failed to deliver %s message from %s to %s: %v", msg.Type, msg.From, msg.To, err)
+			}
+		default:
+			f.xl.Warnf("Unknown federation message type: %s", msg.Type)
+		}
+	}
+}
+
+// addLink 登记连接，已有同一服务端的连接时保留发起方ID较小的一条
+func (f *Federation) addLink(l *link) bool {
+	f.syncMu.Lock()
+	defer f.syncMu.Unlock()
+	if value, ok := f.links.Load(l.serverID); ok {
+		old := value.(*link)
+		if old.dialer <= l.dialer {
+			return false
+		}
+		old.conn.Close()
+	}
+	f.links.Store(l.serverID, l)
+	return true
+}
+
+// removeLink 注销连接并移除对方同步的客户端，连接已被替换时不做处理
+func (f *Federation) removeLink(l *link) {
+	f.syncMu.Lock()
+	defer f.syncMu.Unlock()
+	if !f.links.CompareAndDelete(l.serverID, l) {
+		return
+	}
+	f.dropRemotes(l.serverID)
+	f.xl.Infof("Federation link with %s closed", l.serverID)
+}
+
+func (f *Federation) dropRemotes(serverID string) {
+	f.remotes.Range(func(key, value interface{}) bool {
+		if value.(*Remote).ServerID == serverID {
+			f.remotes.Delete(key)
+		}
+		return true
+	})
+}
+
+func (f *Federation) applySync(serverID string, payload *hole.SyncPayload) {
+	f.syncMu.Lock()
+	defer f.syncMu.Unlock()
+	if payload.Full {
+		f.dropRemotes(serverID)
+	}
+	for _, client := range payload.Clients {
+		f.remotes.Store(client.ClientID, &Remote{FederatedClient: client, ServerID: serverID})
+	}
+	for _, clientID := range payload.Removed {
+		if value, ok := f.remotes.Load(clientID); ok && value.(*Remote).ServerID == serverID {
+			f.remotes.Delete(clientID)
+		}
+	}
+}
+
+// sendSnapshot 发送本地在线客户端的完整注册表
+func (f *Federation) sendSnapshot(l *link) error {
+	f.syncMu.Lock()
+	defer f.syncMu.Unlock()
+	payload := &hole.SyncPayload{Full: true}
+	for _, client := range f.clientMgr.Snapshots() {
+		if client.Status.Connected {
+			payload.Clients = append(payload.Clients, federatedClient(client))
+		}
+	}
+	return f.writeSync(l, payload)
+}
+
+// Announce 把新注册的本地客户端同步给所有区域
+func (f *Federation) Announce(client *types.ClientInfo) {
+	f.broadcast(&hole.SyncPayload{Clients: []hole.FederatedClient{federatedClient(client)}})
+}
+
+// Withdraw 通知所有区域本地客户端已断开
+func (f *Federation) Withdraw(clientID string) {
+	f.broadcast(&hole.SyncPayload{Removed: []string{clientID}})
+}
+
+func (f *Federation) broadcast(payload *hole.SyncPayload) {
+	f.syncMu.Lock()
+	defer f.syncMu.Unlock()
+	f.links.Range(func(_, value interface{}) bool {
+		l := value.(*link)
+		if err := f.writeSync(l, payload); err != nil {
+			f.xl.Warnf("Failed to sync with %s: %v", l.serverID, err)
+		}
+		return true
+	})
+}
+
+func (f *Federation) writeSync(l *link, payload *hole.SyncPayload) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("marshal sync payload error: %v", err)
+	}
+	return l.conn.WriteMessage(&hole.Message{
+		Type:    hole.TypeSync,
+		From:    f.config.ServerID,
+		To:      l.serverID,
+		Payload: data,
+	})
+}
+
+func federatedClient(client *types.ClientInfo) hole.FederatedClient {
+	return hole.FederatedClient{
+		ClientID:  client.ClientID,
+		Name:      client.Name,
+		PublicKey: client.PublicKey,
+		NATType:   client.Status.NATType,
+	}
+}
+
+// Lookup 查找注册在其他区域的客户端
+func (f *Federation) Lookup(clientID string) (*Remote, bool) {
+	if value, ok := f.remotes.Load(clientID); ok {
+		return value.(*Remote), true
+	}
+	return nil, false
+}
+
+// Remotes 返回其他区域的所有客户端，按客户端ID排序
+func (f *Federation) Remotes() []*Remote {
+	remotes := make([]*Remote, 0)
+	f.remotes.Range(func(_, value interface{}) bool {
+		remotes = append(remotes, value.(*Remote))
+		return true
+	})
+	sort.Slice(remotes, func(i, j int) bool {
+		return remotes[i].ClientID < remotes[j].ClientID
+	})
+	return remotes
+}
+
+// Links 返回已连接的服务端ID
+func (f *Federation) Links() []string {
+	links := make([]string, 0)
+	f.links.Range(func(key, _ interface{}) bool {
+		links = append(links, key.(string))
+		return true
+	})
+	sort.Strings(links)
+	return links
+}
+
+// Forward 把信令转发给目标客户端所在的服务端
+func (f *Federation) Forward(msg *hole.Message) error {
+	remote, ok := f.Lookup(msg.To)
+	if !ok {
+		return fmt.Errorf("target client not found: %s", msg.To)
+	}
+	value, ok := f.links.Load(remote.ServerID)
+	if !ok {
+		return fmt.Errorf("server %s is not connected", remote.ServerID)
+	}
+	if err := value.(*link).conn.WriteMessage(msg); err != nil {
+		return fmt.Errorf("forward to server %s error: %v", remote.ServerID, err)
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+package federation
+
+import (
+	"net"
+	"testing"
+
+	"github.com/liuscraft/spider-network/pkg/config"
+	"github.com/liuscraft/spider-network/pkg/protocol/hole"
+	"github.com/liuscraft/spider-network/server/client_mgr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDuplicateLink(t *testing.T) {
+	f, err := New(config.FederationConfig{ServerID: "area-b", Token: "secret"}, client_mgr.NewClientManager(), nil)
+	require.NoError(t, err)
+
+	newLink := func(dialer string) *link {
+		a, b := net.Pipe()
+		t.Cleanup(func() { b.Close() })
+		return &link{serverID: "area-a", dialer: dialer, conn: hole.NewConn(a)}
+	}
+
+	// 双方互相连接时两端都保留发起方ID较小的一条
+	inbound := newLink("area-a")
+	outbound := newLink("area-b")
+	require.True(t, f.addLink(outbound))
+	require.True(t, f.addLink(inbound))
+	assert.False(t, f.addLink(newLink("area-b")))
+
+	f.applySync("area-a", &hole.SyncPayload{Full: true, Clients: []hole.FederatedClient{{ClientID: "client-a"}}})
+	_, ok := f.Lookup("client-a")
+	require.True(t, ok)
+
+	// 被替换的连接关闭时不影响新连接同步的客户端
+	f.removeLink(outbound)
+	_, ok = f.Lookup("client-a")
+	assert.True(t, ok)
+	f.removeLink(inbound)
+	_, ok = f.Lookup("client-a")
+	assert.False(t, ok)
+	assert.Empty(t, f.Links())
+}
+
+func TestNewWithoutServerID(t *testing.T) {
+	f, err := New(config.FederationConfig{}, client_mgr.NewClientManager(), nil)
+	assert.NoError(t, err)
+	assert.Nil(t, f)
+
+	_, err = New(config.FederationConfig{ServerID: "area-a"}, client_mgr.NewClientManager(), nil)
+	assert.Error(t, err)
+}
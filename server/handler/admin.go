@@ -0,0 +1,108 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/liuscraft/spider-network/pkg/protocol/hole"
+	"github.com/liuscraft/spider-network/pkg/xlog"
+	"github.com/liuscraft/spider-network/server/client_mgr"
+	"github.com/liuscraft/spider-network/server/types"
+)
+
+var ErrClientNotFound = errors.New("client not found")
+
+// Kick 断开客户端并通知与其相连的对等端断开，客户端之后仍可重新注册，需要阻止时使用 Ban
+func (h *HoleHandler) Kick(clientID, reason string) error {
+	client, ok := h.clientMgr.Snapshot(clientID)
+	if !ok {
+		return ErrClientNotFound
+	}
+	if reason == "" {
+		reason = "kicked by administrator"
+	}
+	h.evict(client, hole.NewError(hole.ErrCodeKicked, reason))
+	return nil
+}
+
+// Ban 封禁客户端ID或来源地址段，并断开当前命中封禁的客户端
+func (h *HoleHandler) Ban(clientID, cidr, reason string, duration time.Duration) (*client_mgr.Ban, error) {
+	ban, err := h.clientMgr.Bans().Add(clientID, cidr, reason, duration)
+	if err != nil {
+		return nil, err
+	}
+	xlog.Infof("Ban %s added: client=%s cidr=%s reason=%s", ban.ID, ban.ClientID, ban.CIDR, ban.Reason)
+	for _, client := range h.clientMgr.Snapshots() {
+		if ban.Matches(client.ClientID, remoteIP(client.Conn)) {
+			h.evict(client, hole.NewError(hole.ErrCodeBanned, ban.Message()))
+		}
+	}
+	return ban, nil
+}
+
+// Unban 解除封禁
+func (h *HoleHandler) Unban(id string) error {
+	return h.clientMgr.Bans().Remove(id)
+}
+
+// evict 通知客户端原因后移除客户端，关闭其中继通道，并通知与其相连的对等端断开，client 为客户端副本
+func (h *HoleHandler) evict(client *types.ClientInfo, reason *hole.ErrorPayload) {
+	xlog.Warnf("Evict client %s: %v", client.ClientID, reason)
+	if client.Conn != nil && client.Status.Connected {
+		h.reject(client.Conn, client.ClientID, reason)
+	}
+
+	// 心跳上报的对等端、对方上报的对等端以及中继的另一端
+	peers := make(map[string]bool)
+	for _, peerID := range client.Status.Peers {
+		peers[peerID] = true
+	}
+	for id, other := range h.clientMgr.Snapshots() {
+		for _, peerID := range other.Status.Peers {
+			if peerID == client.ClientID {
+				peers[id] = true
+			}
+		}
+	}
+	for _, peerID := range h.relayMgr.CloseClient(client.ClientID) {
+		peers[peerID] = true
+	}
+
+	h.clientMgr.RemoveClient(client.ClientID)
+	if h.federation != nil {
+		h.federation.Withdraw(client.ClientID)
+	}
+
+	payload, err := json.Marshal(hole.RevokePayload{ClientID: client.ClientID, Reason: reason.Message})
+	if err != nil {
+		return
+	}
+	for peerID := range peers {
+		peer, ok := h.clientMgr.GetClient(peerID)
+		if !ok || peer.Conn == nil || peer.Version < hole.ProtocolVersion {
+			continue
+		}
+		if err := peer.Conn.WriteMessage(&hole.Message{
+			Type:    hole.TypeRevoke,
+			From:    "server",
+			To:      peerID,
+			Payload: payload,
+		}); err != nil {
+			xlog.Errorf("Failed to revoke %s for peer %s: %v", client.ClientID, peerID, err)
+		}
+	}
+}
+
+// remoteIP 返回连接的来源地址
+func remoteIP(conn *hole.Conn) net.IP {
+	if conn == nil {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
@@ -0,0 +1,90 @@
+package handler
+
+import (
+	"testing"
+	"time"
+
+	"github.com/liuscraft/spider-network/client"
+	"github.com/liuscraft/spider-network/pkg/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKickAndBan(t *testing.T) {
+	h, err := NewHoleHandler(config.HoleConfig{BindAddr: "127.0.0.1:0"})
+	require.NoError(t, err)
+	go h.Start()
+	defer h.Stop()
+	addr := h.listener.Addr().String()
+
+	// 心跳上报对等端后服务端才知道两者相连
+	client1 := client.NewClient("admin-1", "Admin 1", "", client.WithHeartbeatInterval(50*time.Millisecond))
+	disconnected := make(chan string, 4)
+	client1.OnPeerDisconnected(func(peerID string, err error) { disconnected <- peerID })
+	require.NoError(t, client1.Connect(addr))
+	defer client1.Close()
+
+	client2 := client.NewClient("admin-2", "Admin 2", "", client.WithHeartbeatInterval(50*time.Millisecond))
+	states := make(chan client.ServerState, 16)
+	client2.OnServerStateChange(func(event client.ServerStateEvent) { states <- event.State })
+	require.NoError(t, client2.Connect(addr))
+	defer client2.Close()
+
+	time.Sleep(100 * time.Millisecond)
+	require.NoError(t, client1.ConnectToPeer("admin-2"))
+	require.Eventually(t, func() bool {
+		status, ok := h.clientMgr.ClientStatus("admin-1")
+		return ok && len(status.Peers) == 1
+	}, 5*time.Second, 20*time.Millisecond)
+
+	t.Run("kick", func(t *testing.T) {
+		assert.ErrorIs(t, h.Kick("missing", ""), ErrClientNotFound)
+		require.NoError(t, h.Kick("admin-2", "maintenance"))
+
+		// 对等端收到撤销通知后断开
+		select {
+		case peerID := <-disconnected:
+			assert.Equal(t, "admin-2", peerID)
+		case <-time.After(5 * time.Second):
+			t.Fatal("peer connection not torn down")
+		}
+		// 被断开的客户端可以重新注册
+		require.Eventually(t, func() bool {
+			status, ok := h.clientMgr.ClientStatus("admin-2")
+			return ok && status.Connected
+		}, 5*time.Second, 20*time.Millisecond)
+	})
+
+	t.Run("ban", func(t *testing.T) {
+		_, err := h.Ban("", "", "", 0)
+		assert.Error(t, err)
+		ban, err := h.Ban("admin-2", "", "abuse", time.Hour)
+		require.NoError(t, err)
+
+		// 重连被拒绝后客户端停止重试
+		require.Eventually(t, func() bool {
+			return client2.ServerState() == client.ServerDisconnected
+		}, 5*time.Second, 20*time.Millisecond)
+		_, ok := h.clientMgr.GetClient("admin-2")
+		assert.False(t, ok)
+
+		// 解除封禁后可以重新注册
+		require.NoError(t, h.Unban(ban.ID))
+		other := client.NewClient("admin-2", "Admin 2", "")
+		require.NoError(t, other.Connect(addr))
+		other.Close()
+
+		// 按来源地址封禁
+		_, err = h.Ban("", "127.0.0.1", "", 0)
+		require.NoError(t, err)
+		require.Eventually(t, func() bool {
+			_, ok := h.clientMgr.GetClient("admin-1")
+			return !ok
+		}, 5*time.Second, 20*time.Millisecond)
+		blocked := client.NewClient("admin-3", "Admin 3", "")
+		err = blocked.Connect(addr)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "banned")
+		blocked.Close()
+	})
+}
@@ -10,47 +10,117 @@
 package handler
 
 import (
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"time"
 
-	"bufio"
-
 	"github.com/liuscraft/spider-network/pkg/config"
 	"github.com/liuscraft/spider-network/pkg/protocol"
 	"github.com/liuscraft/spider-network/pkg/protocol/hole"
+	"github.com/liuscraft/spider-network/pkg/punch"
+	"github.com/liuscraft/spider-network/pkg/secure"
+	"github.com/liuscraft/spider-network/pkg/tlsutil"
 	"github.com/liuscraft/spider-network/pkg/xlog"
+	"github.com/liuscraft/spider-network/server/auth"
 	"github.com/liuscraft/spider-network/server/client_mgr"
+	"github.com/liuscraft/spider-network/server/federation"
+	"github.com/liuscraft/spider-network/server/relay_mgr"
 	"github.com/liuscraft/spider-network/server/types"
 )
 
 type HoleHandler struct {
 	config    config.HoleConfig
 	listener  net.Listener
+	udpConn   net.PacketConn
 	clientMgr *client_mgr.ClientManager
+	relayMgr  *relay_mgr.RelayManager
+	auth      *auth.Authenticator // 为 nil 时不校验注册
+	// 多区域互联，为 nil 时只在本地查找目标客户端
+	federation *federation.Federation
+	metrics    holeMetrics
 }
 
 func NewHoleHandler(config config.HoleConfig) (h *HoleHandler, err error) {
+	tlsConfig, err := tlsutil.ServerConfig(config.TLSConfig)
+	if err != nil {
+		return nil, err
+	}
+	clientMgr := client_mgr.NewClientManager()
+	if config.NetworkConfig.CIDR != "" {
+		ipam, err := client_mgr.NewIPAM(config.NetworkConfig)
+		if err != nil {
+			return nil, err
+		}
+		clientMgr.SetIPAM(ipam)
+	}
+	if config.BanFile != "" {
+		bans, err := client_mgr.NewBanList(config.BanFile)
+		if err != nil {
+			return nil, err
+		}
+		clientMgr.SetBans(bans)
+	}
+	if config.RegistryDir != "" {
+		store, err := client_mgr.NewFileStore(config.RegistryDir)
+		if err != nil {
+			return nil, err
+		}
+		if err := clientMgr.SetStore(store); err != nil {
+			store.Close()
+			return nil, err
+		}
+	}
 	listener, err := net.Listen("tcp", config.BindAddr)
 	if err != nil {
 		return nil, err
 	}
 
-	return &HoleHandler{
+	// UDP 与 TCP 使用相同的地址和端口，用于观察客户端的 UDP 反射地址
+	udpConn, err := net.ListenPacket("udp", listener.Addr().String())
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+	// 只有信令通道使用 TLS，UDP 仅用于地址观察
+	if tlsConfig != nil {
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+
+	h = &HoleHandler{
 		config:    config,
 		listener:  listener,
-		clientMgr: client_mgr.NewClientManager(),
-	}, nil
+		udpConn:   udpConn,
+		clientMgr: clientMgr,
+		relayMgr:  relay_mgr.NewRelayManager(config.RelayConfig),
+		auth:      auth.NewAuthenticator(config.AuthConfig),
+	}
+	h.federation, err = federation.New(config.FederationConfig, clientMgr, h.deliverRemote)
+	if err != nil {
+		listener.Close()
+		udpConn.Close()
+		return nil, err
+	}
+	clientMgr.Subscribe(h.metrics.observe)
+	return h, nil
 }
 
 func (h *HoleHandler) Start() error {
 	xl := xlog.New()
+	go h.serveUDP(xl)
+	if h.federation != nil {
+		h.federation.Start()
+	}
 
 	for {
 		conn, err := h.listener.Accept()
 		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
 			xl.Errorf("spider-hole service accept error: %v", err)
 			continue
 		}
@@ -58,66 +128,129 @@ func (h *HoleHandler) Start() error {
 	}
 }
 
-func (h *HoleHandler) acceptSpiderConn(xl xlog.Logger, conn net.Conn) {
-	xl.Infof("spider-hole service accept connection from %s", conn.RemoteAddr())
-	xl = xlog.WithLogId(xl, fmt.Sprintf("spider-hole-conn[%s]", conn.RemoteAddr().String()))
+func (h *HoleHandler) acceptSpiderConn(xl xlog.Logger, rawConn net.Conn) {
+	xl.Infof("spider-hole service accept connection from %s", rawConn.RemoteAddr())
+	xl = xlog.WithLogId(xl, fmt.Sprintf("spider-hole-conn[%s]", rawConn.RemoteAddr().String()))
 
+	conn := hole.NewServerConn(rawConn)
 	defer func() {
 		conn.Close()
 		// 清理客户端信息
-		h.clientMgr.HandleDisconnect(conn)
+		if clientID := h.clientMgr.HandleDisconnect(conn); clientID != "" && h.federation != nil {
+			h.federation.Withdraw(clientID)
+		}
 	}()
 
-	reader := bufio.NewReader(conn)
 	for {
 		// 读取消息
-		data, err := reader.ReadBytes('\n')
+		msg, err := conn.ReadMessage()
 		if err != nil {
-			if err != io.EOF {
+			if err != io.EOF && !errors.Is(err, net.ErrClosed) {
 				xl.Errorf("read error: %v", err)
 			}
 			return
 		}
 
-		// 解析消息
-		var msg hole.Message
-		if err := json.Unmarshal(data, &msg); err != nil {
-			xl.Errorf("unmarshal error: %v", err)
+		// 除注册、中继绑定和互联握手外，消息必须来自已在该连接上注册的客户端
+		if msg.Type != hole.TypeRegister && msg.Type != hole.TypeRelayBind && msg.Type != hole.TypeFederate && !h.ownsClient(conn, msg.From) {
+			xl.Warnf("drop %s message from unregistered client: %s", msg.Type, msg.From)
 			continue
 		}
 
 		// 处理消息
 		switch msg.Type {
 		case hole.TypeRegister:
-			if err := h.handleRegister(xl, conn, &msg); err != nil {
+			if err := h.handleRegister(xl, conn, msg); err != nil {
 				xl.Errorf("handle register error: %v", err)
 				return
 			}
 		case hole.TypePunch:
-			if err := h.handlePunch(xl, &msg); err != nil {
+			if err := h.handlePunch(xl, msg); err != nil {
 				xl.Errorf("handle punch error: %v", err)
 				continue
 			}
 		case hole.TypeConnect:
-			if err := h.handleConnect(xl, &msg); err != nil {
+			if err := h.handleConnect(xl, msg); err != nil {
 				xl.Errorf("handle connect error: %v", err)
 				continue
 			}
 		case hole.TypeHeartbeat:
-			if err := h.handleHeartbeat(xl, &msg); err != nil {
+			if err := h.handleHeartbeat(xl, msg); err != nil {
 				xl.Errorf("handle heartbeat error: %v", err)
 				continue
 			}
+		case hole.TypeRelay:
+			if err := h.handleRelay(xl, msg); err != nil {
+				xl.Errorf("handle relay error: %v", err)
+				continue
+			}
+		case hole.TypePeerKey:
+			if err := h.handlePeerKey(conn, msg); err != nil {
+				xl.Errorf("handle peer key error: %v", err)
+				continue
+			}
+		case hole.TypeResolve:
+			if err := h.handleResolve(conn, msg); err != nil {
+				xl.Errorf("handle resolve error: %v", err)
+				continue
+			}
+		case hole.TypePublish:
+			if err := h.handlePublish(conn, msg); err != nil {
+				xl.Errorf("handle publish error: %v", err)
+				continue
+			}
+		case hole.TypeRelayBind:
+			// 中继连接绑定后只转发字节流，结束即关闭
+			if err := h.handleRelayBind(xl, conn, msg); err != nil {
+				xl.Errorf("handle relay bind error: %v", err)
+			}
+			return
+		case hole.TypeFederate:
+			// 互联连接只用于服务端之间的同步和信令转发
+			if h.federation == nil {
+				xl.Warnf("federation disabled, reject server %s", msg.From)
+				return
+			}
+			if err := h.federation.Accept(conn, msg); err != nil {
+				xl.Errorf("federation link with %s error: %v", msg.From, err)
+			}
+			return
 		default:
 			xl.Warnf("unknown message type: %s", msg.Type)
 		}
 	}
 }
 
-func (h *HoleHandler) handleRegister(xl xlog.Logger, conn net.Conn, msg *hole.Message) error {
+func (h *HoleHandler) handleRegister(xl xlog.Logger, conn *hole.Conn, msg *hole.Message) error {
 	var payload hole.RegisterPayload
 	if err := json.Unmarshal(msg.Payload, &payload); err != nil {
-		return fmt.Errorf("unmarshal register payload error: %v", err)
+		return h.reject(conn, msg.From, hole.NewError(hole.ErrCodeBadRequest, "invalid register payload"))
+	}
+	if payload.ClientID == "" {
+		return h.reject(conn, msg.From, hole.NewError(hole.ErrCodeBadRequest, "missing client id"))
+	}
+	if payload.PublicKey != "" {
+		if _, err := secure.ParsePublicKey(payload.PublicKey); err != nil {
+			return h.reject(conn, payload.ClientID, hole.NewError(hole.ErrCodeBadRequest, "invalid public key"))
+		}
+	}
+	if name := peerCertName(conn); name != "" && name != payload.ClientID {
+		xl.Warnf("Client %s from %s presented certificate of %s", payload.ClientID, conn.RemoteAddr(), name)
+		return h.reject(conn, payload.ClientID, hole.NewError(hole.ErrCodeUnauthorized, "client certificate does not match client id"))
+	}
+
+	// 被封禁的客户端ID或来源地址不允许注册
+	if ban, banned := h.clientMgr.Bans().Check(payload.ClientID, remoteIP(conn)); banned {
+		xl.Warnf("Client %s from %s is banned by %s", payload.ClientID, conn.RemoteAddr(), ban.ID)
+		return h.reject(conn, payload.ClientID, hole.NewError(hole.ErrCodeBanned, ban.Message()))
+	}
+
+	// 认证通过后才允许注册，避免冒用已有的客户端ID
+	if h.auth != nil {
+		if err := h.auth.Verify(&payload); err != nil {
+			xl.Warnf("Client %s from %s failed authentication: %v", payload.ClientID, conn.RemoteAddr(), err)
+			return h.reject(conn, payload.ClientID, err)
+		}
 	}
 
 	// 检查是否是重连
@@ -133,87 +266,462 @@ func (h *HoleHandler) handleRegister(xl xlog.Logger, conn net.Conn, msg *hole.Me
 
 	// 创建或更新客户端信息
 	client := types.NewClientInfo(conn, payload.ClientID, payload.Name)
+	client.Version = negotiateVersion(conn, payload.Version)
+	client.Status.NATType = payload.NATType
+	client.PublicKey = payload.PublicKey
+	// 帧格式连接上启用多路复用，用于向客户端转发发布的 HTTP 服务
+	if !conn.Legacy() {
+		conn.EnableSession(false)
+	}
+	udpToken, err := hole.NewNonce()
+	if err != nil {
+		return fmt.Errorf("generate udp bind token error: %v", err)
+	}
+	client.UDPToken = udpToken
+	ack := hole.RegisterAckPayload{
+		Version:  client.Version,
+		UDPPort:  h.udpConn.LocalAddr().(*net.UDPAddr).Port,
+		UDPToken: udpToken,
+	}
+	if ipam := h.clientMgr.IPAM(); ipam != nil {
+		if ip, err := ipam.Assign(payload.ClientID); err != nil {
+			xl.Warnf("Failed to assign virtual ip to %s: %v", payload.ClientID, err)
+		} else {
+			client.VirtualIP = ip.String()
+			ack.VirtualIP = ipam.CIDR(ip)
+		}
+	}
 	h.clientMgr.AddClient(client)
+	if h.federation != nil {
+		h.federation.Announce(client)
+	}
 
 	// 发送注册确认
-	response := &hole.Message{
-		Type: hole.TypeRegister,
-		From: "server",
-		To:   payload.ClientID,
-	}
-	data, err := json.Marshal(response)
+	ackBytes, err := json.Marshal(ack)
 	if err != nil {
-		return fmt.Errorf("marshal register response error: %v", err)
+		return fmt.Errorf("marshal register ack payload error: %v", err)
 	}
-
-	if _, err := conn.Write(append(data, '\n')); err != nil {
+	response := &hole.Message{
+		Type:    hole.TypeRegister,
+		From:    "server",
+		To:      payload.ClientID,
+		Payload: ackBytes,
+	}
+	if err := conn.WriteMessage(response); err != nil {
 		return fmt.Errorf("write register response error: %v", err)
 	}
 
 	return nil
 }
 
+// ownsClient 判断客户端是否注册在该连接上
+func (h *HoleHandler) ownsClient(conn *hole.Conn, clientID string) bool {
+	client, ok := h.clientMgr.GetClient(clientID)
+	return ok && client.Conn == conn
+}
+
+// reject 向客户端发送错误响应，返回该错误
+func (h *HoleHandler) reject(conn *hole.Conn, clientID string, reason error) error {
+	errPayload, ok := reason.(*hole.ErrorPayload)
+	if !ok {
+		errPayload = hole.NewError(hole.ErrCodeBadRequest, reason.Error())
+	}
+	data, err := json.Marshal(errPayload)
+	if err != nil {
+		return fmt.Errorf("marshal error payload error: %v", err)
+	}
+	if err := conn.WriteMessage(&hole.Message{
+		Type:    hole.TypeError,
+		From:    "server",
+		To:      clientID,
+		Payload: data,
+	}); err != nil {
+		return fmt.Errorf("write error response error: %v", err)
+	}
+	return reason
+}
+
+// negotiateVersion 协商协议版本
+// 旧版换行 JSON 客户端固定使用 ProtocolVersionLegacy，未声明版本的帧格式客户端按当前版本处理
+func negotiateVersion(conn *hole.Conn, clientVersion int) int {
+	if conn.Legacy() {
+		return hole.ProtocolVersionLegacy
+	}
+	if clientVersion <= hole.ProtocolVersionLegacy || clientVersion > hole.ProtocolVersion {
+		return hole.ProtocolVersion
+	}
+	return clientVersion
+}
+
 func (h *HoleHandler) handlePunch(xl xlog.Logger, msg *hole.Message) error {
 	var payload hole.PunchPayload
 	if err := json.Unmarshal(msg.Payload, &payload); err != nil {
 		xl.Errorf("parse punch payload error: %v", err)
 		return err
 	}
+	h.metrics.punchAttempts.Inc()
 
 	// 查找目标客户端
-	target, ok := h.clientMgr.GetClient(msg.To)
-	if !ok {
+	target, remote := h.findTarget(msg.To)
+	// 从注册表加载的离线客户端没有连接
+	if remote == nil && (target == nil || !h.clientMgr.Online(target)) {
 		xl.Warnf("target client not found: %s", msg.To)
+		h.metrics.punchFailures.Inc()
 		return nil
 	}
 
-	// 向目标客户端转发打洞消息
+	if err := h.fillPeerInfo(msg, &payload); err != nil {
+		h.metrics.punchFailures.Inc()
+		return err
+	}
+
+	// 目标在其他区域时由目标所在的服务端转换消息类型
+	if remote != nil {
+		if err := h.federation.Forward(msg); err != nil {
+			h.metrics.punchFailures.Inc()
+			return err
+		}
+		h.metrics.forwarded.WithLabel(string(msg.Type)).Inc()
+		xl.Infof("Forwarded punch message from %s to remote client %s", msg.From, msg.To)
+		return nil
+	}
+	if err := target.Conn.WriteMessage(punchMessage(target, msg)); err != nil {
+		xl.Errorf("write punch message error: %v", err)
+		h.metrics.punchFailures.Inc()
+		return err
+	}
+	h.metrics.forwarded.WithLabel(string(msg.Type)).Inc()
+	h.metrics.awaitPunch(msg.From, msg.To)
+
+	xl.Infof("Forwarded punch message from %s to %s", msg.From, msg.To)
+	return nil
+}
+
+// punchMessage 向目标客户端转发的打洞准备消息，旧版客户端仍使用 TypePunch
+func punchMessage(target *types.ClientInfo, msg *hole.Message) *hole.Message {
 	punchMsg := &hole.Message{
-		Type:    hole.TypePunch,
+		Type:    hole.TypePunchReady,
 		From:    msg.From,
 		To:      msg.To,
 		Payload: msg.Payload,
 	}
+	if target.Version < hole.ProtocolVersion {
+		punchMsg.Type = hole.TypePunch
+	}
+	return punchMsg
+}
 
-	data, err := json.Marshal(punchMsg)
-	if err != nil {
-		xl.Errorf("marshal punch message error: %v", err)
-		return err
+// findTarget 查找信令的目标客户端，本地不在线而其他区域有该客户端时返回 remote
+func (h *HoleHandler) findTarget(clientID string) (*types.ClientInfo, *federation.Remote) {
+	target, ok := h.clientMgr.GetClient(clientID)
+	if ok && h.clientMgr.Online(target) {
+		return target, nil
 	}
+	if h.federation != nil {
+		if remote, ok := h.federation.Lookup(clientID); ok {
+			return nil, remote
+		}
+	}
+	return target, nil
+}
 
-	if _, err := target.Conn.Write(append(data, '\n')); err != nil {
-		xl.Errorf("write punch message error: %v", err)
+// deliverRemote 投递其他区域转发来的信令
+func (h *HoleHandler) deliverRemote(msg *hole.Message) error {
+	target, ok := h.clientMgr.GetClient(msg.To)
+	if !ok || !h.clientMgr.Online(target) {
+		return fmt.Errorf("target client not found: %s", msg.To)
+	}
+	if msg.Type == hole.TypePunch || msg.Type == hole.TypePunchReady {
+		msg = punchMessage(target, msg)
+	}
+	if err := target.Conn.WriteMessage(msg); err != nil {
 		return err
 	}
-
-	xl.Infof("Forwarded punch message from %s to %s", msg.From, msg.To)
+	h.metrics.forwarded.WithLabel(string(msg.Type)).Inc()
 	return nil
 }
 
 func (h *HoleHandler) handleConnect(xl xlog.Logger, msg *hole.Message) error {
 	// 查找目标客户端
-	target, ok := h.clientMgr.GetClient(msg.To)
-	if !ok {
+	target, remote := h.findTarget(msg.To)
+	// 从注册表加载的离线客户端没有连接
+	if remote == nil && (target == nil || !h.clientMgr.Online(target)) {
 		xl.Warnf("target client not found: %s", msg.To)
 		return nil
 	}
 
-	// 转发连接请求
-	data, err := json.Marshal(msg)
-	if err != nil {
-		xl.Errorf("marshal connect message error: %v", err)
-		return err
+	if len(msg.Payload) > 0 {
+		var payload hole.PunchPayload
+		if err := json.Unmarshal(msg.Payload, &payload); err != nil {
+			xl.Errorf("parse connect payload error: %v", err)
+			return err
+		}
+		if err := h.fillPeerInfo(msg, &payload); err != nil {
+			return err
+		}
 	}
 
-	if _, err := target.Conn.Write(append(data, '\n')); err != nil {
+	// 转发连接请求
+	if remote != nil {
+		if err := h.federation.Forward(msg); err != nil {
+			return err
+		}
+		h.metrics.forwarded.WithLabel(string(msg.Type)).Inc()
+		xl.Infof("Forwarded connect message from %s to remote client %s", msg.From, msg.To)
+		return nil
+	}
+	if err := target.Conn.WriteMessage(msg); err != nil {
 		xl.Errorf("write connect message error: %v", err)
 		return err
 	}
+	h.metrics.forwarded.WithLabel(string(msg.Type)).Inc()
 
 	xl.Infof("Forwarded connect message from %s to %s", msg.From, msg.To)
 	return nil
 }
 
+// handlePeerKey 返回目标客户端注册时发布的静态公钥
+func (h *HoleHandler) handlePeerKey(conn *hole.Conn, msg *hole.Message) error {
+	var payload hole.PeerKeyPayload
+	if target, remote := h.findTarget(msg.To); remote != nil {
+		if remote.PublicKey == "" {
+			payload.Error = fmt.Sprintf("target client %s has no public key", msg.To)
+		} else {
+			payload.PublicKey = remote.PublicKey
+		}
+	} else if target == nil {
+		payload.Error = fmt.Sprintf("target client not found: %s", msg.To)
+	} else if target.PublicKey == "" {
+		payload.Error = fmt.Sprintf("target client %s has no public key", msg.To)
+	} else {
+		payload.PublicKey = target.PublicKey
+	}
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("marshal peer key payload error: %v", err)
+	}
+	return conn.WriteMessage(&hole.Message{
+		Type:    hole.TypePeerKey,
+		From:    msg.To,
+		To:      msg.From,
+		Payload: data,
+	})
+}
+
+// handleResolve 返回虚拟 IP 所属的在线客户端
+func (h *HoleHandler) handleResolve(conn *hole.Conn, msg *hole.Message) error {
+	var payload hole.ResolvePayload
+	if err := json.Unmarshal(msg.Payload, &payload); err != nil {
+		return fmt.Errorf("unmarshal resolve payload error: %v", err)
+	}
+
+	ipam := h.clientMgr.IPAM()
+	if ipam == nil {
+		payload.Error = "virtual network disabled"
+	} else if clientID, ok := ipam.Lookup(net.ParseIP(payload.VirtualIP)); !ok {
+		payload.Error = fmt.Sprintf("virtual ip not assigned: %s", payload.VirtualIP)
+	} else if target, ok := h.clientMgr.GetClient(clientID); !ok || !h.clientMgr.Online(target) {
+		payload.Error = fmt.Sprintf("client %s is offline", clientID)
+	} else {
+		payload.ClientID = clientID
+	}
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("marshal resolve payload error: %v", err)
+	}
+	return conn.WriteMessage(&hole.Message{
+		Type:    hole.TypeResolve,
+		From:    "server",
+		To:      msg.From,
+		Payload: data,
+	})
+}
+
+// handlePublish 为客户端发布 HTTP 服务，结果以同类型消息返回
+func (h *HoleHandler) handlePublish(conn *hole.Conn, msg *hole.Message) error {
+	var payload hole.PublishPayload
+	if err := json.Unmarshal(msg.Payload, &payload); err != nil {
+		return fmt.Errorf("unmarshal publish payload error: %v", err)
+	}
+
+	if conn.Session() == nil {
+		payload.Error = "client does not support stream multiplexing"
+	} else if service, err := h.clientMgr.PublishService(payload.Name, msg.From); err != nil {
+		payload.Error = fmt.Sprintf("publish %s error: %v", payload.Name, err)
+	} else {
+		payload.Name = service.Name
+	}
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("marshal publish payload error: %v", err)
+	}
+	return conn.WriteMessage(&hole.Message{
+		Type:    hole.TypePublish,
+		From:    "server",
+		To:      msg.From,
+		Payload: data,
+	})
+}
+
+// handleRelay 为打洞失败的两个客户端分配中继通道，并通知双方绑定
+func (h *HoleHandler) handleRelay(xl xlog.Logger, msg *hole.Message) error {
+	sender, ok := h.clientMgr.GetClient(msg.From)
+	if !ok {
+		return fmt.Errorf("relay request from unknown client: %s", msg.From)
+	}
+	// 打洞失败后才会请求中继
+	h.metrics.punchFinished(msg.From, msg.To, false)
+
+	target, remote := h.findTarget(msg.To)
+	if remote != nil {
+		return h.rejectRelay(sender, msg.To, fmt.Errorf("target client %s is registered in another area", msg.To))
+	}
+	if target == nil || !h.clientMgr.Online(target) {
+		return h.rejectRelay(sender, msg.To, fmt.Errorf("target client not found: %s", msg.To))
+	}
+	if target.Version < hole.ProtocolVersion {
+		return h.rejectRelay(sender, msg.To, fmt.Errorf("target client %s does not support relay", msg.To))
+	}
+
+	channelID, created, err := h.relayMgr.Allocate(msg.From, msg.To)
+	if err != nil {
+		return h.rejectRelay(sender, msg.To, err)
+	}
+	if !created {
+		xl.Debugf("Relay channel %s between %s and %s already allocated", channelID, msg.From, msg.To)
+		return nil
+	}
+
+	for _, notify := range []struct {
+		client *types.ClientInfo
+		peer   *types.ClientInfo
+	}{
+		{sender, target},
+		{target, sender},
+	} {
+		// 同时下发对方的静态公钥，用于中继连接上的加密握手
+		payload, err := json.Marshal(hole.RelayPayload{ChannelID: channelID, PublicKey: notify.peer.PublicKey})
+		if err != nil {
+			return fmt.Errorf("marshal relay payload error: %v", err)
+		}
+		if err := notify.client.Conn.WriteMessage(&hole.Message{
+			Type:    hole.TypeRelay,
+			From:    notify.peer.ClientID,
+			To:      notify.client.ClientID,
+			Payload: payload,
+		}); err != nil {
+			return fmt.Errorf("write relay message to %s error: %v", notify.client.ClientID, err)
+		}
+	}
+
+	xl.Infof("Allocated relay channel %s between %s and %s", channelID, msg.From, msg.To)
+	return nil
+}
+
+// rejectRelay 通知请求方中继分配失败
+func (h *HoleHandler) rejectRelay(sender *types.ClientInfo, targetID string, reason error) error {
+	payload, err := json.Marshal(hole.RelayPayload{Error: reason.Error()})
+	if err != nil {
+		return fmt.Errorf("marshal relay payload error: %v", err)
+	}
+	if err := sender.Conn.WriteMessage(&hole.Message{
+		Type:    hole.TypeRelay,
+		From:    targetID,
+		To:      sender.ClientID,
+		Payload: payload,
+	}); err != nil {
+		return fmt.Errorf("write relay reject error: %v", err)
+	}
+	return reason
+}
+
+// handleRelayBind 将新连接绑定到中继通道并转发数据，直到任意一端关闭
+func (h *HoleHandler) handleRelayBind(xl xlog.Logger, conn *hole.Conn, msg *hole.Message) error {
+	var payload hole.RelayPayload
+	if err := json.Unmarshal(msg.Payload, &payload); err != nil {
+		return fmt.Errorf("unmarshal relay bind payload error: %v", err)
+	}
+	if _, ok := h.clientMgr.GetClient(msg.From); !ok {
+		return fmt.Errorf("relay bind from unregistered client: %s", msg.From)
+	}
+	if name := peerCertName(conn); name != "" && name != msg.From {
+		return fmt.Errorf("relay bind from %s with certificate of %s", msg.From, name)
+	}
+
+	if err := h.relayMgr.Bind(payload.ChannelID, msg.From, conn); err != nil {
+		return err
+	}
+	xl.Infof("Relay channel %s of %s finished", payload.ChannelID, msg.From)
+	return nil
+}
+
+// peerCertName 双向 TLS 连接中客户端证书的 CommonName，即客户端身份
+func peerCertName(conn *hole.Conn) string {
+	tlsConn, ok := conn.Conn.(*tls.Conn)
+	if !ok {
+		return ""
+	}
+	state := tlsConn.ConnectionState()
+	return tlsutil.PeerCommonName(&state)
+}
+
+// fillPeerInfo 填写发送方注册时发布的静态公钥，不信任客户端自行声明的公钥
+// UDP 打洞时使用服务端观察到的发送方地址作为公网候选地址
+func (h *HoleHandler) fillPeerInfo(msg *hole.Message, payload *hole.PunchPayload) error {
+	sender, ok := h.clientMgr.GetClient(msg.From)
+	if !ok {
+		return nil
+	}
+
+	payload.PublicKey = sender.PublicKey
+	if udpAddr := h.clientMgr.UDPAddr(sender.ClientID); payload.Network == hole.NetworkUDP && udpAddr != "" {
+		payload.PublicAddr = udpAddr
+	}
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("marshal punch payload error: %v", err)
+	}
+	msg.Payload = data
+	return nil
+}
+
+// serveUDP 应答客户端的 UDP 绑定请求，记录观察到的反射地址
+func (h *HoleHandler) serveUDP(xl xlog.Logger) {
+	buf := make([]byte, 1500)
+	for {
+		n, addr, err := h.udpConn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			xl.Errorf("spider-hole udp read error: %v", err)
+			continue
+		}
+
+		txn, clientID, token, err := punch.DecodeBind(buf[:n])
+		if err != nil {
+			continue
+		}
+
+		// 只接受携带本次注册令牌的绑定，避免他人冒用客户端ID改写其地址
+		changed, err := h.clientMgr.SetUDPAddr(clientID, token, addr.String())
+		if err != nil {
+			xl.Debugf("Reject udp bind of %s from %s: %v", clientID, addr, err)
+			continue
+		}
+		if changed {
+			xl.Infof("Client %s bound udp address %s", clientID, addr)
+		}
+
+		if _, err := h.udpConn.WriteTo(punch.EncodeBindAck(txn, addr.String()), addr); err != nil {
+			xl.Errorf("write bind ack to %s error: %v", addr, err)
+		}
+	}
+}
+
 func (h *HoleHandler) handleHeartbeat(xl xlog.Logger, msg *hole.Message) error {
     // 从消息中获取客户端ID
     clientID := msg.From
@@ -237,6 +745,7 @@ func (h *HoleHandler) handleHeartbeat(xl xlog.Logger, msg *hole.Message) error {
 
     // 更新客户端状态
     client, ok := h.clientMgr.GetClient(clientID)
+    prev, _ := h.clientMgr.ClientStatus(clientID)
     if !ok {
         xl.Warnf("heartbeat from unknown client: %s", clientID)
         return nil
@@ -259,21 +768,24 @@ func (h *HoleHandler) handleHeartbeat(xl xlog.Logger, msg *hole.Message) error {
 
     // 计算传输速率
     now := time.Now()
-    timeSinceLastUpdate := now.Sub(client.Status.LastSeen)
+    timeSinceLastUpdate := now.Sub(prev.LastSeen)
     var bytesRate float64
     var p2pBytesRate float64
     if timeSinceLastUpdate > 0 {
         // 计算总传输速率
         totalBytesDelta := (heartbeat.BytesSent + heartbeat.BytesRecv) - 
-            (client.Status.BytesSent + client.Status.BytesRecv)
+            (prev.BytesSent + prev.BytesRecv)
         bytesRate = float64(totalBytesDelta) / timeSinceLastUpdate.Seconds()
 
         // 计算点对点传输速率
         p2pBytesDelta := (heartbeat.P2PBytesSent + heartbeat.P2PBytesRecv) - 
-            (client.Status.P2PBytesSent + client.Status.P2PBytesRecv)
+            (prev.P2PBytesSent + prev.P2PBytesRecv)
         p2pBytesRate = float64(p2pBytesDelta) / timeSinceLastUpdate.Seconds()
     }
 
+    // 中继流量由服务端统计
+    relaySent, relayRecv, relayChannels := h.relayMgr.Stats(clientID)
+
     // 更新客户端状态
     status := types.ClientStatus{
         Connected:     true,
@@ -283,13 +795,17 @@ func (h *HoleHandler) handleHeartbeat(xl xlog.Logger, msg *hole.Message) error {
         BytesRecv:    heartbeat.BytesRecv,
         P2PBytesSent: heartbeat.P2PBytesSent,
         P2PBytesRecv: heartbeat.P2PBytesRecv,
+        RelayBytesSent: relaySent,
+        RelayBytesRecv: relayRecv,
+        RelayChannels: relayChannels,
         BytesRate:    bytesRate,
         P2PBytesRate: p2pBytesRate,
         Latency:      latencyMs,
-        ConnectedAt:  client.Status.ConnectedAt,
-        LastError:    client.Status.LastError,
-        LastErrorTime: client.Status.LastErrorTime,
-        PunchStatus:  client.Status.PunchStatus,
+        ConnectedAt:  prev.ConnectedAt,
+        LastError:    prev.LastError,
+        LastErrorTime: prev.LastErrorTime,
+        PunchStatus:  prev.PunchStatus,
+        NATType:      prev.NATType,
     }
     h.clientMgr.UpdateClientStatus(clientID, status)
 
@@ -299,6 +815,14 @@ func (h *HoleHandler) handleHeartbeat(xl xlog.Logger, msg *hole.Message) error {
         heartbeat.P2PBytesSent, heartbeat.P2PBytesRecv, p2pBytesRate,
         validPeers)
 
+    // 回复心跳确认，客户端据此检测连接是否存活，旧版客户端不识别该消息
+    if client.Version >= hole.ProtocolVersion {
+        ack := &hole.Message{Type: hole.TypeHeartbeat, From: "server", To: clientID}
+        if err := client.Conn.WriteMessage(ack); err != nil {
+            xl.Errorf("send heartbeat ack error: %v", err)
+        }
+    }
+
     return nil
 }
 
@@ -307,6 +831,14 @@ func (h *HoleHandler) Stop() error {
 		return nil
 	}
 	xlog.Info("spider-hole service stopping...")
+	if h.federation != nil {
+		h.federation.Close()
+	}
+	h.relayMgr.Close()
+	h.udpConn.Close()
+	if err := h.clientMgr.Close(); err != nil {
+		xlog.Errorf("close client registry error: %v", err)
+	}
 	return h.listener.Close()
 }
 
@@ -325,3 +857,8 @@ func (h *HoleHandler) Receive(packet protocol.Packet) error {
 func (h *HoleHandler) GetClientManager() *client_mgr.ClientManager {
 	return h.clientMgr
 }
+
+// GetFederation 返回多区域互联管理器，未启用时为 nil
+func (h *HoleHandler) GetFederation() *federation.Federation {
+	return h.federation
+}
@@ -1,14 +1,22 @@
 package handler
 
 import (
+	"bufio"
+	"crypto/tls"
 	"encoding/json"
+	"io"
 	"net"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
 	"github.com/liuscraft/spider-network/pkg/config"
 	"github.com/liuscraft/spider-network/pkg/protocol"
 	"github.com/liuscraft/spider-network/pkg/protocol/hole"
+	"github.com/liuscraft/spider-network/pkg/punch"
+	"github.com/liuscraft/spider-network/pkg/secure"
+	"github.com/liuscraft/spider-network/pkg/tlsutil"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -24,7 +32,17 @@ type mockClient struct {
 func newMockClient(t *testing.T, serverAddr string, clientID, name string) *mockClient {
 	conn, err := net.Dial("tcp", serverAddr)
 	require.NoError(t, err)
+	return startMockClient(t, conn, clientID, name)
+}
+
+// newMockTLSClient 创建通过 TLS 连接服务端的模拟客户端
+func newMockTLSClient(t *testing.T, serverAddr string, clientID, name string, tlsConfig *tls.Config) *mockClient {
+	conn, err := tls.Dial("tcp", serverAddr, tlsConfig)
+	require.NoError(t, err)
+	return startMockClient(t, conn, clientID, name)
+}
 
+func startMockClient(t *testing.T, conn net.Conn, clientID, name string) *mockClient {
 	client := &mockClient{
 		conn:     conn,
 		clientID: clientID,
@@ -60,7 +78,8 @@ func (c *mockClient) register(t *testing.T) {
 		From: c.clientID,
 		Payload: []byte(`{
 			"client_id": "` + c.clientID + `",
-			"name": "` + c.name + `"
+			"name": "` + c.name + `",
+			"nat_type": "port-restricted-cone"
 		}`),
 	}
 
@@ -126,6 +145,11 @@ func TestHoleHandlerRegistration(t *testing.T) {
 	case <-time.After(time.Second):
 		t.Fatal("Registration confirmation timeout")
 	}
+
+	// NAT 类型记录在客户端状态中
+	info, ok := handler.clientMgr.GetClient("test-1")
+	require.True(t, ok)
+	assert.Equal(t, "port-restricted-cone", info.Status.NATType)
 }
 
 func TestHolePunching(t *testing.T) {
@@ -179,3 +203,565 @@ func TestHolePunching(t *testing.T) {
 		t.Fatal("Punch ready message timeout")
 	}
 }
+
+func TestLegacyClientRegistration(t *testing.T) {
+	// 创建服务器
+	cfg := config.HoleConfig{
+		BindAddr: "127.0.0.1:0",
+	}
+	handler, err := NewHoleHandler(cfg)
+	require.NoError(t, err)
+
+	go handler.Start()
+	defer handler.Stop()
+
+	// 旧版客户端使用换行分隔的 JSON
+	legacy, err := net.Dial("tcp", handler.listener.Addr().String())
+	require.NoError(t, err)
+	defer legacy.Close()
+
+	_, err = legacy.Write([]byte(`{"type":"register","from":"legacy-1","payload":{"client_id":"legacy-1","name":"Legacy"}}` + "\n"))
+	require.NoError(t, err)
+
+	legacy.SetReadDeadline(time.Now().Add(time.Second))
+	reader := bufio.NewReader(legacy)
+	line, err := reader.ReadBytes('\n')
+	require.NoError(t, err)
+
+	var ack hole.Message
+	require.NoError(t, json.Unmarshal(line, &ack))
+	assert.Equal(t, hole.TypeRegister, ack.Type)
+	assert.Equal(t, "legacy-1", ack.To)
+
+	var ackPayload hole.RegisterAckPayload
+	require.NoError(t, json.Unmarshal(ack.Payload, &ackPayload))
+	assert.Equal(t, hole.ProtocolVersionLegacy, ackPayload.Version)
+
+	// 新版客户端向旧版客户端打洞，旧版客户端应收到 TypePunch
+	client := newMockClient(t, handler.listener.Addr().String(), "test-1", "Test Client 1")
+	defer client.close()
+	client.register(t)
+	select {
+	case <-client.messages:
+	case <-time.After(time.Second):
+		t.Fatal("Registration confirmation timeout")
+	}
+
+	client.sendPunchRequest(t, "legacy-1")
+	line, err = reader.ReadBytes('\n')
+	require.NoError(t, err)
+
+	var punch hole.Message
+	require.NoError(t, json.Unmarshal(line, &punch))
+	assert.Equal(t, hole.TypePunch, punch.Type)
+	assert.Equal(t, "test-1", punch.From)
+}
+
+func TestUDPBindReflexiveAddr(t *testing.T) {
+	// 创建服务器
+	cfg := config.HoleConfig{
+		BindAddr: "127.0.0.1:0",
+	}
+	handler, err := NewHoleHandler(cfg)
+	require.NoError(t, err)
+
+	go handler.Start()
+	defer handler.Stop()
+
+	client1 := newMockClient(t, handler.listener.Addr().String(), "test-1", "Test Client 1")
+	defer client1.close()
+	client2 := newMockClient(t, handler.listener.Addr().String(), "test-2", "Test Client 2")
+	defer client2.close()
+	client1.register(t)
+	client2.register(t)
+
+	var ack hole.RegisterAckPayload
+	select {
+	case msg := <-client1.messages:
+		require.NoError(t, json.Unmarshal(msg.Payload, &ack))
+	case <-time.After(time.Second):
+		t.Fatal("Registration confirmation timeout")
+	}
+	require.NotZero(t, ack.UDPPort)
+	require.NotEmpty(t, ack.UDPToken)
+	var ack2 hole.RegisterAckPayload
+	require.NoError(t, json.Unmarshal((<-client2.messages).Payload, &ack2))
+	assert.NotEqual(t, ack.UDPToken, ack2.UDPToken)
+
+	// 通过 UDP 绑定，服务端返回观察到的地址
+	udpConn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer udpConn.Close()
+
+	serverUDPAddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: ack.UDPPort}
+	_, err = udpConn.WriteTo(punch.EncodeBind(7, "test-1", ack.UDPToken), serverUDPAddr)
+	require.NoError(t, err)
+
+	udpConn.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 1500)
+	n, _, err := udpConn.ReadFrom(buf)
+	require.NoError(t, err)
+	txn, observed, err := punch.DecodeBindAck(buf[:n])
+	require.NoError(t, err)
+	assert.Equal(t, uint32(7), txn)
+	assert.Equal(t, udpConn.LocalAddr().String(), observed)
+
+	// 冒用 test-1 的绑定请求：令牌错误或使用其他客户端的令牌，都不会改写地址
+	forger, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer forger.Close()
+	for _, token := range []string{"", "guess", ack2.UDPToken} {
+		_, err = forger.WriteTo(punch.EncodeBind(8, "test-1", token), serverUDPAddr)
+		require.NoError(t, err)
+	}
+	forger.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	_, _, err = forger.ReadFrom(buf)
+	assert.Error(t, err, "forged bind should not be acknowledged")
+	assert.Equal(t, observed, handler.clientMgr.UDPAddr("test-1"))
+
+	// UDP 打洞消息中的公网地址由服务端观察到的地址填充
+	payload, err := json.Marshal(hole.PunchPayload{
+		Network:     hole.NetworkUDP,
+		PublicAddr:  "10.0.0.1:1234",
+		PrivateAddr: "10.0.0.1:1234",
+	})
+	require.NoError(t, err)
+	packet, err := hole.CreateHolePacket(&hole.Message{
+		Type:    hole.TypePunch,
+		From:    "test-1",
+		To:      "test-2",
+		Payload: payload,
+	})
+	require.NoError(t, err)
+	require.NoError(t, protocol.NewPacketIO(nil, client1.conn).WritePacket(packet))
+
+	select {
+	case msg := <-client2.messages:
+		assert.Equal(t, hole.TypePunchReady, msg.Type)
+		var punchPayload hole.PunchPayload
+		require.NoError(t, json.Unmarshal(msg.Payload, &punchPayload))
+		assert.Equal(t, observed, punchPayload.PublicAddr)
+		assert.Equal(t, "10.0.0.1:1234", punchPayload.PrivateAddr)
+	case <-time.After(time.Second):
+		t.Fatal("Punch ready message timeout")
+	}
+}
+
+func TestRelayAllocation(t *testing.T) {
+	cfg := config.HoleConfig{
+		BindAddr: "127.0.0.1:0",
+	}
+	handler, err := NewHoleHandler(cfg)
+	require.NoError(t, err)
+
+	go handler.Start()
+	defer handler.Stop()
+
+	addr := handler.listener.Addr().String()
+	client1 := newMockClient(t, addr, "test-1", "Test Client 1")
+	defer client1.close()
+	client2 := newMockClient(t, addr, "test-2", "Test Client 2")
+	defer client2.close()
+
+	client1.register(t)
+	client2.register(t)
+	<-client1.messages
+	<-client2.messages
+
+	// 客户端1请求中继，双方都收到同一个通道
+	packet, err := hole.CreateHolePacket(&hole.Message{Type: hole.TypeRelay, From: "test-1", To: "test-2"})
+	require.NoError(t, err)
+	require.NoError(t, protocol.NewPacketIO(nil, client1.conn).WritePacket(packet))
+
+	channelOf := func(c *mockClient, from string) string {
+		select {
+		case msg := <-c.messages:
+			require.Equal(t, hole.TypeRelay, msg.Type)
+			assert.Equal(t, from, msg.From)
+			var payload hole.RelayPayload
+			require.NoError(t, json.Unmarshal(msg.Payload, &payload))
+			require.Empty(t, payload.Error)
+			return payload.ChannelID
+		case <-time.After(time.Second):
+			t.Fatal("Relay allocation timeout")
+			return ""
+		}
+	}
+	channelID := channelOf(client1, "test-2")
+	assert.Equal(t, channelID, channelOf(client2, "test-1"))
+
+	// 双方建立中继连接并绑定通道
+	bind := func(clientID string) *hole.Conn {
+		rawConn, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+		conn := hole.NewConn(rawConn)
+		payload, _ := json.Marshal(hole.RelayPayload{ChannelID: channelID})
+		require.NoError(t, conn.WriteMessage(&hole.Message{Type: hole.TypeRelayBind, From: clientID, To: "server", Payload: payload}))
+		return conn
+	}
+	relay1, relay2 := bind("test-1"), bind("test-2")
+	defer relay1.Close()
+	defer relay2.Close()
+	for _, conn := range []*hole.Conn{relay1, relay2} {
+		ack, err := conn.ReadMessage()
+		require.NoError(t, err)
+		assert.Equal(t, hole.TypeRelayBind, ack.Type)
+	}
+
+	_, err = relay1.Write([]byte("ping"))
+	require.NoError(t, err)
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(relay2, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "ping", string(buf))
+
+	require.Eventually(t, func() bool {
+		sent, _, channels := handler.relayMgr.Stats("test-1")
+		return sent == 4 && channels == 1
+	}, time.Second, 10*time.Millisecond)
+
+	// 目标不存在时返回错误
+	packet, _ = hole.CreateHolePacket(&hole.Message{Type: hole.TypeRelay, From: "test-1", To: "missing"})
+	require.NoError(t, protocol.NewPacketIO(nil, client1.conn).WritePacket(packet))
+	select {
+	case msg := <-client1.messages:
+		var payload hole.RelayPayload
+		require.NoError(t, json.Unmarshal(msg.Payload, &payload))
+		assert.NotEmpty(t, payload.Error)
+	case <-time.After(time.Second):
+		t.Fatal("Relay reject timeout")
+	}
+}
+
+func TestAuthenticatedRegistration(t *testing.T) {
+	cfg := config.HoleConfig{
+		BindAddr: "127.0.0.1:0",
+		AuthConfig: config.AuthConfig{
+			Credentials: map[string]string{"test-1": "secret"},
+		},
+	}
+	handler, err := NewHoleHandler(cfg)
+	require.NoError(t, err)
+
+	go handler.Start()
+	defer handler.Stop()
+
+	register := func(payload *hole.RegisterPayload) *hole.Message {
+		client := newMockClient(t, handler.listener.Addr().String(), payload.ClientID, payload.Name)
+		defer client.close()
+
+		data, err := json.Marshal(payload)
+		require.NoError(t, err)
+		packet, err := hole.CreateHolePacket(&hole.Message{Type: hole.TypeRegister, From: payload.ClientID, Payload: data})
+		require.NoError(t, err)
+		require.NoError(t, protocol.NewPacketIO(nil, client.conn).WritePacket(packet))
+
+		select {
+		case msg := <-client.messages:
+			return msg
+		case <-time.After(time.Second):
+			t.Fatal("Registration response timeout")
+			return nil
+		}
+	}
+
+	// 未签名的注册被拒绝
+	msg := register(&hole.RegisterPayload{ClientID: "test-1", Name: "Intruder"})
+	require.Equal(t, hole.TypeError, msg.Type)
+	var rejected hole.ErrorPayload
+	require.NoError(t, json.Unmarshal(msg.Payload, &rejected))
+	assert.Equal(t, hole.ErrCodeUnauthorized, rejected.Code)
+	_, exists := handler.clientMgr.GetClient("test-1")
+	assert.False(t, exists)
+
+	// 正确签名的注册成功
+	payload := &hole.RegisterPayload{ClientID: "test-1", Name: "Test Client 1"}
+	require.NoError(t, payload.Sign("secret"))
+	msg = register(payload)
+	assert.Equal(t, hole.TypeRegister, msg.Type)
+
+	// 重放同一个注册消息被拒绝
+	msg = register(payload)
+	require.Equal(t, hole.TypeError, msg.Type)
+	require.NoError(t, json.Unmarshal(msg.Payload, &rejected))
+	assert.Equal(t, hole.ErrCodeReplay, rejected.Code)
+}
+
+func TestPublicKeyDistribution(t *testing.T) {
+	cfg := config.HoleConfig{
+		BindAddr: "127.0.0.1:0",
+	}
+	handler, err := NewHoleHandler(cfg)
+	require.NoError(t, err)
+
+	go handler.Start()
+	defer handler.Stop()
+
+	identity, err := secure.GenerateIdentity()
+	require.NoError(t, err)
+
+	send := func(c *mockClient, msg *hole.Message) {
+		packet, err := hole.CreateHolePacket(msg)
+		require.NoError(t, err)
+		require.NoError(t, protocol.NewPacketIO(nil, c.conn).WritePacket(packet))
+	}
+	receive := func(c *mockClient) *hole.Message {
+		select {
+		case msg := <-c.messages:
+			return msg
+		case <-time.After(time.Second):
+			t.Fatal("Message timeout")
+			return nil
+		}
+	}
+
+	addr := handler.listener.Addr().String()
+	client1 := newMockClient(t, addr, "test-1", "Test Client 1")
+	defer client1.close()
+	client2 := newMockClient(t, addr, "test-2", "Test Client 2")
+	defer client2.close()
+
+	payload, _ := json.Marshal(hole.RegisterPayload{ClientID: "test-1", Name: "Test Client 1", PublicKey: identity.PublicKey()})
+	send(client1, &hole.Message{Type: hole.TypeRegister, From: "test-1", Payload: payload})
+	require.Equal(t, hole.TypeRegister, receive(client1).Type)
+	client2.register(t)
+	receive(client2)
+
+	// 查询公钥
+	send(client2, &hole.Message{Type: hole.TypePeerKey, From: "test-2", To: "test-1"})
+	msg := receive(client2)
+	require.Equal(t, hole.TypePeerKey, msg.Type)
+	var keyPayload hole.PeerKeyPayload
+	require.NoError(t, json.Unmarshal(msg.Payload, &keyPayload))
+	assert.Equal(t, identity.PublicKey(), keyPayload.PublicKey)
+
+	// 打洞消息中客户端自行声明的公钥会被替换为注册时发布的公钥
+	punchPayload, _ := json.Marshal(hole.PunchPayload{PublicAddr: "127.0.0.1:1", PrivateAddr: "127.0.0.1:1", PublicKey: "forged"})
+	send(client1, &hole.Message{Type: hole.TypePunch, From: "test-1", To: "test-2", Payload: punchPayload})
+	msg = receive(client2)
+	var forwarded hole.PunchPayload
+	require.NoError(t, json.Unmarshal(msg.Payload, &forwarded))
+	assert.Equal(t, identity.PublicKey(), forwarded.PublicKey)
+}
+
+func TestMutualTLSRegistration(t *testing.T) {
+	dir := t.TempDir()
+	ca, err := tlsutil.NewCA("test CA")
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "ca.pem"), ca.CertPEM(), 0o600))
+	issue := func(name string, hosts []string, client bool) {
+		certPEM, keyPEM, err := ca.Issue(name, hosts, client)
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name+".pem"), certPEM, 0o600))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name+"-key.pem"), keyPEM, 0o600))
+	}
+	issue("server", []string{"127.0.0.1"}, false)
+	issue("test-1", nil, true)
+	issue("test-2", nil, true)
+
+	cfg := config.HoleConfig{
+		BindAddr: "127.0.0.1:0",
+		TLSConfig: config.TLSConfig{
+			CertFile:     filepath.Join(dir, "server.pem"),
+			KeyFile:      filepath.Join(dir, "server-key.pem"),
+			ClientCAFile: filepath.Join(dir, "ca.pem"),
+		},
+	}
+	handler, err := NewHoleHandler(cfg)
+	require.NoError(t, err)
+
+	go handler.Start()
+	defer handler.Stop()
+
+	register := func(clientID, certName string) *hole.Message {
+		tlsConfig, err := tlsutil.ClientConfig(tlsutil.ClientOptions{
+			CAFile:   filepath.Join(dir, "ca.pem"),
+			CertFile: filepath.Join(dir, certName+".pem"),
+			KeyFile:  filepath.Join(dir, certName+"-key.pem"),
+		})
+		require.NoError(t, err)
+		client := newMockTLSClient(t, handler.listener.Addr().String(), clientID, "Test Client", tlsConfig)
+		defer client.close()
+
+		client.register(t)
+		select {
+		case msg := <-client.messages:
+			return msg
+		case <-time.After(time.Second):
+			t.Fatal("Registration response timeout")
+			return nil
+		}
+	}
+
+	// 证书与客户端ID一致时注册成功
+	msg := register("test-1", "test-1")
+	assert.Equal(t, hole.TypeRegister, msg.Type)
+
+	// 使用其他客户端的证书冒用ID被拒绝
+	msg = register("test-1", "test-2")
+	require.Equal(t, hole.TypeError, msg.Type)
+	var rejected hole.ErrorPayload
+	require.NoError(t, json.Unmarshal(msg.Payload, &rejected))
+	assert.Equal(t, hole.ErrCodeUnauthorized, rejected.Code)
+
+	// 明文客户端无法注册
+	client := newMockClient(t, handler.listener.Addr().String(), "test-1", "Test Client")
+	defer client.close()
+	client.register(t)
+	select {
+	case msg, ok := <-client.messages:
+		assert.False(t, ok, "unexpected message: %v", msg)
+	case <-time.After(time.Second):
+		t.Fatal("Plain connection not closed")
+	}
+}
+
+func TestVirtualIPAssignment(t *testing.T) {
+	cfg := config.HoleConfig{
+		BindAddr: "127.0.0.1:0",
+		NetworkConfig: config.NetworkConfig{
+			CIDR:         "10.10.0.0/24",
+			Reservations: map[string]string{"test-2": "10.10.0.100"},
+		},
+	}
+	handler, err := NewHoleHandler(cfg)
+	require.NoError(t, err)
+
+	go handler.Start()
+	defer handler.Stop()
+
+	receive := func(c *mockClient) *hole.Message {
+		select {
+		case msg := <-c.messages:
+			return msg
+		case <-time.After(time.Second):
+			t.Fatal("Message timeout")
+			return nil
+		}
+	}
+	register := func(c *mockClient) string {
+		c.register(t)
+		msg := receive(c)
+		require.Equal(t, hole.TypeRegister, msg.Type)
+		var ack hole.RegisterAckPayload
+		require.NoError(t, json.Unmarshal(msg.Payload, &ack))
+		return ack.VirtualIP
+	}
+
+	addr := handler.listener.Addr().String()
+	client1 := newMockClient(t, addr, "test-1", "Test Client 1")
+	defer client1.close()
+	client2 := newMockClient(t, addr, "test-2", "Test Client 2")
+	defer client2.close()
+
+	assert.Equal(t, "10.10.0.1/24", register(client1))
+	assert.Equal(t, "10.10.0.100/24", register(client2))
+
+	resolve := func(ip string) hole.ResolvePayload {
+		payload, _ := json.Marshal(hole.ResolvePayload{VirtualIP: ip})
+		packet, err := hole.CreateHolePacket(&hole.Message{Type: hole.TypeResolve, From: "test-1", To: "server", Payload: payload})
+		require.NoError(t, err)
+		require.NoError(t, protocol.NewPacketIO(nil, client1.conn).WritePacket(packet))
+		msg := receive(client1)
+		require.Equal(t, hole.TypeResolve, msg.Type)
+		var result hole.ResolvePayload
+		require.NoError(t, json.Unmarshal(msg.Payload, &result))
+		return result
+	}
+
+	assert.Equal(t, "test-2", resolve("10.10.0.100").ClientID)
+	assert.NotEmpty(t, resolve("10.10.0.9").Error)
+}
+
+func TestFederation(t *testing.T) {
+	newArea := func(serverID, token string, peers ...string) *HoleHandler {
+		cfg := config.HoleConfig{
+			BindAddr: "127.0.0.1:0",
+			FederationConfig: config.FederationConfig{
+				ServerID: serverID,
+				Token:    token,
+			},
+		}
+		for _, addr := range peers {
+			cfg.FederationConfig.Peers = append(cfg.FederationConfig.Peers, config.FederationPeer{Addr: addr})
+		}
+		handler, err := NewHoleHandler(cfg)
+		require.NoError(t, err)
+		go handler.Start()
+		t.Cleanup(func() { handler.Stop() })
+		return handler
+	}
+	waitRemote := func(handler *HoleHandler, clientID string, want bool) {
+		assert.Eventually(t, func() bool {
+			_, ok := handler.federation.Lookup(clientID)
+			return ok == want
+		}, 5*time.Second, 20*time.Millisecond)
+	}
+
+	areaB := newArea("area-b", "secret")
+	areaA := newArea("area-a", "secret", areaB.listener.Addr().String())
+
+	clientA := newMockClient(t, areaA.listener.Addr().String(), "client-a", "Client A")
+	defer clientA.close()
+	clientB := newMockClient(t, areaB.listener.Addr().String(), "client-b", "Client B")
+	defer clientB.close()
+	clientA.register(t)
+	clientB.register(t)
+	for _, c := range []*mockClient{clientA, clientB} {
+		select {
+		case msg := <-c.messages:
+			require.Equal(t, hole.TypeRegister, msg.Type)
+		case <-time.After(time.Second):
+			t.Fatal("Registration confirmation timeout")
+		}
+	}
+	waitRemote(areaA, "client-b", true)
+	waitRemote(areaB, "client-a", true)
+	assert.Equal(t, []string{"area-a"}, areaB.federation.Links())
+
+	t.Run("forward punch", func(t *testing.T) {
+		clientA.sendPunchRequest(t, "client-b")
+		select {
+		case msg := <-clientB.messages:
+			assert.Equal(t, hole.TypePunchReady, msg.Type)
+			assert.Equal(t, "client-a", msg.From)
+			assert.Equal(t, "client-b", msg.To)
+		case <-time.After(2 * time.Second):
+			t.Fatal("Punch message not forwarded")
+		}
+	})
+
+	t.Run("forward connect", func(t *testing.T) {
+		packet, err := hole.CreateHolePacket(&hole.Message{Type: hole.TypeConnect, From: "client-b", To: "client-a"})
+		require.NoError(t, err)
+		require.NoError(t, protocol.NewPacketIO(nil, clientB.conn).WritePacket(packet))
+		select {
+		case msg := <-clientA.messages:
+			assert.Equal(t, hole.TypeConnect, msg.Type)
+			assert.Equal(t, "client-b", msg.From)
+		case <-time.After(2 * time.Second):
+			t.Fatal("Connect message not forwarded")
+		}
+	})
+
+	t.Run("wrong token", func(t *testing.T) {
+		areaC := newArea("area-c", "other", areaB.listener.Addr().String())
+		time.Sleep(200 * time.Millisecond)
+		assert.Empty(t, areaC.federation.Links())
+		_, ok := areaC.federation.Lookup("client-b")
+		assert.False(t, ok)
+	})
+
+	t.Run("multiple areas", func(t *testing.T) {
+		areaD := newArea("area-d", "secret", areaB.listener.Addr().String())
+		assert.Eventually(t, func() bool {
+			return len(areaD.federation.Links()) == 1 && len(areaB.federation.Links()) == 2
+		}, 5*time.Second, 20*time.Millisecond)
+		waitRemote(areaD, "client-b", true)
+	})
+
+	t.Run("withdraw on disconnect", func(t *testing.T) {
+		clientB.close()
+		waitRemote(areaA, "client-b", false)
+	})
+}
@@ -0,0 +1,160 @@
+/*
+	HTTPHandler HTTP 反向代理
+	1. 按请求的 Host 头找到发布该服务的客户端
+	2. 在客户端信令连接的多路复用会话上打开流，由客户端连接本地服务
+*/
+
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+	"time"
+
+	"github.com/liuscraft/spider-network/pkg/config"
+	"github.com/liuscraft/spider-network/pkg/protocol/hole"
+	"github.com/liuscraft/spider-network/pkg/xlog"
+	"github.com/liuscraft/spider-network/server/client_mgr"
+)
+
+// httpStreamTimeout 等待客户端连接本地服务的超时时间
+const httpStreamTimeout = 10 * time.Second
+
+type HTTPHandler struct {
+	config    config.HTTPConfig
+	clientMgr *client_mgr.ClientManager
+	listener  net.Listener
+	server    *http.Server
+	proxy     *httputil.ReverseProxy
+	xl        xlog.Logger
+}
+
+func NewHTTPHandler(cfg config.HTTPConfig, clientMgr *client_mgr.ClientManager) (*HTTPHandler, error) {
+	listener, err := net.Listen("tcp", cfg.BindAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	h := &HTTPHandler{
+		config:    cfg,
+		clientMgr: clientMgr,
+		listener:  listener,
+		xl:        xlog.NewWithLogId("spider-http"),
+	}
+	h.proxy = &httputil.ReverseProxy{
+		// 连接池按服务名区分，Host 头保持原样
+		Rewrite: func(r *httputil.ProxyRequest) {
+			r.Out.URL.Scheme = "http"
+			r.Out.URL.Host = h.serviceName(r.In.Host)
+			r.SetXForwarded()
+		},
+		Transport: &http.Transport{
+			DialContext:         h.dialService,
+			MaxIdleConnsPerHost: 8,
+			IdleConnTimeout:     90 * time.Second,
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			h.xl.Warnf("Failed to proxy %s%s: %v", r.Host, r.URL.Path, err)
+			http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		},
+	}
+	h.server = &http.Server{Handler: h}
+	return h, nil
+}
+
+func (h *HTTPHandler) Start() error {
+	h.xl.Infof("http proxy listening on %s", h.listener.Addr())
+	if err := h.server.Serve(h.listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+func (h *HTTPHandler) Stop() error {
+	return h.server.Close()
+}
+
+// Addr 返回代理的监听地址
+func (h *HTTPHandler) Addr() net.Addr {
+	return h.listener.Addr()
+}
+
+func (h *HTTPHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := h.serviceName(r.Host)
+	if name == "" {
+		http.NotFound(w, r)
+		return
+	}
+	if service, _, ok := h.clientMgr.LookupService(name); !ok {
+		if service == nil {
+			http.NotFound(w, r)
+		} else {
+			http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+		}
+		return
+	}
+	h.proxy.ServeHTTP(w, r)
+}
+
+// serviceName 从 Host 头中取出服务名，不属于配置的域名时返回空
+func (h *HTTPHandler) serviceName(host string) string {
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if h.config.Domain == "" {
+		name, _, _ := strings.Cut(host, ".")
+		return name
+	}
+	name, ok := strings.CutSuffix(host, "."+strings.ToLower(h.config.Domain))
+	if !ok || strings.Contains(name, ".") {
+		return ""
+	}
+	return name
+}
+
+// dialService 在服务所属客户端的信令连接上打开流，addr 的主机部分为服务名
+func (h *HTTPHandler) dialService(ctx context.Context, network, addr string) (net.Conn, error) {
+	name, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	_, client, ok := h.clientMgr.LookupService(name)
+	if !ok {
+		return nil, fmt.Errorf("service %s is offline", name)
+	}
+	session := client.Conn.Session()
+	if session == nil {
+		return nil, fmt.Errorf("client %s does not support stream multiplexing", client.ClientID)
+	}
+
+	stream, err := session.OpenStream()
+	if err != nil {
+		return nil, err
+	}
+	if err := hole.WriteStreamHeader(stream, &hole.StreamHeader{Service: hole.StreamHTTP, Target: name}); err != nil {
+		stream.Close()
+		return nil, err
+	}
+	deadline := time.Now().Add(httpStreamTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	stream.SetReadDeadline(deadline)
+	reply, err := hole.ReadStreamHeader(stream)
+	if err != nil {
+		stream.Close()
+		return nil, fmt.Errorf("read stream reply error: %v", err)
+	}
+	stream.SetReadDeadline(time.Time{})
+	if reply.Error != "" {
+		stream.Close()
+		return nil, fmt.Errorf("client %s refused: %s", client.ClientID, reply.Error)
+	}
+	return stream, nil
+}
@@ -0,0 +1,85 @@
+package handler
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/liuscraft/spider-network/client"
+	"github.com/liuscraft/spider-network/pkg/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHTTPProxy(t *testing.T) {
+	holeHandler, err := NewHoleHandler(config.HoleConfig{BindAddr: "127.0.0.1:0"})
+	require.NoError(t, err)
+	go holeHandler.Start()
+	defer holeHandler.Stop()
+
+	httpHandler, err := NewHTTPHandler(config.HTTPConfig{
+		BindAddr: "127.0.0.1:0",
+		Domain:   "spider.test",
+	}, holeHandler.GetClientManager())
+	require.NoError(t, err)
+	go httpHandler.Start()
+	defer httpHandler.Stop()
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s %s %s", r.Host, r.URL.Path, r.Header.Get("X-Forwarded-For"))
+	}))
+	defer backend.Close()
+
+	owner := client.NewClient("web-1", "Web 1", "")
+	require.NoError(t, owner.Connect(holeHandler.listener.Addr().String()))
+	require.NoError(t, owner.PublishHTTP("App", backend.Listener.Addr().String()))
+
+	other := client.NewClient("web-2", "Web 2", "")
+	require.NoError(t, other.Connect(holeHandler.listener.Addr().String()))
+	defer other.Close()
+	err = other.PublishHTTP("app", backend.Listener.Addr().String())
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "already taken")
+	assert.Error(t, other.PublishHTTP("bad.name", backend.Listener.Addr().String()))
+
+	get := func(host, path string) (int, string) {
+		req, err := http.NewRequest(http.MethodGet, "http://"+httpHandler.Addr().String()+path, nil)
+		require.NoError(t, err)
+		req.Host = host
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp.StatusCode, string(body)
+	}
+
+	t.Run("route by host", func(t *testing.T) {
+		for i := 0; i < 3; i++ {
+			code, body := get("app.spider.test:8000", "/hello")
+			assert.Equal(t, http.StatusOK, code)
+			assert.Equal(t, "app.spider.test:8000 /hello 127.0.0.1", body)
+		}
+	})
+
+	t.Run("unknown host", func(t *testing.T) {
+		code, _ := get("missing.spider.test", "/")
+		assert.Equal(t, http.StatusNotFound, code)
+		code, _ = get("app.example.com", "/")
+		assert.Equal(t, http.StatusNotFound, code)
+	})
+
+	t.Run("owner disconnected", func(t *testing.T) {
+		owner.Close()
+		assert.Eventually(t, func() bool {
+			code, _ := get("app.spider.test", "/")
+			return code == http.StatusNotFound
+		}, 5*time.Second, 50*time.Millisecond)
+		require.NoError(t, other.PublishHTTP("app", backend.Listener.Addr().String()))
+		code, _ := get("app.spider.test", "/")
+		assert.Equal(t, http.StatusOK, code)
+	})
+}
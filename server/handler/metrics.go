@@ -0,0 +1,151 @@
+package handler
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/liuscraft/spider-network/server/client_mgr"
+	"github.com/liuscraft/spider-network/server/metrics"
+	"github.com/liuscraft/spider-network/server/types"
+)
+
+// punchTimeout 打洞请求后超过该时间仍未上报连接也未请求中继，按失败统计
+const punchTimeout = 30 * time.Second
+
+// holeMetrics 信令服务统计
+// 服务端看不到打洞结果：任一方心跳上报与对方相连时记为成功，请求中继或超时记为失败
+// 目标在其他区域时对方不会出现在本地上报的连接中，只统计请求
+type holeMetrics struct {
+	punchAttempts  metrics.Counter
+	punchSuccesses metrics.Counter
+	punchFailures  metrics.Counter
+	forwarded      metrics.CounterVec // 按消息类型统计转发的信令
+	pending        sync.Map           // punchKey -> 发起打洞的时间
+}
+
+// punchKey 与方向无关的客户端对
+func punchKey(a, b string) string {
+	if a > b {
+		a, b = b, a
+	}
+	return a + "\x00" + b
+}
+
+// awaitPunch 打洞消息已转发给本地目标，等待结果
+func (m *holeMetrics) awaitPunch(from, to string) {
+	m.pending.Store(punchKey(from, to), time.Now())
+}
+
+// punchFinished 记录打洞结果，该客户端对没有等待结果的打洞时忽略
+func (m *holeMetrics) punchFinished(from, to string, success bool) {
+	if _, ok := m.pending.LoadAndDelete(punchKey(from, to)); !ok {
+		return
+	}
+	if success {
+		m.punchSuccesses.Inc()
+	} else {
+		m.punchFailures.Inc()
+	}
+}
+
+// expirePunches 将超时的打洞记为失败
+func (m *holeMetrics) expirePunches(now time.Time) {
+	m.pending.Range(func(key, value interface{}) bool {
+		if now.Sub(value.(time.Time)) > punchTimeout {
+			if _, ok := m.pending.LoadAndDelete(key); ok {
+				m.punchFailures.Inc()
+			}
+		}
+		return true
+	})
+}
+
+// observe 从心跳上报的连接变化中识别打洞成功
+func (m *holeMetrics) observe(event client_mgr.Event) {
+	if event.Type != client_mgr.EventTopology {
+		return
+	}
+	for _, edge := range event.Added {
+		m.punchFinished(edge.From, edge.To, true)
+	}
+}
+
+// Collect 实现 metrics.Collector，输出服务端汇总和各客户端最近一次心跳上报的指标
+func (h *HoleHandler) Collect() []metrics.Family {
+	h.metrics.expirePunches(time.Now())
+
+	// 心跳会同时更新客户端状态，只读取副本
+	clients := make([]*types.ClientInfo, 0)
+	for _, client := range h.clientMgr.Snapshots() {
+		clients = append(clients, client)
+	}
+	sort.Slice(clients, func(i, j int) bool {
+		return clients[i].ClientID < clients[j].ClientID
+	})
+
+	var online int
+	for _, client := range clients {
+		if client.Status.Connected {
+			online++
+		}
+	}
+	families := []metrics.Family{
+		gauge("spiderhole_clients_registered", "Number of registered clients, including offline ones.", float64(len(clients))),
+		gauge("spiderhole_clients_online", "Number of online clients.", float64(online)),
+		counter("spiderhole_punch_attempts_total", "Hole punching requests handled.", h.metrics.punchAttempts.Value()),
+		counter("spiderhole_punch_successes_total", "Hole punching requests followed by a reported peer connection.", h.metrics.punchSuccesses.Value()),
+		counter("spiderhole_punch_failures_total", "Hole punching requests that failed, fell back to relay or timed out.", h.metrics.punchFailures.Value()),
+		{
+			Name:    "spiderhole_signaling_forwarded_total",
+			Help:    "Signaling messages forwarded to clients or other areas, by message type.",
+			Type:    metrics.TypeCounter,
+			Samples: h.metrics.forwarded.Samples("type"),
+		},
+		counter("spiderhole_heartbeat_timeouts_total", "Clients marked offline after missing heartbeats.", uint64(h.clientMgr.HeartbeatTimeouts())),
+	}
+
+	perClient := []struct {
+		name, help, typ string
+		value           func(status *types.ClientStatus) float64
+	}{
+		{"spiderhole_client_online", "Whether the client is online.", metrics.TypeGauge, func(s *types.ClientStatus) float64 { return boolValue(s.Connected) }},
+		{"spiderhole_client_latency_milliseconds", "Signaling latency measured from the last heartbeat.", metrics.TypeGauge, func(s *types.ClientStatus) float64 { return float64(s.Latency) }},
+		{"spiderhole_client_peers", "Number of peers the client reported as connected.", metrics.TypeGauge, func(s *types.ClientStatus) float64 { return float64(len(s.Peers)) }},
+		{"spiderhole_client_bytes_rate", "Total transfer rate in bytes per second.", metrics.TypeGauge, func(s *types.ClientStatus) float64 { return s.BytesRate }},
+		{"spiderhole_client_p2p_bytes_rate", "Peer-to-peer transfer rate in bytes per second.", metrics.TypeGauge, func(s *types.ClientStatus) float64 { return s.P2PBytesRate }},
+		{"spiderhole_client_relay_channels", "Active relay channels of the client.", metrics.TypeGauge, func(s *types.ClientStatus) float64 { return float64(s.RelayChannels) }},
+		{"spiderhole_client_sent_bytes_total", "Bytes sent in the current session.", metrics.TypeCounter, func(s *types.ClientStatus) float64 { return float64(s.BytesSent) }},
+		{"spiderhole_client_received_bytes_total", "Bytes received in the current session.", metrics.TypeCounter, func(s *types.ClientStatus) float64 { return float64(s.BytesRecv) }},
+		{"spiderhole_client_p2p_sent_bytes_total", "Peer-to-peer bytes sent in the current session.", metrics.TypeCounter, func(s *types.ClientStatus) float64 { return float64(s.P2PBytesSent) }},
+		{"spiderhole_client_p2p_received_bytes_total", "Peer-to-peer bytes received in the current session.", metrics.TypeCounter, func(s *types.ClientStatus) float64 { return float64(s.P2PBytesRecv) }},
+		{"spiderhole_client_relay_sent_bytes_total", "Bytes sent through server relay in the current session.", metrics.TypeCounter, func(s *types.ClientStatus) float64 { return float64(s.RelayBytesSent) }},
+		{"spiderhole_client_relay_received_bytes_total", "Bytes received through server relay in the current session.", metrics.TypeCounter, func(s *types.ClientStatus) float64 { return float64(s.RelayBytesRecv) }},
+	}
+	for _, m := range perClient {
+		family := metrics.Family{Name: m.name, Help: m.help, Type: m.typ}
+		for _, client := range clients {
+			family.Samples = append(family.Samples, metrics.Sample{
+				Labels: []metrics.Label{{Name: "client_id", Value: client.ClientID}, {Name: "name", Value: client.Name}},
+				Value:  m.value(&client.Status),
+			})
+		}
+		families = append(families, family)
+	}
+	return families
+}
+
+func gauge(name, help string, value float64) metrics.Family {
+	return metrics.Family{Name: name, Help: help, Type: metrics.TypeGauge, Samples: []metrics.Sample{{Value: value}}}
+}
+
+func counter(name, help string, value uint64) metrics.Family {
+	return metrics.Family{Name: name, Help: help, Type: metrics.TypeCounter, Samples: []metrics.Sample{{Value: float64(value)}}}
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
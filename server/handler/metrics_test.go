@@ -0,0 +1,69 @@
+package handler
+
+import (
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/liuscraft/spider-network/client"
+	"github.com/liuscraft/spider-network/pkg/config"
+	"github.com/liuscraft/spider-network/server/metrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetrics(t *testing.T) {
+	h, err := NewHoleHandler(config.HoleConfig{BindAddr: "127.0.0.1:0"})
+	require.NoError(t, err)
+	go h.Start()
+	defer h.Stop()
+	addr := h.listener.Addr().String()
+
+	scrape := func() string {
+		rec := httptest.NewRecorder()
+		metrics.Handler(h).ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+		body, err := io.ReadAll(rec.Body)
+		require.NoError(t, err)
+		return string(body)
+	}
+
+	client1 := client.NewClient("metrics-1", "Metrics 1", "", client.WithHeartbeatInterval(50*time.Millisecond))
+	require.NoError(t, client1.Connect(addr))
+	defer client1.Close()
+	client2 := client.NewClient("metrics-2", "Metrics 2", "", client.WithHeartbeatInterval(50*time.Millisecond))
+	require.NoError(t, client2.Connect(addr))
+	defer client2.Close()
+
+	body := scrape()
+	assert.Contains(t, body, "spiderhole_clients_registered 2\n")
+	assert.Contains(t, body, "spiderhole_clients_online 2\n")
+	assert.Contains(t, body, "spiderhole_punch_attempts_total 0\n")
+	assert.Contains(t, body, `spiderhole_client_online{client_id="metrics-1",name="Metrics 1"} 1`)
+
+	// 打洞成功后由心跳上报的连接计入成功
+	time.Sleep(100 * time.Millisecond)
+	require.NoError(t, client1.ConnectToPeer("metrics-2"))
+	require.Eventually(t, func() bool {
+		return strings.Contains(scrape(), "spiderhole_punch_successes_total 1\n")
+	}, 5*time.Second, 20*time.Millisecond)
+	body = scrape()
+	assert.Contains(t, body, "spiderhole_punch_attempts_total 1\n")
+	assert.Contains(t, body, "spiderhole_punch_failures_total 0\n")
+	assert.Contains(t, body, `spiderhole_signaling_forwarded_total{type="punch"} 1`)
+	assert.Contains(t, body, `spiderhole_client_peers{client_id="metrics-1",name="Metrics 1"} 1`)
+
+	// 目标不存在时记为失败
+	require.NoError(t, client1.ConnectToPeer("missing"))
+	require.Eventually(t, func() bool {
+		return strings.Contains(scrape(), "spiderhole_punch_failures_total 1\n")
+	}, 5*time.Second, 20*time.Millisecond)
+
+	// 请求中继说明打洞失败，超时未上报连接同样记为失败
+	h.metrics.awaitPunch("metrics-1", "metrics-3")
+	h.metrics.punchFinished("metrics-3", "metrics-1", false)
+	h.metrics.pending.Store(punchKey("metrics-2", "metrics-3"), time.Now().Add(-2*punchTimeout))
+	body = scrape()
+	assert.Contains(t, body, "spiderhole_punch_failures_total 3\n")
+}
@@ -0,0 +1,155 @@
+/*
+	StunHandler 反射地址发现服务
+	1. UDP：应答绑定请求，返回观察到的源地址，可按要求从备用地址回复以探测 NAT 类型
+	2. TCP：在主地址上应答 TypeBinding 消息
+*/
+
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/liuscraft/spider-network/pkg/config"
+	"github.com/liuscraft/spider-network/pkg/protocol"
+	"github.com/liuscraft/spider-network/pkg/protocol/hole"
+	"github.com/liuscraft/spider-network/pkg/punch"
+	"github.com/liuscraft/spider-network/pkg/xlog"
+)
+
+const stunTCPTimeout = 5 * time.Second
+
+type StunHandler struct {
+	config    config.StunConfig
+	primary   net.PacketConn
+	alternate net.PacketConn
+	listener  net.Listener
+}
+
+func NewStunHandler(cfg config.StunConfig) (h *StunHandler, err error) {
+	primary, err := net.ListenPacket("udp", cfg.BindAddr)
+	if err != nil {
+		return nil, err
+	}
+	alternate, err := net.ListenPacket("udp", cfg.AltBindAddr)
+	if err != nil {
+		primary.Close()
+		return nil, err
+	}
+	listener, err := net.Listen("tcp", primary.LocalAddr().String())
+	if err != nil {
+		primary.Close()
+		alternate.Close()
+		return nil, err
+	}
+
+	return &StunHandler{
+		config:    cfg,
+		primary:   primary,
+		alternate: alternate,
+		listener:  listener,
+	}, nil
+}
+
+func (h *StunHandler) Start() error {
+	xl := xlog.NewWithLogId("spider-stun")
+	xl.Infof("stun service listening on %s (alternate %s)", h.primary.LocalAddr(), h.alternate.LocalAddr())
+
+	go h.serveUDP(xl, h.primary, h.alternate)
+	go h.serveUDP(xl, h.alternate, h.primary)
+
+	for {
+		conn, err := h.listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			xl.Errorf("stun service accept error: %v", err)
+			continue
+		}
+		go h.serveTCP(xl, conn)
+	}
+}
+
+// serveUDP 应答绑定请求，设置 FlagChangeAddr 时从另一个地址回复
+func (h *StunHandler) serveUDP(xl xlog.Logger, conn, other net.PacketConn) {
+	buf := make([]byte, 1500)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			xl.Errorf("stun udp read error: %v", err)
+			continue
+		}
+
+		txn, flags, err := punch.DecodeBindingRequest(buf[:n])
+		if err != nil {
+			continue
+		}
+
+		resp := punch.EncodeBindingResponse(&punch.BindingResponse{
+			Txn:        txn,
+			MappedAddr: addr.String(),
+			OtherAddr:  other.LocalAddr().String(),
+		})
+		replyConn := conn
+		if flags&punch.FlagChangeAddr != 0 {
+			replyConn = other
+		}
+		if _, err := replyConn.WriteTo(resp, addr); err != nil {
+			xl.Errorf("write binding response to %s error: %v", addr, err)
+		}
+	}
+}
+
+// serveTCP 应答一次 TCP 绑定查询后关闭连接
+func (h *StunHandler) serveTCP(xl xlog.Logger, rawConn net.Conn) {
+	defer rawConn.Close()
+	rawConn.SetDeadline(time.Now().Add(stunTCPTimeout))
+
+	conn := hole.NewConn(rawConn)
+	msg, err := conn.ReadMessage()
+	if err != nil {
+		xl.Debugf("read binding request from %s error: %v", rawConn.RemoteAddr(), err)
+		return
+	}
+	if msg.Type != hole.TypeBinding {
+		xl.Warnf("unexpected message type on stun service: %s", msg.Type)
+		return
+	}
+
+	payload, err := json.Marshal(hole.BindingPayload{MappedAddr: rawConn.RemoteAddr().String()})
+	if err != nil {
+		xl.Errorf("marshal binding payload error: %v", err)
+		return
+	}
+	response := &hole.Message{
+		Type:    hole.TypeBinding,
+		From:    "server",
+		To:      msg.From,
+		Payload: payload,
+	}
+	if err := conn.WriteMessage(response); err != nil {
+		xl.Errorf("write binding response error: %v", err)
+	}
+}
+
+func (h *StunHandler) Stop() error {
+	xlog.Info("stun service stopping...")
+	h.primary.Close()
+	h.alternate.Close()
+	return h.listener.Close()
+}
+
+func (h *StunHandler) Handle(packet protocol.Packet) error {
+	return nil
+}
+
+// Addr 返回主地址
+func (h *StunHandler) Addr() net.Addr {
+	return h.primary.LocalAddr()
+}
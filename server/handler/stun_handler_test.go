@@ -0,0 +1,109 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/liuscraft/spider-network/pkg/config"
+	"github.com/liuscraft/spider-network/pkg/protocol/hole"
+	"github.com/liuscraft/spider-network/pkg/punch"
+	"github.com/liuscraft/spider-network/pkg/punch/natsim"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func startStunHandler(t *testing.T, cfg config.StunConfig) *StunHandler {
+	h, err := NewStunHandler(cfg)
+	require.NoError(t, err)
+	go h.Start()
+	t.Cleanup(func() { h.Stop() })
+	return h
+}
+
+func discoverNAT(t *testing.T, typ natsim.Type, server net.Addr) *punch.NATInfo {
+	pc, err := natsim.New(typ, 0).ListenPacket()
+	require.NoError(t, err)
+	e := punch.NewEndpoint(pc, "client")
+	defer e.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	info, err := punch.DiscoverNAT(ctx, e, server)
+	require.NoError(t, err)
+	return info
+}
+
+func TestDiscoverNATType(t *testing.T) {
+	h := startStunHandler(t, config.StunConfig{
+		BindAddr:    "127.0.0.1:0",
+		AltBindAddr: "127.0.0.1:0",
+	})
+
+	cases := []struct {
+		typ  natsim.Type
+		want punch.NATType
+	}{
+		{natsim.RestrictedCone, punch.NATRestrictedCone},
+		{natsim.PortRestrictedCone, punch.NATPortRestricted},
+		{natsim.Symmetric, punch.NATSymmetric},
+	}
+	for _, tc := range cases {
+		t.Run(tc.typ.String(), func(t *testing.T) {
+			info := discoverNAT(t, tc.typ, h.Addr())
+			assert.Equal(t, tc.want, info.Type)
+			assert.NotEmpty(t, info.MappedAddr)
+		})
+	}
+
+	t.Run("open", func(t *testing.T) {
+		pc, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		require.NoError(t, err)
+		e := punch.NewEndpoint(pc, "client")
+		defer e.Close()
+
+		info, err := punch.DiscoverNAT(context.Background(), e, h.Addr())
+		require.NoError(t, err)
+		assert.Equal(t, punch.NATOpen, info.Type)
+	})
+}
+
+func TestDiscoverFullCone(t *testing.T) {
+	// 备用地址使用不同的 IP 才能区分完全锥形
+	probe, err := net.ListenPacket("udp4", "127.0.0.2:0")
+	if err != nil {
+		t.Skip("127.0.0.2 not available")
+	}
+	probe.Close()
+
+	h := startStunHandler(t, config.StunConfig{
+		BindAddr:    "127.0.0.1:0",
+		AltBindAddr: "127.0.0.2:0",
+	})
+	info := discoverNAT(t, natsim.FullCone, h.Addr())
+	assert.Equal(t, punch.NATFullCone, info.Type)
+}
+
+func TestStunTCPBinding(t *testing.T) {
+	h := startStunHandler(t, config.StunConfig{
+		BindAddr:    "127.0.0.1:0",
+		AltBindAddr: "127.0.0.1:0",
+	})
+
+	rawConn, err := net.Dial("tcp", h.Addr().String())
+	require.NoError(t, err)
+	defer rawConn.Close()
+
+	conn := hole.NewConn(rawConn)
+	require.NoError(t, conn.WriteMessage(&hole.Message{Type: hole.TypeBinding, From: "client", To: "server"}))
+
+	resp, err := conn.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, hole.TypeBinding, resp.Type)
+
+	var payload hole.BindingPayload
+	require.NoError(t, json.Unmarshal(resp.Payload, &payload))
+	assert.Equal(t, rawConn.LocalAddr().String(), payload.MappedAddr)
+}
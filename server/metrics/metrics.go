@@ -0,0 +1,146 @@
+package metrics
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/liuscraft/spider-network/pkg/xlog"
+)
+
+// 指标类型
+const (
+	TypeCounter = "counter"
+	TypeGauge   = "gauge"
+)
+
+// Counter 单调递增的计数器
+type Counter struct {
+	v atomic.Uint64
+}
+
+func (c *Counter) Inc() {
+	c.v.Add(1)
+}
+
+func (c *Counter) Value() uint64 {
+	return c.v.Load()
+}
+
+// CounterVec 按一个标签值区分的一组计数器
+type CounterVec struct {
+	counters sync.Map // 标签值 -> *Counter
+}
+
+// WithLabel 返回标签值对应的计数器，不存在时创建
+func (v *CounterVec) WithLabel(value string) *Counter {
+	if c, ok := v.counters.Load(value); ok {
+		return c.(*Counter)
+	}
+	c, _ := v.counters.LoadOrStore(value, &Counter{})
+	return c.(*Counter)
+}
+
+// Samples 返回按标签值排序的样本，name 为标签名
+func (v *CounterVec) Samples(name string) []Sample {
+	var samples []Sample
+	v.counters.Range(func(key, value interface{}) bool {
+		samples = append(samples, Sample{
+			Labels: []Label{{Name: name, Value: key.(string)}},
+			Value:  float64(value.(*Counter).Value()),
+		})
+		return true
+	})
+	sort.Slice(samples, func(i, j int) bool {
+		return samples[i].Labels[0].Value < samples[j].Labels[0].Value
+	})
+	return samples
+}
+
+type Label struct {
+	Name  string
+	Value string
+}
+
+type Sample struct {
+	Labels []Label
+	Value  float64
+}
+
+// Family 同名指标的一组样本
+type Family struct {
+	Name    string
+	Help    string
+	Type    string
+	Samples []Sample
+}
+
+// Collector 在每次抓取时返回当前的指标
+type Collector interface {
+	Collect() []Family
+}
+
+// Write 以 Prometheus 文本格式输出指标
+func Write(w io.Writer, families []Family) error {
+	bw := bufio.NewWriter(w)
+	for _, family := range families {
+		bw.WriteString("# HELP " + family.Name + " " + escape(family.Help, false) + "\n")
+		bw.WriteString("# TYPE " + family.Name + " " + family.Type + "\n")
+		for _, sample := range family.Samples {
+			bw.WriteString(family.Name)
+			if len(sample.Labels) > 0 {
+				bw.WriteByte('{')
+				for i, label := range sample.Labels {
+					if i > 0 {
+						bw.WriteByte(',')
+					}
+					bw.WriteString(label.Name + `="` + escape(label.Value, true) + `"`)
+				}
+				bw.WriteByte('}')
+			}
+			bw.WriteString(" " + formatValue(sample.Value) + "\n")
+		}
+	}
+	return bw.Flush()
+}
+
+// escape 转义 HELP 文本或标签值中的特殊字符
+func escape(s string, quote bool) string {
+	replacements := []string{`\`, `\\`, "\n", `\n`}
+	if quote {
+		replacements = append(replacements, `"`, `\"`)
+	}
+	return strings.NewReplacer(replacements...).Replace(s)
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// Handler 返回输出所有 collector 指标的 HTTP 处理器
+func Handler(collectors ...Collector) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var families []Family
+		for _, collector := range collectors {
+			families = append(families, collector.Collect()...)
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		if err := Write(w, families); err != nil {
+			xlog.Debugf("write metrics error: %v", err)
+		}
+	})
+}
@@ -0,0 +1,58 @@
+package metrics
+
+import (
+	"io"
+	"math"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type collectorFunc func() []Family
+
+func (f collectorFunc) Collect() []Family {
+	return f()
+}
+
+func TestHandler(t *testing.T) {
+	var forwarded CounterVec
+	forwarded.WithLabel("punch").Inc()
+	forwarded.WithLabel("connect").Inc()
+	forwarded.WithLabel("punch").Inc()
+	var timeouts Counter
+	timeouts.Inc()
+
+	handler := Handler(collectorFunc(func() []Family {
+		return []Family{
+			{Name: "test_forwarded_total", Help: "Forwarded\nmessages.", Type: TypeCounter, Samples: forwarded.Samples("type")},
+			{Name: "test_timeouts_total", Help: `With \ backslash.`, Type: TypeCounter, Samples: []Sample{{Value: float64(timeouts.Value())}}},
+			{Name: "test_rate", Help: "Rate.", Type: TypeGauge, Samples: []Sample{
+				{Labels: []Label{{Name: "client_id", Value: "a"}, {Name: "name", Value: "say \"hi\"\n"}}, Value: 1.5},
+				{Labels: []Label{{Name: "client_id", Value: "b"}}, Value: math.Inf(1)},
+			}},
+			{Name: "test_empty", Help: "No samples.", Type: TypeGauge},
+		}
+	}))
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(t, "text/plain; version=0.0.4; charset=utf-8", rec.Header().Get("Content-Type"))
+	body, err := io.ReadAll(rec.Body)
+	require.NoError(t, err)
+	assert.Equal(t, `# HELP test_forwarded_total Forwarded\nmessages.
+# TYPE test_forwarded_total counter
+test_forwarded_total{type="connect"} 1
+test_forwarded_total{type="punch"} 2
+# HELP test_timeouts_total With \\ backslash.
+# TYPE test_timeouts_total counter
+test_timeouts_total 1
+# HELP test_rate Rate.
+# TYPE test_rate gauge
+test_rate{client_id="a",name="say \"hi\"\n"} 1.5
+test_rate{client_id="b"} +Inf
+# HELP test_empty No samples.
+# TYPE test_empty gauge
+`, string(body))
+}
@@ -0,0 +1,49 @@
+package relay_mgr
+
+import (
+	"sync"
+	"time"
+)
+
+// rateLimiter 令牌桶限速，rate 为 0 时不限制
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   float64 // 每秒字节数
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate int64) *rateLimiter {
+	return &rateLimiter{
+		rate:   float64(rate),
+		burst:  float64(rate),
+		tokens: float64(rate),
+		last:   time.Now(),
+	}
+}
+
+// wait 消耗 n 个字节的令牌，不足时等待
+func (l *rateLimiter) wait(n int) {
+	if l.rate <= 0 {
+		return
+	}
+
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	var delay time.Duration
+	if l.tokens < 0 {
+		delay = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
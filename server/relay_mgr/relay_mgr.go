@@ -0,0 +1,287 @@
+/*
+	RelayManager 中继管理器
+	打洞失败时，服务端在两个已注册的客户端之间分配中继通道：
+	1. 双方各自向服务端建立一条新连接，发送 TypeRelayBind 绑定通道
+	2. 双方都绑定后服务端回复确认，此后连接上的字节流原样转发给对方
+	3. 按客户端统计中继流量，并限制带宽和总流量
+*/
+
+package relay_mgr
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/liuscraft/spider-network/pkg/config"
+	"github.com/liuscraft/spider-network/pkg/protocol/hole"
+	"github.com/liuscraft/spider-network/pkg/utils"
+	"github.com/liuscraft/spider-network/pkg/xlog"
+)
+
+const (
+	BindTimeout = 10 * time.Second // 等待双方绑定的超时时间
+	bufferSize  = 32 * 1024
+)
+
+var (
+	ErrRelayDisabled = errors.New("relay is disabled")
+	ErrRelayNotFound = errors.New("relay channel not found")
+	ErrRelayTimeout  = errors.New("relay peer did not bind in time")
+	ErrQuotaExceeded = errors.New("relay quota exceeded")
+)
+
+// RelayStats 客户端的中继统计
+type RelayStats struct {
+	bytesSent atomic.Int64
+	bytesRecv atomic.Int64
+	channels  atomic.Int32
+	limiter   *rateLimiter
+}
+
+type relayChannel struct {
+	id      string
+	key     string
+	clients [2]string
+
+	mu    sync.Mutex
+	conns map[string]*hole.Conn
+	ready chan struct{}
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// peerOf 返回通道另一端的客户端ID
+func (ch *relayChannel) peerOf(clientID string) (string, bool) {
+	switch clientID {
+	case ch.clients[0]:
+		return ch.clients[1], true
+	case ch.clients[1]:
+		return ch.clients[0], true
+	}
+	return "", false
+}
+
+// RelayManager 中继管理器
+type RelayManager struct {
+	config   config.RelayConfig
+	channels sync.Map // 通道ID -> *relayChannel
+	pending  sync.Map // 客户端对 -> 通道ID，避免双方同时请求时重复分配
+	stats    sync.Map // 客户端ID -> *RelayStats
+	xl       xlog.Logger
+}
+
+func NewRelayManager(cfg config.RelayConfig) *RelayManager {
+	return &RelayManager{
+		config: cfg,
+		xl:     xlog.New(),
+	}
+}
+
+// Enabled 是否启用中继
+func (m *RelayManager) Enabled() bool {
+	return !m.config.Disabled
+}
+
+// Allocate 为两个客户端分配中继通道，双方已有待绑定的通道时返回该通道且 created 为 false
+func (m *RelayManager) Allocate(a, b string) (channelID string, created bool, err error) {
+	if !m.Enabled() {
+		return "", false, ErrRelayDisabled
+	}
+	if m.quotaExceeded(a) || m.quotaExceeded(b) {
+		return "", false, ErrQuotaExceeded
+	}
+
+	ch := &relayChannel{
+		id:      utils.RandString(16),
+		key:     pairKey(a, b),
+		clients: [2]string{a, b},
+		conns:   make(map[string]*hole.Conn),
+		ready:   make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	if existing, loaded := m.pending.LoadOrStore(ch.key, ch.id); loaded {
+		return existing.(string), false, nil
+	}
+	m.channels.Store(ch.id, ch)
+
+	// 超时未完成绑定的通道自动回收
+	time.AfterFunc(BindTimeout, func() {
+		select {
+		case <-ch.ready:
+		default:
+			m.closeChannel(ch)
+		}
+	})
+
+	m.xl.Infof("Relay channel %s allocated between %s and %s", ch.id, a, b)
+	return ch.id, true, nil
+}
+
+// Bind 将客户端的连接绑定到中继通道，阻塞直到对方也完成绑定
+// 最后完成绑定的一方负责向双方发送确认，确认之后的字节流直接转发
+func (m *RelayManager) Bind(channelID, clientID string, conn *hole.Conn) error {
+	value, ok := m.channels.Load(channelID)
+	if !ok {
+		return ErrRelayNotFound
+	}
+	ch := value.(*relayChannel)
+	peerID, ok := ch.peerOf(clientID)
+	if !ok {
+		return ErrRelayNotFound
+	}
+
+	ch.mu.Lock()
+	if _, exists := ch.conns[clientID]; exists {
+		ch.mu.Unlock()
+		return fmt.Errorf("client %s already bound to relay channel %s", clientID, channelID)
+	}
+	ch.conns[clientID] = conn
+	complete := len(ch.conns) == len(ch.clients)
+	ch.mu.Unlock()
+
+	if complete {
+		m.pending.CompareAndDelete(ch.key, ch.id)
+		for _, id := range ch.clients {
+			if err := writeBindAck(ch.conns[id], ch.id, id); err != nil {
+				m.closeChannel(ch)
+				return fmt.Errorf("write relay bind ack error: %v", err)
+			}
+		}
+		close(ch.ready)
+	}
+
+	select {
+	case <-ch.ready:
+	case <-ch.done:
+		return ErrRelayTimeout
+	}
+
+	ch.mu.Lock()
+	peerConn := ch.conns[peerID]
+	ch.mu.Unlock()
+
+	stats := m.clientStats(clientID)
+	stats.channels.Add(1)
+	defer stats.channels.Add(-1)
+
+	m.xl.Infof("Client %s bound relay channel %s to %s", clientID, channelID, peerID)
+	err := m.pipe(clientID, peerID, conn, peerConn)
+	m.closeChannel(ch)
+	return err
+}
+
+// pipe 把 from 发出的数据转发给 to，并计入双方的中继流量
+func (m *RelayManager) pipe(from, to string, src, dst net.Conn) error {
+	fromStats, toStats := m.clientStats(from), m.clientStats(to)
+	buf := make([]byte, bufferSize)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			if m.quotaExceeded(from) || m.quotaExceeded(to) {
+				return ErrQuotaExceeded
+			}
+			fromStats.limiter.wait(n)
+			toStats.limiter.wait(n)
+			if _, werr := dst.Write(buf[:n]); werr != nil {
+				return nil
+			}
+			fromStats.bytesSent.Add(int64(n))
+			toStats.bytesRecv.Add(int64(n))
+		}
+		if err != nil {
+			return nil
+		}
+	}
+}
+
+func (m *RelayManager) closeChannel(ch *relayChannel) {
+	ch.closeOnce.Do(func() {
+		close(ch.done)
+		m.channels.Delete(ch.id)
+		m.pending.CompareAndDelete(ch.key, ch.id)
+
+		ch.mu.Lock()
+		for _, conn := range ch.conns {
+			conn.Close()
+		}
+		ch.mu.Unlock()
+		m.xl.Infof("Relay channel %s between %s and %s closed", ch.id, ch.clients[0], ch.clients[1])
+	})
+}
+
+func (m *RelayManager) clientStats(clientID string) *RelayStats {
+	if value, ok := m.stats.Load(clientID); ok {
+		return value.(*RelayStats)
+	}
+	value, _ := m.stats.LoadOrStore(clientID, &RelayStats{
+		limiter: newRateLimiter(m.config.Bandwidth),
+	})
+	return value.(*RelayStats)
+}
+
+func (m *RelayManager) quotaExceeded(clientID string) bool {
+	if m.config.Quota <= 0 {
+		return false
+	}
+	stats := m.clientStats(clientID)
+	return stats.bytesSent.Load()+stats.bytesRecv.Load() >= m.config.Quota
+}
+
+// Stats 返回客户端的中继流量及活跃通道数
+func (m *RelayManager) Stats(clientID string) (bytesSent, bytesRecv int64, channels int) {
+	value, ok := m.stats.Load(clientID)
+	if !ok {
+		return 0, 0, 0
+	}
+	stats := value.(*RelayStats)
+	return stats.bytesSent.Load(), stats.bytesRecv.Load(), int(stats.channels.Load())
+}
+
+// CloseClient 关闭客户端参与的所有中继通道，返回通道另一端的客户端
+func (m *RelayManager) CloseClient(clientID string) []string {
+	var peers []string
+	m.channels.Range(func(key, value interface{}) bool {
+		ch := value.(*relayChannel)
+		if peer, ok := ch.peerOf(clientID); ok {
+			m.closeChannel(ch)
+			peers = append(peers, peer)
+		}
+		return true
+	})
+	return peers
+}
+
+// Close 关闭所有中继通道
+func (m *RelayManager) Close() {
+	m.channels.Range(func(key, value interface{}) bool {
+		m.closeChannel(value.(*relayChannel))
+		return true
+	})
+}
+
+func writeBindAck(conn *hole.Conn, channelID, clientID string) error {
+	payload, err := json.Marshal(hole.RelayPayload{ChannelID: channelID})
+	if err != nil {
+		return err
+	}
+	return conn.WriteMessage(&hole.Message{
+		Type:    hole.TypeRelayBind,
+		From:    "server",
+		To:      clientID,
+		Payload: payload,
+	})
+}
+
+func pairKey(a, b string) string {
+	ids := []string{a, b}
+	sort.Strings(ids)
+	return strings.Join(ids, "|")
+}
@@ -0,0 +1,102 @@
+package relay_mgr
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/liuscraft/spider-network/pkg/config"
+	"github.com/liuscraft/spider-network/pkg/protocol/hole"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func waitBound(t *testing.T, conn net.Conn) *hole.Conn {
+	c := hole.NewConn(conn)
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	ack, err := c.ReadMessage()
+	require.NoError(t, err)
+	require.Equal(t, hole.TypeRelayBind, ack.Type)
+	c.SetReadDeadline(time.Time{})
+	return c
+}
+
+func newBoundPair(t *testing.T, m *RelayManager) (*hole.Conn, *hole.Conn) {
+	channelID, created, err := m.Allocate("a", "b")
+	require.NoError(t, err)
+	require.True(t, created)
+
+	// 双方同时请求时复用同一个通道
+	again, created, err := m.Allocate("b", "a")
+	require.NoError(t, err)
+	assert.False(t, created)
+	assert.Equal(t, channelID, again)
+
+	endA, serverA := net.Pipe()
+	endB, serverB := net.Pipe()
+	go m.Bind(channelID, "a", hole.NewConn(serverA))
+	go m.Bind(channelID, "b", hole.NewConn(serverB))
+	return waitBound(t, endA), waitBound(t, endB)
+}
+
+func TestRelayForwarding(t *testing.T) {
+	m := NewRelayManager(config.RelayConfig{})
+	defer m.Close()
+
+	a, b := newBoundPair(t, m)
+
+	data := []byte("hello through relay")
+	go a.Write(data)
+	buf := make([]byte, len(data))
+	_, err := io.ReadFull(b, buf)
+	require.NoError(t, err)
+	assert.Equal(t, data, buf)
+
+	require.Eventually(t, func() bool {
+		sent, _, channels := m.Stats("a")
+		_, recv, _ := m.Stats("b")
+		return sent == int64(len(data)) && recv == int64(len(data)) && channels == 1
+	}, time.Second, 10*time.Millisecond)
+
+	// 一端关闭后通道随之关闭
+	a.Close()
+	b.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = b.Read(buf)
+	assert.Error(t, err)
+}
+
+func TestRelayQuota(t *testing.T) {
+	m := NewRelayManager(config.RelayConfig{Quota: 16})
+	defer m.Close()
+
+	a, b := newBoundPair(t, m)
+
+	data := make([]byte, 32)
+	go a.Write(data)
+	_, err := io.ReadFull(b, make([]byte, len(data)))
+	require.NoError(t, err)
+
+	// 超出配额后继续发送会关闭通道，也不再分配新的通道
+	go a.Write(data)
+	b.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = b.Read(make([]byte, 1))
+	assert.Error(t, err)
+
+	_, _, err = m.Allocate("a", "c")
+	assert.ErrorIs(t, err, ErrQuotaExceeded)
+}
+
+func TestRelayDisabled(t *testing.T) {
+	m := NewRelayManager(config.RelayConfig{Disabled: true})
+	_, _, err := m.Allocate("a", "b")
+	assert.ErrorIs(t, err, ErrRelayDisabled)
+}
+
+func TestRateLimiter(t *testing.T) {
+	l := newRateLimiter(1000)
+	start := time.Now()
+	l.wait(1000) // 初始令牌
+	l.wait(500)
+	assert.GreaterOrEqual(t, time.Since(start), 400*time.Millisecond)
+}
@@ -6,6 +6,7 @@ import (
 	"github.com/liuscraft/spider-network/server/web"
 	"fmt"
 	"os"
+	"path/filepath"
 )
 
 /*
@@ -18,6 +19,8 @@ spider-hole service:
 type Service struct {
 	config      *config.ServerConfig
 	holeHandler *handler.HoleHandler
+	stunHandler *handler.StunHandler
+	httpHandler *handler.HTTPHandler
 	webServer   *web.Server
 }
 
@@ -28,15 +31,17 @@ func NewService(cfg *config.ServerConfig) (srv *Service, err error) {
 		return nil, err
 	}
 
-	// 获取当前工作目录作为基础目录
-	baseDir, err := os.Getwd()
+	// 查找 web 模板所在的基础目录
+	baseDir, err := findBaseDir()
 	if err != nil {
-		return nil, fmt.Errorf("get working directory error: %v", err)
+		holeHandler.Stop()
+		return nil, err
 	}
 
 	// 创建 web 服务器
-	webServer, err := web.NewServer(holeHandler.GetClientManager(), baseDir)
+	webServer, err := web.NewServer(holeHandler.GetClientManager(), holeHandler, cfg.WebConfig.AdminToken, holeHandler, baseDir)
 	if err != nil {
+		holeHandler.Stop()
 		return nil, err
 	}
 
@@ -45,20 +50,70 @@ func NewService(cfg *config.ServerConfig) (srv *Service, err error) {
 		holeHandler: holeHandler,
 		webServer:   webServer,
 	}
+
+	// 创建反射地址发现服务
+	if cfg.StunConfig.BindAddr != "" {
+		srv.stunHandler, err = handler.NewStunHandler(cfg.StunConfig)
+		if err != nil {
+			holeHandler.Stop()
+			return nil, err
+		}
+	}
+
+	// 创建 HTTP 反向代理
+	if cfg.HTTPConfig.BindAddr != "" {
+		srv.httpHandler, err = handler.NewHTTPHandler(cfg.HTTPConfig, holeHandler.GetClientManager())
+		if err != nil {
+			srv.Close()
+			return nil, err
+		}
+	}
 	return
 }
 
+// findBaseDir 从当前工作目录向上查找包含 web/templates 的目录
+func findBaseDir() (string, error) {
+	wd, err := os.Getwd()
+	if err != nil {
+		return "", fmt.Errorf("get working directory error: %v", err)
+	}
+	for dir := wd; ; dir = filepath.Dir(dir) {
+		if info, err := os.Stat(filepath.Join(dir, "web", "templates")); err == nil && info.IsDir() {
+			return dir, nil
+		}
+		if filepath.Dir(dir) == dir {
+			return wd, nil
+		}
+	}
+}
+
 func (s *Service) Start() error {
 	// 启动打洞服务
 	go s.holeHandler.Start()
+	if s.stunHandler != nil {
+		go s.stunHandler.Start()
+	}
+	if s.httpHandler != nil {
+		go s.httpHandler.Start()
+	}
 
 	// 启动心跳检测
 	s.holeHandler.GetClientManager().StartHeartbeat()
 
 	// 启动 Web 服务
-	return s.webServer.Start(":8080")
+	addr := s.config.WebConfig.BindAddr
+	if addr == "" {
+		addr = ":8080"
+	}
+	return s.webServer.Start(addr)
 }
 
 func (s *Service) Close() error {
+	if s.stunHandler != nil {
+		s.stunHandler.Stop()
+	}
+	if s.httpHandler != nil {
+		s.httpHandler.Stop()
+	}
 	return s.holeHandler.Stop()
 }
@@ -1,16 +1,22 @@
 package types
 
 import (
-    "net"
     "time"
+
+    "github.com/liuscraft/spider-network/pkg/protocol/hole"
 )
 
 // ClientInfo 客户端信息
 type ClientInfo struct {
-    Conn       net.Conn    `json:"-"`           // 连接对象，不序列化
+    Conn       *hole.Conn  `json:"-"`           // 连接对象，不序列化
     ClientID   string      `json:"client_id"`   // 客户端ID
     Name       string      `json:"name"`        // 客户端名称
     PublicAddr string      `json:"public_addr"` // 公网地址
+    UDPAddr    string      `json:"udp_addr"`    // UDP 反射地址
+    UDPToken   string      `json:"-"`           // UDP 绑定令牌，只接受携带该令牌的绑定请求
+    PublicKey  string      `json:"public_key"`  // 端到端加密的静态公钥
+    VirtualIP  string      `json:"virtual_ip"`  // 虚拟网络地址
+    Version    int         `json:"version"`     // 协商后的协议版本
     Status     ClientStatus `json:"status"`      // 客户端状态
 }
 
@@ -22,24 +28,29 @@ type ClientStatus struct {
     LastError     string    `json:"last_error"`         // 最后一次错误
     LastErrorTime time.Time `json:"last_error_time"`    // 最后一次错误时间
     PunchStatus   string    `json:"punch_status"`       // 打洞状态
+    NATType       string    `json:"nat_type"`           // NAT 类型
     Peers         []string  `json:"peers"`              // 已连接的节点
     BytesSent     int64     `json:"bytes_sent"`         // 已发送字节数
     BytesRecv     int64     `json:"bytes_recv"`         // 已接收字节数
     P2PBytesSent  int64     `json:"p2p_bytes_sent"`     // 点对点发送字节数
     P2PBytesRecv  int64     `json:"p2p_bytes_recv"`     // 点对点接收字节数
+    RelayBytesSent int64    `json:"relay_bytes_sent"`   // 经服务端中继发送字节数
+    RelayBytesRecv int64    `json:"relay_bytes_recv"`   // 经服务端中继接收字节数
+    RelayChannels int       `json:"relay_channels"`     // 活跃的中继通道数
     BytesRate     float64   `json:"bytes_rate"`         // 传输速率（字节/秒）
     P2PBytesRate  float64   `json:"p2p_bytes_rate"`     // 点对点传输速率（字节/秒）
     Latency       int64     `json:"latency"`            // 延迟（毫秒）
 }
 
 // NewClientInfo 创建新的客户端信息
-func NewClientInfo(conn net.Conn, clientID, name string) *ClientInfo {
+func NewClientInfo(conn *hole.Conn, clientID, name string) *ClientInfo {
     now := time.Now()
     return &ClientInfo{
         Conn:       conn,
         ClientID:   clientID,
         Name:       name,
         PublicAddr: conn.RemoteAddr().String(),
+        Version:    conn.Version(),
         Status: ClientStatus{
             Connected:      true,
             LastSeen:      now,
@@ -0,0 +1,290 @@
+package api
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/liuscraft/spider-network/server/client_mgr"
+)
+
+// Admin 客户端管理操作，由 handler.HoleHandler 实现
+type Admin interface {
+	Kick(clientID, reason string) error
+	Ban(clientID, cidr, reason string, duration time.Duration) (*client_mgr.Ban, error)
+	Unban(id string) error
+}
+
+// AdminRequest 管理操作参数，支持 JSON 和表单
+type AdminRequest struct {
+	ClientID string `json:"client_id"`
+	CIDR     string `json:"cidr"`
+	Scope    string `json:"scope"`    // 封禁客户端时 ip 表示封禁其来源地址，默认封禁客户端ID
+	Reason   string `json:"reason"`   // 返回给客户端的说明
+	Duration string `json:"duration"` // 封禁时长，如 1h、30m，为空时永久封禁
+}
+
+// adminCookie 控制台登录后保存管理令牌的 Cookie
+const adminCookie = "spider_admin_token"
+
+// authorize 校验管理操作：拒绝浏览器的跨站请求，配置了管理令牌时要求 Authorization: Bearer <token>
+// 或登录后的 Cookie，否则只接受本机请求
+func (api *RestAPI) authorize(w http.ResponseWriter, r *http.Request) bool {
+	if !sameOrigin(r) {
+		writeError(w, http.StatusForbidden, "cross_origin", "cross-origin admin request is not allowed")
+		return false
+	}
+	if api.adminToken == "" {
+		host, _, _ := net.SplitHostPort(r.RemoteAddr)
+		if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+			writeError(w, http.StatusForbidden, "forbidden", "admin token is not configured, only local admin requests are allowed")
+			return false
+		}
+		return true
+	}
+	// 脚本通过请求头携带令牌，控制台登录后通过 Cookie 携带
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		if cookie, err := r.Cookie(adminCookie); err == nil {
+			token = cookie.Value
+		}
+	}
+	if !api.validToken(token) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeError(w, http.StatusUnauthorized, "unauthorized", "invalid admin token")
+		return false
+	}
+	return true
+}
+
+func (api *RestAPI) validToken(token string) bool {
+	return api.adminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(api.adminToken)) == 1
+}
+
+// Login 控制台登录（POST），校验管理令牌后写入 Cookie，之后的管理操作由浏览器自动携带；DELETE 退出登录
+func (api *RestAPI) Login(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		if !sameOrigin(r) {
+			writeError(w, http.StatusForbidden, "cross_origin", "cross-origin admin request is not allowed")
+			return
+		}
+		if api.adminToken == "" {
+			writeError(w, http.StatusBadRequest, "login_disabled", "admin token is not configured, only local admin requests are allowed")
+			return
+		}
+		var body struct {
+			Token string `json:"token"`
+		}
+		if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil && !errors.Is(err, io.EOF) {
+				writeError(w, http.StatusBadRequest, "invalid_request", fmt.Sprintf("invalid json body: %v", err))
+				return
+			}
+		} else {
+			body.Token = r.FormValue("token")
+		}
+		if !api.validToken(body.Token) {
+			writeError(w, http.StatusUnauthorized, "unauthorized", "invalid admin token")
+			return
+		}
+		http.SetCookie(w, &http.Cookie{
+			Name:     adminCookie,
+			Value:    body.Token,
+			Path:     "/",
+			HttpOnly: true,
+			Secure:   r.TLS != nil,
+			SameSite: http.SameSiteStrictMode,
+		})
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		http.SetCookie(w, &http.Cookie{Name: adminCookie, Path: "/", MaxAge: -1})
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		allowMethod(w, r, http.MethodPost, http.MethodDelete)
+	}
+}
+
+// sameOrigin 浏览器发起的请求必须与控制台同源，不带来源信息的请求（如脚本）不受限制
+func sameOrigin(r *http.Request) bool {
+	if site := r.Header.Get("Sec-Fetch-Site"); site != "" && site != "same-origin" && site != "none" {
+		return false
+	}
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Host == r.Host
+}
+
+func decodeAdminRequest(r *http.Request) (*AdminRequest, error) {
+	req := &AdminRequest{}
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil && !errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("invalid json body: %v", err)
+		}
+		return req, nil
+	}
+	if err := r.ParseForm(); err != nil {
+		return nil, fmt.Errorf("invalid form: %v", err)
+	}
+	req.ClientID = r.Form.Get("client_id")
+	req.CIDR = r.Form.Get("cidr")
+	req.Scope = r.Form.Get("scope")
+	req.Reason = r.Form.Get("reason")
+	req.Duration = r.Form.Get("duration")
+	return req, nil
+}
+
+// KickClient 断开客户端，客户端之后仍可重新注册
+func (api *RestAPI) KickClient(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+	if !api.authorize(w, r) {
+		return
+	}
+	clientID := r.PathValue("id")
+	if _, ok := api.clientMgr.GetClient(clientID); !ok {
+		writeError(w, http.StatusNotFound, "client_not_found", fmt.Sprintf("client %s not found", clientID))
+		return
+	}
+	req, err := decodeAdminRequest(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+	if err := api.admin.Kick(clientID, req.Reason); err != nil {
+		writeError(w, http.StatusNotFound, "client_not_found", err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// BanClient 封禁客户端ID，scope=ip 时封禁客户端的来源地址，并断开命中的客户端
+func (api *RestAPI) BanClient(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+	if !api.authorize(w, r) {
+		return
+	}
+	clientID := r.PathValue("id")
+	client, ok := api.clientMgr.Snapshot(clientID)
+	if !ok {
+		writeError(w, http.StatusNotFound, "client_not_found", fmt.Sprintf("client %s not found", clientID))
+		return
+	}
+	req, err := decodeAdminRequest(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+	req.ClientID = clientID
+	if req.Scope == "ip" {
+		host, _, err := net.SplitHostPort(client.PublicAddr)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_request", fmt.Sprintf("unknown address of client %s", clientID))
+			return
+		}
+		req.ClientID, req.CIDR = "", host
+	}
+	api.ban(w, req)
+}
+
+// Bans 查询（GET）或添加（POST）封禁
+func (api *RestAPI) Bans(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		writeJSON(w, http.StatusOK, api.clientMgr.Bans().List())
+	case http.MethodPost:
+		if !api.authorize(w, r) {
+			return
+		}
+		req, err := decodeAdminRequest(r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_request", err.Error())
+			return
+		}
+		api.ban(w, req)
+	default:
+		allowMethod(w, r, http.MethodGet, http.MethodPost)
+	}
+}
+
+// DeleteBan 解除封禁
+func (api *RestAPI) DeleteBan(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodDelete) {
+		return
+	}
+	if !api.authorize(w, r) {
+		return
+	}
+	if err := api.admin.Unban(r.PathValue("id")); err != nil {
+		if errors.Is(err, client_mgr.ErrBanNotFound) {
+			writeError(w, http.StatusNotFound, "ban_not_found", err.Error())
+		} else {
+			writeError(w, http.StatusInternalServerError, "internal_error", err.Error())
+		}
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (api *RestAPI) ban(w http.ResponseWriter, req *AdminRequest) {
+	var duration time.Duration
+	if req.Duration != "" {
+		d, err := time.ParseDuration(req.Duration)
+		if err != nil || d < 0 {
+			writeError(w, http.StatusBadRequest, "invalid_duration", fmt.Sprintf("invalid duration %q", req.Duration))
+			return
+		}
+		duration = d
+	}
+	ban, err := api.admin.Ban(req.ClientID, req.CIDR, req.Reason, duration)
+	if err != nil {
+		if errors.Is(err, client_mgr.ErrInvalidBan) || errors.Is(err, client_mgr.ErrInvalidCIDR) {
+			writeError(w, http.StatusBadRequest, "invalid_ban", err.Error())
+		} else {
+			writeError(w, http.StatusInternalServerError, "internal_error", err.Error())
+		}
+		return
+	}
+	writeJSON(w, http.StatusCreated, ban)
+}
+
+type BanAPI struct {
+	clientMgr *client_mgr.ClientManager
+	templates *template.Template
+}
+
+func NewBanAPI(mgr *client_mgr.ClientManager, tmpl *template.Template) *BanAPI {
+	return &BanAPI{
+		clientMgr: mgr,
+		templates: tmpl,
+	}
+}
+
+// BanData 封禁表模板数据
+func BanData(mgr *client_mgr.ClientManager) map[string]interface{} {
+	return map[string]interface{}{
+		"Bans": mgr.Bans().List(),
+	}
+}
+
+// GetBans 获取封禁列表
+func (api *BanAPI) GetBans(w http.ResponseWriter, r *http.Request) {
+	if err := api.templates.ExecuteTemplate(w, "ban_list", BanData(api.clientMgr)); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+}
@@ -21,7 +21,7 @@ func NewClientAPI(mgr *client_mgr.ClientManager, tmpl *template.Template) *Clien
 // GetClients 获取所有客户端列表
 func (api *ClientAPI) GetClients(w http.ResponseWriter, r *http.Request) {
     data := map[string]interface{}{
-        "Clients": api.clientMgr.GetClients(),
+        "Clients": api.clientMgr.Snapshots(),
     }
     if err := api.templates.ExecuteTemplate(w, "client_list", data); err != nil {
         http.Error(w, "Internal Server Error", http.StatusInternalServerError)
@@ -32,15 +32,12 @@ func (api *ClientAPI) GetClients(w http.ResponseWriter, r *http.Request) {
 // GetClientDetail 获取客户端详情
 func (api *ClientAPI) GetClientDetail(w http.ResponseWriter, r *http.Request) {
     clientID := r.URL.Query().Get("id")
-    client, ok := api.clientMgr.GetClient(clientID)
+    client, ok := api.clientMgr.Snapshot(clientID)
     if !ok {
         http.Error(w, "Client not found", http.StatusNotFound)
         return
     }
-    data := map[string]interface{}{
-        "Client": client,
-    }
-    if err := api.templates.ExecuteTemplate(w, "client_detail", data); err != nil {
+    if err := api.templates.ExecuteTemplate(w, "client_detail", client); err != nil {
         http.Error(w, "Internal Server Error", http.StatusInternalServerError)
         return
     }
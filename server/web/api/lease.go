@@ -0,0 +1,39 @@
+package api
+
+import (
+	"html/template"
+	"net/http"
+
+	"github.com/liuscraft/spider-network/server/client_mgr"
+)
+
+type LeaseAPI struct {
+	clientMgr *client_mgr.ClientManager
+	templates *template.Template
+}
+
+func NewLeaseAPI(mgr *client_mgr.ClientManager, tmpl *template.Template) *LeaseAPI {
+	return &LeaseAPI{
+		clientMgr: mgr,
+		templates: tmpl,
+	}
+}
+
+// LeaseData 租约表模板数据，未启用虚拟网络时 Network 为空
+func LeaseData(mgr *client_mgr.ClientManager) map[string]interface{} {
+	data := map[string]interface{}{}
+	if ipam := mgr.IPAM(); ipam != nil {
+		data["Network"] = ipam.Network().String()
+		data["Leases"] = ipam.Leases()
+		data["Clients"] = mgr.Snapshots()
+	}
+	return data
+}
+
+// GetLeases 获取虚拟 IP 租约表
+func (api *LeaseAPI) GetLeases(w http.ResponseWriter, r *http.Request) {
+	if err := api.templates.ExecuteTemplate(w, "lease_list", LeaseData(api.clientMgr)); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+}
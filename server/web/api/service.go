@@ -0,0 +1,36 @@
+package api
+
+import (
+	"html/template"
+	"net/http"
+
+	"github.com/liuscraft/spider-network/server/client_mgr"
+)
+
+type ServiceAPI struct {
+	clientMgr *client_mgr.ClientManager
+	templates *template.Template
+}
+
+func NewServiceAPI(mgr *client_mgr.ClientManager, tmpl *template.Template) *ServiceAPI {
+	return &ServiceAPI{
+		clientMgr: mgr,
+		templates: tmpl,
+	}
+}
+
+// ServiceData 已发布服务表模板数据
+func ServiceData(mgr *client_mgr.ClientManager) map[string]interface{} {
+	return map[string]interface{}{
+		"Services": mgr.GetServices(),
+		"Clients":  mgr.Snapshots(),
+	}
+}
+
+// GetServices 获取已发布的 HTTP 服务
+func (api *ServiceAPI) GetServices(w http.ResponseWriter, r *http.Request) {
+	if err := api.templates.ExecuteTemplate(w, "service_list", ServiceData(api.clientMgr)); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+}
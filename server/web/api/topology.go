@@ -18,7 +18,7 @@ func NewTopologyAPI(mgr *client_mgr.ClientManager) *TopologyAPI {
 
 // GetTopology 获取网络拓扑
 func (api *TopologyAPI) GetTopology(w http.ResponseWriter, r *http.Request) {
-    clients := api.clientMgr.GetClients()
+    clients := api.clientMgr.Snapshots()
     topology := make(map[string][]string)
     
     for id, client := range clients {
@@ -53,7 +53,7 @@ func (api *TopologyAPI) formatTopologyData(topology map[string][]string) Topolog
     }
 
     // 添加节点
-    for id, client := range api.clientMgr.GetClients() {
+    for id, client := range api.clientMgr.Snapshots() {
         data.Nodes = append(data.Nodes, Node{
             ID:    id,
             Label: client.Name,
@@ -0,0 +1,224 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/liuscraft/spider-network/server/client_mgr"
+	"github.com/liuscraft/spider-network/server/types"
+)
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 500
+)
+
+// RestAPI 版本化的 JSON 接口，供脚本和外部系统调用，挂载在 /api/v1 下
+type RestAPI struct {
+	clientMgr  *client_mgr.ClientManager
+	admin      Admin
+	adminToken string // 管理操作令牌，为空时管理操作只接受本机请求
+	topo       *TopologyAPI
+}
+
+func NewRestAPI(mgr *client_mgr.ClientManager, admin Admin, adminToken string) *RestAPI {
+	return &RestAPI{
+		clientMgr:  mgr,
+		admin:      admin,
+		adminToken: adminToken,
+		topo:       NewTopologyAPI(mgr),
+	}
+}
+
+// Register 注册 /api/v1 下的路由
+func (api *RestAPI) Register(mux *http.ServeMux) {
+	mux.HandleFunc("/api/v1/clients", api.GetClients)
+	mux.HandleFunc("/api/v1/clients/{id}", api.GetClient)
+	mux.HandleFunc("/api/v1/clients/{id}/history", api.GetClientHistory)
+	mux.HandleFunc("/api/v1/clients/{id}/kick", api.KickClient)
+	mux.HandleFunc("/api/v1/clients/{id}/ban", api.BanClient)
+	mux.HandleFunc("/api/v1/bans", api.Bans)
+	mux.HandleFunc("/api/v1/bans/{id}", api.DeleteBan)
+	mux.HandleFunc("/api/v1/login", api.Login)
+	mux.HandleFunc("/api/v1/topology", api.GetTopology)
+	mux.HandleFunc("/api/v1/stats", api.GetStats)
+	mux.HandleFunc("/api/v1/", func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, http.StatusNotFound, "not_found", fmt.Sprintf("no route for %s", r.URL.Path))
+	})
+}
+
+// ErrorBody 错误响应
+type ErrorBody struct {
+	Error ErrorDetail `json:"error"`
+}
+
+type ErrorDetail struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// ClientPage 分页的客户端列表
+type ClientPage struct {
+	Items    []*types.ClientInfo `json:"items"`
+	Total    int                 `json:"total"`
+	Page     int                 `json:"page"`
+	PageSize int                 `json:"page_size"`
+}
+
+// Stats 服务端汇总统计，流量为各客户端最近一次心跳上报值之和
+type Stats struct {
+	Clients        int   `json:"clients"`
+	Online         int   `json:"online"`
+	Services       int   `json:"services"`
+	BytesSent      int64 `json:"bytes_sent"`
+	BytesRecv      int64 `json:"bytes_recv"`
+	P2PBytesSent   int64 `json:"p2p_bytes_sent"`
+	P2PBytesRecv   int64 `json:"p2p_bytes_recv"`
+	RelayBytesSent int64 `json:"relay_bytes_sent"`
+	RelayBytesRecv int64 `json:"relay_bytes_recv"`
+	RelayChannels  int   `json:"relay_channels"`
+}
+
+// GetClients 分页获取客户端列表，按客户端ID排序
+// 查询参数：state=online|offline，page 从 1 开始，page_size 默认 50，最大 500
+func (api *RestAPI) GetClients(w http.ResponseWriter, r *http.Request) {
+	if !allowGet(w, r) {
+		return
+	}
+	query := r.URL.Query()
+	state := query.Get("state")
+	if state != "" && state != "all" && state != "online" && state != "offline" {
+		writeError(w, http.StatusBadRequest, "invalid_state", fmt.Sprintf("invalid state %q, expect online, offline or all", state))
+		return
+	}
+	page, ok := intParam(w, query.Get("page"), "page", 1, 1<<31-1)
+	if !ok {
+		return
+	}
+	pageSize, ok := intParam(w, query.Get("page_size"), "page_size", defaultPageSize, maxPageSize)
+	if !ok {
+		return
+	}
+
+	clients := make([]*types.ClientInfo, 0)
+	for _, client := range api.clientMgr.Snapshots() {
+		if (state == "online" && !client.Status.Connected) || (state == "offline" && client.Status.Connected) {
+			continue
+		}
+		clients = append(clients, client)
+	}
+	sort.Slice(clients, func(i, j int) bool {
+		return clients[i].ClientID < clients[j].ClientID
+	})
+
+	result := ClientPage{Items: []*types.ClientInfo{}, Total: len(clients), Page: page, PageSize: pageSize}
+	if start := (page - 1) * pageSize; start < len(clients) {
+		result.Items = clients[start:min(start+pageSize, len(clients))]
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+// GetClient 获取单个客户端
+func (api *RestAPI) GetClient(w http.ResponseWriter, r *http.Request) {
+	if !allowGet(w, r) {
+		return
+	}
+	clientID := r.PathValue("id")
+	client, ok := api.clientMgr.Snapshot(clientID)
+	if !ok {
+		writeError(w, http.StatusNotFound, "client_not_found", fmt.Sprintf("client %s not found", clientID))
+		return
+	}
+	writeJSON(w, http.StatusOK, client)
+}
+
+// GetClientHistory 获取客户端的持久化记录：首次出现时间、累计流量和注册断开历史
+func (api *RestAPI) GetClientHistory(w http.ResponseWriter, r *http.Request) {
+	if !allowGet(w, r) {
+		return
+	}
+	clientID := r.PathValue("id")
+	record, ok := api.clientMgr.GetRecord(clientID)
+	if !ok {
+		writeError(w, http.StatusNotFound, "history_not_found", fmt.Sprintf("no history for client %s", clientID))
+		return
+	}
+	writeJSON(w, http.StatusOK, record)
+}
+
+// GetTopology 获取客户端之间的连接拓扑
+func (api *RestAPI) GetTopology(w http.ResponseWriter, r *http.Request) {
+	if !allowGet(w, r) {
+		return
+	}
+	topology := make(map[string][]string)
+	for id, client := range api.clientMgr.Snapshots() {
+		topology[id] = client.Status.Peers
+	}
+	writeJSON(w, http.StatusOK, api.topo.formatTopologyData(topology))
+}
+
+// GetStats 获取汇总统计
+func (api *RestAPI) GetStats(w http.ResponseWriter, r *http.Request) {
+	if !allowGet(w, r) {
+		return
+	}
+	stats := Stats{Services: len(api.clientMgr.GetServices())}
+	for _, client := range api.clientMgr.Snapshots() {
+		stats.Clients++
+		if client.Status.Connected {
+			stats.Online++
+		}
+		stats.BytesSent += client.Status.BytesSent
+		stats.BytesRecv += client.Status.BytesRecv
+		stats.P2PBytesSent += client.Status.P2PBytesSent
+		stats.P2PBytesRecv += client.Status.P2PBytesRecv
+		stats.RelayBytesSent += client.Status.RelayBytesSent
+		stats.RelayBytesRecv += client.Status.RelayBytesRecv
+		stats.RelayChannels += client.Status.RelayChannels
+	}
+	writeJSON(w, http.StatusOK, stats)
+}
+
+func allowGet(w http.ResponseWriter, r *http.Request) bool {
+	return allowMethod(w, r, http.MethodGet, http.MethodHead)
+}
+
+// allowMethod 请求方法不在 methods 中时返回 405
+func allowMethod(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, method := range methods {
+		if r.Method == method {
+			return true
+		}
+	}
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", fmt.Sprintf("method %s is not allowed", r.Method))
+	return false
+}
+
+// intParam 解析正整数查询参数，为空时返回 def，超过 limit 时返回 limit
+func intParam(w http.ResponseWriter, value, name string, def, limit int) (int, bool) {
+	if value == "" {
+		return def, true
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 1 {
+		writeError(w, http.StatusBadRequest, "invalid_"+name, fmt.Sprintf("%s must be a positive integer", name))
+		return 0, false
+	}
+	return min(n, limit), true
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	writeJSON(w, status, ErrorBody{Error: ErrorDetail{Code: code, Message: message}})
+}
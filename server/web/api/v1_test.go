@@ -0,0 +1,250 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/liuscraft/spider-network/server/client_mgr"
+	"github.com/liuscraft/spider-network/server/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeAdmin struct {
+	mgr    *client_mgr.ClientManager
+	kicked []string
+}
+
+func (a *fakeAdmin) Kick(clientID, reason string) error {
+	a.kicked = append(a.kicked, clientID+": "+reason)
+	return nil
+}
+
+func (a *fakeAdmin) Ban(clientID, cidr, reason string, duration time.Duration) (*client_mgr.Ban, error) {
+	return a.mgr.Bans().Add(clientID, cidr, reason, duration)
+}
+
+func (a *fakeAdmin) Unban(id string) error {
+	return a.mgr.Bans().Remove(id)
+}
+
+func TestRestAPI(t *testing.T) {
+	mgr := client_mgr.NewClientManager()
+	for i := 0; i < 5; i++ {
+		mgr.AddClient(&types.ClientInfo{
+			ClientID:   fmt.Sprintf("client-%d", i),
+			Name:       fmt.Sprintf("Client %d", i),
+			PublicAddr: fmt.Sprintf("192.0.2.%d:4000", i),
+			Status: types.ClientStatus{
+				Connected: i%2 == 0,
+				BytesSent: 100,
+				Peers:     []string{"client-0"},
+			},
+		})
+	}
+	mux := http.NewServeMux()
+	admin := &fakeAdmin{mgr: mgr}
+	NewRestAPI(mgr, admin, "secret").Register(mux)
+
+	get := func(method, target string, v interface{}) int {
+		req := httptest.NewRequest(method, target, nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), v))
+		return rec.Code
+	}
+
+	t.Run("list clients", func(t *testing.T) {
+		var page ClientPage
+		require.Equal(t, http.StatusOK, get(http.MethodGet, "/api/v1/clients?page=2&page_size=2", &page))
+		assert.Equal(t, 5, page.Total)
+		require.Len(t, page.Items, 2)
+		assert.Equal(t, "client-2", page.Items[0].ClientID)
+
+		require.Equal(t, http.StatusOK, get(http.MethodGet, "/api/v1/clients?state=offline", &page))
+		assert.Equal(t, 2, page.Total)
+		assert.Equal(t, "client-1", page.Items[0].ClientID)
+
+		require.Equal(t, http.StatusOK, get(http.MethodGet, "/api/v1/clients?page=9", &page))
+		assert.Equal(t, 5, page.Total)
+		assert.Empty(t, page.Items)
+	})
+
+	t.Run("client detail", func(t *testing.T) {
+		var client types.ClientInfo
+		require.Equal(t, http.StatusOK, get(http.MethodGet, "/api/v1/clients/client-3", &client))
+		assert.Equal(t, "Client 3", client.Name)
+	})
+
+	t.Run("topology and stats", func(t *testing.T) {
+		var topology TopologyData
+		require.Equal(t, http.StatusOK, get(http.MethodGet, "/api/v1/topology", &topology))
+		assert.Len(t, topology.Nodes, 5)
+		assert.Len(t, topology.Edges, 5)
+
+		var stats Stats
+		require.Equal(t, http.StatusOK, get(http.MethodGet, "/api/v1/stats", &stats))
+		assert.Equal(t, Stats{Clients: 5, Online: 3, BytesSent: 500}, stats)
+	})
+
+	t.Run("admin", func(t *testing.T) {
+		send := func(method, target, contentType, body string) *httptest.ResponseRecorder {
+			req := httptest.NewRequest(method, target, strings.NewReader(body))
+			req.Header.Set("Content-Type", contentType)
+			req.Header.Set("Authorization", "Bearer secret")
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, req)
+			return rec
+		}
+		form := "application/x-www-form-urlencoded"
+
+		rec := send(http.MethodPost, "/api/v1/clients/client-1/kick", form, "reason=maintenance")
+		assert.Equal(t, http.StatusNoContent, rec.Code)
+		assert.Equal(t, []string{"client-1: maintenance"}, admin.kicked)
+
+		// 表单和 JSON 两种请求体
+		rec = send(http.MethodPost, "/api/v1/clients/client-2/ban", form, "scope=ip&duration=1h")
+		require.Equal(t, http.StatusCreated, rec.Code)
+		var ban client_mgr.Ban
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &ban))
+		assert.Equal(t, "192.0.2.2/32", ban.CIDR)
+		assert.False(t, ban.ExpiresAt.IsZero())
+
+		rec = send(http.MethodPost, "/api/v1/bans", "application/json", `{"client_id":"client-9","reason":"abuse"}`)
+		require.Equal(t, http.StatusCreated, rec.Code)
+
+		var bans []client_mgr.Ban
+		require.Equal(t, http.StatusOK, get(http.MethodGet, "/api/v1/bans", &bans))
+		require.Len(t, bans, 2)
+		assert.Equal(t, "client-9", bans[1].ClientID)
+
+		assert.Equal(t, http.StatusNoContent, send(http.MethodDelete, "/api/v1/bans/"+ban.ID, form, "").Code)
+		require.Equal(t, http.StatusOK, get(http.MethodGet, "/api/v1/bans", &bans))
+		assert.Len(t, bans, 1)
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		for _, tc := range []struct {
+			method, target string
+			status         int
+			code           string
+		}{
+			{http.MethodGet, "/api/v1/clients/missing", http.StatusNotFound, "client_not_found"},
+			{http.MethodGet, "/api/v1/clients?state=busy", http.StatusBadRequest, "invalid_state"},
+			{http.MethodGet, "/api/v1/clients?page=0", http.StatusBadRequest, "invalid_page"},
+			{http.MethodPost, "/api/v1/clients", http.StatusMethodNotAllowed, "method_not_allowed"},
+			{http.MethodGet, "/api/v1/unknown", http.StatusNotFound, "not_found"},
+			{http.MethodGet, "/api/v1/clients/client-1/kick", http.StatusMethodNotAllowed, "method_not_allowed"},
+			{http.MethodPost, "/api/v1/clients/missing/kick", http.StatusNotFound, "client_not_found"},
+			{http.MethodPost, "/api/v1/clients/client-1/ban?duration=soon", http.StatusBadRequest, "invalid_duration"},
+			{http.MethodPost, "/api/v1/bans", http.StatusBadRequest, "invalid_ban"},
+			{http.MethodDelete, "/api/v1/bans/missing", http.StatusNotFound, "ban_not_found"},
+			{http.MethodGet, "/api/v1/clients/client-1/history", http.StatusNotFound, "history_not_found"},
+		} {
+			var body ErrorBody
+			assert.Equal(t, tc.status, get(tc.method, tc.target, &body), tc.target)
+			assert.Equal(t, tc.code, body.Error.Code, tc.target)
+			assert.NotEmpty(t, body.Error.Message, tc.target)
+		}
+	})
+}
+
+func TestRestAPIAuthorize(t *testing.T) {
+	mgr := client_mgr.NewClientManager()
+	mgr.AddClient(&types.ClientInfo{ClientID: "client-1", Status: types.ClientStatus{Connected: true}})
+	admin := &fakeAdmin{mgr: mgr}
+
+	send := func(adminToken string, header http.Header, remoteAddr string) *httptest.ResponseRecorder {
+		mux := http.NewServeMux()
+		NewRestAPI(mgr, admin, adminToken).Register(mux)
+		req := httptest.NewRequest(http.MethodPost, "http://console.example/api/v1/clients/client-1/kick", nil)
+		for key, values := range header {
+			req.Header[key] = values
+		}
+		req.RemoteAddr = remoteAddr
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		return rec
+	}
+
+	for _, tc := range []struct {
+		name       string
+		adminToken string
+		header     http.Header
+		remoteAddr string
+		status     int
+	}{
+		{"token", "secret", http.Header{"Authorization": {"Bearer secret"}}, "192.0.2.1:1234", http.StatusNoContent},
+		{"missing token", "secret", nil, "127.0.0.1:1234", http.StatusUnauthorized},
+		{"wrong token", "secret", http.Header{"Authorization": {"Bearer guess"}}, "192.0.2.1:1234", http.StatusUnauthorized},
+		{"local without token", "", nil, "127.0.0.1:1234", http.StatusNoContent},
+		{"remote without token", "", http.Header{"Authorization": {"Bearer secret"}}, "192.0.2.1:1234", http.StatusForbidden},
+		{"same origin", "secret", http.Header{"Authorization": {"Bearer secret"}, "Origin": {"http://console.example"}, "Sec-Fetch-Site": {"same-origin"}}, "192.0.2.1:1234", http.StatusNoContent},
+		{"cross origin", "", http.Header{"Origin": {"http://evil.example"}}, "127.0.0.1:1234", http.StatusForbidden},
+		{"cross site", "secret", http.Header{"Authorization": {"Bearer secret"}, "Sec-Fetch-Site": {"cross-site"}}, "192.0.2.1:1234", http.StatusForbidden},
+	} {
+		assert.Equal(t, tc.status, send(tc.adminToken, tc.header, tc.remoteAddr).Code, tc.name)
+	}
+	assert.Len(t, admin.kicked, 3)
+}
+
+func TestConsoleLogin(t *testing.T) {
+	mgr := client_mgr.NewClientManager()
+	mgr.AddClient(&types.ClientInfo{ClientID: "client-1", Status: types.ClientStatus{Connected: true}})
+	admin := &fakeAdmin{mgr: mgr}
+	mux := http.NewServeMux()
+	NewRestAPI(mgr, admin, "secret").Register(mux)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	jar, err := cookiejar.New(nil)
+	require.NoError(t, err)
+	browser := &http.Client{Jar: jar}
+
+	// 按控制台页面的方式提交表单：htmx 请求头、同源的 Origin，Cookie 由浏览器自动携带
+	post := func(path, form string) int {
+		req, err := http.NewRequest(http.MethodPost, server.URL+path, strings.NewReader(form))
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("HX-Request", "true")
+		req.Header.Set("Origin", server.URL)
+		req.Header.Set("Sec-Fetch-Site", "same-origin")
+		resp, err := browser.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, post("/api/v1/clients/client-1/kick", "reason=maintenance"))
+	assert.Equal(t, http.StatusUnauthorized, post("/api/v1/login", "token=guess"))
+	assert.Equal(t, http.StatusNoContent, post("/api/v1/login", "token=secret"))
+	assert.Equal(t, http.StatusNoContent, post("/api/v1/clients/client-1/kick", "reason=maintenance"))
+	assert.Equal(t, http.StatusCreated, post("/api/v1/clients/client-1/ban", "scope=client&duration=1h"))
+	assert.Equal(t, []string{"client-1: maintenance"}, admin.kicked)
+
+	// 其他站点即使带着 Cookie 也会被拒绝
+	req, err := http.NewRequest(http.MethodPost, server.URL+"/api/v1/clients/client-1/kick", nil)
+	require.NoError(t, err)
+	req.Header.Set("Origin", "http://evil.example")
+	resp, err := browser.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	// 退出登录后不能再执行管理操作
+	req, err = http.NewRequest(http.MethodDelete, server.URL+"/api/v1/login", nil)
+	require.NoError(t, err)
+	resp, err = browser.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assert.Equal(t, http.StatusUnauthorized, post("/api/v1/clients/client-1/kick", ""))
+}
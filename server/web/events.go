@@ -0,0 +1,18 @@
+package web
+
+import (
+	"encoding/json"
+
+	"github.com/liuscraft/spider-network/pkg/xlog"
+	"github.com/liuscraft/spider-network/server/client_mgr"
+)
+
+// publishEvent 将客户端变化事件以 JSON 推送给浏览器
+func (s *Server) publishEvent(event client_mgr.Event) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		xlog.Errorf("marshal event error: %v", err)
+		return
+	}
+	s.hub.Broadcast(data)
+}
@@ -6,6 +6,7 @@ import (
 
 	"github.com/liuscraft/spider-network/pkg/xlog"
 	"github.com/liuscraft/spider-network/server/client_mgr"
+	"github.com/liuscraft/spider-network/server/web/api"
 )
 
 type ClientHandler struct {
@@ -23,7 +24,9 @@ func NewClientHandler(mgr *client_mgr.ClientManager, tmpl *template.Template) *C
 func (h *ClientHandler) HandleList(w http.ResponseWriter, r *http.Request) {
 	data := map[string]interface{}{
 		"Title":      "客户端管理",
-		"Clients":    h.clientMgr.GetClients(),
+		"Clients":    h.clientMgr.Snapshots(),
+		"Leases":     api.LeaseData(h.clientMgr),
+		"Bans":       api.BanData(h.clientMgr),
 		"ContentTpl": "content-clients",
 	}
 	if err := h.templates.ExecuteTemplate(w, "base", data); err != nil {
@@ -34,7 +37,7 @@ func (h *ClientHandler) HandleList(w http.ResponseWriter, r *http.Request) {
 
 func (h *ClientHandler) HandleDetail(w http.ResponseWriter, r *http.Request) {
 	clientID := r.URL.Query().Get("id")
-	client, ok := h.clientMgr.GetClient(clientID)
+	client, ok := h.clientMgr.Snapshot(clientID)
 	if !ok {
 		http.NotFound(w, r)
 		return
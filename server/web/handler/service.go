@@ -0,0 +1,34 @@
+package handler
+
+import (
+	"html/template"
+	"net/http"
+
+	"github.com/liuscraft/spider-network/pkg/xlog"
+	"github.com/liuscraft/spider-network/server/client_mgr"
+	"github.com/liuscraft/spider-network/server/web/api"
+)
+
+type ServiceHandler struct {
+	clientMgr *client_mgr.ClientManager
+	templates *template.Template
+}
+
+func NewServiceHandler(mgr *client_mgr.ClientManager, tmpl *template.Template) *ServiceHandler {
+	return &ServiceHandler{
+		clientMgr: mgr,
+		templates: tmpl,
+	}
+}
+
+func (h *ServiceHandler) HandleList(w http.ResponseWriter, r *http.Request) {
+	data := map[string]interface{}{
+		"Title":      "服务发布",
+		"Services":   api.ServiceData(h.clientMgr),
+		"ContentTpl": "content-services",
+	}
+	if err := h.templates.ExecuteTemplate(w, "base", data); err != nil {
+		xlog.Debug(err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
@@ -1,10 +1,12 @@
 package ws
 
 import (
+	"net/http"
 	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/liuscraft/spider-network/pkg/xlog"
 )
 
 const (
@@ -12,6 +14,7 @@ const (
 	pongWait       = 60 * time.Second
 	pingPeriod     = (pongWait * 9) / 10
 	maxMessageSize = 512
+	sendBufferSize = 256
 )
 
 var upgrader = websocket.Upgrader{
@@ -70,3 +73,70 @@ func (h *Hub) Run() {
 		}
 	}
 }
+
+// Broadcast 向所有连接的浏览器推送消息，需要先启动 Run
+func (h *Hub) Broadcast(message []byte) {
+	h.broadcast <- message
+}
+
+// ServeWs 将请求升级为 WebSocket 并注册到 Hub
+func ServeWs(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		xlog.Warnf("websocket upgrade error: %v", err)
+		return
+	}
+	client := &Client{hub: hub, conn: conn, send: make(chan []byte, sendBufferSize)}
+	hub.register <- client
+
+	go client.writePump()
+	go client.readPump()
+}
+
+// readPump 丢弃浏览器发来的消息，只用于处理 pong 和检测连接关闭
+func (c *Client) readPump() {
+	defer func() {
+		c.hub.unregister <- c
+		c.conn.Close()
+	}()
+	c.conn.SetReadLimit(maxMessageSize)
+	c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
+	for {
+		if _, _, err := c.conn.ReadMessage(); err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
+				xlog.Debugf("websocket read error: %v", err)
+			}
+			return
+		}
+	}
+}
+
+// writePump 发送推送消息并定时 ping，send 被 Hub 关闭时结束
+func (c *Client) writePump() {
+	ticker := time.NewTicker(pingPeriod)
+	defer func() {
+		ticker.Stop()
+		c.conn.Close()
+	}()
+	for {
+		select {
+		case message, ok := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if !ok {
+				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+				return
+			}
+			if err := c.conn.WriteMessage(websocket.TextMessage, message); err != nil {
+				return
+			}
+		case <-ticker.C:
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
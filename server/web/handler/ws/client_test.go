@@ -0,0 +1,52 @@
+package ws
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHubBroadcast(t *testing.T) {
+	hub := NewHub()
+	go hub.Run()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ServeWs(hub, w, r)
+	}))
+	defer server.Close()
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+	conns := make([]*websocket.Conn, 2)
+	for i := range conns {
+		conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+		require.NoError(t, err)
+		defer conn.Close()
+		conns[i] = conn
+	}
+	require.Eventually(t, func() bool {
+		hub.mu.Lock()
+		defer hub.mu.Unlock()
+		return len(hub.clients) == 2
+	}, time.Second, 10*time.Millisecond)
+
+	hub.Broadcast([]byte(`{"type":"client_registered"}`))
+	for _, conn := range conns {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		_, data, err := conn.ReadMessage()
+		require.NoError(t, err)
+		assert.Equal(t, `{"type":"client_registered"}`, string(data))
+	}
+
+	// 浏览器断开后从 Hub 注销
+	conns[0].Close()
+	require.Eventually(t, func() bool {
+		hub.mu.Lock()
+		defer hub.mu.Unlock()
+		return len(hub.clients) == 1
+	}, time.Second, 10*time.Millisecond)
+}
@@ -7,26 +7,37 @@ import (
 	"path/filepath"
 
 	"github.com/liuscraft/spider-network/server/client_mgr"
+	"github.com/liuscraft/spider-network/server/metrics"
 	"github.com/liuscraft/spider-network/server/web/api"
 	"github.com/liuscraft/spider-network/server/web/handler"
+	"github.com/liuscraft/spider-network/server/web/handler/ws"
 )
 
 type Server struct {
 	clientMgr *client_mgr.ClientManager
 	templates *template.Template
 	baseDir   string
+	hub       *ws.Hub // 向浏览器推送客户端变化
+	collector metrics.Collector
 
 	// API handlers
-	clientAPI *api.ClientAPI
-	topoAPI   *api.TopologyAPI
+	clientAPI  *api.ClientAPI
+	topoAPI    *api.TopologyAPI
+	leaseAPI   *api.LeaseAPI
+	serviceAPI *api.ServiceAPI
+	banAPI     *api.BanAPI
+	restAPI    *api.RestAPI
 
 	// Page handlers
 	indexHandler    *handler.IndexHandler
 	clientHandler   *handler.ClientHandler
+	serviceHandler  *handler.ServiceHandler
 	topologyHandler *handler.TopologyHandler
 }
 
-func NewServer(mgr *client_mgr.ClientManager, baseDir string) (*Server, error) {
+// NewServer 创建 Web 控制台，admin 执行断开、封禁等管理操作，adminToken 为管理操作的令牌，
+// collector 提供 /metrics 输出的指标
+func NewServer(mgr *client_mgr.ClientManager, admin api.Admin, adminToken string, collector metrics.Collector, baseDir string) (*Server, error) {
 	// 创建基础模板
 	baseTemplate := template.New("base").Funcs(template.FuncMap{
 		"div": func(a, b int64) float64 {
@@ -61,14 +72,21 @@ func NewServer(mgr *client_mgr.ClientManager, baseDir string) (*Server, error) {
 		clientMgr: mgr,
 		templates: tmpl,
 		baseDir:   baseDir,
+		hub:       ws.NewHub(),
+		collector: collector,
 
 		// Initialize API handlers
-		clientAPI: api.NewClientAPI(mgr, tmpl),
-		topoAPI:   api.NewTopologyAPI(mgr),
+		clientAPI:  api.NewClientAPI(mgr, tmpl),
+		topoAPI:    api.NewTopologyAPI(mgr),
+		leaseAPI:   api.NewLeaseAPI(mgr, tmpl),
+		serviceAPI: api.NewServiceAPI(mgr, tmpl),
+		banAPI:     api.NewBanAPI(mgr, tmpl),
+		restAPI:    api.NewRestAPI(mgr, admin, adminToken),
 
 		// Initialize page handlers
 		indexHandler:    handler.NewIndexHandler(tmpl),
 		clientHandler:   handler.NewClientHandler(mgr, tmpl),
+		serviceHandler:  handler.NewServiceHandler(mgr, tmpl),
 		topologyHandler: handler.NewTopologyHandler(mgr, tmpl),
 	}
 
@@ -76,19 +94,35 @@ func NewServer(mgr *client_mgr.ClientManager, baseDir string) (*Server, error) {
 }
 
 func (s *Server) Start(addr string) error {
-	// 启动心跳检测
-	s.clientMgr.StartHeartbeat()
+	// 推送客户端变化
+	go s.hub.Run()
+	s.clientMgr.Subscribe(s.publishEvent)
 
 	// Page routes
 	http.HandleFunc("/", s.indexHandler.HandleIndex)
 	http.HandleFunc("/clients", s.clientHandler.HandleList)
 	http.HandleFunc("/clients/detail", s.clientHandler.HandleDetail)
+	http.HandleFunc("/services", s.serviceHandler.HandleList)
 	http.HandleFunc("/topology", s.topologyHandler.HandleView)
 
 	// API routes
 	http.HandleFunc("/api/clients", s.clientAPI.GetClients)
 	http.HandleFunc("/api/clients/detail", s.clientAPI.GetClientDetail)
 	http.HandleFunc("/api/topology", s.topoAPI.GetTopology)
+	http.HandleFunc("/api/leases", s.leaseAPI.GetLeases)
+	http.HandleFunc("/api/services", s.serviceAPI.GetServices)
+	http.HandleFunc("/api/bans", s.banAPI.GetBans)
+
+	// WebSocket
+	http.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
+		ws.ServeWs(s.hub, w, r)
+	})
+
+	// Prometheus metrics
+	http.Handle("/metrics", metrics.Handler(s.collector))
+
+	// JSON API routes
+	s.restAPI.Register(http.DefaultServeMux)
 
 	// Static files
 	http.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir(s.baseDir+"/web/static"))))
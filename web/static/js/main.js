@@ -1,14 +1,24 @@
+// 拓扑图数据，由 /ws 推送的事件增量更新
+let topologyNodes = null;
+let topologyEdges = null;
+
+function edgeId(edge) {
+    return edge.from + '->' + edge.to;
+}
+
 // 拓扑图初始化
 function initTopology(data) {
     const container = document.getElementById('topology-graph');
     if (!container) return;
 
-    const nodes = new vis.DataSet(data.nodes);
-    const edges = new vis.DataSet(data.edges);
+    topologyNodes = new vis.DataSet(data.nodes);
+    topologyEdges = new vis.DataSet(data.edges.map(function(edge) {
+        return Object.assign({id: edgeId(edge)}, edge);
+    }));
 
     const network = new vis.Network(container, {
-        nodes: nodes,
-        edges: edges
+        nodes: topologyNodes,
+        edges: topologyEdges
     }, {
         nodes: {
             shape: 'dot',
@@ -34,9 +44,93 @@ function initTopology(data) {
     });
 }
 
-// 自动刷新处理
-document.addEventListener('htmx:afterSettle', function(evt) {
-    if (evt.detail.target.id === 'topology-container') {
-        initTopology(JSON.parse(evt.detail.target.dataset.topology));
+function loadTopology() {
+    if (!document.getElementById('topology-graph')) return;
+    fetch('/api/topology')
+        .then(function(resp) { return resp.json(); })
+        .then(initTopology);
+}
+
+// 根据客户端事件更新拓扑图
+function updateTopology(event) {
+    if (!topologyNodes) return;
+    switch (event.type) {
+    case 'client_registered':
+        topologyNodes.update({id: event.client_id, label: event.client.name});
+        break;
+    case 'client_removed':
+        topologyNodes.remove(event.client_id);
+        topologyEdges.remove(topologyEdges.getIds({
+            filter: function(edge) {
+                return edge.from === event.client_id || edge.to === event.client_id;
+            }
+        }));
+        break;
+    case 'topology':
+        (event.added || []).forEach(function(edge) {
+            topologyEdges.update(Object.assign({id: edgeId(edge)}, edge));
+        });
+        (event.removed || []).forEach(function(edge) {
+            topologyEdges.remove(edgeId(edge));
+        });
+        break;
+    }
+}
+
+// 合并短时间内的多次变化，只刷新一次客户端列表
+let refreshTimer = null;
+
+function refreshClients() {
+    if (refreshTimer) return;
+    refreshTimer = setTimeout(function() {
+        refreshTimer = null;
+        htmx.trigger(document.body, 'clients-changed');
+    }, 300);
+}
+
+// 订阅服务端推送，断开后重连并重新加载，避免遗漏断开期间的变化
+function connectEvents() {
+    const scheme = location.protocol === 'https:' ? 'wss:' : 'ws:';
+    const socket = new WebSocket(scheme + '//' + location.host + '/ws');
+    let reconnected = false;
+
+    socket.onopen = function() {
+        if (connectEvents.opened) {
+            refreshClients();
+            loadTopology();
+        }
+        connectEvents.opened = true;
+    };
+    socket.onmessage = function(evt) {
+        const event = JSON.parse(evt.data);
+        refreshClients();
+        updateTopology(event);
+    };
+    socket.onclose = function() {
+        if (reconnected) return;
+        reconnected = true;
+        setTimeout(connectEvents, 3000);
+    };
+}
+
+// 管理操作失败时提示服务端返回的错误
+document.addEventListener('htmx:responseError', function(evt) {
+    let message = evt.detail.xhr.statusText;
+    try {
+        message = JSON.parse(evt.detail.xhr.responseText).error.message;
+    } catch (e) {}
+    alert('操作失败: ' + message);
+});
+
+// 登录成功后清空输入的令牌
+document.addEventListener('htmx:afterRequest', function(evt) {
+    if (evt.detail.elt.id === 'admin-login' && evt.detail.successful) {
+        evt.detail.elt.reset();
+        alert('登录成功');
     }
-}); 
\ No newline at end of file
+});
+
+document.addEventListener('DOMContentLoaded', function() {
+    loadTopology();
+    connectEvents();
+});